@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -11,7 +15,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt"
+	"github.com/beshoyabdelmalak/gobank/iban"
+	"github.com/beshoyabdelmalak/gobank/totp"
 	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -20,125 +25,1938 @@ type contextKey int
 
 const claimsKey contextKey = iota
 
+const (
+	defaultIBANCountry  = "DE"
+	defaultIBANBankCode = "10010010"
+)
+
+const maxReferenceLength = 140
+
 type APIServer struct {
 	listenAddr string
 	store      Storage
+	keys       *Keyring
+}
+
+type apiFunc func(http.ResponseWriter, *http.Request) error
+
+// APIError is an RFC 7807 problem details document. Code repeats the
+// machine-readable code of the underlying *Error.
+type APIError struct {
+	Type    string         `json:"type"`
+	Title   string         `json:"title"`
+	Status  int            `json:"status"`
+	Detail  string         `json:"detail"`
+	Code    string         `json:"code"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+func NewAPIServer(listenAddr string, store Storage, keys *Keyring) *APIServer {
+	return &APIServer{
+		listenAddr: listenAddr,
+		store:      store,
+		keys:       keys,
+	}
+}
+
+func (s *APIServer) Run() {
+	log.Println("JSON API server running on port:", s.listenAddr)
+	if err := http.ListenAndServe(s.listenAddr, s.router()); err != nil {
+		log.Fatal("Could not bring up the server")
+	}
+}
+
+// router registers every route together with the permission it requires.
+func (s *APIServer) router() *mux.Router {
+	router := mux.NewRouter()
+
+	router.HandleFunc("/customers", makeHTTPHandleFunc(s.handleCreateCustomer)).Methods("POST")
+	router.HandleFunc("/customers/me", s.authorized(PermissionReadProfile, s.handleGetCustomer)).Methods("GET")
+	router.HandleFunc("/customers/me/2fa/totp", s.authorized(PermissionManageTwoFactor, s.handleEnrolTOTP)).Methods("POST")
+	router.HandleFunc("/customers/me/2fa/totp/confirm", s.authorized(PermissionManageTwoFactor, s.handleConfirmTOTP)).Methods("POST")
+	router.HandleFunc("/customers/me/2fa/totp", s.authorized(PermissionManageTwoFactor, s.handleDisableTOTP)).Methods("DELETE")
+	router.HandleFunc("/accounts/{id}", s.authorized(PermissionReadAccounts, s.handleGetAccount)).Methods("GET")
+	router.HandleFunc("/accounts", s.authorized(PermissionOpenAccounts, s.handleCreateAccount)).Methods("POST")
+	router.HandleFunc("/accounts/{id}", s.authorized(PermissionDeleteAccounts, s.handleDeleteAccount)).Methods("DELETE")
+	router.HandleFunc("/accounts/{id}/transactions", s.authorized(PermissionReadTransactions, s.handleGetTransactions)).Methods("GET")
+	router.HandleFunc("/accounts/{id}/transactions/{transactionId}/refund", s.authorized(PermissionTransfer, s.handleRefundTransfer)).Methods("POST")
+	router.HandleFunc("/accounts/{id}/deposits", s.authorized(PermissionMoveCash, s.handleDeposit)).Methods("POST")
+	router.HandleFunc("/accounts/{id}/withdrawals", s.authorized(PermissionMoveCash, s.handleWithdrawal)).Methods("POST")
+	router.HandleFunc("/accounts/{id}/holders", s.authorized(PermissionReadAccounts, s.handleGetAccountHolders)).Methods("GET")
+	router.HandleFunc("/accounts/{id}/holders", s.authorized(PermissionManageHolders, s.handleAddAccountHolder)).Methods("POST")
+	router.HandleFunc("/accounts/{id}/holders/{customerId}/accept", s.authorized(PermissionManageHolders, s.handleAcceptAccountHolder)).Methods("POST")
+	router.HandleFunc("/accounts/{id}/holders/{customerId}", s.authorized(PermissionManageHolders, s.handleRemoveAccountHolder)).Methods("DELETE")
+	router.HandleFunc("/accounts/{id}/approval-limit", s.authorized(PermissionManageHolders, s.handleSetApprovalLimit)).Methods("PUT")
+	router.HandleFunc("/accounts/{id}/approvals", s.authorized(PermissionReadTransactions, s.handleGetTransferApprovals)).Methods("GET")
+	router.HandleFunc("/accounts/{id}/approvals/{approvalId}/approve", s.authorized(PermissionTransfer, s.handleApproveTransfer)).Methods("POST")
+	router.HandleFunc("/accounts/{id}/approvals/{approvalId}/reject", s.authorized(PermissionTransfer, s.handleRejectTransfer)).Methods("POST")
+	router.HandleFunc("/accounts/{id}/scheduled-transfers", s.authorized(PermissionReadTransactions, s.handleGetScheduledTransfers)).Methods("GET")
+	router.HandleFunc("/accounts/{id}/scheduled-transfers/{scheduledTransferId}/cancel", s.authorized(PermissionTransfer, s.handleCancelScheduledTransfer)).Methods("POST")
+	router.HandleFunc("/accounts/{id}/standing-orders", s.authorized(PermissionReadTransactions, s.handleGetStandingOrders)).Methods("GET")
+	router.HandleFunc("/accounts/{id}/standing-orders", s.authorized(PermissionTransfer, s.handleCreateStandingOrder)).Methods("POST")
+	router.HandleFunc("/accounts/{id}/standing-orders/{standingOrderId}", s.authorized(PermissionReadTransactions, s.handleGetStandingOrder)).Methods("GET")
+	router.HandleFunc("/accounts/{id}/standing-orders/{standingOrderId}", s.authorized(PermissionTransfer, s.handleUpdateStandingOrder)).Methods("PUT")
+	router.HandleFunc("/accounts/{id}/standing-orders/{standingOrderId}", s.authorized(PermissionTransfer, s.handleCancelStandingOrder)).Methods("DELETE")
+	router.HandleFunc("/admin/accounts", s.authorized(PermissionInspectAccounts, s.handleGetAccounts)).Methods("GET")
+	router.HandleFunc("/admin/accounts/{id}", s.authorized(PermissionInspectAccounts, s.handleInspectAccount)).Methods("GET")
+	router.HandleFunc("/admin/accounts/{id}/freeze", s.authorized(PermissionSetAccountStatus, s.handleFreezeAccount)).Methods("POST")
+	router.HandleFunc("/admin/accounts/{id}/unfreeze", s.authorized(PermissionSetAccountStatus, s.handleUnfreezeAccount)).Methods("POST")
+	router.HandleFunc("/admin/accounts/{id}/status", s.authorized(PermissionSetAccountStatus, s.handleChangeAccountStatus)).Methods("POST")
+	router.HandleFunc("/admin/customers/{id}", s.authorized(PermissionInspectAccounts, s.handleInspectCustomer)).Methods("GET")
+	router.HandleFunc("/admin/customers/{id}/unlock", s.authorized(PermissionUnlockLogins, s.handleUnlockCustomer)).Methods("POST")
+	router.HandleFunc("/admin/transactions/{transactionId}/reverse", s.authorized(PermissionReverseTransfers, s.handleReverseTransfer)).Methods("POST")
+	router.HandleFunc("/admin/audit-events", s.authorized(PermissionReadAuditEvents, s.handleGetAuditEvents)).Methods("GET")
+	router.HandleFunc("/admin/staff", s.authorized(PermissionManageStaff, s.handleGetStaffUsers)).Methods("GET")
+	router.HandleFunc("/admin/staff", s.authorized(PermissionManageStaff, s.handleCreateStaffUser)).Methods("POST")
+	router.HandleFunc("/admin/fx/rates", s.authorized(PermissionManageRates, s.handleSetExchangeRates)).Methods("PUT")
+	router.HandleFunc("/fx/rates", s.authorized(PermissionReadAccounts, s.handleGetExchangeRates)).Methods("GET")
+	router.HandleFunc("/fx/quotes", s.authorized(PermissionTransfer, s.handleCreateFXQuote)).Methods("POST")
+	router.HandleFunc("/login", makeHTTPHandleFunc(s.handleLogin)).Methods("POST")
+	router.HandleFunc("/login/2fa", makeHTTPHandleFunc(s.handleLoginSecondFactor)).Methods("POST")
+	router.HandleFunc("/staff/login", makeHTTPHandleFunc(s.handleStaffLogin)).Methods("POST")
+	router.HandleFunc("/token/refresh", makeHTTPHandleFunc(s.handleRefreshToken)).Methods("POST")
+	router.HandleFunc("/.well-known/jwks.json", makeHTTPHandleFunc(s.handleJWKS)).Methods("GET")
+	router.HandleFunc("/logout", s.validateTokenMiddleware(makeHTTPHandleFunc(s.handleLogout))).Methods("POST")
+	router.HandleFunc("/transfer", s.authorized(PermissionTransfer, s.handleTransfer)).Methods("POST")
+	router.HandleFunc("/transfers/batch", s.authorized(PermissionTransfer, s.handleTransferBatch)).Methods("POST")
+	router.HandleFunc("/transfers/batch/{batchId}", s.authorized(PermissionReadTransactions, s.handleGetTransferBatch)).Methods("GET")
+	return router
+}
+
+// handleLogin authenticates customers by username or email. Customers that
+// existed before accounts got owners log in with the IBAN of their account
+// as username, in any formatting.
+func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
+	loginReq := new(LoginRequest)
+
+	if err := decodeJSON(r, loginReq); err != nil {
+		return err
+	}
+	login := strings.TrimSpace(loginReq.Username)
+	if normalized := iban.Normalize(login); iban.Validate(normalized) == nil {
+		login = normalized
+	}
+
+	policy, err := loginPolicy()
+	if err != nil {
+		return err
+	}
+	ip := clientIP(r)
+	if err := s.checkLoginThrottle(policy, ThrottleIP, ip); err != nil {
+		return err
+	}
+
+	customer, err := s.store.GetCustomerByLogin(login)
+	if err != nil {
+		if !IsKind(err, KindNotFound) {
+			return err
+		}
+		// unknown logins get the same answer as wrong passwords, and take
+		// as long to get it
+		checkPasswordHash(loginReq.Password, dummyPasswordHash)
+		if _, err := s.store.RecordLoginFailure(ThrottleIP, ip, policy); err != nil {
+			return err
+		}
+		return errInvalidCredentials()
+	}
+	subject := customerSubject(customer.ID)
+	if err := s.checkLoginThrottle(policy, ThrottleAccount, subject); err != nil {
+		return err
+	}
+	if !checkPasswordHash(loginReq.Password, customer.EncryptedPassword) {
+		if _, err := s.store.RecordLoginFailure(ThrottleAccount, subject, policy); err != nil {
+			return err
+		}
+		if _, err := s.store.RecordLoginFailure(ThrottleIP, ip, policy); err != nil {
+			return err
+		}
+		return errInvalidCredentials()
+	}
+	if err := s.store.ResetLoginThrottle(ThrottleAccount, subject); err != nil {
+		return err
+	}
+
+	enrolment, err := s.store.GetTOTPEnrolment(subject)
+	if err != nil {
+		return err
+	}
+	if enrolment.Enabled() {
+		challenge, err := newLoginChallenge(subject)
+		if err != nil {
+			return err
+		}
+		if err := s.store.CreateLoginChallenge(challenge); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusAccepted, &LoginChallengeResponse{
+			Challenge: challenge.ID,
+			ExpiresAt: challenge.ExpiresAt,
+		})
+	}
+	return s.issueTokens(w, customerPrincipal(customer))
+}
+
+// handleStaffLogin authenticates staff users by username. Failed attempts
+// are throttled like those of customers.
+func (s *APIServer) handleStaffLogin(w http.ResponseWriter, r *http.Request) error {
+	loginReq := new(StaffLoginRequest)
+	if err := decodeJSON(r, loginReq); err != nil {
+		return err
+	}
+
+	policy, err := loginPolicy()
+	if err != nil {
+		return err
+	}
+	ip := clientIP(r)
+	subject := staffSubjectPrefix + loginReq.Username
+	if err := s.checkLoginThrottle(policy, ThrottleIP, ip); err != nil {
+		return err
+	}
+	if err := s.checkLoginThrottle(policy, ThrottleAccount, subject); err != nil {
+		return err
+	}
+
+	user, err := s.store.GetStaffUserByUsername(loginReq.Username)
+	if err != nil && !IsKind(err, KindNotFound) {
+		return err
+	}
+	hash := dummyPasswordHash
+	if user != nil {
+		hash = user.EncryptedPassword
+	}
+	if !checkPasswordHash(loginReq.Password, hash) || user == nil {
+		// only known users are throttled, so unknown names leave no trace
+		if user != nil {
+			if _, err := s.store.RecordLoginFailure(ThrottleAccount, subject, policy); err != nil {
+				return err
+			}
+		}
+		if _, err := s.store.RecordLoginFailure(ThrottleIP, ip, policy); err != nil {
+			return err
+		}
+		return errInvalidCredentials()
+	}
+	if err := s.store.ResetLoginThrottle(ThrottleAccount, subject); err != nil {
+		return err
+	}
+	return s.issueTokens(w, staffPrincipal(user))
+}
+
+// handleLoginSecondFactor completes a login challenge with a TOTP or
+// recovery code. Wrong codes count as failed logins of the customer.
+func (s *APIServer) handleLoginSecondFactor(w http.ResponseWriter, r *http.Request) error {
+	secondFactorReq := new(SecondFactorRequest)
+	if err := decodeJSON(r, secondFactorReq); err != nil {
+		return err
+	}
+	challenge, err := s.store.GetLoginChallenge(secondFactorReq.Challenge)
+	if err != nil {
+		return err
+	}
+
+	policy, err := loginPolicy()
+	if err != nil {
+		return err
+	}
+	if err := s.checkLoginThrottle(policy, ThrottleAccount, challenge.Subject); err != nil {
+		return err
+	}
+
+	err = verifySecondFactor(s.store, challenge.Subject, secondFactorReq.Code, secondFactorReq.RecoveryCode)
+	if IsKind(err, KindUnauthorized) {
+		if _, err := s.store.RecordLoginFailure(ThrottleAccount, challenge.Subject, policy); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.store.CompleteLoginChallenge(challenge.ID); err != nil {
+		return err
+	}
+	if err := s.store.ResetLoginThrottle(ThrottleAccount, challenge.Subject); err != nil {
+		return err
+	}
+
+	principal, err := s.principal(challenge.Subject)
+	if err != nil {
+		return err
+	}
+	return s.issueTokens(w, principal)
+}
+
+// issueTokens starts a new session for the principal and answers with its
+// access and refresh token.
+func (s *APIServer) issueTokens(w http.ResponseWriter, principal Principal) error {
+	session, err := newSession(principal.Subject)
+	if err != nil {
+		return err
+	}
+	refreshToken, stored, err := newRefreshToken(session.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.store.CreateSession(session, stored); err != nil {
+		return err
+	}
+
+	token, err := s.keys.CreateToken(principal, session.ID)
+	if err != nil {
+		return err
+	}
+
+	loginResponse := &LoginResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+	}
+	return WriteJSON(w, http.StatusOK, loginResponse)
+}
+
+// checkLoginThrottle rejects the login while the subject or client IP is
+// delayed or locked because of earlier failed attempts.
+func (s *APIServer) checkLoginThrottle(policy LoginPolicy, kind, subject string) error {
+	throttle, err := s.store.GetLoginThrottle(kind, subject)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if until := throttle.BlockedUntil(policy, now); !until.IsZero() {
+		return errLoginThrottled(until, now)
+	}
+	return nil
+}
+
+// handleEnrolTOTP creates a new TOTP secret for the customer. It replaces a
+// pending enrolment but not a confirmed one; that has to be disabled first.
+func (s *APIServer) handleEnrolTOTP(w http.ResponseWriter, r *http.Request) error {
+	customer, err := s.getCurrentCustomer(r)
+	if err != nil {
+		return err
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return err
+	}
+	enrolment := &TOTPEnrolment{Subject: customerSubject(customer.ID), Secret: secret, CreatedAt: time.Now().UTC()}
+	if err := s.store.SaveTOTPEnrolment(enrolment); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, &TOTPEnrolmentResponse{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(totpIssuer, customer.Username, secret),
+	})
+}
+
+// handleConfirmTOTP enables two-factor authentication once the client proves
+// it set up the secret by sending a valid code, and hands out the recovery
+// codes.
+func (s *APIServer) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	confirmReq := new(ConfirmTOTPRequest)
+	if err := decodeJSON(r, confirmReq); err != nil {
+		return err
+	}
+
+	enrolment, err := s.store.GetTOTPEnrolment(claims.Subject)
+	if err != nil {
+		return err
+	}
+	if enrolment == nil {
+		return NotFoundError("totp_enrolment_not_found", "No pending TOTP enrolment")
+	}
+	if enrolment.Enabled() {
+		return errTOTPAlreadyEnabled()
+	}
+	step, ok := totp.Validate(enrolment.Secret, confirmReq.Code, time.Now(), totpSkew)
+	if !ok {
+		return errInvalidSecondFactor()
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	if err := s.store.ConfirmTOTPEnrolment(claims.Subject, step, hashes); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, &RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// handleDisableTOTP turns two-factor authentication off. It needs a current
+// code so that a stolen access token alone cannot disable it.
+func (s *APIServer) handleDisableTOTP(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	if err := s.requireSecondFactor(r, claims.Subject); err != nil {
+		return err
+	}
+	if err := s.store.DeleteTOTPEnrolment(claims.Subject); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// requireSecondFactor checks the code in the X-TOTP-Code or X-Recovery-Code
+// header against the subject.
+func (s *APIServer) requireSecondFactor(r *http.Request, subject string) error {
+	code, recoveryCode := r.Header.Get(totpCodeHeader), r.Header.Get(recoveryCodeHeader)
+	if code == "" && recoveryCode == "" {
+		return ForbiddenError("second_factor_required", "A %s or %s header is required", totpCodeHeader, recoveryCodeHeader)
+	}
+	return verifySecondFactor(s.store, subject, code, recoveryCode)
+}
+
+// handleUnlockCustomer lifts the login lockout of a customer before it
+// expires.
+func (s *APIServer) handleUnlockCustomer(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	customer, err := s.store.GetCustomerById(id)
+	if err != nil {
+		return err
+	}
+	if err := s.store.UnlockLogin(customerSubject(customer.ID), claims.Subject); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, map[string]int{"unlocked": customer.ID})
+}
+
+// handleGetAccounts lists accounts for staff, newest first, optionally
+// only those with the status given in the query.
+func (s *APIServer) handleGetAccounts(w http.ResponseWriter, r *http.Request) error {
+	filter := &AccountFilter{Status: r.URL.Query().Get("status")}
+	if filter.Status != "" && !isAccountStatus(filter.Status) {
+		return ValidationError("invalid_query", "Invalid status: %v", filter.Status).WithDetail("parameter", "status")
+	}
+	var err error
+	if filter.Cursor, filter.Limit, err = getPage(r); err != nil {
+		return err
+	}
+	// fetch one extra account to find out whether there is a next page
+	limit := filter.Limit
+	filter.Limit++
+
+	accounts, err := s.store.GetAccounts(filter)
+	if err != nil {
+		return err
+	}
+
+	resp := &AccountsResponse{Accounts: []*AccountResponse{}}
+	for _, account := range accounts {
+		resp.Accounts = append(resp.Accounts, NewAccountResponse(account))
+	}
+	if len(resp.Accounts) > limit {
+		resp.Accounts = resp.Accounts[:limit]
+		resp.NextCursor = encodeCursor(resp.Accounts[limit-1].ID)
+	}
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// handleInspectAccount shows staff an account together with its latest
+// audit events. The owner's login security state is shown on the customer.
+func (s *APIServer) handleInspectAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.store.GetAccountById(id)
+	if err != nil {
+		return err
+	}
+	events, err := s.store.GetAuditEvents(account.IBAN, defaultPageSize)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, &AccountDetailsResponse{
+		AccountResponse: NewAccountResponse(account),
+		AuditEvents:     events,
+	})
+}
+
+// handleInspectCustomer shows staff a customer with their accounts, login
+// security state and latest audit events.
+func (s *APIServer) handleInspectCustomer(w http.ResponseWriter, r *http.Request) error {
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	customer, err := s.store.GetCustomerById(id)
+	if err != nil {
+		return err
+	}
+	accounts, err := s.store.GetAccountsByCustomer(customer.ID)
+	if err != nil {
+		return err
+	}
+
+	subject := customerSubject(customer.ID)
+	enrolment, err := s.store.GetTOTPEnrolment(subject)
+	if err != nil {
+		return err
+	}
+	throttle, err := s.store.GetLoginThrottle(ThrottleAccount, subject)
+	if err != nil {
+		return err
+	}
+	events, err := s.store.GetAuditEvents(subject, defaultPageSize)
+	if err != nil {
+		return err
+	}
+
+	resp := &CustomerDetailsResponse{
+		CustomerResponse: NewCustomerResponse(customer, accounts),
+		TwoFactorEnabled: enrolment.Enabled(),
+		AuditEvents:      events,
+	}
+	if throttle.LockedUntil.After(time.Now().UTC()) {
+		resp.LockedUntil = &throttle.LockedUntil
+	}
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+func (s *APIServer) handleFreezeAccount(w http.ResponseWriter, r *http.Request) error {
+	return s.handleSetAccountStatus(w, r, AccountStatusFrozen)
+}
+
+func (s *APIServer) handleUnfreezeAccount(w http.ResponseWriter, r *http.Request) error {
+	return s.handleSetAccountStatus(w, r, AccountStatusActive)
+}
+
+// handleChangeAccountStatus moves the account in the path to the status in
+// the body. Closing an account also needs the permission to delete it.
+func (s *APIServer) handleChangeAccountStatus(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	statusReq := new(AccountStatusRequest)
+	if err := decodeJSON(r, statusReq); err != nil {
+		return err
+	}
+	if !isAccountStatus(statusReq.Status) {
+		return ValidationError("invalid_status", "Invalid status: %s", statusReq.Status).WithDetail("field", "status")
+	}
+	if statusReq.Status != AccountStatusClosed {
+		return s.handleSetAccountStatus(w, r, statusReq.Status)
+	}
+
+	if !roleHasPermission(claims.Role, PermissionDeleteAccounts) {
+		return errForbidden()
+	}
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.store.GetAccountById(id)
+	if err != nil {
+		return err
+	}
+	return s.closeAccount(w, claims, account, statusReq.PayoutIban)
+}
+
+// handleSetAccountStatus moves the account in the path to status. Frozen
+// accounts can neither send nor receive money.
+func (s *APIServer) handleSetAccountStatus(w http.ResponseWriter, r *http.Request, status string) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.store.GetAccountById(id)
+	if err != nil {
+		return err
+	}
+	if err := s.store.SetAccountStatus(account.IBAN, status, claims.Subject); err != nil {
+		return err
+	}
+	account.Status = status
+	return WriteJSON(w, http.StatusOK, NewAccountResponse(account))
+}
+
+func (s *APIServer) handleGetStaffUsers(w http.ResponseWriter, r *http.Request) error {
+	users, err := s.store.GetStaffUsers()
+	if err != nil {
+		return err
+	}
+	resp := []*StaffUserResponse{}
+	for _, user := range users {
+		resp = append(resp, NewStaffUserResponse(user))
+	}
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+func (s *APIServer) handleCreateStaffUser(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	createReq := new(CreateStaffUserRequest)
+	if err := decodeJSON(r, createReq); err != nil {
+		return err
+	}
+	user, err := NewStaffUser(createReq.Username, createReq.Password, createReq.Role)
+	if err != nil {
+		return err
+	}
+	if err := s.store.CreateStaffUser(user, claims.Subject); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, NewStaffUserResponse(user))
+}
+
+// handleSetExchangeRates stores the rates of the request. Every rate is
+// recorded as an audit event naming the staff user.
+func (s *APIServer) handleSetExchangeRates(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	ratesReq := new(ExchangeRatesRequest)
+	if err := decodeJSON(r, ratesReq); err != nil {
+		return err
+	}
+	if len(ratesReq.Rates) == 0 {
+		return ValidationError("invalid_request", "At least one rate is required").WithDetail("field", "rates")
+	}
+	now := time.Now().UTC()
+	for _, rate := range ratesReq.Rates {
+		rate.UpdatedAt = now
+	}
+	if err := s.store.SetExchangeRates(ratesReq.Rates, claims.Subject); err != nil {
+		return err
+	}
+	return s.handleGetExchangeRates(w, r)
+}
+
+func (s *APIServer) handleGetExchangeRates(w http.ResponseWriter, r *http.Request) error {
+	rates, err := s.store.GetExchangeRates()
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, rates)
+}
+
+// handleCreateFXQuote locks the current rate between two currencies for
+// FX_QUOTE_TTL. Only the customer who asked for the quote can use it.
+func (s *APIServer) handleCreateFXQuote(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	quoteReq := new(FXQuoteRequest)
+	if err := decodeJSON(r, quoteReq); err != nil {
+		return err
+	}
+	if quoteReq.Amount != nil && !quoteReq.Amount.IsPositive() {
+		return errAmountNotPositive()
+	}
+	rate, err := s.store.GetExchangeRate(quoteReq.From, quoteReq.To)
+	if err != nil {
+		return err
+	}
+	ttl, err := fxQuoteTTL()
+	if err != nil {
+		return err
+	}
+	quote, err := newFXQuote(claims.Subject, rate, quoteReq.Amount, ttl)
+	if err != nil {
+		return err
+	}
+	if err := s.store.CreateFXQuote(quote); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, quote)
+}
+
+// handleGetAuditEvents lists the newest audit events, optionally only those
+// of one subject.
+func (s *APIServer) handleGetAuditEvents(w http.ResponseWriter, r *http.Request) error {
+	limit := defaultPageSize
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 1 || limit > maxPageSize {
+			return ValidationError("invalid_query", "Invalid limit: %v", limitStr).WithDetail("parameter", "limit")
+		}
+	}
+	events, err := s.store.GetAuditEvents(r.URL.Query().Get("subject"), limit)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, events)
+}
+
+// handleRefreshToken trades a refresh token for a new access token and a
+// new refresh token. The presented refresh token cannot be used again.
+func (s *APIServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) error {
+	refreshReq := new(RefreshTokenRequest)
+	if err := decodeJSON(r, refreshReq); err != nil {
+		return err
+	}
+	if refreshReq.RefreshToken == "" {
+		return errInvalidRefreshToken()
+	}
+
+	refreshToken, next, err := newRefreshToken("")
+	if err != nil {
+		return err
+	}
+	session, err := s.store.RotateRefreshToken(hashRefreshToken(refreshReq.RefreshToken), next)
+	if err != nil {
+		return err
+	}
+
+	principal, err := s.principal(session.Subject)
+	if IsKind(err, KindNotFound) {
+		return errInvalidRefreshToken()
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := s.keys.CreateToken(principal, session.ID)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, &LoginResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+	})
+}
+
+// handleJWKS publishes the public keys so that other services can verify
+// access tokens themselves.
+func (s *APIServer) handleJWKS(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	return WriteJSON(w, http.StatusOK, s.keys.JWKS())
+}
+
+// handleLogout revokes the session of the access token, which invalidates
+// its refresh token and every access token issued for it.
+func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.RevokeSession(claims.SessionID, claims.Id, time.Unix(claims.ExpiresAt, 0).UTC()); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleCreateCustomer signs up a new customer. The customer logs in next
+// and opens accounts with POST /accounts.
+func (s *APIServer) handleCreateCustomer(w http.ResponseWriter, r *http.Request) error {
+	createReq := new(CreateCustomerRequest)
+	if err := decodeJSON(r, createReq); err != nil {
+		return err
+	}
+	customer, err := NewCustomer(createReq.Username, createReq.Email, createReq.Password, createReq.FirstName, createReq.LastName)
+	if err != nil {
+		return err
+	}
+	if err := s.store.CreateCustomer(customer); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, NewCustomerResponse(customer, nil))
+}
+
+// handleGetCustomer shows the logged in customer their profile, accounts
+// and pending invitations to hold accounts.
+func (s *APIServer) handleGetCustomer(w http.ResponseWriter, r *http.Request) error {
+	customer, err := s.getCurrentCustomer(r)
+	if err != nil {
+		return err
+	}
+	accounts, err := s.store.GetAccountsByCustomer(customer.ID)
+	if err != nil {
+		return err
+	}
+	invitations, err := s.store.GetInvitations(customer.ID)
+	if err != nil {
+		return err
+	}
+	resp := NewCustomerResponse(customer, accounts)
+	resp.Invitations = invitations
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+func (s *APIServer) handleGetAccount(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.getAuthorizedAccount(r, HolderPermissionView)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, NewAccountResponse(account))
+}
+
+// handleCreateAccount opens an account for the logged in customer.
+func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
+	customer, err := s.getCurrentCustomer(r)
+	if err != nil {
+		return err
+	}
+	createReq := new(CreateAccountRequest)
+	if err := decodeJSON(r, createReq); err != nil {
+		return err
+	}
+
+	accountIban, err := s.newIBAN()
+	if err != nil {
+		return err
+	}
+
+	account, err := NewAccount(customer.ID, createReq.Type, createReq.Currency, accountIban)
+	if err != nil {
+		return err
+	}
+	account.Status = initialAccountStatus()
+
+	scope := "POST /accounts " + customerSubject(customer.ID)
+	key, err := newIdempotencyKey(r, scope, createReq, func(result any) (int, any) {
+		return http.StatusOK, NewAccountResponse(result.(*Account))
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.CreateAccount(account, key); err != nil {
+		return err
+	}
+	if key != nil {
+		return writeIdempotentResponse(w, key)
+	}
+	return WriteJSON(w, http.StatusOK, NewAccountResponse(account))
+}
+
+// handleDeleteAccount closes the account. Closed accounts are kept together
+// with their transactions, but no money moves from or to them anymore.
+func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.getAuthorizedAccount(r, HolderPermissionManage)
+	if err != nil {
+		return err
+	}
+	closeReq := new(CloseAccountRequest)
+	if err := decodeOptionalJSON(r, closeReq); err != nil {
+		return err
+	}
+	if claims.Role == RoleCustomer && closeReq.PayoutIban != "" && !account.Balance.IsZero() {
+		if err := s.checkPayout(r, claims, account); err != nil {
+			return err
+		}
+	}
+	return s.closeAccount(w, claims, account, closeReq.PayoutIban)
+}
+
+// checkPayout applies the checks of a transfer to customers paying out the
+// balance of an account they close: the account has to be able to send,
+// the balance may need the second factor, and balances above the approval
+// limit have to be transferred with another holder's approval first.
+func (s *APIServer) checkPayout(r *http.Request, claims *Claims, account *Account) error {
+	if err := checkCanSend(account); err != nil {
+		return err
+	}
+	if err := s.requireTransferSecondFactor(r, claims.Subject, account.Balance); err != nil {
+		return err
+	}
+	approvalNeeded, err := needsApproval(s.store, account, account.Balance)
+	if err != nil {
+		return err
+	}
+	if approvalNeeded {
+		return ConflictError("payout_needs_approval", "Account %s holds more than its approval limit; transfer the balance with another holder's approval before closing it", account.IBAN)
+	}
+	return nil
+}
+
+// closeAccount closes the account, paying out what is left to payoutIban.
+func (s *APIServer) closeAccount(w http.ResponseWriter, claims *Claims, account *Account, payoutIban string) error {
+	if payoutIban != "" {
+		var err error
+		if payoutIban, err = parseIBAN("payoutIban", payoutIban); err != nil {
+			return err
+		}
+	}
+	payout, err := s.store.CloseAccount(account.IBAN, payoutIban, claims.Subject)
+	if err != nil {
+		return err
+	}
+	if account, err = s.store.GetAccountById(account.ID); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, &AccountClosedResponse{
+		AccountResponse: NewAccountResponse(account),
+		Payout:          payout,
+	})
+}
+
+// handleTransfer moves money from an account the customer of the token
+// holds with the transfer permission to any other account. Transfers above
+// the approval limit of a joint account are held back until another holder
+// approves them; transfers with a future execution date are scheduled.
+func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
+	// get the claims of the JWT token
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+
+	transferReq := new(TransferRequest)
+	if err := decodeJSON(r, transferReq); err != nil {
+		return err
+	}
+	fromAccountIban, err := parseIBAN("fromAccountIban", transferReq.FromAccountIban)
+	if err != nil {
+		return err
+	}
+	toAccountIban, err := parseIBAN("toAccountIban", transferReq.ToAccountIban)
+	if err != nil {
+		return err
+	}
+	transferReq.FromAccountIban, transferReq.ToAccountIban = fromAccountIban, toAccountIban
+	scheduled := false
+	if transferReq.ExecutionDate != "" {
+		if transferReq.ExecutionDate, scheduled, err = parseExecutionDate(transferReq.ExecutionDate, time.Now()); err != nil {
+			return err
+		}
+	}
+	// quotes expire long before the execution date
+	if scheduled && transferReq.QuoteID != "" {
+		return ValidationError("invalid_request", "Scheduled transfers cannot use a quote").WithDetail("field", "quoteId")
+	}
+
+	// other customers' accounts look the same as missing ones
+	fromAccount, err := s.store.GetAccountByIban(fromAccountIban)
+	if err != nil && !IsKind(err, KindNotFound) {
+		return err
+	}
+	if err != nil {
+		return errForbidden()
+	}
+	if err := s.checkHolder(claims, fromAccount, HolderPermissionTransfer); err != nil {
+		return err
+	}
+
+	// keys are scoped to the sender so clients cannot collide with each other
+	scope := "POST /transfer " + fromAccountIban
+	if replayed, err := s.replayIdempotentResponse(w, r, scope, transferReq); err != nil || replayed {
+		return err
+	}
+	if err := s.requireTransferSecondFactor(r, claims.Subject, transferReq.Amount); err != nil {
+		return err
+	}
+
+	// quotes of other customers look the same as missing ones
+	if transferReq.QuoteID != "" {
+		quote, err := s.store.GetFXQuote(transferReq.QuoteID)
+		if err != nil {
+			return err
+		}
+		if quote.Subject != claims.Subject {
+			return errFXQuoteNotFound(transferReq.QuoteID)
+		}
+	}
+
+	approvalNeeded, err := needsApproval(s.store, fromAccount, transferReq.Amount)
+	if err != nil {
+		return err
+	}
+	if approvalNeeded && scheduled {
+		return ConflictError("scheduled_transfer_needs_approval", "Transfers above the approval limit cannot be scheduled")
+	}
+	if approvalNeeded {
+		return s.requestTransferApproval(w, r, scope, transferReq)
+	}
+	if scheduled {
+		return s.scheduleTransfer(w, r, scope, fromAccount, transferReq)
+	}
+
+	respond := func(result any) (int, any) {
+		return http.StatusOK, &TransferResponse{Status: "success", Transaction: result.(*Transaction)}
+	}
+	key, err := newIdempotencyKey(r, scope, transferReq, respond)
+	if err != nil {
+		return err
+	}
+
+	transaction, err := s.store.TransferFunds(fromAccountIban, transferReq.ToAccountIban, transferReq.Amount, transferReq.QuoteID, key)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		return writeIdempotentResponse(w, key)
+	}
+	status, resp := respond(transaction)
+	return WriteJSON(w, status, resp)
+}
+
+// handleTransferBatch pays several beneficiaries from an account the
+// customer of the token holds with the transfer permission. The batch is
+// created even if transfers fail; its status and the items tell which went
+// through.
+func (s *APIServer) handleTransferBatch(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+
+	batchReq := new(TransferBatchRequest)
+	if err := decodeJSON(r, batchReq); err != nil {
+		return err
+	}
+	if batchReq.FromAccountIban, err = parseIBAN("fromAccountIban", batchReq.FromAccountIban); err != nil {
+		return err
+	}
+	for i := range batchReq.Items {
+		item := &batchReq.Items[i]
+		if item.ToAccountIban, err = parseIBAN(fmt.Sprintf("items[%d].toAccountIban", i), item.ToAccountIban); err != nil {
+			return err
+		}
+	}
+	requestedBy, _ := customerID(claims.Subject)
+	batch, err := newTransferBatch(batchReq, requestedBy)
+	if err != nil {
+		return err
+	}
+
+	// other customers' accounts look the same as missing ones
+	fromAccount, err := s.store.GetAccountByIban(batch.FromAccountIban)
+	if err != nil && !IsKind(err, KindNotFound) {
+		return err
+	}
+	if err != nil {
+		return errForbidden()
+	}
+	if err := s.checkHolder(claims, fromAccount, HolderPermissionTransfer); err != nil {
+		return err
+	}
+
+	scope := "POST /transfers/batch " + batch.FromAccountIban
+	if replayed, err := s.replayIdempotentResponse(w, r, scope, batchReq); err != nil || replayed {
+		return err
+	}
+	// the batch as a whole is what the thresholds apply to
+	if err := s.requireTransferSecondFactor(r, claims.Subject, batch.Total); err != nil {
+		return err
+	}
+	approvalNeeded, err := needsApproval(s.store, fromAccount, batch.Total)
+	if err != nil {
+		return err
+	}
+	if approvalNeeded {
+		return ConflictError("transfer_batch_needs_approval", "Batches above the approval limit are not possible")
+	}
+
+	respond := func(result any) (int, any) {
+		return http.StatusCreated, result
+	}
+	key, err := newIdempotencyKey(r, scope, batchReq, respond)
+	if err != nil {
+		return err
+	}
+	if err := s.store.ExecuteTransferBatch(batch, key); err != nil {
+		return err
+	}
+	if key != nil {
+		return writeIdempotentResponse(w, key)
+	}
+	status, resp := respond(batch)
+	return WriteJSON(w, status, resp)
+}
+
+// handleGetTransferBatch returns a batch from an account the customer of
+// the token may view. Batches of other accounts look like missing ones.
+func (s *APIServer) handleGetTransferBatch(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	batchID, err := getPathId(r, "batchId")
+	if err != nil {
+		return err
+	}
+	batch, err := s.store.GetTransferBatch(batchID)
+	if err != nil {
+		return err
+	}
+	account, err := s.store.GetAccountByIban(batch.FromAccountIban)
+	if err != nil {
+		return err
+	}
+	if err := s.checkHolder(claims, account, HolderPermissionView); err != nil {
+		if IsKind(err, KindForbidden) {
+			return errTransferBatchNotFound(batchID)
+		}
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, batch)
+}
+
+// handleRefundTransfer pays a transfer the account in the path received
+// back to its sender, in part or in full. The money goes back where it came
+// from, so neither a second factor nor an approval is needed.
+func (s *APIServer) handleRefundTransfer(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.getAuthorizedAccount(r, HolderPermissionTransfer)
+	if err != nil {
+		return err
+	}
+	transactionID, err := getPathId(r, "transactionId")
+	if err != nil {
+		return err
+	}
+	refundReq, err := decodeRefundRequest(r)
+	if err != nil {
+		return err
+	}
+	return s.refundTransfer(w, r, "POST /accounts/transactions/refund "+account.IBAN, refundReq, &Refund{
+		TransactionID: transactionID,
+		AccountIban:   account.IBAN,
+		Amount:        refundReq.Amount,
+		Reference:     refundReq.Reference,
+		Actor:         claims.Subject,
+	})
+}
+
+// handleReverseTransfer pays all of a transfer back to its sender, no
+// matter which of its transactions the path names. Unless
+// REVERSAL_NEGATIVE_BALANCE is reject, the recipient's balance may go
+// negative.
+func (s *APIServer) handleReverseTransfer(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	transactionID, err := getPathId(r, "transactionId")
+	if err != nil {
+		return err
+	}
+	refundReq, err := decodeRefundRequest(r)
+	if err != nil {
+		return err
+	}
+	if refundReq.Amount != nil {
+		return ValidationError("invalid_amount", "Reversals pay back the whole transfer, refund it to pay back a part").WithDetail("field", "amount")
+	}
+	policy, err := reversalNegativeBalancePolicy()
+	if err != nil {
+		return err
+	}
+	return s.refundTransfer(w, r, "POST /admin/transactions/reverse "+claims.Subject, refundReq, &Refund{
+		TransactionID: transactionID,
+		Reference:     refundReq.Reference,
+		Reversal:      true,
+		AllowNegative: policy == NegativeBalanceAllow,
+		Actor:         claims.Subject,
+	})
+}
+
+func decodeRefundRequest(r *http.Request) (*RefundRequest, error) {
+	refundReq := new(RefundRequest)
+	if err := decodeOptionalJSON(r, refundReq); err != nil {
+		return nil, err
+	}
+	if len(refundReq.Reference) > maxReferenceLength {
+		return nil, ValidationError("invalid_reference", "Reference must be at most %d characters", maxReferenceLength)
+	}
+	return refundReq, nil
+}
+
+// refundTransfer runs the refund and responds with the transaction that
+// took the money from the recipient.
+func (s *APIServer) refundTransfer(w http.ResponseWriter, r *http.Request, scope string, refundReq *RefundRequest, refund *Refund) error {
+	respond := func(result any) (int, any) {
+		return http.StatusCreated, result.(*Transaction)
+	}
+	key, err := newIdempotencyKey(r, scope, refundReq, respond)
+	if err != nil {
+		return err
+	}
+	transaction, err := s.store.RefundTransfer(refund, key)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		return writeIdempotentResponse(w, key)
+	}
+	status, resp := respond(transaction)
+	return WriteJSON(w, status, resp)
+}
+
+// requireTransferSecondFactor asks for a second factor if the amount is
+// above TRANSFER_2FA_THRESHOLD.
+func (s *APIServer) requireTransferSecondFactor(r *http.Request, subject string, amount Money) error {
+	threshold, ok, err := transferSecondFactorThreshold()
+	if err != nil || !ok {
+		return err
+	}
+	above, err := s.exceedsThreshold(amount, threshold)
+	if err != nil {
+		return err
+	}
+	if above {
+		return s.requireSecondFactor(r, subject)
+	}
+	return nil
+}
+
+// exceedsThreshold compares amount with the threshold, converting amounts in
+// other currencies at the mid-market rate. Without a rate there is nothing
+// to compare with, so the amount counts as above the threshold.
+func (s *APIServer) exceedsThreshold(amount, threshold Money) (bool, error) {
+	if amount.Currency == threshold.Currency {
+		return amount.Cmp(threshold) > 0, nil
+	}
+	rate, err := s.store.GetExchangeRate(amount.Currency, threshold.Currency)
+	if IsKind(err, KindConflict) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return exceedsAt(amount, rate.Rate, threshold), nil
+}
+
+// requestTransferApproval holds the transfer back and answers with
+// 202 Accepted and the pending approval.
+func (s *APIServer) requestTransferApproval(w http.ResponseWriter, r *http.Request, scope string, transferReq *TransferRequest) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	requestedBy, _ := customerID(claims.Subject)
+	// fail now rather than when the transfer is approved
+	if _, err := s.store.GetAccountByIban(transferReq.ToAccountIban); err != nil {
+		return err
+	}
+
+	respond := func(result any) (int, any) {
+		return http.StatusAccepted, &TransferResponse{Status: "pending_approval", Approval: result.(*TransferApproval)}
+	}
+	key, err := newIdempotencyKey(r, scope, transferReq, respond)
+	if err != nil {
+		return err
+	}
+
+	approval := newTransferApproval(transferReq.FromAccountIban, transferReq.ToAccountIban, transferReq.Amount, requestedBy)
+	if err := s.store.CreateTransferApproval(approval, key); err != nil {
+		return err
+	}
+	if key != nil {
+		return writeIdempotentResponse(w, key)
+	}
+	status, resp := respond(approval)
+	return WriteJSON(w, status, resp)
+}
+
+// scheduleTransfer stores the transfer for its execution date and answers
+// with 202 Accepted and the scheduled transfer.
+func (s *APIServer) scheduleTransfer(w http.ResponseWriter, r *http.Request, scope string, fromAccount *Account, transferReq *TransferRequest) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	requestedBy, _ := customerID(claims.Subject)
+	// fail now what would fail on the execution date anyway
+	if err := checkCanSend(fromAccount); err != nil {
+		return err
+	}
+	if !transferReq.Amount.SameCurrency(fromAccount.Balance) {
+		return errCurrencyMismatch()
+	}
+	if _, err := s.store.GetAccountByIban(transferReq.ToAccountIban); err != nil {
+		return err
+	}
+
+	respond := func(result any) (int, any) {
+		return http.StatusAccepted, &TransferResponse{Status: "scheduled", ScheduledTransfer: result.(*ScheduledTransfer)}
+	}
+	key, err := newIdempotencyKey(r, scope, transferReq, respond)
+	if err != nil {
+		return err
+	}
+
+	transfer := newScheduledTransfer(transferReq.FromAccountIban, transferReq.ToAccountIban, transferReq.Amount, transferReq.ExecutionDate, requestedBy)
+	if err := s.store.CreateScheduledTransfer(transfer, key); err != nil {
+		return err
+	}
+	if key != nil {
+		return writeIdempotentResponse(w, key)
+	}
+	status, resp := respond(transfer)
+	return WriteJSON(w, status, resp)
+}
+
+// handleGetScheduledTransfers lists the scheduled transfers from the
+// account, newest first, optionally only those with the status given in the
+// query.
+func (s *APIServer) handleGetScheduledTransfers(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.getAuthorizedAccount(r, HolderPermissionView)
+	if err != nil {
+		return err
+	}
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", ScheduledStatusPending, ScheduledStatusExecuting, ScheduledStatusExecuted, ScheduledStatusFailed, ScheduledStatusCancelled, ScheduledStatusNeedsApproval:
+	default:
+		return ValidationError("invalid_query", "Invalid status: %v", status).WithDetail("parameter", "status")
+	}
+	transfers, err := s.store.GetScheduledTransfers(account.IBAN, status)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, transfers)
+}
+
+// handleCancelScheduledTransfer cancels a pending scheduled transfer from
+// the account in the path.
+func (s *APIServer) handleCancelScheduledTransfer(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.getAuthorizedAccount(r, HolderPermissionTransfer)
+	if err != nil {
+		return err
+	}
+	transferID, err := getPathId(r, "scheduledTransferId")
+	if err != nil {
+		return err
+	}
+	cancelledBy, _ := customerID(claims.Subject)
+	transfer, err := s.store.CancelScheduledTransfer(transferID, account.IBAN, cancelledBy)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, transfer)
+}
+
+// handleGetStandingOrders lists the standing orders from the account,
+// newest first, optionally only those with the status given in the query.
+func (s *APIServer) handleGetStandingOrders(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.getAuthorizedAccount(r, HolderPermissionView)
+	if err != nil {
+		return err
+	}
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", StandingOrderStatusActive, StandingOrderStatusFinished, StandingOrderStatusCancelled:
+	default:
+		return ValidationError("invalid_query", "Invalid status: %v", status).WithDetail("parameter", "status")
+	}
+	orders, err := s.store.GetStandingOrders(account.IBAN, status)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, orders)
+}
+
+func (s *APIServer) handleGetStandingOrder(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.getAuthorizedAccount(r, HolderPermissionView)
+	if err != nil {
+		return err
+	}
+	orderID, err := getPathId(r, "standingOrderId")
+	if err != nil {
+		return err
+	}
+	order, err := s.store.GetStandingOrder(orderID, account.IBAN)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, order)
+}
+
+// handleCreateStandingOrder sets up a standing order from the account in
+// the path. The customer who creates it has to keep the transfer permission
+// for its executions to go through.
+func (s *APIServer) handleCreateStandingOrder(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.getAuthorizedAccount(r, HolderPermissionTransfer)
+	if err != nil {
+		return err
+	}
+	orderReq, err := s.decodeStandingOrderRequest(r, account)
+	if err != nil {
+		return err
+	}
+	scope := "POST /standing-orders " + account.IBAN
+	if replayed, err := s.replayIdempotentResponse(w, r, scope, orderReq); err != nil || replayed {
+		return err
+	}
+	if err := s.checkStandingOrderLimits(r, account, orderReq); err != nil {
+		return err
+	}
+
+	createdBy, _ := customerID(claims.Subject)
+	order, err := newStandingOrder(account.IBAN, orderReq, createdBy, time.Now())
+	if err != nil {
+		return err
+	}
+
+	respond := func(result any) (int, any) {
+		return http.StatusCreated, result
+	}
+	key, err := newIdempotencyKey(r, scope, orderReq, respond)
+	if err != nil {
+		return err
+	}
+	if err := s.store.CreateStandingOrder(order, key); err != nil {
+		return err
+	}
+	if key != nil {
+		return writeIdempotentResponse(w, key)
+	}
+	status, resp := respond(order)
+	return WriteJSON(w, status, resp)
+}
+
+// handleUpdateStandingOrder replaces the terms of an active standing order.
+// Executions that were scheduled already keep the old terms.
+func (s *APIServer) handleUpdateStandingOrder(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.getAuthorizedAccount(r, HolderPermissionTransfer)
+	if err != nil {
+		return err
+	}
+	orderID, err := getPathId(r, "standingOrderId")
+	if err != nil {
+		return err
+	}
+	orderReq, err := s.decodeStandingOrderRequest(r, account)
+	if err != nil {
+		return err
+	}
+	if err := s.checkStandingOrderLimits(r, account, orderReq); err != nil {
+		return err
+	}
+	order, err := s.store.UpdateStandingOrder(orderID, account.IBAN, orderReq)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, order)
+}
+
+// handleCancelStandingOrder cancels a standing order together with its
+// executions that are still pending.
+func (s *APIServer) handleCancelStandingOrder(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.getAuthorizedAccount(r, HolderPermissionTransfer)
+	if err != nil {
+		return err
+	}
+	orderID, err := getPathId(r, "standingOrderId")
+	if err != nil {
+		return err
+	}
+	cancelledBy, _ := customerID(claims.Subject)
+	order, err := s.store.CancelStandingOrder(orderID, account.IBAN, cancelledBy)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, order)
 }
 
-type apiFunc func(http.ResponseWriter, *http.Request) error
+// decodeStandingOrderRequest reads a standing order from the account and
+// checks what its executions would otherwise fail on.
+func (s *APIServer) decodeStandingOrderRequest(r *http.Request, account *Account) (*StandingOrderRequest, error) {
+	var err error
+	orderReq := new(StandingOrderRequest)
+	if err := decodeJSON(r, orderReq); err != nil {
+		return nil, err
+	}
+	if orderReq.ToAccountIban, err = parseIBAN("toAccountIban", orderReq.ToAccountIban); err != nil {
+		return nil, err
+	}
 
-type APIError struct {
-	Error string `json:"error"`
+	if err := checkCanSend(account); err != nil {
+		return nil, err
+	}
+	if !orderReq.Amount.SameCurrency(account.Balance) {
+		return nil, errCurrencyMismatch()
+	}
+	if _, err := s.store.GetAccountByIban(orderReq.ToAccountIban); err != nil {
+		return nil, err
+	}
+	return orderReq, nil
 }
 
-func NewAPIServer(listenAddr string, store Storage) *APIServer {
-	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
+// checkStandingOrderLimits treats the order like a transfer: it needs a
+// second factor above the threshold, and it cannot bypass the approval
+// limit of a joint account.
+func (s *APIServer) checkStandingOrderLimits(r *http.Request, account *Account, orderReq *StandingOrderRequest) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	if err := s.requireTransferSecondFactor(r, claims.Subject, orderReq.Amount); err != nil {
+		return err
+	}
+	approvalNeeded, err := needsApproval(s.store, account, orderReq.Amount)
+	if err != nil {
+		return err
 	}
+	if approvalNeeded {
+		return ConflictError("standing_order_needs_approval", "Standing orders above the approval limit are not possible")
+	}
+	return nil
 }
 
-func (s *APIServer) Run() {
-	router := mux.NewRouter()
+// handleGetTransferApprovals lists the approvals of transfers from the
+// account, newest first, optionally only those with the status given in the
+// query.
+func (s *APIServer) handleGetTransferApprovals(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.getAuthorizedAccount(r, HolderPermissionView)
+	if err != nil {
+		return err
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != ApprovalStatusPending && status != ApprovalStatusApproved && status != ApprovalStatusRejected {
+		return ValidationError("invalid_query", "Invalid status: %v", status).WithDetail("parameter", "status")
+	}
+	approvals, err := s.store.GetTransferApprovals(account.IBAN, status)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, approvals)
+}
 
-	router.HandleFunc("/accounts/{id}", makeHTTPHandleFunc(s.handleGetAccount)).Methods("GET")
-	router.HandleFunc("/accounts", makeHTTPHandleFunc(s.handleCreateAccount)).Methods("POST")
-	router.HandleFunc("/accounts/{id}", makeHTTPHandleFunc(s.handleDeleteAccount)).Methods("DELETE")
-	router.HandleFunc("/login", makeHTTPHandleFunc(s.handleLogin)).Methods("POST")
-	router.HandleFunc("/transfer", validateTokenMiddleware(makeHTTPHandleFunc(s.handleTransfer))).Methods("POST")
+func (s *APIServer) handleApproveTransfer(w http.ResponseWriter, r *http.Request) error {
+	return s.handleDecideTransfer(w, r, true)
+}
 
-	log.Println("JSON API server running on port:", s.listenAddr)
-	if err := http.ListenAndServe(s.listenAddr, router); err != nil {
-		log.Fatal("Could not bring up the server")
+func (s *APIServer) handleRejectTransfer(w http.ResponseWriter, r *http.Request) error {
+	return s.handleDecideTransfer(w, r, false)
+}
+
+// handleDecideTransfer approves or rejects a pending transfer from the
+// account in the path. Approving moves the money, so it needs a second
+// factor just like sending the transfer would.
+func (s *APIServer) handleDecideTransfer(w http.ResponseWriter, r *http.Request, approve bool) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.getAuthorizedAccount(r, HolderPermissionTransfer)
+	if err != nil {
+		return err
+	}
+	approvalID, err := getPathId(r, "approvalId")
+	if err != nil {
+		return err
+	}
+
+	if approve {
+		approval, err := s.store.GetTransferApproval(approvalID, account.IBAN)
+		if err != nil {
+			return err
+		}
+		if err := s.requireTransferSecondFactor(r, claims.Subject, approval.Amount); err != nil {
+			return err
+		}
+	}
+
+	decidedBy, _ := customerID(claims.Subject)
+	approval, transaction, err := s.store.DecideTransferApproval(approvalID, account.IBAN, approve, decidedBy)
+	if err != nil {
+		return err
 	}
+	if !approve {
+		return WriteJSON(w, http.StatusOK, &TransferResponse{Status: "rejected", Approval: approval})
+	}
+	return WriteJSON(w, http.StatusOK, &TransferResponse{Status: "success", Transaction: transaction, Approval: approval})
 }
 
-func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
-	loginReq := new(LoginRequest)
+// handleGetAccountHolders lists the holders of the account, including
+// customers who were invited but did not accept yet.
+func (s *APIServer) handleGetAccountHolders(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.getAuthorizedAccount(r, HolderPermissionView)
+	if err != nil {
+		return err
+	}
+	holders, err := s.store.GetAccountHolders(account.ID)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, holders)
+}
 
-	if err := json.NewDecoder(r.Body).Decode(loginReq); err != nil {
+// handleAddAccountHolder invites another customer, by username or email, to
+// hold the account. The invitation is listed on the customer's profile
+// until they accept or decline it.
+func (s *APIServer) handleAddAccountHolder(w http.ResponseWriter, r *http.Request) error {
+	customer, err := s.getCurrentCustomer(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.getAuthorizedAccount(r, HolderPermissionManage)
+	if err != nil {
 		return err
 	}
+	addReq := new(AddAccountHolderRequest)
+	if err := decodeJSON(r, addReq); err != nil {
+		return err
+	}
+
+	if account.Status == AccountStatusClosed {
+		return errAccountUnavailable(account.IBAN, account.Status)
+	}
 
-	account, err := s.store.GetAccountByIban(loginReq.IBAN)
+	invitee, err := s.store.GetCustomerByLogin(strings.TrimSpace(addReq.Login))
 	if err != nil {
 		return err
 	}
-	if !checkPasswordHash(loginReq.Password, account.EncryptedPassword) {
-		return fmt.Errorf("Access Denied")
+	holder, err := NewAccountHolder(account.ID, invitee.ID, addReq.Permission, customer.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.store.AddAccountHolder(holder); err != nil {
+		return err
 	}
+	holder.Username = invitee.Username
+	return WriteJSON(w, http.StatusCreated, holder)
+}
 
-	token, err := CreateToken(loginReq.IBAN)
+// handleAcceptAccountHolder accepts an invitation to hold the account. Only
+// the invited customer can accept it.
+func (s *APIServer) handleAcceptAccountHolder(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	accountID, err := getId(r)
 	if err != nil {
 		return err
 	}
+	holderID, err := getPathId(r, "customerId")
+	if err != nil {
+		return err
+	}
+	if id, ok := customerID(claims.Subject); !ok || id != holderID {
+		return errForbidden()
+	}
 
-	loginResponse := &LoginResponse{
-		IBAN:  loginReq.IBAN,
-		Token: token,
+	holder, err := s.store.AcceptAccountHolder(accountID, holderID)
+	if IsKind(err, KindNotFound) {
+		return errForbidden()
 	}
-	return WriteJSON(w, http.StatusOK, loginResponse)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, holder)
 }
 
-func (s *APIServer) handleGetAccount(w http.ResponseWriter, r *http.Request) error {
-	id, err := getId(r)
+// handleRemoveAccountHolder removes a holder from the account or withdraws
+// their invitation. Holders who manage the account can remove anyone; every
+// holder can remove themselves, which is also how invitations are declined.
+func (s *APIServer) handleRemoveAccountHolder(w http.ResponseWriter, r *http.Request) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	holderID, err := getPathId(r, "customerId")
 	if err != nil {
 		return err
 	}
 
-	account, err := s.store.GetAccountById(id)
+	if id, ok := customerID(claims.Subject); ok && id == holderID {
+		accountID, err := getId(r)
+		if err != nil {
+			return err
+		}
+		err = s.store.RemoveAccountHolder(accountID, holderID)
+		if IsKind(err, KindNotFound) {
+			return errForbidden()
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		account, err := s.getAuthorizedAccount(r, HolderPermissionManage)
+		if err != nil {
+			return err
+		}
+		if err := s.store.RemoveAccountHolder(account.ID, holderID); err != nil {
+			return err
+		}
+	}
+	return WriteJSON(w, http.StatusOK, map[string]int{"removed": holderID})
+}
+
+// handleSetApprovalLimit sets the amount above which transfers from the
+// account need the approval of a second holder, or removes it.
+func (s *APIServer) handleSetApprovalLimit(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.getAuthorizedAccount(r, HolderPermissionManage)
 	if err != nil {
 		return err
 	}
-	return WriteJSON(w, http.StatusOK, account)
+	limitReq := new(ApprovalLimitRequest)
+	if err := decodeJSON(r, limitReq); err != nil {
+		return err
+	}
+	if limitReq.Limit != nil {
+		if !limitReq.Limit.SameCurrency(account.Balance) {
+			return errCurrencyMismatch()
+		}
+		if !limitReq.Limit.IsPositive() {
+			return ValidationError("invalid_approval_limit", "Approval limit must be positive").WithDetail("field", "limit")
+		}
+	}
+	if err := s.store.SetApprovalLimit(account.ID, limitReq.Limit); err != nil {
+		return err
+	}
+	account.ApprovalLimit = limitReq.Limit
+	return WriteJSON(w, http.StatusOK, NewAccountResponse(account))
 }
 
-func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
-	createReq := new(CreateAccountRequest)
-	if err := json.NewDecoder(r.Body).Decode(createReq); err != nil {
+func (s *APIServer) handleDeposit(w http.ResponseWriter, r *http.Request) error {
+	return s.handleCash(w, r, "deposits", s.store.Deposit)
+}
+
+func (s *APIServer) handleWithdrawal(w http.ResponseWriter, r *http.Request) error {
+	return s.handleCash(w, r, "withdrawals", s.store.Withdraw)
+}
+
+// handleCash books a deposit or a withdrawal on the account in the path.
+// Cash is handed over at the counter, so only staff book it; customers move
+// money through transfers, which have the second factor and approvals.
+func (s *APIServer) handleCash(w http.ResponseWriter, r *http.Request, resource string, move func(string, Money, string, string, *IdempotencyKey) (*Transaction, error)) error {
+	claims, err := getClaims(r)
+	if err != nil {
+		return err
+	}
+	if !roleHasPermission(claims.Role, PermissionMoveCash) {
+		return errForbidden()
+	}
+	account, err := s.getAuthorizedAccount(r, HolderPermissionTransfer)
+	if err != nil {
 		return err
 	}
 
-	account, err := NewAccount(createReq.FirstName, createReq.LastName, createReq.Password)
+	cashReq := new(CashRequest)
+	if err := decodeJSON(r, cashReq); err != nil {
+		return err
+	}
+	if len(cashReq.Reference) > maxReferenceLength {
+		return ValidationError("invalid_reference", "Reference must be at most %d characters", maxReferenceLength)
+	}
+
+	respond := func(result any) (int, any) {
+		return http.StatusOK, result.(*Transaction)
+	}
+	key, err := newIdempotencyKey(r, "POST /accounts/"+resource+" "+account.IBAN, cashReq, respond)
 	if err != nil {
 		return err
 	}
 
-	if err := s.store.CreateAccount(account); err != nil {
+	transaction, err := move(account.IBAN, cashReq.Amount, cashReq.Reference, claims.Subject, key)
+	if err != nil {
 		return err
 	}
-	return WriteJSON(w, http.StatusOK, account)
+	if key != nil {
+		return writeIdempotentResponse(w, key)
+	}
+	status, resp := respond(transaction)
+	return WriteJSON(w, status, resp)
 }
 
-func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
-	id, err := getId(r)
+func (s *APIServer) handleGetTransactions(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.getAuthorizedAccount(r, HolderPermissionView)
+	if err != nil {
+		return err
+	}
+
+	filter, err := getTransactionFilter(r)
 	if err != nil {
 		return err
 	}
-	err = s.store.DeleteAccount(id)
+	// fetch one extra transaction to find out whether there is a next page
+	limit := filter.Limit
+	filter.Limit++
+
+	transactions, err := s.store.GetTransactions(account.IBAN, filter)
 	if err != nil {
 		return err
 	}
-	return WriteJSON(w, http.StatusOK, map[string]int{"deleted": id})
+
+	resp := &TransactionsResponse{Transactions: transactions}
+	if len(transactions) > limit {
+		resp.Transactions = transactions[:limit]
+		resp.NextCursor = encodeCursor(resp.Transactions[limit-1].ID)
+	}
+	return WriteJSON(w, http.StatusOK, resp)
 }
 
-func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
-	// get the claims of the JWT token
+// getAuthorizedAccount loads the account addressed by the id in the path
+// and makes sure the caller may act on it: customers only on accounts they
+// hold with at least the given holder permission, staff on any (their
+// permission is checked by the route).
+// Customers get the same forbidden error for accounts that do not exist, so
+// ids cannot be probed.
+func (s *APIServer) getAuthorizedAccount(r *http.Request, permission string) (*Account, error) {
+	claims, err := getClaims(r)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := getId(r)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := s.store.GetAccountById(id)
+	if claims.Role != RoleCustomer {
+		return account, err
+	}
+	if err != nil && !IsKind(err, KindNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errForbidden()
+	}
+	if err := s.checkHolder(claims, account, permission); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// checkHolder makes sure the customer of the token is an active holder of
+// the account with at least the given permission. Customers who do not hold
+// the account get the same error as for accounts that do not exist.
+func (s *APIServer) checkHolder(claims *Claims, account *Account, permission string) error {
+	id, ok := customerID(claims.Subject)
+	if !ok {
+		return errForbidden()
+	}
+	holder, err := s.store.GetAccountHolder(account.ID, id)
+	if err != nil && !IsKind(err, KindNotFound) {
+		return err
+	}
+	if err != nil || holder.Status != HolderStatusActive {
+		return errForbidden()
+	}
+	if !holder.Permits(permission) {
+		return ForbiddenError("holder_permission_required", "Holders with the %s permission cannot do this", holder.Permission).WithDetail("required", permission)
+	}
+	return nil
+}
+
+// getCurrentCustomer loads the customer the access token was issued to.
+func (s *APIServer) getCurrentCustomer(r *http.Request) (*Customer, error) {
+	claims, err := getClaims(r)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := customerID(claims.Subject)
+	if !ok {
+		return nil, errForbidden()
+	}
+	return s.store.GetCustomerById(id)
+}
+
+// newIBAN assigns the next account number of the bank and turns it into an
+// IBAN. The country and bank code are read from IBAN_COUNTRY and
+// IBAN_BANK_CODE.
+func (s *APIServer) newIBAN() (string, error) {
+	number, err := s.store.NextAccountNumber()
+	if err != nil {
+		return "", err
+	}
+	country, bankCode := ibanSettings()
+	return iban.Generate(country, bankCode, number)
+}
+
+func ibanSettings() (country, bankCode string) {
+	country = os.Getenv("IBAN_COUNTRY")
+	if country == "" {
+		country = defaultIBANCountry
+	}
+	bankCode = os.Getenv("IBAN_BANK_CODE")
+	if bankCode == "" {
+		bankCode = defaultIBANBankCode
+	}
+	return country, bankCode
+}
+
+// parseIBAN normalizes an IBAN taken from the request field and rejects it
+// unless it is valid.
+func parseIBAN(field, value string) (string, error) {
+	normalized := iban.Normalize(value)
+	if err := iban.Validate(normalized); err != nil {
+		return "", ValidationError("invalid_iban", "Invalid IBAN %s: %v", value, err).WithDetail("field", field)
+	}
+	return normalized, nil
+}
+
+func getClaims(r *http.Request) (*Claims, error) {
 	claims, ok := r.Context().Value(claimsKey).(*Claims)
 	if !ok {
-		return fmt.Errorf("no claims found in request context")
+		return nil, InternalError(fmt.Errorf("no claims found in request context"))
 	}
-	fromAccountIban := claims.IBAN
+	return claims, nil
+}
 
-	transferReq := new(TransferRequest)
-	if err := json.NewDecoder(r.Body).Decode(&transferReq); err != nil {
-		return err
+func errForbidden() *Error {
+	return ForbiddenError("forbidden", "Forbidden")
+}
+
+// decodeJSON decodes the request body into v. Typed errors raised while
+// decoding, e.g. by Money, are passed on; anything else is reported as
+// malformed JSON.
+func decodeJSON(r *http.Request, v any) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return nil
 	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return ValidationError("invalid_json", "Invalid request body: %v", err)
+}
 
-	if err := s.store.TransferFunds(fromAccountIban, transferReq.ToAccountIban, transferReq.Amount); err != nil {
+// decodeOptionalJSON works like decodeJSON but leaves v untouched if the
+// request has no body.
+func decodeOptionalJSON(r *http.Request, v any) error {
+	if r.Body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
 		return err
 	}
-	return WriteJSON(w, http.StatusOK, map[string]string{"status": "success"})
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return decodeJSON(r, v)
 }
 
 func WriteJSON(w http.ResponseWriter, status int, v any) error {
@@ -150,30 +1968,42 @@ func WriteJSON(w http.ResponseWriter, status int, v any) error {
 func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
-			_ = WriteJSON(w, http.StatusBadRequest, APIError{Error: err.Error()})
+			writeError(w, err)
 		}
 	}
 }
 
-func validateTokenMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// validateTokenMiddleware authenticates requests with a bearer access token
+// that has neither expired nor been revoked.
+func (s *APIServer) validateTokenMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			_ = WriteJSON(w, http.StatusBadRequest, APIError{Error: "Authorization header is required"})
+			writeError(w, UnauthorizedError("missing_token", "Authorization header is required"))
 			return
 		}
 
 		headerParts := strings.Split(authHeader, " ")
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			_ = WriteJSON(w, http.StatusBadRequest, APIError{Error: "Authorization header must be in the format 'Bearer {token}'"})
+			writeError(w, UnauthorizedError("invalid_token", "Authorization header must be in the format 'Bearer {token}'"))
 			return
 		}
 
 		tokenStr := headerParts[1]
 
-		claims, err := ValidateToken(tokenStr)
+		claims, err := s.keys.ValidateToken(tokenStr)
+		if err != nil {
+			writeError(w, UnauthorizedError("invalid_token", "Access Denied"))
+			return
+		}
+
+		revoked, err := s.store.IsTokenRevoked(claims.Id, claims.SessionID)
 		if err != nil {
-			_ = WriteJSON(w, http.StatusBadRequest, APIError{Error: "Access Denied"})
+			writeError(w, err)
+			return
+		}
+		if revoked {
+			writeError(w, UnauthorizedError("token_revoked", "Token has been revoked"))
 			return
 		}
 
@@ -183,59 +2013,128 @@ func validateTokenMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// writeError answers with an application/problem+json document. Errors
+// that are not an *Error are logged and reported as internal errors without
+// revealing their message.
+func writeError(w http.ResponseWriter, err error) {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		apiErr = InternalError(err)
+	}
+	if apiErr.Kind == KindInternal {
+		log.Printf("Internal error: %v\n", apiErr.Err)
+	}
+	if apiErr.Kind == KindUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gobank"`)
+	}
+	if retryAfter, ok := apiErr.Details["retryAfter"].(int); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+
+	status := apiErr.Kind.HTTPStatus()
+	w.Header().Add("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(APIError{
+		Type:    "about:blank",
+		Title:   http.StatusText(status),
+		Status:  status,
+		Detail:  apiErr.Message,
+		Code:    apiErr.Code,
+		Details: apiErr.Details,
+	})
+}
+
 func getId(r *http.Request) (int, error) {
-	vars := mux.Vars(r)
-	idStr := vars["id"]
+	return getPathId(r, "id")
+}
+
+// getPathId reads the numeric path variable name, e.g. "approvalId".
+func getPathId(r *http.Request, name string) (int, error) {
+	idStr := mux.Vars(r)[name]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return id, fmt.Errorf("Invalid id: %v", idStr)
+		return id, ValidationError("invalid_id", "Invalid %s: %v", name, idStr)
 	}
 	return id, nil
 }
 
-func checkPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
-}
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
 
-func CreateToken(iban string) (string, error) {
-	expirationTime := time.Now().Add(60 * time.Minute)
-	jwtKey := os.Getenv("JWT_SECRET")
+// getTransactionFilter reads the from, to, cursor and limit query parameters.
+// Dates are accepted as RFC 3339 timestamps or as plain YYYY-MM-DD days.
+func getTransactionFilter(r *http.Request) (*TransactionFilter, error) {
+	query := r.URL.Query()
+	filter := new(TransactionFilter)
 
-	claims := &Claims{
-		IBAN: iban,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-			IssuedAt:  time.Now().Unix(),
-			Issuer:    "gobank",
-		},
+	var err error
+	if filter.From, err = parseTimeParam(query.Get("from")); err != nil {
+		return nil, ValidationError("invalid_query", "Invalid from: %v", query.Get("from")).WithDetail("parameter", "from")
+	}
+	if filter.To, err = parseTimeParam(query.Get("to")); err != nil {
+		return nil, ValidationError("invalid_query", "Invalid to: %v", query.Get("to")).WithDetail("parameter", "to")
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if filter.Cursor, filter.Limit, err = getPage(r); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
 
-	tokenString, err := token.SignedString([]byte(jwtKey))
-	if err != nil {
-		return "", err
+// getPage reads the cursor and limit query parameters of paginated lists.
+func getPage(r *http.Request) (cursor int, limit int, err error) {
+	query := r.URL.Query()
+	if cursorStr := query.Get("cursor"); cursorStr != "" {
+		if cursor, err = decodeCursor(cursorStr); err != nil {
+			return 0, 0, ValidationError("invalid_query", "Invalid cursor: %v", cursorStr).WithDetail("parameter", "cursor")
+		}
 	}
 
-	return tokenString, nil
+	limit = defaultPageSize
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, ValidationError("invalid_query", "Invalid limit: %v", limitStr).WithDetail("parameter", "limit")
+		}
+	}
+	return cursor, limit, nil
 }
 
-func ValidateToken(tokenString string) (*Claims, error) {
-	jwtKey := os.Getenv("JWT_SECRET")
-	claims := new(Claims)
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t.UTC(), err
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(jwtKey), nil
-	})
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
 
+func decodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-
-	if !token.Valid {
-		return nil, fmt.Errorf("invalid token")
+	id, err := strconv.Atoi(string(raw))
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid cursor")
 	}
+	return id, nil
+}
 
-	return claims, nil
+// dummyPasswordHash is checked instead of a password hash when the login
+// is unknown, so that unknown logins cannot be told apart from wrong
+// passwords by how long the answer takes. It has the cost of HashPassword.
+const dummyPasswordHash = "$2a$10$QJ9ssx2v6ABkfQ/6Lz1j.OLcDYIbEzOji99V8QloYl3YOveO8Ld7y"
+
+func checkPasswordHash(password, hash string) bool {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return err == nil
 }
@@ -7,13 +7,20 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/beshoyabdelmalak/gobank/iban"
+	"github.com/beshoyabdelmalak/gobank/totp"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestHandleCreateAccount(t *testing.T) {
@@ -22,15 +29,67 @@ func TestHandleCreateAccount(t *testing.T) {
 	defer tearDownTestDB(store)
 
 	// Create an instance of the APIServer with the test database
-	apiServer := NewAPIServer(":8000", store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
 
 	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
 	account := createTestAccount(apiServer, t, testAccountReq)
-	assert.Equal(t, testAccountReq.FirstName, account.FirstName)
-	assert.Equal(t, testAccountReq.LastName, account.LastName)
 	assert.NotEmpty(t, account.ID, "Expected non-empty ID")
+	assert.NotEmpty(t, account.CustomerID, "Expected non-empty customer ID")
 	assert.NotEmpty(t, account.IBAN, "Expected non-empty IBAN")
-	assert.NotEmpty(t, account.Balance, "Expected non-empty Balance")
+	assert.Equal(t, AccountTypeCurrent, account.Type)
+	assert.Equal(t, NewMoney(0, DefaultCurrency), account.Balance)
+	assert.NoError(t, iban.Validate(account.IBAN))
+
+	// a customer can own several accounts
+	jwtToken := loginTestAccount(apiServer, t, testAccountReq.Username, testAccountReq.Password)
+	other := openTestAccount(apiServer, t, jwtToken, AccountTypeSavings)
+	assert.NoError(t, iban.Validate(other.IBAN))
+	assert.NotEqual(t, account.IBAN, other.IBAN)
+	assert.Equal(t, account.CustomerID, other.CustomerID)
+	assert.Equal(t, AccountTypeSavings, other.Type)
+
+	respRec := routeTestRequest(apiServer, "POST", "/accounts", jwtToken, CreateAccountRequest{Type: "brokerage"})
+	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", "/accounts", "", CreateAccountRequest{})
+	assert.Equal(t, http.StatusUnauthorized, respRec.Code)
+
+	respRec = routeTestRequest(apiServer, "GET", "/customers/me", jwtToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var customer CustomerResponse
+	err := json.Unmarshal(respRec.Body.Bytes(), &customer)
+	assert.NoError(t, err)
+	assert.Equal(t, testAccountReq.Username, customer.Username)
+	assert.Equal(t, testAccountReq.Email, customer.Email)
+	assert.Equal(t, testAccountReq.FirstName, customer.FirstName)
+	assert.Len(t, customer.Accounts, 2)
+	assertNoPasswordHash(t, store, customer.ID, respRec.Body.String())
+}
+
+func TestHandleCreateCustomer(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	customerReq := createTestAccountReq("testFName", "testLName", "testPassword")
+	assert.Equal(t, http.StatusCreated, createTestCustomerRequest(apiServer, customerReq).Code)
+
+	// usernames and emails are unique
+	codes := map[string]*CreateCustomerRequest{
+		"username_taken":   {Username: customerReq.Username, Email: "other@example.com", Password: "testPassword"},
+		"email_taken":      {Username: "other", Email: strings.ToUpper(customerReq.Email), Password: "testPassword"},
+		"invalid_email":    {Username: "other", Email: "Other <other@example.com>", Password: "testPassword"},
+		"invalid_password": {Username: "other", Email: "other@example.com", Password: "short"},
+	}
+	for code, req := range codes {
+		respRec := createTestCustomerRequest(apiServer, req)
+		var resp APIError
+		err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+		assert.NoError(t, err)
+		assert.Equal(t, code, resp.Code)
+	}
 }
 
 func TestHandleLogin(t *testing.T) {
@@ -39,14 +98,14 @@ func TestHandleLogin(t *testing.T) {
 	defer tearDownTestDB(store)
 
 	// Create an instance of the APIServer with the test database
-	apiServer := NewAPIServer(":8000", store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
 
 	// create test account
 	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
-	testAccount := createTestAccount(apiServer, t, testAccountReq)
+	createTestAccount(apiServer, t, testAccountReq)
 
 	loginReq := LoginRequest{
-		IBAN:     testAccount.IBAN,
+		Username: testAccountReq.Username,
 		Password: testAccountReq.Password,
 	}
 	reqBody, _ := json.Marshal(loginReq)
@@ -70,10 +129,10 @@ func TestHandleLoginNonExistAccount(t *testing.T) {
 	defer tearDownTestDB(store)
 
 	// Create an instance of the APIServer with the test database
-	apiServer := NewAPIServer(":8000", store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
 
 	loginReq := LoginRequest{
-		IBAN:     "test_IBAN",
+		Username: "nobody",
 		Password: "test_password",
 	}
 	reqBody, _ := json.Marshal(loginReq)
@@ -84,12 +143,21 @@ func TestHandleLoginNonExistAccount(t *testing.T) {
 	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleLogin))
 	handler.ServeHTTP(respRec, req)
 
-	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	// unknown customers cannot be told apart from wrong passwords
+	assert.Equal(t, http.StatusUnauthorized, respRec.Code)
 
 	var resp APIError
 	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
 	assert.NoError(t, err)
-	assert.Equal(t, "Account with IBAN number test_IBAN not found", resp.Error)
+	assert.Equal(t, "invalid_credentials", resp.Code)
+
+	// the hash checked for unknown logins costs as much as real ones
+	hash, err := HashPassword("test_password")
+	assert.NoError(t, err)
+	cost, err := bcrypt.Cost([]byte(dummyPasswordHash))
+	assert.NoError(t, err)
+	realCost, _ := bcrypt.Cost([]byte(hash))
+	assert.Equal(t, realCost, cost)
 }
 
 func TestHandleLoginWrongPassword(t *testing.T) {
@@ -98,14 +166,14 @@ func TestHandleLoginWrongPassword(t *testing.T) {
 	defer tearDownTestDB(store)
 
 	// Create an instance of the APIServer with the test database
-	apiServer := NewAPIServer(":8000", store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
 
 	// create test account
 	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
-	testAccount := createTestAccount(apiServer, t, testAccountReq)
+	createTestAccount(apiServer, t, testAccountReq)
 
 	loginReq := LoginRequest{
-		IBAN:     testAccount.IBAN,
+		Username: testAccountReq.Username,
 		Password: "test_password1",
 	}
 	reqBody, _ := json.Marshal(loginReq)
@@ -116,11 +184,207 @@ func TestHandleLoginWrongPassword(t *testing.T) {
 	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleLogin))
 	handler.ServeHTTP(respRec, req)
 
-	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	assert.Equal(t, http.StatusUnauthorized, respRec.Code)
+	var resp APIError
+	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "Access Denied", resp.Detail)
+	assert.Equal(t, "invalid_credentials", resp.Code)
+}
+
+func TestHandleLoginByEmailAndIban(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
+	createTestAccount(apiServer, t, testAccountReq)
+
+	// emails are matched in any case
+	respRec := loginTestRequest(apiServer, strings.ToUpper(testAccountReq.Email), testAccountReq.Password)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+
+	// customers of accounts from before the split log in with the IBAN,
+	// which is accepted with spaces as well
+	customer, err := NewCustomer("DE89370400440532013000", "legacy@example.com", "testPassword", "testFName", "testLName")
+	assert.NoError(t, err)
+	assert.NoError(t, store.CreateCustomer(customer))
+	respRec = loginTestRequest(apiServer, "de89 3704 0044 0532 0130 00", "testPassword")
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var loginResp LoginResponse
+	err = json.Unmarshal(respRec.Body.Bytes(), &loginResp)
+	assert.NoError(t, err)
+	claims, err := testKeyring.ValidateToken(loginResp.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, customerSubject(customer.ID), claims.Subject)
+}
+
+func TestHandleLoginThrottling(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
+	createTestAccount(apiServer, t, testAccountReq)
+
+	assert.Equal(t, http.StatusUnauthorized, loginTestRequest(apiServer, testAccountReq.Username, "wrongPassword").Code)
+
+	// even the right password has to wait for the delay after a failure
+	respRec := loginTestRequest(apiServer, testAccountReq.Username, testAccountReq.Password)
+	assert.Equal(t, http.StatusTooManyRequests, respRec.Code)
+	assert.Equal(t, "1", respRec.Header().Get("Retry-After"))
+	var resp APIError
+	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "login_throttled", resp.Code)
+}
+
+func TestHandleLoginLockoutAndUnlock(t *testing.T) {
+	t.Setenv("LOGIN_BASE_DELAY", "0s")
+	t.Setenv("LOGIN_MAX_FAILURES", "3")
+
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
+	testAccount := createTestAccount(apiServer, t, testAccountReq)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, loginTestRequest(apiServer, testAccountReq.Username, "wrongPassword").Code)
+	}
+	respRec := loginTestRequest(apiServer, testAccountReq.Username, testAccountReq.Password)
+	assert.Equal(t, http.StatusTooManyRequests, respRec.Code)
+	assert.NotEmpty(t, respRec.Header().Get("Retry-After"))
+
+	subject := customerSubject(testAccount.CustomerID)
+	events, err := store.GetAuditEvents(subject, 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, AuditAccountLocked, events[0].Kind)
+
+	// the lockout shows on the customer
+	adminToken := createTestAdmin(apiServer, t)
+	customerPath := fmt.Sprintf("/admin/customers/%d", testAccount.CustomerID)
+	respRec = routeTestRequest(apiServer, "GET", customerPath, adminToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var details CustomerDetailsResponse
+	err = json.Unmarshal(respRec.Body.Bytes(), &details)
+	assert.NoError(t, err)
+	assert.NotNil(t, details.LockedUntil)
+	assert.Len(t, details.Accounts, 1)
+	assert.Equal(t, testAccount.IBAN, details.Accounts[0].IBAN)
+
+	unlock := func(token string) *httptest.ResponseRecorder {
+		return routeTestRequest(apiServer, "POST", customerPath+"/unlock", token, nil)
+	}
+
+	// customers cannot unlock logins, not even their own
+	otherAccountReq := createTestAccountReq("otherFName", "otherLName", "otherPassword")
+	createTestAccount(apiServer, t, otherAccountReq)
+	assert.Equal(t, http.StatusForbidden, unlock(loginTestAccount(apiServer, t, otherAccountReq.Username, otherAccountReq.Password)).Code)
+
+	assert.Equal(t, http.StatusOK, unlock(adminToken).Code)
+	assert.Equal(t, http.StatusOK, loginTestRequest(apiServer, testAccountReq.Username, testAccountReq.Password).Code)
+
+	respRec = routeTestRequest(apiServer, "GET", "/admin/audit-events?subject="+subject, adminToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	err = json.Unmarshal(respRec.Body.Bytes(), &events)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, AuditAccountUnlocked, events[0].Kind)
+	assert.Equal(t, AuditAccountLocked, events[1].Kind)
+}
+
+func TestHandleRefreshToken(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
+	testAccount := createTestAccount(apiServer, t, testAccountReq)
+	login := loginTestSession(apiServer, t, testAccountReq.Username, testAccountReq.Password)
+
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		reqBody, _ := json.Marshal(RefreshTokenRequest{RefreshToken: refreshToken})
+		req, _ := http.NewRequest("POST", "/token/refresh", bytes.NewBuffer(reqBody))
+		respRec := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleRefreshToken))
+		handler.ServeHTTP(respRec, req)
+		return respRec
+	}
+
+	respRec := refresh(login.RefreshToken)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var refreshed LoginResponse
+	err := json.Unmarshal(respRec.Body.Bytes(), &refreshed)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, refreshed.Token)
+	assert.NotEqual(t, login.RefreshToken, refreshed.RefreshToken)
+	assert.Equal(t, http.StatusOK, getTestAccount(apiServer, testAccount.ID, "Bearer "+refreshed.Token).Code)
+
+	// reusing a rotated refresh token revokes the whole session
+	respRec = refresh(login.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, respRec.Code)
+	assert.Equal(t, http.StatusUnauthorized, refresh(refreshed.RefreshToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, getTestAccount(apiServer, testAccount.ID, "Bearer "+refreshed.Token).Code)
+
+	assert.Equal(t, http.StatusUnauthorized, refresh("unknown").Code)
+}
+
+func TestHandleLogout(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
+	testAccount := createTestAccount(apiServer, t, testAccountReq)
+	login := loginTestSession(apiServer, t, testAccountReq.Username, testAccountReq.Password)
+	otherSessionToken := loginTestAccount(apiServer, t, testAccountReq.Username, testAccountReq.Password)
+	jwtToken := "Bearer " + login.Token
+
+	req, _ := http.NewRequest("POST", "/logout", nil)
+	req.Header.Set("Authorization", jwtToken)
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleLogout)))
+	handler.ServeHTTP(respRec, req)
+	assert.Equal(t, http.StatusNoContent, respRec.Code)
+
+	// the access token is rejected right away
+	respRec = getTestAccount(apiServer, testAccount.ID, jwtToken)
+	assert.Equal(t, http.StatusUnauthorized, respRec.Code)
 	var resp APIError
 	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
 	assert.NoError(t, err)
-	assert.Equal(t, "Access Denied", resp.Error)
+	assert.Equal(t, "token_revoked", resp.Code)
+
+	// and so is the refresh token of the session
+	reqBody, _ := json.Marshal(RefreshTokenRequest{RefreshToken: login.RefreshToken})
+	req, _ = http.NewRequest("POST", "/token/refresh", bytes.NewBuffer(reqBody))
+	respRec = httptest.NewRecorder()
+	handler = http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleRefreshToken))
+	handler.ServeHTTP(respRec, req)
+	assert.Equal(t, http.StatusUnauthorized, respRec.Code)
+
+	// other sessions are not affected
+	assert.Equal(t, http.StatusOK, getTestAccount(apiServer, testAccount.ID, otherSessionToken).Code)
 }
 
 func TestHandleGetAccount(t *testing.T) {
@@ -129,28 +393,30 @@ func TestHandleGetAccount(t *testing.T) {
 	defer tearDownTestDB(store)
 
 	// Create an instance of the APIServer with the test database
-	apiServer := NewAPIServer(":8000", store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
 
 	// create test account
 	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
 	testAccount := createTestAccount(apiServer, t, testAccountReq)
+	jwtToken := loginTestAccount(apiServer, t, testAccountReq.Username, testAccountReq.Password)
 
 	req, _ := http.NewRequest("GET", "/accounts", nil)
 	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(testAccount.ID)})
+	req.Header.Set("Authorization", jwtToken)
 	respRec := httptest.NewRecorder()
 
-	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleGetAccount))
+	handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleGetAccount)))
 	handler.ServeHTTP(respRec, req)
 
 	assert.Equal(t, http.StatusOK, respRec.Code)
-	var resp Account
+	var resp AccountResponse
 	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
 	assert.NoError(t, err)
-	assert.Equal(t, testAccount.FirstName, resp.FirstName)
-	assert.Equal(t, testAccount.LastName, resp.LastName)
+	assert.Equal(t, testAccount.CustomerID, resp.CustomerID)
+	assert.Equal(t, testAccount.Type, resp.Type)
 	assert.Equal(t, testAccount.IBAN, resp.IBAN)
-	assert.Equal(t, testAccount.EncryptedPassword, resp.EncryptedPassword)
 	assert.Equal(t, testAccount.ID, resp.ID)
+	assertNoPasswordHash(t, store, testAccount.CustomerID, respRec.Body.String())
 }
 
 func TestHandleGetAccountNonExist(t *testing.T) {
@@ -159,218 +425,2280 @@ func TestHandleGetAccountNonExist(t *testing.T) {
 	defer tearDownTestDB(store)
 
 	// Create an instance of the APIServer with the test database
-	apiServer := NewAPIServer(":8000", store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	// only admins learn whether an account exists
+	adminToken := createTestAdmin(apiServer, t)
 
 	req, _ := http.NewRequest("GET", "/accounts", nil)
-	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	req = mux.SetURLVars(req, map[string]string{"id": "1000"})
+	req.Header.Set("Authorization", adminToken)
 	respRec := httptest.NewRecorder()
 
-	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleGetAccount))
+	handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleGetAccount)))
 	handler.ServeHTTP(respRec, req)
 
-	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	assert.Equal(t, http.StatusNotFound, respRec.Code)
 	var resp APIError
 	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
 	assert.NoError(t, err)
-	assert.Equal(t, "Account with id 1 not found", resp.Error)
+	assert.Equal(t, "Account with id 1000 not found", resp.Detail)
 }
 
-func TestHandleDeleteAccount(t *testing.T) {
+func TestHandleGetAccountUnauthenticated(t *testing.T) {
 	// Set up the test database
 	store := setupTestDB()
 	defer tearDownTestDB(store)
 
 	// Create an instance of the APIServer with the test database
-	apiServer := NewAPIServer(":8000", store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
+	testAccount := createTestAccount(apiServer, t, testAccountReq)
+
+	for _, authHeader := range []string{"", "Bearer invalid-token"} {
+		req, _ := http.NewRequest("GET", "/accounts", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(testAccount.ID)})
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		respRec := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleGetAccount)))
+		handler.ServeHTTP(respRec, req)
+
+		assert.Equal(t, http.StatusUnauthorized, respRec.Code)
+		assert.NotEmpty(t, respRec.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestHandleGetAccountOtherCustomer(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	ownerAccountReq := createTestAccountReq("ownerFName", "ownerLName", "ownerPassword")
+	ownerAccount := createTestAccount(apiServer, t, ownerAccountReq)
+
+	otherAccountReq := createTestAccountReq("otherFName", "otherLName", "otherPassword")
+	createTestAccount(apiServer, t, otherAccountReq)
+	jwtToken := loginTestAccount(apiServer, t, otherAccountReq.Username, otherAccountReq.Password)
+
+	// existing and missing accounts of others look the same
+	for _, id := range []string{strconv.Itoa(ownerAccount.ID), "1000"} {
+		for _, handle := range []apiFunc{apiServer.handleGetAccount, apiServer.handleDeleteAccount} {
+			req, _ := http.NewRequest("GET", "/accounts", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": id})
+			req.Header.Set("Authorization", jwtToken)
+			respRec := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(handle)))
+			handler.ServeHTTP(respRec, req)
+
+			assert.Equal(t, http.StatusForbidden, respRec.Code)
+			var resp APIError
+			err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+			assert.NoError(t, err)
+			assert.Equal(t, "Forbidden", resp.Detail)
+		}
+	}
+
+	// the owner's account is still there
+	_, err := store.GetAccountById(ownerAccount.ID)
+	assert.NoError(t, err)
+}
+
+func TestHandleDeleteAccountAsAdmin(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
 
-	// create test account
 	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
 	testAccount := createTestAccount(apiServer, t, testAccountReq)
+	adminToken := createTestAdmin(apiServer, t)
 
 	req, _ := http.NewRequest("DELETE", "/accounts", nil)
 	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(testAccount.ID)})
+	req.Header.Set("Authorization", adminToken)
 	respRec := httptest.NewRecorder()
 
-	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleDeleteAccount))
+	handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleDeleteAccount)))
 	handler.ServeHTTP(respRec, req)
 
 	assert.Equal(t, http.StatusOK, respRec.Code)
-	var resp map[string]int
-	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+	account, err := store.GetAccountById(testAccount.ID)
 	assert.NoError(t, err)
-	assert.Equal(t, testAccount.ID, resp["deleted"])
-
-	// check account deleted
-	_, err = store.GetAccountById(testAccount.ID)
-	assert.Equal(t, fmt.Sprintf("Account with id %d not found", testAccount.ID), err.Error())
+	assert.Equal(t, AccountStatusClosed, account.Status)
 }
 
-func TestHandleTransfer(t *testing.T) {
+func TestHandleStaffPermissions(t *testing.T) {
+	// failed staff logins below share the test client's IP throttle
+	t.Setenv("LOGIN_BASE_DELAY", "0s")
+
 	// Set up the test database
 	store := setupTestDB()
 	defer tearDownTestDB(store)
 
 	// Create an instance of the APIServer with the test database
-	apiServer := NewAPIServer(":8000", store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
 
-	// create test accounts
-	senderAccountReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
-	senderAccount := createTestAccount(apiServer, t, senderAccountReq)
-
-	receiverAccountReq := createTestAccountReq("receiverFName", "receiverLName", "receiverPassword")
-	receiverAccount := createTestAccount(apiServer, t, receiverAccountReq)
-
-	// login with the sender account to get the token
-	loginReq := LoginRequest{
-		IBAN:     senderAccount.IBAN,
-		Password: senderAccountReq.Password,
-	}
-	reqBody, _ := json.Marshal(loginReq)
+	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
+	testAccount := createTestAccount(apiServer, t, testAccountReq)
+	customerToken := loginTestAccount(apiServer, t, testAccountReq.Username, testAccountReq.Password)
+	supportToken := createTestStaff(apiServer, t, "support", RoleSupport)
+	auditorToken := createTestStaff(apiServer, t, "auditor", RoleAuditor)
+	accountPath := fmt.Sprintf("/accounts/%d", testAccount.ID)
+
+	// staff read any account, but only admins delete them
+	assert.Equal(t, http.StatusOK, routeTestRequest(apiServer, "GET", accountPath, supportToken, nil).Code)
+	assert.Equal(t, http.StatusOK, routeTestRequest(apiServer, "GET", accountPath+"/transactions", auditorToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "DELETE", accountPath, supportToken, nil).Code)
+
+	// staff have no account to send money from
+	transferReq := TransferRequest{FromAccountIban: testAccount.IBAN, ToAccountIban: testAccount.IBAN, Amount: NewMoney(100, DefaultCurrency)}
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "POST", "/transfer", supportToken, transferReq).Code)
+
+	// the admin endpoints are closed to customers and to roles without the permission
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "GET", "/admin/accounts", customerToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "GET", "/admin/audit-events", supportToken, nil).Code)
+	assert.Equal(t, http.StatusOK, routeTestRequest(apiServer, "GET", "/admin/audit-events", auditorToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "GET", "/admin/staff", auditorToken, nil).Code)
+
+	// staff log in by username only
+	assert.Equal(t, http.StatusUnauthorized, staffLoginTestRequest(apiServer, "support", "wrongPassword").Code)
+	assert.Equal(t, http.StatusUnauthorized, staffLoginTestRequest(apiServer, "nobody", "staffPassword").Code)
+	respRec := staffLoginTestRequest(apiServer, testAccount.IBAN, testAccountReq.Password)
+	assert.Equal(t, http.StatusUnauthorized, respRec.Code)
+}
 
-	req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(reqBody))
-	respRec := httptest.NewRecorder()
+func TestHandleStaffRefreshToken(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
 
-	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleLogin))
-	handler.ServeHTTP(respRec, req)
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
 
-	assert.Equal(t, http.StatusOK, respRec.Code)
+	createTestStaff(apiServer, t, "auditor", RoleAuditor)
+	respRec := staffLoginTestRequest(apiServer, "auditor", "staffPassword")
 	var loginResp LoginResponse
 	err := json.Unmarshal(respRec.Body.Bytes(), &loginResp)
 	assert.NoError(t, err)
-	jwtToken := fmt.Sprintf("Bearer %s", loginResp.Token)
-
-	receiverOldBalance := receiverAccount.Balance
-	transferAmount := senderAccount.Balance
-	transferRequest := TransferRequest{
-		ToAccountIban: receiverAccount.IBAN,
-		Amount:        transferAmount,
-	}
-	reqBody, _ = json.Marshal(transferRequest)
 
-	req, _ = http.NewRequest("POST", "/transfer", bytes.NewBuffer(reqBody))
-	req.Header.Set("Authorization", jwtToken)
+	reqBody, _ := json.Marshal(RefreshTokenRequest{RefreshToken: loginResp.RefreshToken})
+	req, _ := http.NewRequest("POST", "/token/refresh", bytes.NewBuffer(reqBody))
 	respRec = httptest.NewRecorder()
-
-	handler = http.HandlerFunc(validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleTransfer)))
-	handler.ServeHTTP(respRec, req)
+	apiServer.router().ServeHTTP(respRec, req)
 
 	assert.Equal(t, http.StatusOK, respRec.Code)
-	var resp map[string]string
-	err = json.Unmarshal(respRec.Body.Bytes(), &resp)
+	err = json.Unmarshal(respRec.Body.Bytes(), &loginResp)
 	assert.NoError(t, err)
-	assert.Equal(t, "success", resp["status"])
-
-	// check updated balances
-	senderAccount, _ = store.GetAccountByIban(senderAccount.IBAN)
-	receiverAccount, _ = store.GetAccountByIban(receiverAccount.IBAN)
-	assert.Equal(t, float64(0), senderAccount.Balance)
-	assert.Equal(t, receiverOldBalance+transferAmount, receiverAccount.Balance)
+	claims, err := testKeyring.ValidateToken(loginResp.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, RoleAuditor, claims.Role)
+	assert.Equal(t, "staff:auditor", claims.Subject)
 }
 
-func TestHandleTransferInsufficientBalance(t *testing.T) {
+func TestHandleFreezeAccount(t *testing.T) {
 	// Set up the test database
 	store := setupTestDB()
 	defer tearDownTestDB(store)
 
 	// Create an instance of the APIServer with the test database
-	apiServer := NewAPIServer(":8000", store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
 
-	// create test accounts
 	senderAccountReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
 	senderAccount := createTestAccount(apiServer, t, senderAccountReq)
-
 	receiverAccountReq := createTestAccountReq("receiverFName", "receiverLName", "receiverPassword")
 	receiverAccount := createTestAccount(apiServer, t, receiverAccountReq)
+	jwtToken := loginTestAccount(apiServer, t, senderAccountReq.Username, senderAccountReq.Password)
+	depositTestFunds(apiServer, t, senderAccount, NewMoney(10000, DefaultCurrency))
 
-	// login with the sender account to get the token
-	loginReq := LoginRequest{
-		IBAN:     senderAccount.IBAN,
-		Password: senderAccountReq.Password,
-	}
-	reqBody, _ := json.Marshal(loginReq)
-
-	req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(reqBody))
-	respRec := httptest.NewRecorder()
-
-	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleLogin))
-	handler.ServeHTTP(respRec, req)
+	supportToken := createTestStaff(apiServer, t, "support", RoleSupport)
+	auditorToken := createTestStaff(apiServer, t, "auditor", RoleAuditor)
+	adminToken := createTestAdmin(apiServer, t)
+	adminPath := fmt.Sprintf("/admin/accounts/%d", senderAccount.ID)
 
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "POST", adminPath+"/freeze", auditorToken, nil).Code)
+	respRec := routeTestRequest(apiServer, "POST", adminPath+"/freeze", supportToken, nil)
 	assert.Equal(t, http.StatusOK, respRec.Code)
-	var loginResp LoginResponse
-	err := json.Unmarshal(respRec.Body.Bytes(), &loginResp)
+	var accountResp AccountResponse
+	err := json.Unmarshal(respRec.Body.Bytes(), &accountResp)
 	assert.NoError(t, err)
-	jwtToken := fmt.Sprintf("Bearer %s", loginResp.Token)
+	assert.Equal(t, AccountStatusFrozen, accountResp.Status)
+	assert.Equal(t, http.StatusConflict, routeTestRequest(apiServer, "POST", adminPath+"/freeze", supportToken, nil).Code)
 
-	receiverOldBalance := receiverAccount.Balance
-	transferAmount := senderAccount.Balance + 1
-	transferRequest := TransferRequest{
-		ToAccountIban: receiverAccount.IBAN,
-		Amount:        transferAmount,
-	}
-	reqBody, _ = json.Marshal(transferRequest)
-
-	req, _ = http.NewRequest("POST", "/transfer", bytes.NewBuffer(reqBody))
-	req.Header.Set("Authorization", jwtToken)
-	respRec = httptest.NewRecorder()
-
-	handler = http.HandlerFunc(validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleTransfer)))
-	handler.ServeHTTP(respRec, req)
-
-	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	// a frozen account can neither send nor receive money
+	transferReq := TransferRequest{FromAccountIban: senderAccount.IBAN, ToAccountIban: receiverAccount.IBAN, Amount: NewMoney(100, DefaultCurrency)}
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", jwtToken, transferReq)
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
 	var resp APIError
 	err = json.Unmarshal(respRec.Body.Bytes(), &resp)
 	assert.NoError(t, err)
-	assert.Equal(t, "Balance not sufficient", resp.Error)
+	assert.Equal(t, "account_frozen", resp.Code)
+	withdrawalReq := CashRequest{Amount: NewMoney(100, DefaultCurrency)}
+	respRec = routeTestRequest(apiServer, "POST", fmt.Sprintf("/accounts/%d/withdrawals", senderAccount.ID), adminToken, withdrawalReq)
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", fmt.Sprintf("/accounts/%d/deposits", senderAccount.ID), adminToken, withdrawalReq)
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+	err = json.Unmarshal(respRec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "account_frozen", resp.Code)
 
-	// check unchanged balances
-	senderAccount, _ = store.GetAccountByIban(senderAccount.IBAN)
-	receiverAccount, _ = store.GetAccountByIban(receiverAccount.IBAN)
-	assert.Equal(t, transferAmount-1, senderAccount.Balance)
-	assert.Equal(t, receiverOldBalance, receiverAccount.Balance)
+	assert.Equal(t, http.StatusOK, routeTestRequest(apiServer, "POST", adminPath+"/unfreeze", supportToken, nil).Code)
+	assert.Equal(t, http.StatusOK, routeTestRequest(apiServer, "POST", "/transfer", jwtToken, transferReq).Code)
+
+	// both changes are audited with the staff user as actor
+	respRec = routeTestRequest(apiServer, "GET", adminPath, auditorToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var details AccountDetailsResponse
+	err = json.Unmarshal(respRec.Body.Bytes(), &details)
+	assert.NoError(t, err)
+	assert.Equal(t, senderAccount.IBAN, details.IBAN)
+	assert.Equal(t, AccountStatusActive, details.Status)
+	assert.Equal(t, senderAccount.CustomerID, details.CustomerID)
+	assert.Len(t, details.AuditEvents, 3)
+	assert.Equal(t, AuditAccountUnfrozen, details.AuditEvents[0].Kind)
+	assert.Equal(t, AuditAccountFrozen, details.AuditEvents[1].Kind)
+	assert.Equal(t, "staff:support", details.AuditEvents[1].Actor)
+	assert.Equal(t, AuditCashDeposited, details.AuditEvents[2].Kind)
+	assertNoPasswordHash(t, store, senderAccount.CustomerID, respRec.Body.String())
 }
 
-func setupTestDB() *PostgresStore {
-	err := godotenv.Load()
-	if err != nil {
-		log.Println("Warning: Error loading .env file")
-	}
+func TestHandleAccountLifecycle(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
 
-	store, err := NewPostgresStore()
-	if err != nil {
-		log.Fatal(err)
-	}
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
 
-	if err := store.Init(); err != nil {
-		log.Fatal(err)
-	}
-	return store
-}
+	senderAccountReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
+	senderAccount := createTestAccount(apiServer, t, senderAccountReq)
+	receiverAccountReq := createTestAccountReq("receiverFName", "receiverLName", "receiverPassword")
+	receiverAccount := createTestAccount(apiServer, t, receiverAccountReq)
+	jwtToken := loginTestAccount(apiServer, t, senderAccountReq.Username, senderAccountReq.Password)
+	depositTestFunds(apiServer, t, senderAccount, NewMoney(10000, DefaultCurrency))
 
-func tearDownTestDB(store *PostgresStore) {
-	_, err := store.db.Exec("DROP table account")
-	if err != nil {
-		log.Fatal("Failed to drop test database:", err)
-	}
-}
+	supportToken := createTestStaff(apiServer, t, "support", RoleSupport)
+	adminToken := createTestAdmin(apiServer, t)
+	statusPath := fmt.Sprintf("/admin/accounts/%d/status", senderAccount.ID)
 
-func createTestAccountReq(firstName, lastName, password string) *CreateAccountRequest {
-	return &CreateAccountRequest{
-		FirstName: firstName,
-		LastName:  lastName,
-		Password:  password,
-	}
-}
+	// a dormant account still receives money but cannot send any
+	respRec := routeTestRequest(apiServer, "POST", statusPath, supportToken, AccountStatusRequest{Status: AccountStatusDormant})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	depositTestFunds(apiServer, t, senderAccount, NewMoney(100, DefaultCurrency))
+	transferReq := TransferRequest{FromAccountIban: senderAccount.IBAN, ToAccountIban: receiverAccount.IBAN, Amount: NewMoney(100, DefaultCurrency)}
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", jwtToken, transferReq)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+	var errResp APIError
+	err := json.Unmarshal(respRec.Body.Bytes(), &errResp)
+	assert.NoError(t, err)
+	assert.Equal(t, "account_dormant", errResp.Code)
 
-func createTestAccount(apiServer *APIServer, t *testing.T, accReq *CreateAccountRequest) *Account {
-	reqBody, _ := json.Marshal(accReq)
-	req, _ := http.NewRequest("POST", "/account", bytes.NewBuffer(reqBody))
-	respRec := httptest.NewRecorder()
+	// accounts only move along the allowed transitions
+	respRec = routeTestRequest(apiServer, "POST", statusPath, supportToken, AccountStatusRequest{Status: AccountStatusPending})
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", statusPath, supportToken, AccountStatusRequest{Status: "deleted"})
+	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", statusPath, supportToken, AccountStatusRequest{Status: AccountStatusActive})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	assert.Equal(t, http.StatusOK, routeTestRequest(apiServer, "POST", "/transfer", jwtToken, transferReq).Code)
 
-	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleCreateAccount))
-	handler.ServeHTTP(respRec, req)
+	// only staff who may delete accounts close them
+	respRec = routeTestRequest(apiServer, "POST", statusPath, supportToken, AccountStatusRequest{Status: AccountStatusClosed})
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
 
-	var testAccount Account
+	// closing needs a zero balance or an account to pay it out to
+	accountPath := fmt.Sprintf("/accounts/%d", senderAccount.ID)
+	respRec = routeTestRequest(apiServer, "DELETE", accountPath, jwtToken, nil)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+	err = json.Unmarshal(respRec.Body.Bytes(), &errResp)
+	assert.NoError(t, err)
+	assert.Equal(t, "account_not_empty", errResp.Code)
+
+	respRec = routeTestRequest(apiServer, "DELETE", accountPath, jwtToken, CloseAccountRequest{PayoutIban: receiverAccount.IBAN})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var closedResp AccountClosedResponse
+	err = json.Unmarshal(respRec.Body.Bytes(), &closedResp)
+	assert.NoError(t, err)
+	assert.Equal(t, AccountStatusClosed, closedResp.Status)
+	assert.True(t, closedResp.Balance.IsZero())
+	assert.NotNil(t, closedResp.Payout)
+	assert.Equal(t, NewMoney(10000, DefaultCurrency), closedResp.Payout.Amount)
+	receiver, err := store.GetAccountById(receiverAccount.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(10100, DefaultCurrency), receiver.Balance)
+
+	// the history of a closed account stays readable but it takes no more money
+	respRec = routeTestRequest(apiServer, "GET", accountPath+"/transactions", jwtToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var transactionsResp TransactionsResponse
+	err = json.Unmarshal(respRec.Body.Bytes(), &transactionsResp)
+	assert.NoError(t, err)
+	assert.Len(t, transactionsResp.Transactions, 4)
+
+	receiverToken := loginTestAccount(apiServer, t, receiverAccountReq.Username, receiverAccountReq.Password)
+	transferReq = TransferRequest{FromAccountIban: receiverAccount.IBAN, ToAccountIban: senderAccount.IBAN, Amount: NewMoney(100, DefaultCurrency)}
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", receiverToken, transferReq)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+	err = json.Unmarshal(respRec.Body.Bytes(), &errResp)
+	assert.NoError(t, err)
+	assert.Equal(t, "account_closed", errResp.Code)
+	respRec = routeTestRequest(apiServer, "POST", statusPath, adminToken, AccountStatusRequest{Status: AccountStatusActive})
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+
+	// accounts opened under review wait for staff to activate them
+	t.Setenv("ACCOUNT_OPENING", "review")
+	pendingAccount := openTestAccount(apiServer, t, receiverToken, AccountTypeSavings)
+	assert.Equal(t, AccountStatusPending, pendingAccount.Status)
+	respRec = routeTestRequest(apiServer, "POST", fmt.Sprintf("/accounts/%d/deposits", pendingAccount.ID), adminToken, CashRequest{Amount: NewMoney(100, DefaultCurrency)})
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", fmt.Sprintf("/admin/accounts/%d/status", pendingAccount.ID), supportToken, AccountStatusRequest{Status: AccountStatusActive})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	depositTestFunds(apiServer, t, pendingAccount, NewMoney(100, DefaultCurrency))
+}
+
+func TestHandleGetAccountsAsStaff(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	accounts := []*AccountResponse{}
+	for i := 0; i < 3; i++ {
+		accounts = append(accounts, createTestAccount(apiServer, t, createTestAccountReq("testFName", "testLName", "testPassword")))
+	}
+	adminToken := createTestAdmin(apiServer, t)
+	assert.NoError(t, store.SetAccountStatus(accounts[0].IBAN, AccountStatusFrozen, "test"))
+
+	getPage := func(query string) *AccountsResponse {
+		respRec := routeTestRequest(apiServer, "GET", "/admin/accounts"+query, adminToken, nil)
+		assert.Equal(t, http.StatusOK, respRec.Code)
+		var resp AccountsResponse
+		err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+		assert.NoError(t, err)
+		return &resp
+	}
+
+	page := getPage("?limit=2")
+	assert.Len(t, page.Accounts, 2)
+	assert.Equal(t, accounts[2].ID, page.Accounts[0].ID)
+	assert.NotEmpty(t, page.NextCursor)
+	page = getPage("?limit=2&cursor=" + page.NextCursor)
+	assert.Len(t, page.Accounts, 1)
+	assert.Empty(t, page.NextCursor)
+
+	page = getPage("?status=frozen")
+	assert.Len(t, page.Accounts, 1)
+	assert.Equal(t, accounts[0].IBAN, page.Accounts[0].IBAN)
+
+	respRec := routeTestRequest(apiServer, "GET", "/admin/accounts?status=deleted", adminToken, nil)
+	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+}
+
+func TestHandleCreateStaffUser(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	adminToken := createTestAdmin(apiServer, t)
+	supportToken := createTestStaff(apiServer, t, "support", RoleSupport)
+
+	createReq := CreateStaffUserRequest{Username: "jane.doe", Password: "correct horse battery", Role: RoleAuditor}
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "POST", "/admin/staff", supportToken, createReq).Code)
+	respRec := routeTestRequest(apiServer, "POST", "/admin/staff", adminToken, createReq)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	assert.NotContains(t, respRec.Body.String(), "password")
+	assert.Equal(t, http.StatusConflict, routeTestRequest(apiServer, "POST", "/admin/staff", adminToken, createReq).Code)
+
+	createReq.Username, createReq.Role = "john.doe", RoleCustomer
+	assert.Equal(t, http.StatusBadRequest, routeTestRequest(apiServer, "POST", "/admin/staff", adminToken, createReq).Code)
+
+	respRec = routeTestRequest(apiServer, "GET", "/admin/staff", adminToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var users []*StaffUserResponse
+	err := json.Unmarshal(respRec.Body.Bytes(), &users)
+	assert.NoError(t, err)
+	assert.Len(t, users, 3)
+	assert.Equal(t, "jane.doe", users[1].Username)
+	assert.Equal(t, RoleAuditor, users[1].Role)
+
+	events, err := store.GetAuditEvents("staff:jane.doe", 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "staff:admin", events[0].Actor)
+	assert.Equal(t, http.StatusOK, staffLoginTestRequest(apiServer, "jane.doe", "correct horse battery").Code)
+}
+
+func TestHandleDeleteAccount(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	// create test account
+	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
+	testAccount := createTestAccount(apiServer, t, testAccountReq)
+	jwtToken := loginTestAccount(apiServer, t, testAccountReq.Username, testAccountReq.Password)
+
+	req, _ := http.NewRequest("DELETE", "/accounts", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(testAccount.ID)})
+	req.Header.Set("Authorization", jwtToken)
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleDeleteAccount)))
+	handler.ServeHTTP(respRec, req)
+
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var resp AccountClosedResponse
+	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, testAccount.ID, resp.ID)
+	assert.Equal(t, AccountStatusClosed, resp.Status)
+	assert.NotNil(t, resp.ClosedAt)
+	assert.Nil(t, resp.Payout)
+
+	// the account is closed but kept
+	account, err := store.GetAccountById(testAccount.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, AccountStatusClosed, account.Status)
+}
+
+func TestHandleDeleteAccountPayout(t *testing.T) {
+	t.Setenv("TRANSFER_2FA_THRESHOLD", "100.00")
+
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	ownerReq := createTestAccountReq("ownerFName", "ownerLName", "ownerPassword")
+	account := createTestAccount(apiServer, t, ownerReq)
+	ownerToken := loginTestAccount(apiServer, t, ownerReq.Username, ownerReq.Password)
+	depositTestFunds(apiServer, t, account, NewMoney(20000, DefaultCurrency))
+	partnerReq := createTestAccountReq("partnerFName", "partnerLName", "partnerPassword")
+	partnerAccount := createTestAccount(apiServer, t, partnerReq)
+	partnerToken := loginTestAccount(apiServer, t, partnerReq.Username, partnerReq.Password)
+	adminToken := createTestAdmin(apiServer, t)
+
+	accountPath := fmt.Sprintf("/accounts/%d", account.ID)
+	closeReq := CloseAccountRequest{PayoutIban: partnerAccount.IBAN}
+	closeAccount := func(code string) {
+		respRec := routeTestRequest(apiServer, "DELETE", accountPath, ownerToken, closeReq)
+		var resp APIError
+		assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &resp))
+		assert.Equal(t, code, resp.Code)
+	}
+
+	// frozen accounts cannot be emptied by closing them
+	freezePath := fmt.Sprintf("/admin/accounts/%d/freeze", account.ID)
+	assert.Equal(t, http.StatusOK, routeTestRequest(apiServer, "POST", freezePath, adminToken, nil).Code)
+	closeAccount("account_frozen")
+	unfreezePath := fmt.Sprintf("/admin/accounts/%d/unfreeze", account.ID)
+	assert.Equal(t, http.StatusOK, routeTestRequest(apiServer, "POST", unfreezePath, adminToken, nil).Code)
+
+	// the payout needs the second factor like a transfer of the balance
+	closeAccount("second_factor_required")
+
+	// and cannot get around the approval limit of a joint account
+	t.Setenv("TRANSFER_2FA_THRESHOLD", "")
+	limitPath := fmt.Sprintf("/accounts/%d/approval-limit", account.ID)
+	respRec := routeTestRequest(apiServer, "PUT", limitPath, ownerToken, ApprovalLimitRequest{Limit: &Money{Amount: 5000, Currency: DefaultCurrency}})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	holdersPath := fmt.Sprintf("/accounts/%d/holders", account.ID)
+	respRec = routeTestRequest(apiServer, "POST", holdersPath, ownerToken, AddAccountHolderRequest{Login: partnerReq.Username, Permission: HolderPermissionTransfer})
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", fmt.Sprintf("%s/%d/accept", holdersPath, partnerAccount.CustomerID), partnerToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	closeAccount("payout_needs_approval")
+
+	updatedAccount, _ := store.GetAccountByIban(account.IBAN)
+	assert.Equal(t, AccountStatusActive, updatedAccount.Status)
+	assert.Equal(t, NewMoney(20000, DefaultCurrency), updatedAccount.Balance)
+
+	// staff pay out accounts that may not send, e.g. dormant ones
+	statusPath := fmt.Sprintf("/admin/accounts/%d/status", account.ID)
+	respRec = routeTestRequest(apiServer, "POST", statusPath, adminToken, AccountStatusRequest{Status: AccountStatusDormant})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", statusPath, adminToken, AccountStatusRequest{Status: AccountStatusClosed, PayoutIban: partnerAccount.IBAN})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var resp AccountClosedResponse
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &resp))
+	assert.Equal(t, AccountStatusClosed, resp.Status)
+	assert.Equal(t, NewMoney(20000, DefaultCurrency), resp.Payout.Amount)
+
+	updatedPartner, _ := store.GetAccountByIban(partnerAccount.IBAN)
+	assert.Equal(t, NewMoney(20000, DefaultCurrency), updatedPartner.Balance)
+}
+
+func TestHandleTransfer(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	// create test accounts
+	senderAccountReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
+	senderAccount := createTestAccount(apiServer, t, senderAccountReq)
+
+	receiverAccountReq := createTestAccountReq("receiverFName", "receiverLName", "receiverPassword")
+	receiverAccount := createTestAccount(apiServer, t, receiverAccountReq)
+
+	// login with the sender account to get the token
+	loginReq := LoginRequest{
+		Username: senderAccountReq.Username,
+		Password: senderAccountReq.Password,
+	}
+	reqBody, _ := json.Marshal(loginReq)
+
+	req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(reqBody))
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleLogin))
+	handler.ServeHTTP(respRec, req)
+
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var loginResp LoginResponse
+	err := json.Unmarshal(respRec.Body.Bytes(), &loginResp)
+	assert.NoError(t, err)
+	jwtToken := fmt.Sprintf("Bearer %s", loginResp.Token)
+	depositTestFunds(apiServer, t, senderAccount, NewMoney(12345, DefaultCurrency))
+
+	receiverOldBalance := receiverAccount.Balance
+	transferAmount := senderAccount.Balance
+	transferRequest := TransferRequest{
+		FromAccountIban: senderAccount.IBAN,
+		ToAccountIban:   receiverAccount.IBAN,
+		Amount:          transferAmount,
+	}
+	reqBody, _ = json.Marshal(transferRequest)
+
+	req, _ = http.NewRequest("POST", "/transfer", bytes.NewBuffer(reqBody))
+	req.Header.Set("Authorization", jwtToken)
+	respRec = httptest.NewRecorder()
+
+	handler = http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleTransfer)))
+	handler.ServeHTTP(respRec, req)
+
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var resp TransferResponse
+	err = json.Unmarshal(respRec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "success", resp.Status)
+	assert.Equal(t, receiverAccount.IBAN, resp.Transaction.CounterpartyIban)
+	assert.Equal(t, Debit, resp.Transaction.Direction)
+	assert.Equal(t, transferAmount, resp.Transaction.Amount)
+	assert.Equal(t, NewMoney(0, DefaultCurrency), resp.Transaction.BalanceAfter)
+
+	// check updated balances
+	updatedSender, _ := store.GetAccountByIban(senderAccount.IBAN)
+	updatedReceiver, _ := store.GetAccountByIban(receiverAccount.IBAN)
+	assert.Equal(t, NewMoney(0, DefaultCurrency), updatedSender.Balance)
+	assert.Equal(t, receiverOldBalance.Add(transferAmount), updatedReceiver.Balance)
+
+	// check the ledger reproduces the balances
+	senderLedgerBalance, err := store.GetLedgerBalance(senderAccount.IBAN, time.Now().UTC())
+	assert.NoError(t, err)
+	assert.Equal(t, updatedSender.Balance, senderLedgerBalance)
+	receiverLedgerBalance, err := store.GetLedgerBalance(receiverAccount.IBAN, time.Now().UTC())
+	assert.NoError(t, err)
+	assert.Equal(t, updatedReceiver.Balance, receiverLedgerBalance)
+}
+
+func TestHandleTransferBetweenCurrencies(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	senderAccountReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
+	senderAccount := createTestAccount(apiServer, t, senderAccountReq)
+	jwtToken := loginTestAccount(apiServer, t, senderAccountReq.Username, senderAccountReq.Password)
+	depositTestFunds(apiServer, t, senderAccount, NewMoney(100000, DefaultCurrency))
+
+	receiverAccountReq := createTestAccountReq("receiverFName", "receiverLName", "receiverPassword")
+	createTestAccount(apiServer, t, receiverAccountReq)
+	receiverToken := loginTestAccount(apiServer, t, receiverAccountReq.Username, receiverAccountReq.Password)
+	respRec := routeTestRequest(apiServer, "POST", "/accounts", receiverToken, CreateAccountRequest{Currency: "USD"})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var receiverAccount AccountResponse
+	err := json.Unmarshal(respRec.Body.Bytes(), &receiverAccount)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(0, "USD"), receiverAccount.Balance)
+	respRec = routeTestRequest(apiServer, "POST", "/accounts", receiverToken, CreateAccountRequest{Currency: "XYZ"})
+	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+
+	// without a rate the transfer cannot be converted
+	transferReq := TransferRequest{FromAccountIban: senderAccount.IBAN, ToAccountIban: receiverAccount.IBAN, Amount: NewMoney(10000, DefaultCurrency)}
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", jwtToken, transferReq)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+	var errResp APIError
+	err = json.Unmarshal(respRec.Body.Bytes(), &errResp)
+	assert.NoError(t, err)
+	assert.Equal(t, "exchange_rate_unavailable", errResp.Code)
+
+	// only admins set rates
+	ratesReq := ExchangeRatesRequest{Rates: []*ExchangeRate{{From: "EUR", To: "USD", Rate: 110_000_000, Spread: 1_000_000}}}
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "PUT", "/admin/fx/rates", jwtToken, ratesReq).Code)
+	adminToken := createTestAdmin(apiServer, t)
+	respRec = routeTestRequest(apiServer, "PUT", "/admin/fx/rates", adminToken, ratesReq)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	respRec = routeTestRequest(apiServer, "GET", "/fx/rates", jwtToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var rates []*ExchangeRate
+	err = json.Unmarshal(respRec.Body.Bytes(), &rates)
+	assert.NoError(t, err)
+	assert.Len(t, rates, 1)
+	assert.Equal(t, "1.1", rates[0].Rate.String())
+
+	// the receiver gets the converted amount at the rate less the spread
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", jwtToken, transferReq)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var transferResp TransferResponse
+	err = json.Unmarshal(respRec.Body.Bytes(), &transferResp)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(10000, DefaultCurrency), transferResp.Transaction.Amount)
+	assert.Equal(t, "1.089", transferResp.Transaction.ExchangeRate.String())
+	assert.Equal(t, "0.01", transferResp.Transaction.Spread.String())
+	assert.Equal(t, NewMoney(10890, "USD"), *transferResp.Transaction.CounterAmount)
+
+	respRec = routeTestRequest(apiServer, "GET", fmt.Sprintf("/accounts/%d/transactions", receiverAccount.ID), receiverToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var transactionsResp TransactionsResponse
+	err = json.Unmarshal(respRec.Body.Bytes(), &transactionsResp)
+	assert.NoError(t, err)
+	receiverTransactions := transactionsResp.Transactions
+	assert.Len(t, receiverTransactions, 1)
+	assert.Equal(t, NewMoney(10890, "USD"), receiverTransactions[0].Amount)
+	assert.Equal(t, NewMoney(10890, "USD"), receiverTransactions[0].BalanceAfter)
+	assert.Equal(t, NewMoney(10000, DefaultCurrency), *receiverTransactions[0].CounterAmount)
+	assert.Equal(t, "1.089", receiverTransactions[0].ExchangeRate.String())
+
+	// a quote locks the rate even if it changes before the transfer
+	respRec = routeTestRequest(apiServer, "POST", "/fx/quotes", jwtToken, FXQuoteRequest{From: "EUR", To: "USD", Amount: &transferReq.Amount})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var quote FXQuote
+	err = json.Unmarshal(respRec.Body.Bytes(), &quote)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(10890, "USD"), *quote.ConvertedAmount)
+	ratesReq.Rates[0].Rate = 120_000_000
+	assert.Equal(t, http.StatusOK, routeTestRequest(apiServer, "PUT", "/admin/fx/rates", adminToken, ratesReq).Code)
+
+	// quotes of other customers look like missing ones
+	receiverTransferReq := TransferRequest{FromAccountIban: receiverAccount.IBAN, ToAccountIban: senderAccount.IBAN, Amount: NewMoney(100, "USD"), QuoteID: quote.ID}
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", receiverToken, receiverTransferReq)
+	assert.Equal(t, http.StatusNotFound, respRec.Code)
+
+	transferReq.QuoteID = quote.ID
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", jwtToken, transferReq)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	err = json.Unmarshal(respRec.Body.Bytes(), &transferResp)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(10890, "USD"), *transferResp.Transaction.CounterAmount)
+
+	// quotes are used once and expire
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", jwtToken, transferReq)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+	err = json.Unmarshal(respRec.Body.Bytes(), &errResp)
+	assert.NoError(t, err)
+	assert.Equal(t, "fx_quote_used", errResp.Code)
+	t.Setenv("FX_QUOTE_TTL", "1ns")
+	respRec = routeTestRequest(apiServer, "POST", "/fx/quotes", jwtToken, FXQuoteRequest{From: "EUR", To: "USD"})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	err = json.Unmarshal(respRec.Body.Bytes(), &quote)
+	assert.NoError(t, err)
+	transferReq.QuoteID = quote.ID
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", jwtToken, transferReq)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+	err = json.Unmarshal(respRec.Body.Bytes(), &errResp)
+	assert.NoError(t, err)
+	assert.Equal(t, "fx_quote_expired", errResp.Code)
+
+	// the inverse rate converts the other way round; 1/1.2 less the spread
+	// is 0.82499999 after rounding down to eight places
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", receiverToken, TransferRequest{FromAccountIban: receiverAccount.IBAN, ToAccountIban: senderAccount.IBAN, Amount: NewMoney(12000, "USD")})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	err = json.Unmarshal(respRec.Body.Bytes(), &transferResp)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(9899, DefaultCurrency), *transferResp.Transaction.CounterAmount)
+
+	receiver, err := store.GetAccountById(receiverAccount.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(9780, "USD"), receiver.Balance)
+	ledgerBalance, err := store.GetLedgerBalance(receiverAccount.IBAN, time.Now().UTC())
+	assert.NoError(t, err)
+	assert.Equal(t, receiver.Balance, ledgerBalance)
+}
+
+func TestHandleTransferIdempotencyKey(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	senderAccountReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
+	senderAccount := createTestAccount(apiServer, t, senderAccountReq)
+
+	receiverAccountReq := createTestAccountReq("receiverFName", "receiverLName", "receiverPassword")
+	receiverAccount := createTestAccount(apiServer, t, receiverAccountReq)
+
+	jwtToken := loginTestAccount(apiServer, t, senderAccountReq.Username, senderAccountReq.Password)
+	depositTestFunds(apiServer, t, senderAccount, NewMoney(1000, DefaultCurrency))
+
+	transfer := func(amount Money) *httptest.ResponseRecorder {
+		reqBody, _ := json.Marshal(TransferRequest{FromAccountIban: senderAccount.IBAN, ToAccountIban: receiverAccount.IBAN, Amount: amount})
+		req, _ := http.NewRequest("POST", "/transfer", bytes.NewBuffer(reqBody))
+		req.Header.Set("Authorization", jwtToken)
+		req.Header.Set("Idempotency-Key", "transfer-1")
+		respRec := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleTransfer)))
+		handler.ServeHTTP(respRec, req)
+		return respRec
+	}
+
+	amount := NewMoney(100, DefaultCurrency)
+	first := transfer(amount)
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Empty(t, first.Header().Get("Idempotent-Replayed"))
+
+	// a retry replays the original response without moving money again
+	retry := transfer(amount)
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+
+	updatedSender, _ := store.GetAccountByIban(senderAccount.IBAN)
+	assert.Equal(t, senderAccount.Balance.Sub(amount), updatedSender.Balance)
+
+	// reusing the key for a different request is rejected
+	conflict := transfer(NewMoney(200, DefaultCurrency))
+	assert.Equal(t, http.StatusConflict, conflict.Code)
+	var resp APIError
+	err := json.Unmarshal(conflict.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "Idempotency-Key has already been used with a different request", resp.Detail)
+
+	updatedSender, _ = store.GetAccountByIban(senderAccount.IBAN)
+	assert.Equal(t, senderAccount.Balance.Sub(amount), updatedSender.Balance)
+}
+
+func TestHandleCreateAccountIdempotencyKey(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
+	testAccount := createTestAccount(apiServer, t, testAccountReq)
+	jwtToken := loginTestAccount(apiServer, t, testAccountReq.Username, testAccountReq.Password)
+
+	createAccount := func() *httptest.ResponseRecorder {
+		reqBody, _ := json.Marshal(CreateAccountRequest{Type: AccountTypeSavings})
+		req, _ := http.NewRequest("POST", "/accounts", bytes.NewBuffer(reqBody))
+		req.Header.Set("Authorization", jwtToken)
+		req.Header.Set("Idempotency-Key", "create-1")
+		respRec := httptest.NewRecorder()
+
+		apiServer.router().ServeHTTP(respRec, req)
+		return respRec
+	}
+
+	first := createAccount()
+	retry := createAccount()
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+
+	var account AccountResponse
+	err := json.Unmarshal(first.Body.Bytes(), &account)
+	assert.NoError(t, err)
+
+	// only one account was created
+	accounts, err := store.GetAccountsByCustomer(testAccount.CustomerID)
+	assert.NoError(t, err)
+	assert.Len(t, accounts, 2)
+}
+
+func TestHandleTransferTooManyDecimals(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	senderAccountReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
+	senderAccount := createTestAccount(apiServer, t, senderAccountReq)
+
+	receiverAccountReq := createTestAccountReq("receiverFName", "receiverLName", "receiverPassword")
+	receiverAccount := createTestAccount(apiServer, t, receiverAccountReq)
+
+	jwtToken := loginTestAccount(apiServer, t, senderAccountReq.Username, senderAccountReq.Password)
+
+	reqBody := fmt.Sprintf(`{"fromAccountIban": %q, "toAccountIban": %q, "amount": {"amount": "0.001", "currency": "EUR"}}`, senderAccount.IBAN, receiverAccount.IBAN)
+	req, _ := http.NewRequest("POST", "/transfer", bytes.NewBufferString(reqBody))
+	req.Header.Set("Authorization", jwtToken)
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleTransfer)))
+	handler.ServeHTTP(respRec, req)
+
+	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	var resp APIError
+	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, `Amount "0.001" has more than 2 decimal places allowed for EUR`, resp.Detail)
+
+	// check unchanged balance
+	unchangedAccount, _ := store.GetAccountByIban(senderAccount.IBAN)
+	assert.Equal(t, senderAccount.Balance, unchangedAccount.Balance)
+}
+
+func TestHandleTransferInvalidIban(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	senderAccountReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
+	senderAccount := createTestAccount(apiServer, t, senderAccountReq)
+
+	jwtToken := loginTestAccount(apiServer, t, senderAccountReq.Username, senderAccountReq.Password)
+
+	reqBody := fmt.Sprintf(`{"fromAccountIban": %q, "toAccountIban": "123456", "amount": {"amount": "1.00", "currency": "EUR"}}`, senderAccount.IBAN)
+	req, _ := http.NewRequest("POST", "/transfer", bytes.NewBufferString(reqBody))
+	req.Header.Set("Authorization", jwtToken)
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleTransfer)))
+	handler.ServeHTTP(respRec, req)
+
+	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	var resp APIError
+	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "invalid_iban", resp.Code)
+	assert.Equal(t, "toAccountIban", resp.Details["field"])
+}
+
+func TestHandleTransferFromOtherCustomersAccount(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	ownerAccountReq := createTestAccountReq("ownerFName", "ownerLName", "ownerPassword")
+	ownerAccount := createTestAccount(apiServer, t, ownerAccountReq)
+	ownerToken := loginTestAccount(apiServer, t, ownerAccountReq.Username, ownerAccountReq.Password)
+	depositTestFunds(apiServer, t, ownerAccount, NewMoney(1000, DefaultCurrency))
+	savingsAccount := openTestAccount(apiServer, t, ownerToken, AccountTypeSavings)
+
+	otherAccountReq := createTestAccountReq("otherFName", "otherLName", "otherPassword")
+	otherAccount := createTestAccount(apiServer, t, otherAccountReq)
+	otherToken := loginTestAccount(apiServer, t, otherAccountReq.Username, otherAccountReq.Password)
+
+	// only the owner may send from the account, e.g. to their own savings
+	transferReq := TransferRequest{FromAccountIban: ownerAccount.IBAN, ToAccountIban: otherAccount.IBAN, Amount: NewMoney(100, DefaultCurrency)}
+	respRec := routeTestRequest(apiServer, "POST", "/transfer", otherToken, transferReq)
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+
+	transferReq.ToAccountIban = savingsAccount.IBAN
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", ownerToken, transferReq)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+
+	updatedOwner, _ := store.GetAccountByIban(ownerAccount.IBAN)
+	assert.Equal(t, NewMoney(900, DefaultCurrency), updatedOwner.Balance)
+	updatedSavings, _ := store.GetAccountByIban(savingsAccount.IBAN)
+	assert.Equal(t, NewMoney(100, DefaultCurrency), updatedSavings.Balance)
+}
+
+func TestHandleJointAccountHolders(t *testing.T) {
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	ownerReq := createTestAccountReq("ownerFName", "ownerLName", "ownerPassword")
+	account := createTestAccount(apiServer, t, ownerReq)
+	ownerToken := loginTestAccount(apiServer, t, ownerReq.Username, ownerReq.Password)
+	depositTestFunds(apiServer, t, account, NewMoney(1000, DefaultCurrency))
+	partnerReq := createTestAccountReq("partnerFName", "partnerLName", "partnerPassword")
+	partnerAccount := createTestAccount(apiServer, t, partnerReq)
+	partnerToken := loginTestAccount(apiServer, t, partnerReq.Username, partnerReq.Password)
+	partnerID := partnerAccount.CustomerID
+	holdersPath := fmt.Sprintf("/accounts/%d/holders", account.ID)
+	partnerPath := fmt.Sprintf("%s/%d", holdersPath, partnerID)
+
+	// only holders who manage the account may invite
+	inviteReq := AddAccountHolderRequest{Login: partnerReq.Email, Permission: HolderPermissionView}
+	respRec := routeTestRequest(apiServer, "POST", holdersPath, partnerToken, inviteReq)
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", holdersPath, ownerToken, AddAccountHolderRequest{Login: partnerReq.Username, Permission: "owner"})
+	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", holdersPath, ownerToken, inviteReq)
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", holdersPath, ownerToken, inviteReq)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+
+	// the invitation gives no access until it is accepted
+	assert.Equal(t, http.StatusForbidden, getTestAccount(apiServer, account.ID, partnerToken).Code)
+	respRec = routeTestRequest(apiServer, "GET", "/customers/me", partnerToken, nil)
+	var partner CustomerResponse
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &partner))
+	assert.Len(t, partner.Accounts, 1)
+	assert.Len(t, partner.Invitations, 1)
+	assert.Equal(t, account.ID, partner.Invitations[0].AccountID)
+
+	respRec = routeTestRequest(apiServer, "POST", partnerPath+"/accept", ownerToken, nil)
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", partnerPath+"/accept", partnerToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	assert.Equal(t, http.StatusOK, getTestAccount(apiServer, account.ID, partnerToken).Code)
+
+	// viewing does not allow sending money
+	transferReq := TransferRequest{FromAccountIban: account.IBAN, ToAccountIban: partnerAccount.IBAN, Amount: NewMoney(100, DefaultCurrency)}
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", partnerToken, transferReq)
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+	var apiErr APIError
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &apiErr))
+	assert.Equal(t, "holder_permission_required", apiErr.Code)
+
+	respRec = routeTestRequest(apiServer, "GET", holdersPath, partnerToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var holders []*AccountHolder
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &holders))
+	assert.Len(t, holders, 2)
+	assert.Equal(t, HolderPermissionManage, holders[0].Permission)
+	assert.Equal(t, partnerReq.Username, holders[1].Username)
+	assert.Equal(t, HolderStatusActive, holders[1].Status)
+
+	// the last holder who manages the account cannot leave it
+	ownerPath := fmt.Sprintf("%s/%d", holdersPath, account.CustomerID)
+	respRec = routeTestRequest(apiServer, "DELETE", ownerPath, ownerToken, nil)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+	respRec = routeTestRequest(apiServer, "DELETE", ownerPath, partnerToken, nil)
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+
+	// but may remove other holders, and holders may leave
+	respRec = routeTestRequest(apiServer, "DELETE", partnerPath, ownerToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	assert.Equal(t, http.StatusForbidden, getTestAccount(apiServer, account.ID, partnerToken).Code)
+	respRec = routeTestRequest(apiServer, "DELETE", partnerPath, partnerToken, nil)
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+}
+
+func TestHandleTransferApproval(t *testing.T) {
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	ownerReq := createTestAccountReq("ownerFName", "ownerLName", "ownerPassword")
+	account := createTestAccount(apiServer, t, ownerReq)
+	ownerToken := loginTestAccount(apiServer, t, ownerReq.Username, ownerReq.Password)
+	depositTestFunds(apiServer, t, account, NewMoney(10000, DefaultCurrency))
+	partnerReq := createTestAccountReq("partnerFName", "partnerLName", "partnerPassword")
+	partnerAccount := createTestAccount(apiServer, t, partnerReq)
+	partnerToken := loginTestAccount(apiServer, t, partnerReq.Username, partnerReq.Password)
+
+	limitPath := fmt.Sprintf("/accounts/%d/approval-limit", account.ID)
+	respRec := routeTestRequest(apiServer, "PUT", limitPath, ownerToken, map[string]any{"limit": NewMoney(0, DefaultCurrency)})
+	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	respRec = routeTestRequest(apiServer, "PUT", limitPath, ownerToken, ApprovalLimitRequest{Limit: &Money{Amount: 5000, Currency: DefaultCurrency}})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+
+	// a sole holder is not held back by the limit
+	transferReq := TransferRequest{FromAccountIban: account.IBAN, ToAccountIban: partnerAccount.IBAN, Amount: NewMoney(6000, DefaultCurrency)}
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", ownerToken, transferReq)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+
+	holdersPath := fmt.Sprintf("/accounts/%d/holders", account.ID)
+	respRec = routeTestRequest(apiServer, "POST", holdersPath, ownerToken, AddAccountHolderRequest{Login: partnerReq.Username, Permission: HolderPermissionTransfer})
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", fmt.Sprintf("%s/%d/accept", holdersPath, partnerAccount.CustomerID), partnerToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+
+	// amounts up to the limit move right away, larger ones wait
+	transferReq.Amount = NewMoney(1000, DefaultCurrency)
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", partnerToken, transferReq)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+
+	transferReq.Amount = NewMoney(5001, DefaultCurrency)
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", ownerToken, transferReq)
+	assert.Equal(t, http.StatusAccepted, respRec.Code)
+	var transferResp TransferResponse
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &transferResp))
+	assert.Equal(t, "pending_approval", transferResp.Status)
+	assert.Nil(t, transferResp.Transaction)
+	approval := transferResp.Approval
+	assert.Equal(t, ApprovalStatusPending, approval.Status)
+
+	updatedAccount, _ := store.GetAccountByIban(account.IBAN)
+	assert.Equal(t, NewMoney(3000, DefaultCurrency), updatedAccount.Balance)
+
+	approvalsPath := fmt.Sprintf("/accounts/%d/approvals", account.ID)
+	respRec = routeTestRequest(apiServer, "GET", approvalsPath+"?status=pending", partnerToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var approvals []*TransferApproval
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &approvals))
+	assert.Len(t, approvals, 1)
+
+	// the requester cannot approve their own transfer, and the approval
+	// fails while the money is not there
+	approvePath := fmt.Sprintf("%s/%d/approve", approvalsPath, approval.ID)
+	respRec = routeTestRequest(apiServer, "POST", approvePath, ownerToken, nil)
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", approvePath, partnerToken, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, respRec.Code)
+
+	depositTestFunds(apiServer, t, account, NewMoney(5000, DefaultCurrency))
+	respRec = routeTestRequest(apiServer, "POST", approvePath, partnerToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &transferResp))
+	assert.Equal(t, "success", transferResp.Status)
+	assert.Equal(t, ApprovalStatusApproved, transferResp.Approval.Status)
+	assert.Equal(t, transferResp.Transaction.ID, transferResp.Approval.TransactionID)
+
+	updatedAccount, _ = store.GetAccountByIban(account.IBAN)
+	assert.Equal(t, NewMoney(2999, DefaultCurrency), updatedAccount.Balance)
+	respRec = routeTestRequest(apiServer, "POST", approvePath, partnerToken, nil)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+
+	// the requester may withdraw a pending transfer
+	transferReq.Amount = NewMoney(5500, DefaultCurrency)
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", partnerToken, transferReq)
+	assert.Equal(t, http.StatusAccepted, respRec.Code)
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &transferResp))
+	respRec = routeTestRequest(apiServer, "POST", fmt.Sprintf("%s/%d/reject", approvalsPath, transferResp.Approval.ID), partnerToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &transferResp))
+	assert.Equal(t, ApprovalStatusRejected, transferResp.Approval.Status)
+	updatedAccount, _ = store.GetAccountByIban(account.IBAN)
+	assert.Equal(t, NewMoney(2999, DefaultCurrency), updatedAccount.Balance)
+}
+
+func TestHandleScheduledTransfer(t *testing.T) {
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+	scheduler := NewTransferScheduler(store, defaultSchedulerPolicy)
+
+	senderReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
+	account := createTestAccount(apiServer, t, senderReq)
+	senderToken := loginTestAccount(apiServer, t, senderReq.Username, senderReq.Password)
+	depositTestFunds(apiServer, t, account, NewMoney(10000, DefaultCurrency))
+	receiverReq := createTestAccountReq("receiverFName", "receiverLName", "receiverPassword")
+	receiverAccount := createTestAccount(apiServer, t, receiverReq)
+	receiverToken := loginTestAccount(apiServer, t, receiverReq.Username, receiverReq.Password)
+
+	now := time.Now().UTC()
+	tomorrow := now.AddDate(0, 0, 1).Format(executionDateLayout)
+	transferReq := TransferRequest{FromAccountIban: account.IBAN, ToAccountIban: receiverAccount.IBAN, Amount: NewMoney(4000, DefaultCurrency), ExecutionDate: now.AddDate(0, 0, -1).Format(executionDateLayout)}
+	respRec := routeTestRequest(apiServer, "POST", "/transfer", senderToken, transferReq)
+	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	transferReq.ExecutionDate = tomorrow
+	transferReq.QuoteID = "quote"
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", senderToken, transferReq)
+	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	transferReq.QuoteID = ""
+
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", senderToken, transferReq)
+	assert.Equal(t, http.StatusAccepted, respRec.Code)
+	var transferResp TransferResponse
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &transferResp))
+	assert.Equal(t, "scheduled", transferResp.Status)
+	assert.Nil(t, transferResp.Transaction)
+	scheduled := transferResp.ScheduledTransfer
+	assert.Equal(t, ScheduledStatusPending, scheduled.Status)
+	assert.Equal(t, tomorrow, scheduled.ExecutionDate)
+
+	// more than the balance can be scheduled, the money has to be there on
+	// the execution date
+	transferReq.Amount = NewMoney(7000, DefaultCurrency)
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", senderToken, transferReq)
+	assert.Equal(t, http.StatusAccepted, respRec.Code)
+	transferReq.Amount = NewMoney(100, DefaultCurrency)
+	respRec = routeTestRequest(apiServer, "POST", "/transfer", senderToken, transferReq)
+	assert.Equal(t, http.StatusAccepted, respRec.Code)
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &transferResp))
+	cancelled := transferResp.ScheduledTransfer
+
+	scheduledPath := fmt.Sprintf("/accounts/%d/scheduled-transfers", account.ID)
+	respRec = routeTestRequest(apiServer, "GET", scheduledPath+"?status=pending", senderToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var transfers []*ScheduledTransfer
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &transfers))
+	assert.Len(t, transfers, 3)
+	assert.Equal(t, http.StatusBadRequest, routeTestRequest(apiServer, "GET", scheduledPath+"?status=done", senderToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "GET", scheduledPath, receiverToken, nil).Code)
+
+	// only pending transfers can be cancelled
+	cancelPath := fmt.Sprintf("%s/%d/cancel", scheduledPath, cancelled.ID)
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "POST", cancelPath, receiverToken, nil).Code)
+	respRec = routeTestRequest(apiServer, "POST", cancelPath, senderToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &cancelled))
+	assert.Equal(t, ScheduledStatusCancelled, cancelled.Status)
+	assert.Equal(t, account.CustomerID, cancelled.CancelledBy)
+	respRec = routeTestRequest(apiServer, "POST", cancelPath, senderToken, nil)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+	assert.Equal(t, http.StatusNotFound, routeTestRequest(apiServer, "POST", scheduledPath+"/999/cancel", senderToken, nil).Code)
+
+	// nothing is due before the execution date
+	executed, err := scheduler.RunDue(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, executed)
+
+	// the first transfer goes through, the second lacks the money and is
+	// tried again after the retry delay
+	executionTime, _ := time.Parse(executionDateLayout, tomorrow)
+	executed, err = scheduler.RunDue(executionTime)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, executed)
+	updatedAccount, _ := store.GetAccountByIban(receiverAccount.IBAN)
+	assert.Equal(t, NewMoney(4000, DefaultCurrency), updatedAccount.Balance)
+
+	transfers, err = store.GetScheduledTransfers(account.IBAN, "")
+	assert.NoError(t, err)
+	assert.Len(t, transfers, 3)
+	retried, done := transfers[1], transfers[2]
+	assert.Equal(t, ScheduledStatusExecuted, done.Status)
+	assert.NotZero(t, done.TransactionID)
+	assert.NotNil(t, done.ExecutedAt)
+	assert.Equal(t, ScheduledStatusPending, retried.Status)
+	assert.Equal(t, 1, retried.Attempts)
+	assert.NotEmpty(t, retried.LastError)
+	assert.Equal(t, executionTime.Add(defaultSchedulerPolicy.RetryDelay), retried.NextAttemptAt.UTC())
+
+	executed, err = scheduler.RunDue(executionTime.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, executed)
+
+	depositTestFunds(apiServer, t, account, NewMoney(1000, DefaultCurrency))
+	executed, err = scheduler.RunDue(executionTime.Add(defaultSchedulerPolicy.RetryDelay))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, executed)
+	updatedAccount, _ = store.GetAccountByIban(receiverAccount.IBAN)
+	assert.Equal(t, NewMoney(11000, DefaultCurrency), updatedAccount.Balance)
+	transfers, err = store.GetScheduledTransfers(account.IBAN, ScheduledStatusExecuted)
+	assert.NoError(t, err)
+	assert.Len(t, transfers, 2)
+	assert.Equal(t, 2, transfers[0].Attempts)
+}
+
+func TestScheduledTransferApprovalLimit(t *testing.T) {
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+	scheduler := NewTransferScheduler(store, defaultSchedulerPolicy)
+
+	ownerReq := createTestAccountReq("ownerFName", "ownerLName", "ownerPassword")
+	account := createTestAccount(apiServer, t, ownerReq)
+	ownerToken := loginTestAccount(apiServer, t, ownerReq.Username, ownerReq.Password)
+	depositTestFunds(apiServer, t, account, NewMoney(10000, DefaultCurrency))
+	partnerReq := createTestAccountReq("partnerFName", "partnerLName", "partnerPassword")
+	partnerAccount := createTestAccount(apiServer, t, partnerReq)
+	partnerToken := loginTestAccount(apiServer, t, partnerReq.Username, partnerReq.Password)
+
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format(executionDateLayout)
+	transferReq := TransferRequest{FromAccountIban: account.IBAN, ToAccountIban: partnerAccount.IBAN, Amount: NewMoney(6000, DefaultCurrency), ExecutionDate: tomorrow}
+	respRec := routeTestRequest(apiServer, "POST", "/transfer", ownerToken, transferReq)
+	assert.Equal(t, http.StatusAccepted, respRec.Code)
+	var transferResp TransferResponse
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &transferResp))
+	scheduled := transferResp.ScheduledTransfer
+
+	// the account becomes joint with a limit below the transfer before its
+	// execution date
+	holdersPath := fmt.Sprintf("/accounts/%d/holders", account.ID)
+	respRec = routeTestRequest(apiServer, "POST", holdersPath, ownerToken, AddAccountHolderRequest{Login: partnerReq.Username, Permission: HolderPermissionTransfer})
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", fmt.Sprintf("%s/%d/accept", holdersPath, partnerAccount.CustomerID), partnerToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	limitPath := fmt.Sprintf("/accounts/%d/approval-limit", account.ID)
+	respRec = routeTestRequest(apiServer, "PUT", limitPath, ownerToken, ApprovalLimitRequest{Limit: &Money{Amount: 5000, Currency: DefaultCurrency}})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+
+	executionTime, _ := time.Parse(executionDateLayout, tomorrow)
+	executed, err := scheduler.RunDue(executionTime)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, executed)
+	updatedAccount, _ := store.GetAccountByIban(account.IBAN)
+	assert.Equal(t, NewMoney(10000, DefaultCurrency), updatedAccount.Balance)
+
+	transfers, err := store.GetScheduledTransfers(account.IBAN, "")
+	assert.NoError(t, err)
+	assert.Len(t, transfers, 1)
+	assert.Equal(t, scheduled.ID, transfers[0].ID)
+	assert.Equal(t, ScheduledStatusNeedsApproval, transfers[0].Status)
+	assert.Zero(t, transfers[0].TransactionID)
+	assert.NotEmpty(t, transfers[0].LastError)
+
+	approvals, err := store.GetTransferApprovals(account.IBAN, ApprovalStatusPending)
+	assert.NoError(t, err)
+	assert.Len(t, approvals, 1)
+	assert.Equal(t, transfers[0].ApprovalID, approvals[0].ID)
+
+	// a rejected approval leaves the money where it is
+	rejectPath := fmt.Sprintf("/accounts/%d/approvals/%d/reject", account.ID, approvals[0].ID)
+	respRec = routeTestRequest(apiServer, "POST", rejectPath, partnerToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	executed, err = scheduler.RunDue(executionTime.Add(defaultSchedulerPolicy.RetryDelay))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, executed)
+	updatedAccount, _ = store.GetAccountByIban(account.IBAN)
+	assert.Equal(t, NewMoney(10000, DefaultCurrency), updatedAccount.Balance)
+}
+
+func TestHandleStandingOrders(t *testing.T) {
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+	scheduler := NewTransferScheduler(store, defaultSchedulerPolicy)
+
+	senderReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
+	account := createTestAccount(apiServer, t, senderReq)
+	senderToken := loginTestAccount(apiServer, t, senderReq.Username, senderReq.Password)
+	depositTestFunds(apiServer, t, account, NewMoney(10000, DefaultCurrency))
+	receiverReq := createTestAccountReq("receiverFName", "receiverLName", "receiverPassword")
+	receiverAccount := createTestAccount(apiServer, t, receiverReq)
+	receiverToken := loginTestAccount(apiServer, t, receiverReq.Username, receiverReq.Password)
+
+	now := time.Now().UTC()
+	start, _ := time.Parse(executionDateLayout, now.AddDate(0, 0, 1).Format(executionDateLayout))
+	ordersPath := fmt.Sprintf("/accounts/%d/standing-orders", account.ID)
+	orderReq := StandingOrderRequest{ToAccountIban: receiverAccount.IBAN, Amount: NewMoney(4000, DefaultCurrency), Frequency: FrequencyWeekly, StartDate: start.Format(executionDateLayout)}
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "POST", ordersPath, receiverToken, orderReq).Code)
+	respRec := routeTestRequest(apiServer, "POST", ordersPath, senderToken, StandingOrderRequest{ToAccountIban: receiverAccount.IBAN, Amount: NewMoney(4000, DefaultCurrency), Frequency: FrequencyMonthly})
+	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", ordersPath, senderToken, orderReq)
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+	var order StandingOrder
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &order))
+	assert.Equal(t, StandingOrderStatusActive, order.Status)
+	assert.Equal(t, orderReq.StartDate, order.NextExecutionDate)
+
+	// an execution the balance does not cover is skipped
+	skipReq := orderReq
+	skipReq.Amount, skipReq.OnInsufficientFunds = NewMoney(20000, DefaultCurrency), InsufficientFundsSkip
+	respRec = routeTestRequest(apiServer, "POST", ordersPath, senderToken, skipReq)
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+	var skipping StandingOrder
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &skipping))
+
+	executed, err := scheduler.RunDue(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, executed)
+	executed, err = scheduler.RunDue(start)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, executed)
+	updatedAccount, _ := store.GetAccountByIban(receiverAccount.IBAN)
+	assert.Equal(t, NewMoney(4000, DefaultCurrency), updatedAccount.Balance)
+
+	failed, err := store.GetScheduledTransfers(account.IBAN, ScheduledStatusFailed)
+	assert.NoError(t, err)
+	assert.Len(t, failed, 1)
+	assert.Equal(t, skipping.ID, failed[0].StandingOrderID)
+	assert.Equal(t, 1, failed[0].Attempts)
+
+	respRec = routeTestRequest(apiServer, "GET", fmt.Sprintf("%s/%d", ordersPath, skipping.ID), senderToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &skipping))
+	assert.Equal(t, StandingOrderStatusActive, skipping.Status)
+	assert.Equal(t, orderReq.StartDate, skipping.LastExecutionDate)
+	assert.Equal(t, start.AddDate(0, 0, 7).Format(executionDateLayout), skipping.NextExecutionDate)
+
+	respRec = routeTestRequest(apiServer, "DELETE", fmt.Sprintf("%s/%d", ordersPath, skipping.ID), senderToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &skipping))
+	assert.Equal(t, StandingOrderStatusCancelled, skipping.Status)
+	respRec = routeTestRequest(apiServer, "DELETE", fmt.Sprintf("%s/%d", ordersPath, skipping.ID), senderToken, nil)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+
+	// changes apply to the executions not scheduled yet
+	orderPath := fmt.Sprintf("%s/%d", ordersPath, order.ID)
+	orderReq.Amount = NewMoney(5000, DefaultCurrency)
+	respRec = routeTestRequest(apiServer, "PUT", orderPath, senderToken, orderReq)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &order))
+	assert.Equal(t, NewMoney(5000, DefaultCurrency), order.Amount)
+	assert.Equal(t, start.AddDate(0, 0, 7).Format(executionDateLayout), order.NextExecutionDate)
+
+	// executions missed while the scheduler did not run are caught up on;
+	// the second one lacks the money and waits for a retry
+	executed, err = scheduler.RunDue(start.AddDate(0, 0, 14))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, executed)
+	updatedAccount, _ = store.GetAccountByIban(receiverAccount.IBAN)
+	assert.Equal(t, NewMoney(9000, DefaultCurrency), updatedAccount.Balance)
+	pending, err := store.GetScheduledTransfers(account.IBAN, ScheduledStatusPending)
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, order.ID, pending[0].StandingOrderID)
+
+	// cancelling the order cancels the pending execution with it
+	respRec = routeTestRequest(apiServer, "DELETE", orderPath, senderToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	pending, err = store.GetScheduledTransfers(account.IBAN, ScheduledStatusPending)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+	assert.Equal(t, http.StatusConflict, routeTestRequest(apiServer, "PUT", orderPath, senderToken, orderReq).Code)
+
+	respRec = routeTestRequest(apiServer, "GET", ordersPath+"?status=cancelled", senderToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var orders []*StandingOrder
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &orders))
+	assert.Len(t, orders, 2)
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "GET", ordersPath, receiverToken, nil).Code)
+	assert.Equal(t, http.StatusNotFound, routeTestRequest(apiServer, "GET", ordersPath+"/999", senderToken, nil).Code)
+}
+
+func TestStandingOrderApprovalLimit(t *testing.T) {
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+	scheduler := NewTransferScheduler(store, defaultSchedulerPolicy)
+
+	ownerReq := createTestAccountReq("ownerFName", "ownerLName", "ownerPassword")
+	account := createTestAccount(apiServer, t, ownerReq)
+	ownerToken := loginTestAccount(apiServer, t, ownerReq.Username, ownerReq.Password)
+	depositTestFunds(apiServer, t, account, NewMoney(10000, DefaultCurrency))
+	partnerReq := createTestAccountReq("partnerFName", "partnerLName", "partnerPassword")
+	partnerAccount := createTestAccount(apiServer, t, partnerReq)
+	partnerToken := loginTestAccount(apiServer, t, partnerReq.Username, partnerReq.Password)
+
+	holdersPath := fmt.Sprintf("/accounts/%d/holders", account.ID)
+	respRec := routeTestRequest(apiServer, "POST", holdersPath, ownerToken, AddAccountHolderRequest{Login: partnerReq.Username, Permission: HolderPermissionTransfer})
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+	respRec = routeTestRequest(apiServer, "POST", fmt.Sprintf("%s/%d/accept", holdersPath, partnerAccount.CustomerID), partnerToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+
+	start, _ := time.Parse(executionDateLayout, time.Now().UTC().AddDate(0, 0, 1).Format(executionDateLayout))
+	ordersPath := fmt.Sprintf("/accounts/%d/standing-orders", account.ID)
+	orderReq := StandingOrderRequest{ToAccountIban: partnerAccount.IBAN, Amount: NewMoney(6000, DefaultCurrency), Frequency: FrequencyWeekly, StartDate: start.Format(executionDateLayout)}
+	respRec = routeTestRequest(apiServer, "POST", ordersPath, ownerToken, orderReq)
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+
+	// the holders lower the limit below the order after it was set up, so
+	// its execution waits for the partner instead of moving the money
+	limitPath := fmt.Sprintf("/accounts/%d/approval-limit", account.ID)
+	respRec = routeTestRequest(apiServer, "PUT", limitPath, ownerToken, ApprovalLimitRequest{Limit: &Money{Amount: 5000, Currency: DefaultCurrency}})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+
+	executed, err := scheduler.RunDue(start)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, executed)
+	updatedAccount, _ := store.GetAccountByIban(account.IBAN)
+	assert.Equal(t, NewMoney(10000, DefaultCurrency), updatedAccount.Balance)
+
+	scheduledPath := fmt.Sprintf("/accounts/%d/scheduled-transfers", account.ID)
+	respRec = routeTestRequest(apiServer, "GET", scheduledPath+"?status=needs_approval", ownerToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var transfers []*ScheduledTransfer
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &transfers))
+	assert.Len(t, transfers, 1)
+	assert.NotZero(t, transfers[0].ApprovalID)
+	assert.Equal(t, 1, transfers[0].Attempts)
+
+	approvals, err := store.GetTransferApprovals(account.IBAN, ApprovalStatusPending)
+	assert.NoError(t, err)
+	assert.Len(t, approvals, 1)
+	assert.Equal(t, transfers[0].ApprovalID, approvals[0].ID)
+	assert.Equal(t, account.CustomerID, approvals[0].RequestedBy)
+	assert.Equal(t, orderReq.Amount, approvals[0].Amount)
+
+	// the execution is not tried again, the approval moves the money
+	executed, err = scheduler.RunDue(start.Add(defaultSchedulerPolicy.RetryDelay))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, executed)
+	approvePath := fmt.Sprintf("/accounts/%d/approvals/%d/approve", account.ID, approvals[0].ID)
+	respRec = routeTestRequest(apiServer, "POST", approvePath, partnerToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	updatedAccount, _ = store.GetAccountByIban(account.IBAN)
+	assert.Equal(t, NewMoney(4000, DefaultCurrency), updatedAccount.Balance)
+}
+
+func TestHandleTransferBatch(t *testing.T) {
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	senderReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
+	account := createTestAccount(apiServer, t, senderReq)
+	senderToken := loginTestAccount(apiServer, t, senderReq.Username, senderReq.Password)
+	depositTestFunds(apiServer, t, account, NewMoney(10000, DefaultCurrency))
+	firstReq := createTestAccountReq("firstFName", "firstLName", "firstPassword")
+	first := createTestAccount(apiServer, t, firstReq)
+	firstToken := loginTestAccount(apiServer, t, firstReq.Username, firstReq.Password)
+	second := createTestAccount(apiServer, t, createTestAccountReq("secondFName", "secondLName", "secondPassword"))
+
+	batchReq := TransferBatchRequest{FromAccountIban: account.IBAN, Items: []TransferBatchItemRequest{
+		{ToAccountIban: first.IBAN, Amount: NewMoney(3000, DefaultCurrency)},
+		{ToAccountIban: second.IBAN, Amount: NewMoney(4000, DefaultCurrency)},
+		{ToAccountIban: first.IBAN, Amount: NewMoney(5000, DefaultCurrency)},
+	}}
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "POST", "/transfers/batch", firstToken, batchReq).Code)
+
+	// an atomic batch moves nothing if one item fails
+	respRec := routeTestRequest(apiServer, "POST", "/transfers/batch", senderToken, batchReq)
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+	var batch TransferBatch
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &batch))
+	assert.Equal(t, BatchModeAtomic, batch.Mode)
+	assert.Equal(t, BatchStatusFailed, batch.Status)
+	assert.Equal(t, NewMoney(12000, DefaultCurrency), batch.Total)
+	assert.Equal(t, BatchItemStatusNotExecuted, batch.Items[0].Status)
+	assert.Zero(t, batch.Items[0].TransactionID)
+	assert.Equal(t, BatchItemStatusFailed, batch.Items[2].Status)
+	assert.Equal(t, "insufficient_funds", batch.Items[2].Error.Code)
+	updatedAccount, _ := store.GetAccountByIban(account.IBAN)
+	assert.Equal(t, NewMoney(10000, DefaultCurrency), updatedAccount.Balance)
+
+	batchPath := fmt.Sprintf("/transfers/batch/%d", batch.ID)
+	respRec = routeTestRequest(apiServer, "GET", batchPath, senderToken, nil)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var stored TransferBatch
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &stored))
+	assert.Equal(t, batch, stored)
+	assert.Equal(t, http.StatusNotFound, routeTestRequest(apiServer, "GET", batchPath, firstToken, nil).Code)
+
+	// best effort executes what it can
+	batchReq.Mode = BatchModeBestEffort
+	respRec = routeTestRequest(apiServer, "POST", "/transfers/batch", senderToken, batchReq)
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &batch))
+	assert.Equal(t, BatchStatusPartiallyCompleted, batch.Status)
+	assert.Equal(t, 2, batch.Succeeded)
+	assert.Equal(t, 1, batch.Failed)
+	assert.NotZero(t, batch.Items[1].TransactionID)
+	assert.Equal(t, "insufficient_funds", batch.Items[2].Error.Code)
+	updatedAccount, _ = store.GetAccountByIban(account.IBAN)
+	assert.Equal(t, NewMoney(3000, DefaultCurrency), updatedAccount.Balance)
+	updatedAccount, _ = store.GetAccountByIban(second.IBAN)
+	assert.Equal(t, NewMoney(4000, DefaultCurrency), updatedAccount.Balance)
+
+	batchReq = TransferBatchRequest{FromAccountIban: account.IBAN, Items: []TransferBatchItemRequest{
+		{ToAccountIban: first.IBAN, Amount: NewMoney(1000, DefaultCurrency)},
+		{ToAccountIban: second.IBAN, Amount: NewMoney(2000, DefaultCurrency)},
+	}}
+	respRec = routeTestRequest(apiServer, "POST", "/transfers/batch", senderToken, batchReq)
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &batch))
+	assert.Equal(t, BatchStatusCompleted, batch.Status)
+	updatedAccount, _ = store.GetAccountByIban(account.IBAN)
+	assert.Equal(t, NewMoney(0, DefaultCurrency), updatedAccount.Balance)
+
+	// invalid requests are rejected as a whole
+	batchReq.Items[1].ToAccountIban = "DE00"
+	respRec = routeTestRequest(apiServer, "POST", "/transfers/batch", senderToken, batchReq)
+	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+	var errResp APIError
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &errResp))
+	assert.Equal(t, "items[1].toAccountIban", errResp.Details["field"])
+	batchReq.Items = nil
+	assert.Equal(t, http.StatusBadRequest, routeTestRequest(apiServer, "POST", "/transfers/batch", senderToken, batchReq).Code)
+	assert.Equal(t, http.StatusNotFound, routeTestRequest(apiServer, "GET", "/transfers/batch/999", senderToken, nil).Code)
+}
+
+func TestHandleRefundAndReversal(t *testing.T) {
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	senderReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
+	sender := createTestAccount(apiServer, t, senderReq)
+	senderToken := loginTestAccount(apiServer, t, senderReq.Username, senderReq.Password)
+	depositTestFunds(apiServer, t, sender, NewMoney(10000, DefaultCurrency))
+	recipientReq := createTestAccountReq("recipientFName", "recipientLName", "recipientPassword")
+	recipient := createTestAccount(apiServer, t, recipientReq)
+	recipientToken := loginTestAccount(apiServer, t, recipientReq.Username, recipientReq.Password)
+	other := createTestAccount(apiServer, t, createTestAccountReq("otherFName", "otherLName", "otherPassword"))
+	adminToken := createTestAdmin(apiServer, t)
+
+	transfer := func(from, to *AccountResponse, token string, amount int64) *Transaction {
+		transferReq := TransferRequest{FromAccountIban: from.IBAN, ToAccountIban: to.IBAN, Amount: NewMoney(amount, DefaultCurrency)}
+		respRec := routeTestRequest(apiServer, "POST", "/transfer", token, transferReq)
+		assert.Equal(t, http.StatusOK, respRec.Code)
+		var resp TransferResponse
+		assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &resp))
+		return resp.Transaction
+	}
+	balance := func(account *AccountResponse) Money {
+		updated, err := store.GetAccountByIban(account.IBAN)
+		assert.NoError(t, err)
+		return updated.Balance
+	}
+
+	debit := transfer(sender, recipient, senderToken, 6000)
+	lines, err := store.GetTransactions(recipient.IBAN, &TransactionFilter{Limit: 1})
+	assert.NoError(t, err)
+	credit := lines[0]
+	refundPath := fmt.Sprintf("/accounts/%d/transactions/%d/refund", recipient.ID, credit.ID)
+
+	amount := NewMoney(2000, DefaultCurrency)
+	respRec := routeTestRequest(apiServer, "POST", refundPath, recipientToken, RefundRequest{Amount: &amount})
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+	var refund Transaction
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &refund))
+	assert.Equal(t, journalKindRefund, refund.Kind)
+	assert.Equal(t, credit.ID, refund.OriginalTransactionID)
+	assert.Equal(t, sender.IBAN, refund.CounterpartyIban)
+	assert.Equal(t, NewMoney(4000, DefaultCurrency), refund.BalanceAfter)
+	assert.Equal(t, NewMoney(6000, DefaultCurrency), balance(sender))
+	lines, err = store.GetTransactions(sender.IBAN, &TransactionFilter{Limit: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, debit.ID, lines[0].OriginalTransactionID)
+
+	// refunds are limited to what is left of the transfer
+	amount = NewMoney(5000, DefaultCurrency)
+	respRec = routeTestRequest(apiServer, "POST", refundPath, recipientToken, RefundRequest{Amount: &amount})
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+	var errResp APIError
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &errResp))
+	assert.Equal(t, "refund_exceeds_transfer", errResp.Code)
+	assert.NotNil(t, errResp.Details["remaining"])
+
+	// only the recipient's account refunds, and only its own line
+	senderPath := fmt.Sprintf("/accounts/%d/transactions/%d/refund", sender.ID, debit.ID)
+	assert.Equal(t, http.StatusNotFound, routeTestRequest(apiServer, "POST", senderPath, senderToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "POST", refundPath, senderToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, routeTestRequest(apiServer, "POST", fmt.Sprintf("/admin/transactions/%d/reverse", debit.ID), recipientToken, nil).Code)
+
+	// admins reverse the rest even if the recipient spent it
+	transfer(recipient, other, recipientToken, 4000)
+	reversePath := fmt.Sprintf("/admin/transactions/%d/reverse", debit.ID)
+	amount = NewMoney(1000, DefaultCurrency)
+	assert.Equal(t, http.StatusBadRequest, routeTestRequest(apiServer, "POST", reversePath, adminToken, RefundRequest{Amount: &amount}).Code)
+	respRec = routeTestRequest(apiServer, "POST", reversePath, adminToken, RefundRequest{Reference: "Wrong recipient"})
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+	var reversal Transaction
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &reversal))
+	assert.Equal(t, journalKindReversal, reversal.Kind)
+	assert.Equal(t, NewMoney(4000, DefaultCurrency), reversal.Amount)
+	assert.Equal(t, "Wrong recipient", reversal.Reference)
+	assert.Equal(t, NewMoney(-4000, DefaultCurrency), balance(recipient))
+	assert.Equal(t, NewMoney(10000, DefaultCurrency), balance(sender))
+	events, err := store.GetAuditEvents(recipient.IBAN, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, AuditTransferReversed, events[0].Kind)
+	assert.Equal(t, "staff:admin", events[0].Actor)
+
+	respRec = routeTestRequest(apiServer, "POST", reversePath, adminToken, nil)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &errResp))
+	assert.Equal(t, "transfer_refunded", errResp.Code)
+
+	// under the reject policy reversals need the recipient's balance
+	t.Setenv("REVERSAL_NEGATIVE_BALANCE", NegativeBalanceReject)
+	debit = transfer(sender, recipient, senderToken, 1000)
+	reversePath = fmt.Sprintf("/admin/transactions/%d/reverse", debit.ID)
+	assert.Equal(t, http.StatusUnprocessableEntity, routeTestRequest(apiServer, "POST", reversePath, adminToken, nil).Code)
+	assert.Equal(t, NewMoney(-3000, DefaultCurrency), balance(recipient))
+}
+
+func TestHandleTransferInsufficientBalance(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	// create test accounts
+	senderAccountReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
+	senderAccount := createTestAccount(apiServer, t, senderAccountReq)
+
+	receiverAccountReq := createTestAccountReq("receiverFName", "receiverLName", "receiverPassword")
+	receiverAccount := createTestAccount(apiServer, t, receiverAccountReq)
+
+	// login with the sender account to get the token
+	loginReq := LoginRequest{
+		Username: senderAccountReq.Username,
+		Password: senderAccountReq.Password,
+	}
+	reqBody, _ := json.Marshal(loginReq)
+
+	req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(reqBody))
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleLogin))
+	handler.ServeHTTP(respRec, req)
+
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var loginResp LoginResponse
+	err := json.Unmarshal(respRec.Body.Bytes(), &loginResp)
+	assert.NoError(t, err)
+	jwtToken := fmt.Sprintf("Bearer %s", loginResp.Token)
+
+	receiverOldBalance := receiverAccount.Balance
+	transferAmount := senderAccount.Balance.Add(NewMoney(1, DefaultCurrency))
+	transferRequest := TransferRequest{
+		FromAccountIban: senderAccount.IBAN,
+		ToAccountIban:   receiverAccount.IBAN,
+		Amount:          transferAmount,
+	}
+	reqBody, _ = json.Marshal(transferRequest)
+
+	req, _ = http.NewRequest("POST", "/transfer", bytes.NewBuffer(reqBody))
+	req.Header.Set("Authorization", jwtToken)
+	respRec = httptest.NewRecorder()
+
+	handler = http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleTransfer)))
+	handler.ServeHTTP(respRec, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, respRec.Code)
+	var resp APIError
+	err = json.Unmarshal(respRec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "Balance not sufficient", resp.Detail)
+	assert.Equal(t, "insufficient_funds", resp.Code)
+
+	// check unchanged balances
+	updatedSender, _ := store.GetAccountByIban(senderAccount.IBAN)
+	updatedReceiver, _ := store.GetAccountByIban(receiverAccount.IBAN)
+	assert.Equal(t, transferAmount.Sub(NewMoney(1, DefaultCurrency)), updatedSender.Balance)
+	assert.Equal(t, receiverOldBalance, updatedReceiver.Balance)
+}
+
+func TestHandleDepositAndWithdrawal(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	testAccountReq := createTestAccountReq("testFName", "testLName", "testPassword")
+	testAccount := createTestAccount(apiServer, t, testAccountReq)
+	jwtToken := loginTestAccount(apiServer, t, testAccountReq.Username, testAccountReq.Password)
+	adminToken := createTestAdmin(apiServer, t)
+
+	moveCash := func(resource, token, amount string) *httptest.ResponseRecorder {
+		reqBody := map[string]any{"amount": map[string]string{"amount": amount, "currency": "EUR"}, "reference": "ATM 42"}
+		return routeTestRequest(apiServer, "POST", fmt.Sprintf("/accounts/%d/%s", testAccount.ID, resource), token, reqBody)
+	}
+
+	// customers cannot create or take out cash themselves
+	assert.Equal(t, http.StatusForbidden, moveCash("deposits", jwtToken, "50.00").Code)
+	assert.Equal(t, http.StatusForbidden, moveCash("withdrawals", jwtToken, "50.00").Code)
+
+	respRec := moveCash("deposits", adminToken, "50.00")
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var deposit Transaction
+	err := json.Unmarshal(respRec.Body.Bytes(), &deposit)
+	assert.NoError(t, err)
+	assert.Equal(t, journalKindDeposit, deposit.Kind)
+	assert.Equal(t, Credit, deposit.Direction)
+	assert.Equal(t, "ATM 42", deposit.Reference)
+	assert.Equal(t, NewMoney(5000, DefaultCurrency), deposit.BalanceAfter)
+
+	respRec = moveCash("withdrawals", adminToken, "20.00")
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var withdrawal Transaction
+	err = json.Unmarshal(respRec.Body.Bytes(), &withdrawal)
+	assert.NoError(t, err)
+	assert.Equal(t, journalKindWithdrawal, withdrawal.Kind)
+	assert.Equal(t, Debit, withdrawal.Direction)
+	assert.Equal(t, NewMoney(3000, DefaultCurrency), withdrawal.BalanceAfter)
+
+	// withdrawing more than the balance is rejected
+	respRec = moveCash("withdrawals", adminToken, "30.01")
+	assert.Equal(t, http.StatusUnprocessableEntity, respRec.Code)
+
+	updatedAccount, _ := store.GetAccountByIban(testAccount.IBAN)
+	assert.Equal(t, NewMoney(3000, DefaultCurrency), updatedAccount.Balance)
+	ledgerBalance, err := store.GetLedgerBalance(testAccount.IBAN, time.Now().UTC())
+	assert.NoError(t, err)
+	assert.Equal(t, updatedAccount.Balance, ledgerBalance)
+
+	// the staff user who booked the cash is audited
+	events, err := store.GetAuditEvents(testAccount.IBAN, 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, AuditCashWithdrawn, events[0].Kind)
+	assert.Equal(t, AuditCashDeposited, events[1].Kind)
+	assert.Equal(t, "staff:admin", events[1].Actor)
+}
+
+func TestHandleDepositOtherAccount(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	ownerAccountReq := createTestAccountReq("ownerFName", "ownerLName", "ownerPassword")
+	ownerAccount := createTestAccount(apiServer, t, ownerAccountReq)
+
+	otherAccountReq := createTestAccountReq("otherFName", "otherLName", "otherPassword")
+	createTestAccount(apiServer, t, otherAccountReq)
+
+	jwtToken := loginTestAccount(apiServer, t, otherAccountReq.Username, otherAccountReq.Password)
+
+	reqBody, _ := json.Marshal(CashRequest{Amount: NewMoney(100, DefaultCurrency)})
+	req, _ := http.NewRequest("POST", "/accounts/deposits", bytes.NewBuffer(reqBody))
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(ownerAccount.ID)})
+	req.Header.Set("Authorization", jwtToken)
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleDeposit)))
+	handler.ServeHTTP(respRec, req)
+
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+	unchangedAccount, _ := store.GetAccountByIban(ownerAccount.IBAN)
+	assert.Equal(t, NewMoney(0, DefaultCurrency), unchangedAccount.Balance)
+}
+
+func TestHandleGetTransactions(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	// create test accounts
+	senderAccountReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
+	senderAccount := createTestAccount(apiServer, t, senderAccountReq)
+
+	receiverAccountReq := createTestAccountReq("receiverFName", "receiverLName", "receiverPassword")
+	receiverAccount := createTestAccount(apiServer, t, receiverAccountReq)
+
+	_, err := store.Deposit(senderAccount.IBAN, NewMoney(1000, DefaultCurrency), "initial funds", "staff:teller", nil)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := store.TransferFunds(senderAccount.IBAN, receiverAccount.IBAN, NewMoney(1, DefaultCurrency), "", nil)
+		assert.NoError(t, err)
+	}
+
+	jwtToken := loginTestAccount(apiServer, t, senderAccountReq.Username, senderAccountReq.Password)
+
+	getPage := func(query string) TransactionsResponse {
+		req, _ := http.NewRequest("GET", "/accounts/transactions"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(senderAccount.ID)})
+		req.Header.Set("Authorization", jwtToken)
+		respRec := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleGetTransactions)))
+		handler.ServeHTTP(respRec, req)
+
+		assert.Equal(t, http.StatusOK, respRec.Code)
+		var resp TransactionsResponse
+		err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	// newest first, paginated with a cursor
+	firstPage := getPage("?limit=2")
+	assert.Len(t, firstPage.Transactions, 2)
+	assert.NotEmpty(t, firstPage.NextCursor)
+	assert.Equal(t, receiverAccount.IBAN, firstPage.Transactions[0].CounterpartyIban)
+	assert.Equal(t, Debit, firstPage.Transactions[0].Direction)
+	assert.Equal(t, NewMoney(997, DefaultCurrency), firstPage.Transactions[0].BalanceAfter)
+
+	secondPage := getPage("?limit=2&cursor=" + firstPage.NextCursor)
+	assert.Len(t, secondPage.Transactions, 2)
+	assert.Empty(t, secondPage.NextCursor)
+	assert.Equal(t, journalKindDeposit, secondPage.Transactions[1].Kind)
+	assert.Equal(t, "initial funds", secondPage.Transactions[1].Reference)
+
+	// date range filters
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format("2006-01-02")
+	assert.Len(t, getPage("?from="+tomorrow).Transactions, 0)
+	assert.Len(t, getPage("?to="+tomorrow).Transactions, 4)
+}
+
+func TestHandleGetTransactionsOtherAccount(t *testing.T) {
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	ownerAccountReq := createTestAccountReq("ownerFName", "ownerLName", "ownerPassword")
+	ownerAccount := createTestAccount(apiServer, t, ownerAccountReq)
+
+	otherAccountReq := createTestAccountReq("otherFName", "otherLName", "otherPassword")
+	createTestAccount(apiServer, t, otherAccountReq)
+
+	jwtToken := loginTestAccount(apiServer, t, otherAccountReq.Username, otherAccountReq.Password)
+
+	req, _ := http.NewRequest("GET", "/accounts/transactions", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(ownerAccount.ID)})
+	req.Header.Set("Authorization", jwtToken)
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleGetTransactions)))
+	handler.ServeHTTP(respRec, req)
+
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+	var resp APIError
+	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "Forbidden", resp.Detail)
+}
+
+func TestHandleTwoFactorLogin(t *testing.T) {
+	// wrong codes count as failed logins; do not delay the next attempt
+	t.Setenv("LOGIN_BASE_DELAY", "0s")
+
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	accountReq := createTestAccountReq("totpFName", "totpLName", "totpPassword")
+	createTestAccount(apiServer, t, accountReq)
+	jwtToken := loginTestAccount(apiServer, t, accountReq.Username, accountReq.Password)
+	secret, recoveryCodes := enableTestTOTP(apiServer, t, jwtToken)
+	assert.Len(t, recoveryCodes, recoveryCodeCount)
+
+	// a second enrolment is rejected while the first one is enabled
+	respRec := totpTestRequest(apiServer, "POST", jwtToken, nil, apiServer.handleEnrolTOTP)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+
+	// the password alone only yields a challenge
+	respRec = loginTestRequest(apiServer, accountReq.Username, accountReq.Password)
+	assert.Equal(t, http.StatusAccepted, respRec.Code)
+	var challengeResp LoginChallengeResponse
+	err := json.Unmarshal(respRec.Body.Bytes(), &challengeResp)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, challengeResp.Challenge)
+
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	assert.NoError(t, err)
+	respRec = secondFactorTestRequest(apiServer, SecondFactorRequest{Challenge: challengeResp.Challenge, Code: code})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var loginResp LoginResponse
+	err = json.Unmarshal(respRec.Body.Bytes(), &loginResp)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, loginResp.Token)
+
+	// the challenge is used up and the code cannot be replayed
+	respRec = secondFactorTestRequest(apiServer, SecondFactorRequest{Challenge: challengeResp.Challenge, Code: code})
+	assert.Equal(t, http.StatusUnauthorized, respRec.Code)
+	respRec = loginTestRequest(apiServer, accountReq.Username, accountReq.Password)
+	err = json.Unmarshal(respRec.Body.Bytes(), &challengeResp)
+	assert.NoError(t, err)
+	respRec = secondFactorTestRequest(apiServer, SecondFactorRequest{Challenge: challengeResp.Challenge, Code: code})
+	assert.Equal(t, http.StatusUnauthorized, respRec.Code)
+	var resp APIError
+	err = json.Unmarshal(respRec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "invalid_second_factor", resp.Code)
+
+	// a recovery code works once, in any case and without the dash
+	recoveryCode := strings.ToUpper(strings.ReplaceAll(recoveryCodes[0], "-", ""))
+	respRec = secondFactorTestRequest(apiServer, SecondFactorRequest{Challenge: challengeResp.Challenge, RecoveryCode: recoveryCode})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	respRec = loginTestRequest(apiServer, accountReq.Username, accountReq.Password)
+	err = json.Unmarshal(respRec.Body.Bytes(), &challengeResp)
+	assert.NoError(t, err)
+	respRec = secondFactorTestRequest(apiServer, SecondFactorRequest{Challenge: challengeResp.Challenge, RecoveryCode: recoveryCode})
+	assert.Equal(t, http.StatusUnauthorized, respRec.Code)
+
+	// disabling needs a second factor, afterwards the password suffices again
+	respRec = totpTestRequest(apiServer, "DELETE", jwtToken, nil, apiServer.handleDisableTOTP)
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+	respRec = totpTestRequest(apiServer, "DELETE", jwtToken, map[string]string{recoveryCodeHeader: recoveryCodes[1]}, apiServer.handleDisableTOTP)
+	assert.Equal(t, http.StatusNoContent, respRec.Code)
+	respRec = loginTestRequest(apiServer, accountReq.Username, accountReq.Password)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+}
+
+func TestHandleTransferSecondFactor(t *testing.T) {
+	t.Setenv("TRANSFER_2FA_THRESHOLD", "100.00")
+
+	// Set up the test database
+	store := setupTestDB()
+	defer tearDownTestDB(store)
+
+	// Create an instance of the APIServer with the test database
+	apiServer := NewAPIServer(":8000", store, testKeyring)
+
+	senderAccountReq := createTestAccountReq("senderFName", "senderLName", "senderPassword")
+	senderAccount := createTestAccount(apiServer, t, senderAccountReq)
+	receiverAccountReq := createTestAccountReq("receiverFName", "receiverLName", "receiverPassword")
+	receiverAccount := createTestAccount(apiServer, t, receiverAccountReq)
+
+	jwtToken := loginTestAccount(apiServer, t, senderAccountReq.Username, senderAccountReq.Password)
+	depositTestFunds(apiServer, t, senderAccount, NewMoney(50000, DefaultCurrency))
+
+	transfer := func(amount Money, headers map[string]string) *httptest.ResponseRecorder {
+		reqBody, _ := json.Marshal(TransferRequest{FromAccountIban: senderAccount.IBAN, ToAccountIban: receiverAccount.IBAN, Amount: amount})
+		req, _ := http.NewRequest("POST", "/transfer", bytes.NewBuffer(reqBody))
+		req.Header.Set("Authorization", jwtToken)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		respRec := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleTransfer)))
+		handler.ServeHTTP(respRec, req)
+		return respRec
+	}
+
+	// amounts up to the threshold need no second factor
+	assert.Equal(t, http.StatusOK, transfer(NewMoney(10000, DefaultCurrency), nil).Code)
+
+	// above it the transfer is refused without a code
+	respRec := transfer(NewMoney(10001, DefaultCurrency), nil)
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+	var resp APIError
+	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "second_factor_required", resp.Code)
+
+	// a code is useless before two-factor authentication is enabled
+	respRec = transfer(NewMoney(10001, DefaultCurrency), map[string]string{totpCodeHeader: "123456"})
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+
+	secret, _ := enableTestTOTP(apiServer, t, jwtToken)
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	assert.NoError(t, err)
+	respRec = transfer(NewMoney(10001, DefaultCurrency), map[string]string{totpCodeHeader: code})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	respRec = transfer(NewMoney(10001, DefaultCurrency), map[string]string{totpCodeHeader: code})
+	assert.Equal(t, http.StatusUnauthorized, respRec.Code)
+
+	// a retry with the same key replays the response, even though its code
+	// was used up by the first attempt
+	code, err = totp.Code(secret, totp.Step(time.Now())+1)
+	assert.NoError(t, err)
+	headers := map[string]string{totpCodeHeader: code, idempotencyKeyHeader: "transfer-1"}
+	first := transfer(NewMoney(10002, DefaultCurrency), headers)
+	assert.Equal(t, http.StatusOK, first.Code)
+	retry := transfer(NewMoney(10002, DefaultCurrency), headers)
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get(idempotentReplayedHeader))
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	// the key cannot be reused for another request
+	respRec = transfer(NewMoney(10003, DefaultCurrency), headers)
+	assert.Equal(t, http.StatusConflict, respRec.Code)
+
+	updatedSender, _ := store.GetAccountByIban(senderAccount.IBAN)
+	assert.Equal(t, NewMoney(19997, DefaultCurrency), updatedSender.Balance)
+
+	// amounts in other currencies are compared at the exchange rate, and
+	// need the second factor while there is none
+	respRec = routeTestRequest(apiServer, "POST", "/accounts", jwtToken, CreateAccountRequest{Currency: "USD"})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var usdAccount AccountResponse
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &usdAccount))
+	_, err = store.Deposit(usdAccount.IBAN, NewMoney(50000, "USD"), "test funds", "staff:teller", nil)
+	assert.NoError(t, err)
+	usdTransfer := func(amount Money) *httptest.ResponseRecorder {
+		transferReq := TransferRequest{FromAccountIban: usdAccount.IBAN, ToAccountIban: receiverAccount.IBAN, Amount: amount}
+		return routeTestRequest(apiServer, "POST", "/transfer", jwtToken, transferReq)
+	}
+	respRec = usdTransfer(NewMoney(1000, "USD"))
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &resp))
+	assert.Equal(t, "second_factor_required", resp.Code)
+
+	rates := []*ExchangeRate{{From: "EUR", To: "USD", Rate: 110_000_000}}
+	assert.NoError(t, store.SetExchangeRates(rates, "staff:admin"))
+	assert.Equal(t, http.StatusOK, usdTransfer(NewMoney(11000, "USD")).Code)
+	respRec = usdTransfer(NewMoney(11001, "USD"))
+	assert.Equal(t, http.StatusForbidden, respRec.Code)
+	assert.NoError(t, json.Unmarshal(respRec.Body.Bytes(), &resp))
+	assert.Equal(t, "second_factor_required", resp.Code)
+}
+
+// testKeyring signs the tokens of every test server.
+var testKeyring = newTestKeyring()
+
+func newTestKeyring() *Keyring {
+	key, err := GenerateSigningKey(AlgorithmEdDSA, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyring, err := NewKeyring(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return keyring
+}
+
+// setupTestDB returns an in-memory store unless TEST_STORAGE asks for
+// another backend, e.g. TEST_STORAGE=postgres in CI.
+func setupTestDB() Storage {
+	switch os.Getenv("TEST_STORAGE") {
+	case "postgres":
+		err := godotenv.Load()
+		if err != nil {
+			log.Println("Warning: Error loading .env file")
+		}
+
+		store, err := NewPostgresStore()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := store.Init(); err != nil {
+			log.Fatal(err)
+		}
+		return store
+	case "sqlite":
+		dir, err := os.MkdirTemp("", "gobank")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		store, err := openSQLiteStore(filepath.Join(dir, "test.db"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := store.Init(); err != nil {
+			log.Fatal(err)
+		}
+		return store
+	default:
+		return NewMemoryStore()
+	}
+}
+
+func tearDownTestDB(store Storage) {
+	switch store := store.(type) {
+	case *PostgresStore:
+		migrator, err := newMigrator(&store.sqlStore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := migrator.Down(len(migrator.migrations)); err != nil {
+			log.Fatal("Failed to drop test database:", err)
+		}
+	case *SQLiteStore:
+		store.db.Close()
+		if err := os.RemoveAll(filepath.Dir(store.path)); err != nil {
+			log.Fatal("Failed to remove test database:", err)
+		}
+	}
+}
+
+var testCustomerCount int
+
+// createTestAccountReq returns the sign-up of a new customer. Usernames and
+// emails are numbered so that requests with the same names do not collide.
+func createTestAccountReq(firstName, lastName, password string) *CreateCustomerRequest {
+	testCustomerCount++
+	username := fmt.Sprintf("%s%d", strings.ToLower(firstName), testCustomerCount)
+	return &CreateCustomerRequest{
+		Username:  username,
+		Email:     username + "@example.com",
+		Password:  password,
+		FirstName: firstName,
+		LastName:  lastName,
+	}
+}
+
+// createTestAccount signs up the customer and opens a current account for
+// them.
+func createTestAccount(apiServer *APIServer, t *testing.T, customerReq *CreateCustomerRequest) *AccountResponse {
+	respRec := createTestCustomerRequest(apiServer, customerReq)
+	assert.Equal(t, http.StatusCreated, respRec.Code)
+	var customer CustomerResponse
+	err := json.Unmarshal(respRec.Body.Bytes(), &customer)
+	assert.NoError(t, err)
+	assertNoPasswordHash(t, apiServer.store, customer.ID, respRec.Body.String())
+
+	token := loginTestAccount(apiServer, t, customerReq.Username, customerReq.Password)
+	return openTestAccount(apiServer, t, token, AccountTypeCurrent)
+}
+
+func createTestCustomerRequest(apiServer *APIServer, customerReq *CreateCustomerRequest) *httptest.ResponseRecorder {
+	reqBody, _ := json.Marshal(customerReq)
+	req, _ := http.NewRequest("POST", "/customers", bytes.NewBuffer(reqBody))
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleCreateCustomer))
+	handler.ServeHTTP(respRec, req)
+	return respRec
+}
+
+func openTestAccount(apiServer *APIServer, t *testing.T, token, accountType string) *AccountResponse {
+	respRec := routeTestRequest(apiServer, "POST", "/accounts", token, CreateAccountRequest{Type: accountType})
+	assert.Equal(t, http.StatusOK, respRec.Code)
+
+	var testAccount AccountResponse
 	err := json.Unmarshal(respRec.Body.Bytes(), &testAccount)
 	assert.NoError(t, err)
 	return &testAccount
 }
+
+// depositTestFunds books a deposit of amount into the account, as a teller
+// at the counter would, and updates the balance of account accordingly.
+func depositTestFunds(apiServer *APIServer, t *testing.T, account *AccountResponse, amount Money) {
+	_, err := apiServer.store.Deposit(account.IBAN, amount, "test funds", "staff:teller", nil)
+	assert.NoError(t, err)
+	account.Balance = account.Balance.Add(amount)
+}
+
+func loginTestAccount(apiServer *APIServer, t *testing.T, username, password string) string {
+	return fmt.Sprintf("Bearer %s", loginTestSession(apiServer, t, username, password).Token)
+}
+
+func loginTestRequest(apiServer *APIServer, username, password string) *httptest.ResponseRecorder {
+	reqBody, _ := json.Marshal(LoginRequest{Username: username, Password: password})
+	req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(reqBody))
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleLogin))
+	handler.ServeHTTP(respRec, req)
+	return respRec
+}
+
+func loginTestSession(apiServer *APIServer, t *testing.T, username, password string) *LoginResponse {
+	respRec := loginTestRequest(apiServer, username, password)
+
+	var loginResp LoginResponse
+	err := json.Unmarshal(respRec.Body.Bytes(), &loginResp)
+	assert.NoError(t, err)
+	return &loginResp
+}
+
+// enableTestTOTP enrols and confirms TOTP for the customer of the token. The
+// confirmation uses the code of the previous time step so that the current
+// one is still unused afterwards.
+func enableTestTOTP(apiServer *APIServer, t *testing.T, token string) (string, []string) {
+	respRec := totpTestRequest(apiServer, "POST", token, nil, apiServer.handleEnrolTOTP)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var enrolResp TOTPEnrolmentResponse
+	err := json.Unmarshal(respRec.Body.Bytes(), &enrolResp)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(enrolResp.ProvisioningURI, "otpauth://totp/"))
+
+	code, err := totp.Code(enrolResp.Secret, totp.Step(time.Now())-1)
+	assert.NoError(t, err)
+	reqBody, _ := json.Marshal(ConfirmTOTPRequest{Code: code})
+	req, _ := http.NewRequest("POST", "/customers/me/2fa/totp/confirm", bytes.NewBuffer(reqBody))
+	req.Header.Set("Authorization", token)
+	respRec = httptest.NewRecorder()
+
+	handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleConfirmTOTP)))
+	handler.ServeHTTP(respRec, req)
+
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var codesResp RecoveryCodesResponse
+	err = json.Unmarshal(respRec.Body.Bytes(), &codesResp)
+	assert.NoError(t, err)
+	return enrolResp.Secret, codesResp.RecoveryCodes
+}
+
+func totpTestRequest(apiServer *APIServer, method string, token string, headers map[string]string, f apiFunc) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "/customers/me/2fa/totp", nil)
+	req.Header.Set("Authorization", token)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(f)))
+	handler.ServeHTTP(respRec, req)
+	return respRec
+}
+
+func secondFactorTestRequest(apiServer *APIServer, secondFactorReq SecondFactorRequest) *httptest.ResponseRecorder {
+	reqBody, _ := json.Marshal(secondFactorReq)
+	req, _ := http.NewRequest("POST", "/login/2fa", bytes.NewBuffer(reqBody))
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleLoginSecondFactor))
+	handler.ServeHTTP(respRec, req)
+	return respRec
+}
+
+func getTestAccount(apiServer *APIServer, id int, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/accounts", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(id)})
+	req.Header.Set("Authorization", token)
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(apiServer.validateTokenMiddleware(makeHTTPHandleFunc(apiServer.handleGetAccount)))
+	handler.ServeHTTP(respRec, req)
+	return respRec
+}
+
+// createTestAdmin stores a staff user with the admin role and returns a
+// bearer token for it.
+func createTestAdmin(apiServer *APIServer, t *testing.T) string {
+	return createTestStaff(apiServer, t, "admin", RoleAdmin)
+}
+
+func createTestStaff(apiServer *APIServer, t *testing.T, username, role string) string {
+	user, err := NewStaffUser(username, "staffPassword", role)
+	assert.NoError(t, err)
+	assert.NoError(t, apiServer.store.CreateStaffUser(user, "test"))
+
+	respRec := staffLoginTestRequest(apiServer, username, "staffPassword")
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var loginResp LoginResponse
+	err = json.Unmarshal(respRec.Body.Bytes(), &loginResp)
+	assert.NoError(t, err)
+	return fmt.Sprintf("Bearer %s", loginResp.Token)
+}
+
+func staffLoginTestRequest(apiServer *APIServer, username, password string) *httptest.ResponseRecorder {
+	reqBody, _ := json.Marshal(StaffLoginRequest{Username: username, Password: password})
+	req, _ := http.NewRequest("POST", "/staff/login", bytes.NewBuffer(reqBody))
+	respRec := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleStaffLogin))
+	handler.ServeHTTP(respRec, req)
+	return respRec
+}
+
+// routeTestRequest sends a request through the router, so that the
+// permission of the route is checked as well.
+func routeTestRequest(apiServer *APIServer, method, path, token string, body any) *httptest.ResponseRecorder {
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(reqBody))
+	req.Header.Set("Authorization", token)
+	respRec := httptest.NewRecorder()
+
+	apiServer.router().ServeHTTP(respRec, req)
+	return respRec
+}
+
+// assertNoPasswordHash checks that a response body leaks neither the
+// password hash of the customer nor any password field.
+func assertNoPasswordHash(t *testing.T, store Storage, customerID int, body string) {
+	customer, err := store.GetCustomerById(customerID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, customer.EncryptedPassword)
+	assert.NotContains(t, body, customer.EncryptedPassword)
+	assert.NotContains(t, strings.ToLower(body), "password")
+}
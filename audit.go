@@ -0,0 +1,51 @@
+package main
+
+import "time"
+
+// Kinds of audit events.
+const (
+	AuditAccountLocked    = "account_locked"
+	AuditIPLocked         = "ip_locked"
+	AuditAccountUnlocked  = "account_unlocked"
+	AuditAccountFrozen    = "account_frozen"
+	AuditAccountUnfrozen  = "account_unfrozen"
+	AuditAccountStatus    = "account_status_changed"
+	AuditAccountClosed    = "account_closed"
+	AuditStaffCreated     = "staff_user_created"
+	AuditExchangeRateSet  = "exchange_rate_set"
+	AuditTransferReversed = "transfer_reversed"
+	AuditCashDeposited    = "cash_deposited"
+	AuditCashWithdrawn    = "cash_withdrawn"
+)
+
+// AuditEvent records a security relevant action, who performed it and on
+// what.
+type AuditEvent struct {
+	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Actor     string    `json:"actor"`
+	Subject   string    `json:"subject"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// insertAuditEvent writes the event inside tx, so that it is only kept if
+// the action it records is.
+func insertAuditEvent(tx *sqlTx, event *AuditEvent) error {
+	query := `
+		insert into audit_event
+		(kind, actor, subject, message, created_at)
+		values
+		($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+	return tx.queryRow(query, event.Kind, event.Actor, event.Subject, event.Message, event.CreatedAt).Scan(&event.ID)
+}
+
+// insertAuditEvent works like its SQL counterpart; the caller holds the
+// store's mutex.
+func (s *MemoryStore) insertAuditEvent(event *AuditEvent) {
+	s.nextAuditEventID++
+	event.ID = s.nextAuditEventID
+	s.auditEvents = append(s.auditEvents, event)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Modes of transfer batches.
+const (
+	// BatchModeAtomic moves the money of all items or of none.
+	BatchModeAtomic = "atomic"
+	// BatchModeBestEffort executes every item on its own.
+	BatchModeBestEffort = "best_effort"
+)
+
+// Statuses of transfer batches and their items. In an atomic batch that
+// failed, the items besides the failed one are not_executed.
+const (
+	BatchStatusCompleted          = "completed"
+	BatchStatusPartiallyCompleted = "partially_completed"
+	BatchStatusFailed             = "failed"
+
+	BatchItemStatusSucceeded   = "succeeded"
+	BatchItemStatusFailed      = "failed"
+	BatchItemStatusNotExecuted = "not_executed"
+)
+
+// maxBatchItems limits the transfers of a batch, which run in a single
+// database transaction.
+const maxBatchItems = 1000
+
+// TransferBatch is a list of transfers from one account, executed in a
+// single request. Total is the sum of all items.
+type TransferBatch struct {
+	ID              int                  `json:"id"`
+	FromAccountIban string               `json:"fromAccountIban"`
+	Mode            string               `json:"mode"`
+	Status          string               `json:"status"`
+	Total           Money                `json:"total"`
+	Succeeded       int                  `json:"succeeded"`
+	Failed          int                  `json:"failed"`
+	RequestedBy     int                  `json:"requestedBy"`
+	CreatedAt       time.Time            `json:"createdAt"`
+	Items           []*TransferBatchItem `json:"items"`
+}
+
+// TransferBatchItem is one transfer of a batch. Index is its position in
+// the request.
+type TransferBatchItem struct {
+	Index         int             `json:"index"`
+	ToAccountIban string          `json:"toAccountIban"`
+	Amount        Money           `json:"amount"`
+	Status        string          `json:"status"`
+	TransactionID int             `json:"transactionId,omitempty"`
+	Error         *BatchItemError `json:"error,omitempty"`
+}
+
+// BatchItemError tells why an item failed, with the code and message the
+// transfer would have been rejected with.
+type BatchItemError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// newTransferBatch validates the request, whose IBANs were parsed before.
+func newTransferBatch(req *TransferBatchRequest, requestedBy int) (*TransferBatch, error) {
+	mode := req.Mode
+	if mode == "" {
+		mode = BatchModeAtomic
+	}
+	if mode != BatchModeAtomic && mode != BatchModeBestEffort {
+		return nil, ValidationError("invalid_mode", "Invalid mode: %q", req.Mode).WithDetail("field", "mode")
+	}
+	if len(req.Items) == 0 || len(req.Items) > maxBatchItems {
+		return nil, ValidationError("invalid_batch", "A batch needs 1 to %d items", maxBatchItems).WithDetail("field", "items")
+	}
+
+	batch := &TransferBatch{
+		FromAccountIban: req.FromAccountIban,
+		Mode:            mode,
+		Total:           NewMoney(0, req.Items[0].Amount.Currency),
+		RequestedBy:     requestedBy,
+		CreatedAt:       time.Now().UTC(),
+	}
+	for i, item := range req.Items {
+		field := fmt.Sprintf("items[%d].amount", i)
+		if !item.Amount.IsPositive() {
+			return nil, errAmountNotPositive().WithDetail("field", field)
+		}
+		if !item.Amount.SameCurrency(batch.Total) {
+			return nil, errCurrencyMismatch().WithDetail("field", field)
+		}
+		if batch.Total.Amount+item.Amount.Amount < batch.Total.Amount {
+			return nil, ValidationError("invalid_amount", "Amount out of range").WithDetail("field", field)
+		}
+		batch.Total = batch.Total.Add(item.Amount)
+		batch.Items = append(batch.Items, &TransferBatchItem{Index: i, ToAccountIban: item.ToAccountIban, Amount: item.Amount})
+	}
+	return batch, nil
+}
+
+// record stores the outcome of executing an item. Internal errors are not
+// shown, like in the responses of failed requests.
+func (b *TransferBatch) record(item *TransferBatchItem, transaction *Transaction, err error) {
+	if err == nil {
+		item.Status = BatchItemStatusSucceeded
+		item.TransactionID = transaction.ID
+		b.Succeeded++
+		return
+	}
+	item.Status = BatchItemStatusFailed
+	item.Error = &BatchItemError{Code: "internal_error", Message: "Internal error"}
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.Kind != KindInternal {
+		item.Error = &BatchItemError{Code: apiErr.Code, Message: apiErr.Message}
+	}
+	b.Failed++
+}
+
+// executes reports whether the item should be executed: atomic batches stop
+// at the first failure.
+func (b *TransferBatch) executes() bool {
+	return b.Mode == BatchModeBestEffort || b.Failed == 0
+}
+
+// finish sets the status once every item ran. An atomic batch with a
+// failure was rolled back, so none of its other items moved money.
+func (b *TransferBatch) finish() {
+	if b.Mode == BatchModeAtomic && b.Failed > 0 {
+		for _, item := range b.Items {
+			if item.Status != BatchItemStatusFailed {
+				item.Status = BatchItemStatusNotExecuted
+				item.TransactionID = 0
+			}
+		}
+		b.Succeeded = 0
+	}
+	for _, item := range b.Items {
+		if item.Status == "" {
+			item.Status = BatchItemStatusNotExecuted
+		}
+	}
+	switch {
+	case b.Failed == 0:
+		b.Status = BatchStatusCompleted
+	case b.Succeeded == 0:
+		b.Status = BatchStatusFailed
+	default:
+		b.Status = BatchStatusPartiallyCompleted
+	}
+}
+
+func errTransferBatchNotFound(id int) *Error {
+	return NotFoundError("transfer_batch_not_found", "Transfer batch %d not found", id)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTransferBatch(t *testing.T) {
+	req := &TransferBatchRequest{FromAccountIban: "DE89370400440532013000", Items: []TransferBatchItemRequest{
+		{ToAccountIban: "DE89370400440532013001", Amount: NewMoney(100, DefaultCurrency)},
+		{ToAccountIban: "DE89370400440532013002", Amount: NewMoney(250, DefaultCurrency)},
+	}}
+	batch, err := newTransferBatch(req, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, BatchModeAtomic, batch.Mode)
+	assert.Equal(t, NewMoney(350, DefaultCurrency), batch.Total)
+	assert.Equal(t, 1, batch.Items[1].Index)
+
+	req.Items[1].Amount = NewMoney(250, "USD")
+	_, err = newTransferBatch(req, 1)
+	assert.True(t, IsKind(err, KindValidation))
+	req.Items[1].Amount = NewMoney(0, DefaultCurrency)
+	_, err = newTransferBatch(req, 1)
+	assert.True(t, IsKind(err, KindValidation))
+	req.Mode = "all"
+	_, err = newTransferBatch(req, 1)
+	assert.True(t, IsKind(err, KindValidation))
+}
+
+func TestTransferBatchFinish(t *testing.T) {
+	newBatch := func(mode string) *TransferBatch {
+		return &TransferBatch{Mode: mode, Items: []*TransferBatchItem{{Index: 0}, {Index: 1}, {Index: 2}}}
+	}
+
+	batch := newBatch(BatchModeBestEffort)
+	batch.record(batch.Items[0], &Transaction{ID: 7}, nil)
+	batch.record(batch.Items[1], nil, errInsufficientFunds())
+	assert.True(t, batch.executes())
+	batch.record(batch.Items[2], &Transaction{ID: 8}, nil)
+	batch.finish()
+	assert.Equal(t, BatchStatusPartiallyCompleted, batch.Status)
+	assert.Equal(t, 7, batch.Items[0].TransactionID)
+
+	batch = newBatch(BatchModeAtomic)
+	batch.record(batch.Items[0], &Transaction{ID: 7}, nil)
+	batch.record(batch.Items[1], nil, assert.AnError)
+	assert.False(t, batch.executes())
+	batch.finish()
+	assert.Equal(t, BatchStatusFailed, batch.Status)
+	assert.Equal(t, 0, batch.Succeeded)
+	assert.Equal(t, BatchItemStatusNotExecuted, batch.Items[0].Status)
+	assert.Zero(t, batch.Items[0].TransactionID)
+	assert.Equal(t, "internal_error", batch.Items[1].Error.Code)
+	assert.Equal(t, BatchItemStatusNotExecuted, batch.Items[2].Status)
+}
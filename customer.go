@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// customerSubjectPrefix sets the subjects of customers apart from those of
+// staff users. It is followed by the customer id, which unlike the username
+// or email never changes.
+const customerSubjectPrefix = "customer:"
+
+// Customer is a client of the bank. A customer owns the credentials and
+// profile and any number of accounts.
+type Customer struct {
+	ID                int
+	Username          string
+	Email             string
+	FirstName         string
+	LastName          string
+	EncryptedPassword string `json:"-"`
+	CreatedAt         time.Time
+}
+
+const minCustomerPasswordLength = 8
+
+func NewCustomer(username, email, password, firstName, lastName string) (*Customer, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, ValidationError("invalid_username", "Username must be 3 to 64 letters, digits, dots, dashes or underscores").WithDetail("field", "username")
+	}
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if len(password) < minCustomerPasswordLength {
+		return nil, ValidationError("invalid_password", "Password must be at least %d characters", minCustomerPasswordLength).WithDetail("field", "password")
+	}
+
+	encryptedPassword, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return &Customer{
+		Username:          username,
+		Email:             email,
+		FirstName:         firstName,
+		LastName:          lastName,
+		EncryptedPassword: encryptedPassword,
+		CreatedAt:         time.Now().UTC(),
+	}, nil
+}
+
+// normalizeEmail accepts a bare address like jane@example.com and lowercases
+// it, so that logins by email ignore case.
+func normalizeEmail(email string) (string, error) {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return "", ValidationError("invalid_email", "Invalid email address: %s", email).WithDetail("field", "email")
+	}
+	return strings.ToLower(email), nil
+}
+
+func customerSubject(id int) string {
+	return customerSubjectPrefix + strconv.Itoa(id)
+}
+
+// customerID returns the id of the customer the subject belongs to, and
+// false for the subjects of staff users.
+func customerID(subject string) (int, bool) {
+	idStr, ok := strings.CutPrefix(subject, customerSubjectPrefix)
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.Atoi(idStr)
+	return id, err == nil
+}
+
+func customerPrincipal(customer *Customer) Principal {
+	return Principal{Subject: customerSubject(customer.ID), Role: RoleCustomer}
+}
+
+func errCustomerNotFound(id int) *Error {
+	return NotFoundError("customer_not_found", "Customer with id %d not found", id)
+}
+
+func errEmailTaken(email string) *Error {
+	return ConflictError("email_taken", "Email %s is already registered", email).WithDetail("field", "email")
+}
+
+func errInvalidCredentials() *Error {
+	return UnauthorizedError("invalid_credentials", "Access Denied")
+}
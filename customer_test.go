@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCustomer(t *testing.T) {
+	customer, err := NewCustomer("jane.doe", "Jane.Doe@Example.com", "correct horse", "Jane", "Doe")
+	assert.NoError(t, err)
+	assert.Equal(t, "jane.doe@example.com", customer.Email)
+	assert.True(t, checkPasswordHash("correct horse", customer.EncryptedPassword))
+
+	_, err = NewCustomer("jane@doe", "jane.doe@example.com", "correct horse", "Jane", "Doe")
+	assert.True(t, IsKind(err, KindValidation))
+	_, err = NewCustomer("jane.doe", "jane.doe", "correct horse", "Jane", "Doe")
+	assert.True(t, IsKind(err, KindValidation))
+	_, err = NewCustomer("jane.doe", "jane.doe@example.com", "short", "Jane", "Doe")
+	assert.True(t, IsKind(err, KindValidation))
+}
+
+func TestCustomerSubject(t *testing.T) {
+	customer := &Customer{ID: 42}
+	assert.Equal(t, "customer:42", customerPrincipal(customer).Subject)
+
+	id, ok := customerID("customer:42")
+	assert.True(t, ok)
+	assert.Equal(t, 42, id)
+	_, ok = customerID("staff:admin")
+	assert.False(t, ok)
+}
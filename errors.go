@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorKind classifies errors by how the client should react to them and
+// decides the HTTP status they are answered with.
+type ErrorKind string
+
+const (
+	KindValidation        ErrorKind = "validation"
+	KindNotFound          ErrorKind = "not_found"
+	KindInsufficientFunds ErrorKind = "insufficient_funds"
+	KindUnauthorized      ErrorKind = "unauthorized"
+	KindForbidden         ErrorKind = "forbidden"
+	KindConflict          ErrorKind = "conflict"
+	KindTooManyRequests   ErrorKind = "too_many_requests"
+	KindInternal          ErrorKind = "internal"
+)
+
+func (k ErrorKind) HTTPStatus() int {
+	switch k {
+	case KindValidation:
+		return http.StatusBadRequest
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindInsufficientFunds:
+		return http.StatusUnprocessableEntity
+	case KindUnauthorized:
+		return http.StatusUnauthorized
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindConflict:
+		return http.StatusConflict
+	case KindTooManyRequests:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Error is the typed error returned by storages and handlers. Code is a
+// stable, machine-readable identifier such as "account_not_found"; Message
+// is meant for humans and may change. Errors that are not an *Error are
+// treated as internal errors.
+type Error struct {
+	Kind    ErrorKind
+	Code    string
+	Message string
+	Details map[string]any
+	Err     error
+}
+
+func NewError(kind ErrorKind, code string, format string, args ...any) *Error {
+	return &Error{Kind: kind, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// WithDetail attaches extra machine-readable information, e.g. the
+// offending field of a validation error.
+func (e *Error) WithDetail(key string, value any) *Error {
+	if e.Details == nil {
+		e.Details = map[string]any{}
+	}
+	e.Details[key] = value
+	return e
+}
+
+func ValidationError(code, format string, args ...any) *Error {
+	return NewError(KindValidation, code, format, args...)
+}
+
+func NotFoundError(code, format string, args ...any) *Error {
+	return NewError(KindNotFound, code, format, args...)
+}
+
+func InsufficientFundsError(code, format string, args ...any) *Error {
+	return NewError(KindInsufficientFunds, code, format, args...)
+}
+
+func UnauthorizedError(code, format string, args ...any) *Error {
+	return NewError(KindUnauthorized, code, format, args...)
+}
+
+func ForbiddenError(code, format string, args ...any) *Error {
+	return NewError(KindForbidden, code, format, args...)
+}
+
+func ConflictError(code, format string, args ...any) *Error {
+	return NewError(KindConflict, code, format, args...)
+}
+
+func TooManyRequestsError(code, format string, args ...any) *Error {
+	return NewError(KindTooManyRequests, code, format, args...)
+}
+
+// InternalError wraps an unexpected failure. Its cause is logged but never
+// sent to the client.
+func InternalError(err error) *Error {
+	return &Error{Kind: KindInternal, Code: "internal_error", Message: "Internal server error", Err: err}
+}
+
+// IsKind reports whether err is or wraps an *Error of the given kind.
+func IsKind(err error, kind ErrorKind) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Kind == kind
+}
+
+// Errors shared by all storage implementations.
+
+func errAccountNotFound(id int) *Error {
+	return NotFoundError("account_not_found", "Account with id %d not found", id).WithDetail("id", id)
+}
+
+func errAccountIbanNotFound(iban string) *Error {
+	return NotFoundError("account_not_found", "Account with IBAN number %s not found", iban).WithDetail("iban", iban)
+}
+
+func errInsufficientFunds() *Error {
+	return InsufficientFundsError("insufficient_funds", "Balance not sufficient")
+}
+
+func errAmountNotPositive() *Error {
+	return ValidationError("invalid_amount", "Amount must be positive")
+}
+
+func errCurrencyMismatch() *Error {
+	return ValidationError("currency_mismatch", "Currency mismatch")
+}
+
+func errIdempotencyKeyReused() *Error {
+	return ConflictError("idempotency_key_reused", "Idempotency-Key has already been used with a different request")
+}
+
+func errLedgerMismatch(iban string) *Error {
+	return InternalError(fmt.Errorf("Balance of account %s does not match its ledger", iban))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteErrorTypedError(t *testing.T) {
+	respRec := httptest.NewRecorder()
+	writeError(respRec, fmt.Errorf("transfer failed: %w", errAccountIbanNotFound("DE00")))
+
+	assert.Equal(t, http.StatusNotFound, respRec.Code)
+	assert.Equal(t, "application/problem+json", respRec.Header().Get("Content-Type"))
+
+	var resp APIError
+	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "about:blank", resp.Type)
+	assert.Equal(t, "Not Found", resp.Title)
+	assert.Equal(t, http.StatusNotFound, resp.Status)
+	assert.Equal(t, "account_not_found", resp.Code)
+	assert.Equal(t, "Account with IBAN number DE00 not found", resp.Detail)
+}
+
+func TestWriteErrorHidesInternalErrors(t *testing.T) {
+	respRec := httptest.NewRecorder()
+	writeError(respRec, fmt.Errorf("pq: connection refused"))
+
+	assert.Equal(t, http.StatusInternalServerError, respRec.Code)
+	assert.NotContains(t, respRec.Body.String(), "connection refused")
+
+	var resp APIError
+	err := json.Unmarshal(respRec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "internal_error", resp.Code)
+	assert.Equal(t, "Internal server error", resp.Detail)
+}
+
+func TestWriteErrorUnauthorizedChallenge(t *testing.T) {
+	respRec := httptest.NewRecorder()
+	writeError(respRec, UnauthorizedError("missing_token", "Authorization header is required"))
+
+	assert.Equal(t, http.StatusUnauthorized, respRec.Code)
+	assert.Equal(t, `Bearer realm="gobank"`, respRec.Header().Get("WWW-Authenticate"))
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateDecimals is the number of decimal places exchange rates and spreads
+// are kept with.
+const rateDecimals = 8
+
+var rateUnit = big.NewInt(100_000_000)
+
+// Rate is an exchange rate or a spread. Like Money it is stored as an
+// integer, here of 10^-8 units, so that conversions never go through a
+// float.
+type Rate int64
+
+// ParseRate parses a non-negative decimal such as "1.0834". Rates with more
+// than eight decimal places are rejected instead of being rounded.
+func ParseRate(rate string) (Rate, error) {
+	whole, fraction, hasFraction := strings.Cut(rate, ".")
+	if whole == "" || !isDigits(whole) || (hasFraction && (fraction == "" || !isDigits(fraction))) {
+		return 0, errInvalidRate(rate)
+	}
+	if len(fraction) > rateDecimals {
+		return 0, ValidationError("invalid_rate", "Rate %q has more than %d decimal places", rate, rateDecimals)
+	}
+	fraction += strings.Repeat("0", rateDecimals-len(fraction))
+
+	units, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return 0, errInvalidRate(rate)
+	}
+	return Rate(units), nil
+}
+
+func errInvalidRate(rate string) *Error {
+	return ValidationError("invalid_rate", "Invalid rate: %q", rate)
+}
+
+// String formats the rate without trailing zeros, e.g. "1.0834" or "0".
+func (r Rate) String() string {
+	digits := strconv.FormatInt(int64(r), 10)
+	if len(digits) <= rateDecimals {
+		digits = strings.Repeat("0", rateDecimals-len(digits)+1) + digits
+	}
+	whole, fraction := digits[:len(digits)-rateDecimals], strings.TrimRight(digits[len(digits)-rateDecimals:], "0")
+	if fraction == "" {
+		return whole
+	}
+	return whole + "." + fraction
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON accepts the rate as a decimal string or as a JSON number.
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	rate := string(data)
+	if strings.HasPrefix(rate, `"`) {
+		if err := json.Unmarshal(data, &rate); err != nil {
+			return err
+		}
+	}
+	parsed, err := ParseRate(rate)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// ExchangeRate converts amounts of From into To. Rate is the mid-market rate
+// an admin or the rates file sets; customers get Rate less Spread, the
+// fraction of it the bank keeps.
+type ExchangeRate struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Rate      Rate      `json:"rate"`
+	Spread    Rate      `json:"spread"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (r *ExchangeRate) Validate() error {
+	for _, currency := range []string{r.From, r.To} {
+		if _, ok := currencyExponents[currency]; !ok {
+			return ValidationError("unsupported_currency", "Unsupported currency: %q", currency)
+		}
+	}
+	if r.From == r.To {
+		return ValidationError("invalid_rate", "Exchange rate from %s to itself", r.From)
+	}
+	if r.Rate <= 0 {
+		return ValidationError("invalid_rate", "Exchange rate from %s to %s must be positive", r.From, r.To)
+	}
+	if r.Spread < 0 || int64(r.Spread) >= rateUnit.Int64() {
+		return ValidationError("invalid_spread", "Spread of %s to %s must be at least 0 and less than 1", r.From, r.To)
+	}
+	return nil
+}
+
+// Applied is the rate customers get: the mid-market rate less the spread,
+// rounded down.
+func (r *ExchangeRate) Applied() Rate {
+	applied := new(big.Int).Mul(big.NewInt(int64(r.Rate)), new(big.Int).Sub(rateUnit, big.NewInt(int64(r.Spread))))
+	return Rate(applied.Quo(applied, rateUnit).Int64())
+}
+
+// Inverse converts the other way round with the same spread, so that a
+// single rate per currency pair is enough.
+func (r *ExchangeRate) Inverse() *ExchangeRate {
+	inverse := new(big.Int).Mul(rateUnit, rateUnit)
+	inverse.Quo(inverse, big.NewInt(int64(r.Rate)))
+	return &ExchangeRate{From: r.To, To: r.From, Rate: Rate(inverse.Int64()), Spread: r.Spread, UpdatedAt: r.UpdatedAt}
+}
+
+// Convert changes amount into To at the applied rate. The result is rounded
+// down to the minor unit of To.
+func (r *ExchangeRate) Convert(amount Money) (Money, error) {
+	if amount.Currency != r.From {
+		return Money{}, errCurrencyMismatch()
+	}
+	return convertAt(amount, r.Applied(), r.To)
+}
+
+func convertAt(amount Money, rate Rate, currency string) (Money, error) {
+	converted := new(big.Int).Mul(big.NewInt(amount.Amount), big.NewInt(int64(rate)))
+	converted.Mul(converted, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyExponents[currency])), nil))
+	divisor := new(big.Int).Mul(rateUnit, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyExponents[amount.Currency])), nil))
+	converted.Quo(converted, divisor)
+	if !converted.IsInt64() {
+		return Money{}, ValidationError("invalid_amount", "Amount out of range")
+	}
+	if converted.Sign() <= 0 {
+		return Money{}, ValidationError("amount_too_small", "%s %s is too small to be converted into %s", amount, amount.Currency, currency)
+	}
+	return NewMoney(converted.Int64(), currency), nil
+}
+
+// exceedsAt reports whether amount, converted at rate, is more than limit,
+// which is in the currency the rate converts into. Nothing is rounded.
+func exceedsAt(amount Money, rate Rate, limit Money) bool {
+	converted := new(big.Int).Mul(big.NewInt(amount.Amount), big.NewInt(int64(rate)))
+	converted.Mul(converted, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyExponents[limit.Currency])), nil))
+	scaled := new(big.Int).Mul(big.NewInt(limit.Amount), rateUnit)
+	scaled.Mul(scaled, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyExponents[amount.Currency])), nil))
+	return converted.Cmp(scaled) > 0
+}
+
+// FXConversion is how a transfer between accounts of different currencies
+// was converted: at Rate, after the bank took Spread, into Amount.
+type FXConversion struct {
+	Rate   Rate
+	Spread Rate
+	Amount Money
+}
+
+// loadExchangeRates reads the rates file named by FX_RATES_FILE, a JSON list
+// such as [{"from": "EUR", "to": "USD", "rate": "1.0834", "spread": "0.005"}].
+// It returns nil if the variable is not set.
+func loadExchangeRates() ([]*ExchangeRate, error) {
+	path := os.Getenv("FX_RATES_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rates := []*ExchangeRate{}
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return nil, fmt.Errorf("Invalid rates file %s: %v", path, err)
+	}
+	now := time.Now().UTC()
+	for _, rate := range rates {
+		if err := rate.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid rates file %s: %v", path, err)
+		}
+		rate.UpdatedAt = now
+	}
+	return rates, nil
+}
+
+// FXQuote locks an exchange rate for the customer who asked for it until
+// ExpiresAt. A transfer between the two currencies can use it once.
+type FXQuote struct {
+	ID              string     `json:"id"`
+	Subject         string     `json:"-"`
+	From            string     `json:"from"`
+	To              string     `json:"to"`
+	Rate            Rate       `json:"rate"`
+	Spread          Rate       `json:"spread"`
+	AppliedRate     Rate       `json:"appliedRate"`
+	Amount          *Money     `json:"amount,omitempty"`
+	ConvertedAmount *Money     `json:"convertedAmount,omitempty"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	ExpiresAt       time.Time  `json:"expiresAt"`
+	UsedAt          *time.Time `json:"usedAt,omitempty"`
+}
+
+// newFXQuote quotes rate to subject for ttl. If amount is given the quote
+// also tells what it converts into.
+func newFXQuote(subject string, rate *ExchangeRate, amount *Money, ttl time.Duration) (*FXQuote, error) {
+	id, err := newRandomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	quote := &FXQuote{
+		ID:          id,
+		Subject:     subject,
+		From:        rate.From,
+		To:          rate.To,
+		Rate:        rate.Rate,
+		Spread:      rate.Spread,
+		AppliedRate: rate.Applied(),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	if amount != nil {
+		converted, err := rate.Convert(*amount)
+		if err != nil {
+			return nil, err
+		}
+		quote.Amount, quote.ConvertedAmount = amount, &converted
+	}
+	return quote, nil
+}
+
+func (q *FXQuote) exchangeRate() *ExchangeRate {
+	return &ExchangeRate{From: q.From, To: q.To, Rate: q.Rate, Spread: q.Spread, UpdatedAt: q.CreatedAt}
+}
+
+// use marks the quote as used for a transfer from one currency into another.
+// Quotes are rejected here if they were used before, expired or were made
+// for other currencies.
+func (q *FXQuote) use(from, to string, now time.Time) error {
+	if q.UsedAt != nil {
+		return ConflictError("fx_quote_used", "Quote %s was already used", q.ID)
+	}
+	if !now.Before(q.ExpiresAt) {
+		return ConflictError("fx_quote_expired", "Quote %s expired at %s", q.ID, q.ExpiresAt.Format(time.RFC3339))
+	}
+	if q.From != from || q.To != to {
+		return ConflictError("fx_quote_mismatch", "Quote %s converts %s into %s, not %s into %s", q.ID, q.From, q.To, from, to)
+	}
+	q.UsedAt = &now
+	return nil
+}
+
+// fxQuoteTTL reads FX_QUOTE_TTL, how long quotes lock a rate. It defaults
+// to 30 seconds.
+func fxQuoteTTL() (time.Duration, error) {
+	value := os.Getenv("FX_QUOTE_TTL")
+	if value == "" {
+		return 30 * time.Second, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("Invalid FX_QUOTE_TTL: %s", value)
+	}
+	return ttl, nil
+}
+
+func exchangeRateEvent(rate *ExchangeRate, actor string) *AuditEvent {
+	return &AuditEvent{
+		Kind:      AuditExchangeRateSet,
+		Actor:     actor,
+		Subject:   rate.From + "/" + rate.To,
+		Message:   fmt.Sprintf("Rate %s with spread %s", rate.Rate, rate.Spread),
+		CreatedAt: rate.UpdatedAt,
+	}
+}
+
+func errExchangeRateUnavailable(from, to string) *Error {
+	return ConflictError("exchange_rate_unavailable", "No exchange rate from %s to %s", from, to)
+}
+
+func errFXQuoteNotFound(id string) *Error {
+	return NotFoundError("fx_quote_not_found", "Quote %s not found", id)
+}
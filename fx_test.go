@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRate(t *testing.T) {
+	rate, err := ParseRate("1.0834")
+	assert.NoError(t, err)
+	assert.Equal(t, Rate(108_340_000), rate)
+	assert.Equal(t, "1.0834", rate.String())
+	assert.Equal(t, "0.00000001", Rate(1).String())
+	assert.Equal(t, "2", Rate(200_000_000).String())
+
+	for _, invalid := range []string{"", "-1", "1.", "1.123456789", "1e3"} {
+		_, err := ParseRate(invalid)
+		assert.True(t, IsKind(err, KindValidation), invalid)
+	}
+
+	var parsed struct{ Rate Rate }
+	assert.NoError(t, json.Unmarshal([]byte(`{"rate": 0.5}`), &parsed))
+	assert.Equal(t, Rate(50_000_000), parsed.Rate)
+}
+
+func TestExchangeRateConvert(t *testing.T) {
+	rate := &ExchangeRate{From: "EUR", To: "USD", Rate: 110_000_000, Spread: 1_000_000}
+	assert.NoError(t, rate.Validate())
+	assert.Equal(t, "1.089", rate.Applied().String())
+
+	converted, err := rate.Convert(NewMoney(10000, "EUR"))
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(10890, "USD"), converted)
+
+	// the result is rounded down to the minor unit
+	converted, err = rate.Convert(NewMoney(1, "EUR"))
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(1, "USD"), converted)
+
+	// currencies with other exponents
+	yen := &ExchangeRate{From: "EUR", To: "JPY", Rate: 16_000_000_000}
+	converted, err = yen.Convert(NewMoney(1050, "EUR"))
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(1680, "JPY"), converted)
+	_, err = yen.Inverse().Convert(NewMoney(1, "JPY"))
+	assert.True(t, IsKind(err, KindValidation))
+	converted, err = yen.Inverse().Convert(NewMoney(1600, "JPY"))
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(1000, "EUR"), converted)
+
+	_, err = rate.Convert(NewMoney(100, "USD"))
+	assert.True(t, IsKind(err, KindValidation))
+
+	assert.True(t, IsKind((&ExchangeRate{From: "EUR", To: "EUR", Rate: 1}).Validate(), KindValidation))
+	assert.True(t, IsKind((&ExchangeRate{From: "EUR", To: "USD", Rate: 1, Spread: 100_000_000}).Validate(), KindValidation))
+}
+
+func TestExceedsAt(t *testing.T) {
+	limit := NewMoney(10000, "EUR")
+	rate := (&ExchangeRate{From: "EUR", To: "USD", Rate: 110_000_000}).Inverse().Rate
+
+	// nothing is rounded, so a cent more tips the balance
+	assert.False(t, exceedsAt(NewMoney(11000, "USD"), rate, limit))
+	assert.True(t, exceedsAt(NewMoney(11001, "USD"), rate, limit))
+	assert.False(t, exceedsAt(NewMoney(1, "USD"), rate, limit))
+	assert.False(t, exceedsAt(NewMoney(16000, "JPY"), 625_000, limit))
+	assert.True(t, exceedsAt(NewMoney(16001, "JPY"), 625_000, limit))
+}
+
+func TestFXQuoteUse(t *testing.T) {
+	rate := &ExchangeRate{From: "EUR", To: "USD", Rate: 110_000_000, Spread: 1_000_000}
+	amount := NewMoney(10000, "EUR")
+	quote, err := newFXQuote("customer:1", rate, &amount, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(10890, "USD"), *quote.ConvertedAmount)
+
+	err = quote.use("USD", "EUR", time.Now())
+	assert.True(t, IsKind(err, KindConflict))
+	assert.True(t, IsKind(quote.use("EUR", "USD", quote.ExpiresAt), KindConflict))
+	assert.NoError(t, quote.use("EUR", "USD", time.Now()))
+	// a quote is used only once
+	assert.True(t, IsKind(quote.use("EUR", "USD", time.Now()), KindConflict))
+}
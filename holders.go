@@ -0,0 +1,156 @@
+package main
+
+import "time"
+
+// Permissions of account holders. Each one includes the ones before it: a
+// holder who may transfer may also view, a holder who manages the account
+// may also transfer.
+const (
+	HolderPermissionView     = "view"
+	HolderPermissionTransfer = "transfer"
+	HolderPermissionManage   = "manage"
+)
+
+var holderPermissionLevels = map[string]int{
+	HolderPermissionView:     1,
+	HolderPermissionTransfer: 2,
+	HolderPermissionManage:   3,
+}
+
+// Invited holders have no access to the account until they accept.
+const (
+	HolderStatusInvited = "invited"
+	HolderStatusActive  = "active"
+)
+
+// AccountHolder gives a customer access to an account. The customer who
+// opens an account becomes its first holder with the manage permission;
+// further holders are invited by a holder who manages it.
+type AccountHolder struct {
+	AccountID  int        `json:"accountId"`
+	CustomerID int        `json:"customerId"`
+	Username   string     `json:"username"`
+	Permission string     `json:"permission"`
+	Status     string     `json:"status"`
+	InvitedBy  int        `json:"invitedBy,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	AcceptedAt *time.Time `json:"acceptedAt,omitempty"`
+}
+
+func NewAccountHolder(accountID, customerID int, permission string, invitedBy int) (*AccountHolder, error) {
+	if _, ok := holderPermissionLevels[permission]; !ok {
+		return nil, ValidationError("invalid_permission", "Permission must be %s, %s or %s", HolderPermissionView, HolderPermissionTransfer, HolderPermissionManage).WithDetail("field", "permission")
+	}
+	return &AccountHolder{
+		AccountID:  accountID,
+		CustomerID: customerID,
+		Permission: permission,
+		Status:     HolderStatusInvited,
+		InvitedBy:  invitedBy,
+		CreatedAt:  time.Now().UTC(),
+	}, nil
+}
+
+// openingHolder is the holder an account is opened with.
+func openingHolder(account *Account) *AccountHolder {
+	return &AccountHolder{
+		AccountID:  account.ID,
+		CustomerID: account.CustomerID,
+		Permission: HolderPermissionManage,
+		Status:     HolderStatusActive,
+		CreatedAt:  account.CreatedAt,
+		AcceptedAt: &account.CreatedAt,
+	}
+}
+
+// Permits reports whether the holder has access to the account with at
+// least the given permission.
+func (h *AccountHolder) Permits(permission string) bool {
+	return h.Status == HolderStatusActive && holderPermissionLevels[h.Permission] >= holderPermissionLevels[permission]
+}
+
+// Statuses of transfer approvals.
+const (
+	ApprovalStatusPending  = "pending"
+	ApprovalStatusApproved = "approved"
+	ApprovalStatusRejected = "rejected"
+)
+
+// TransferApproval holds back a transfer above the approval limit of a joint
+// account until a holder other than the one who requested it approves it.
+// The money only moves once it is approved.
+type TransferApproval struct {
+	ID              int        `json:"id"`
+	FromAccountIban string     `json:"fromAccountIban"`
+	ToAccountIban   string     `json:"toAccountIban"`
+	Amount          Money      `json:"amount"`
+	Status          string     `json:"status"`
+	RequestedBy     int        `json:"requestedBy"`
+	DecidedBy       int        `json:"decidedBy,omitempty"`
+	TransactionID   int        `json:"transactionId,omitempty"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	DecidedAt       *time.Time `json:"decidedAt,omitempty"`
+}
+
+func newTransferApproval(fromIban, toIban string, amount Money, requestedBy int) *TransferApproval {
+	return &TransferApproval{
+		FromAccountIban: fromIban,
+		ToAccountIban:   toIban,
+		Amount:          amount,
+		Status:          ApprovalStatusPending,
+		RequestedBy:     requestedBy,
+		CreatedAt:       time.Now().UTC(),
+	}
+}
+
+// decide records the decision of a holder. Approvals are rejected here if
+// they were decided before or if the holder asks to approve their own
+// transfer; rejecting it withdraws the request.
+func (a *TransferApproval) decide(approve bool, decidedBy int, now time.Time) error {
+	if a.Status != ApprovalStatusPending {
+		return ConflictError("approval_decided", "Transfer approval %d was already %s", a.ID, a.Status)
+	}
+	if approve && decidedBy == a.RequestedBy {
+		return ForbiddenError("approval_requires_other_holder", "Transfers have to be approved by another holder of the account")
+	}
+	a.Status = ApprovalStatusRejected
+	if approve {
+		a.Status = ApprovalStatusApproved
+	}
+	a.DecidedBy = decidedBy
+	a.DecidedAt = &now
+	return nil
+}
+
+// needsApproval reports whether a transfer from the account has to wait for
+// a second holder: the amount is above the approval limit and another
+// active holder may transfer, and so approve it.
+func needsApproval(store Storage, account *Account, amount Money) (bool, error) {
+	limit := account.ApprovalLimit
+	if limit == nil || !amount.SameCurrency(*limit) || amount.Cmp(*limit) <= 0 {
+		return false, nil
+	}
+	holders, err := store.GetAccountHolders(account.ID)
+	if err != nil {
+		return false, err
+	}
+	approvers := 0
+	for _, holder := range holders {
+		if holder.Permits(HolderPermissionTransfer) {
+			approvers++
+		}
+	}
+	return approvers > 1, nil
+}
+
+func errAccountHolderNotFound(accountID, customerID int) *Error {
+	return NotFoundError("account_holder_not_found", "Customer %d is not a holder of account %d", customerID, accountID)
+}
+
+func errTransferApprovalNotFound(id int) *Error {
+	return NotFoundError("transfer_approval_not_found", "Transfer approval %d not found", id)
+}
+
+func errLastAccountManager() *Error {
+	return ConflictError("last_account_manager", "An account needs at least one active holder who manages it")
+}
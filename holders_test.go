@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountHolderPermits(t *testing.T) {
+	holder, err := NewAccountHolder(1, 2, HolderPermissionTransfer, 1)
+	assert.NoError(t, err)
+	// invited holders have no access yet
+	assert.False(t, holder.Permits(HolderPermissionView))
+
+	holder.Status = HolderStatusActive
+	assert.True(t, holder.Permits(HolderPermissionView))
+	assert.True(t, holder.Permits(HolderPermissionTransfer))
+	assert.False(t, holder.Permits(HolderPermissionManage))
+
+	_, err = NewAccountHolder(1, 2, "owner", 1)
+	assert.True(t, IsKind(err, KindValidation))
+}
+
+func TestTransferApprovalDecide(t *testing.T) {
+	approval := newTransferApproval("DE89370400440532013000", "DE02120300000000202051", NewMoney(100, DefaultCurrency), 1)
+
+	err := approval.decide(true, 1, time.Now())
+	assert.True(t, IsKind(err, KindForbidden))
+
+	assert.NoError(t, approval.decide(true, 2, time.Now()))
+	assert.Equal(t, ApprovalStatusApproved, approval.Status)
+	assert.Equal(t, 2, approval.DecidedBy)
+
+	err = approval.decide(false, 1, time.Now())
+	assert.True(t, IsKind(err, KindConflict))
+
+	// the requester can withdraw their own transfer
+	approval = newTransferApproval("DE89370400440532013000", "DE02120300000000202051", NewMoney(100, DefaultCurrency), 1)
+	assert.NoError(t, approval.decide(false, 1, time.Now()))
+	assert.Equal(t, ApprovalStatusRejected, approval.Status)
+}
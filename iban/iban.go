@@ -0,0 +1,119 @@
+// Package iban generates and validates International Bank Account Numbers
+// as defined by ISO 13616.
+package iban
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnsupportedCountry = errors.New("unsupported country")
+	ErrInvalidLength      = errors.New("invalid length")
+	ErrInvalidCharacters  = errors.New("invalid characters")
+	ErrInvalidChecksum    = errors.New("invalid checksum")
+)
+
+// lengths holds the IBAN length of the supported countries.
+var lengths = map[string]int{
+	"AT": 20, "BE": 16, "BG": 22, "CH": 21, "CY": 28, "CZ": 24, "DE": 22,
+	"DK": 18, "EE": 20, "ES": 24, "FI": 18, "FR": 27, "GB": 22, "GR": 27,
+	"HR": 21, "HU": 28, "IE": 22, "IS": 26, "IT": 27, "LI": 21, "LT": 20,
+	"LU": 20, "LV": 21, "MC": 27, "MT": 31, "NL": 18, "NO": 15, "PL": 28,
+	"PT": 25, "RO": 24, "SE": 24, "SI": 19, "SK": 24, "SM": 27,
+}
+
+// Normalize converts an IBAN from its print format, e.g.
+// "de89 3704 0044 0532 0130 00", to the electronic format.
+func Normalize(iban string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(iban), ""))
+}
+
+// Validate checks the country, the length and the check digits of an IBAN
+// in electronic format.
+func Validate(iban string) error {
+	if len(iban) < 4 {
+		return ErrInvalidLength
+	}
+	length, ok := lengths[iban[:2]]
+	if !ok {
+		return ErrUnsupportedCountry
+	}
+	if len(iban) != length {
+		return ErrInvalidLength
+	}
+	if !isDigits(iban[2:4]) || !isAlphanumeric(iban[4:]) {
+		return ErrInvalidCharacters
+	}
+	if mod97(iban[4:]+iban[:4]) != 1 {
+		return ErrInvalidChecksum
+	}
+	return nil
+}
+
+// Generate builds the IBAN of an account at the bank identified by bankCode.
+// The account number is zero-padded to fill the country's BBAN, which suits
+// countries whose BBAN is a bank code followed by the account number.
+func Generate(country, bankCode string, accountNumber int64) (string, error) {
+	length, ok := lengths[country]
+	if !ok {
+		return "", ErrUnsupportedCountry
+	}
+	if !isAlphanumeric(bankCode) {
+		return "", ErrInvalidCharacters
+	}
+	if accountNumber < 0 {
+		return "", fmt.Errorf("account number %d is negative", accountNumber)
+	}
+
+	digits := length - 4 - len(bankCode)
+	number := strconv.FormatInt(accountNumber, 10)
+	if digits < 1 || len(number) > digits {
+		return "", fmt.Errorf("%w: bank code %s and account number %d do not fit into a %s IBAN", ErrInvalidLength, bankCode, accountNumber, country)
+	}
+
+	bban := bankCode + strings.Repeat("0", digits-len(number)) + number
+	return country + CheckDigits(country, bban) + bban, nil
+}
+
+// CheckDigits computes the two check digits of an IBAN from its country
+// code and BBAN.
+func CheckDigits(country, bban string) string {
+	return fmt.Sprintf("%02d", 98-mod97(bban+country+"00"))
+}
+
+// mod97 computes the remainder of the decimal number that results from
+// replacing every letter with two digits (A = 10, ..., Z = 35).
+func mod97(s string) int {
+	remainder := 0
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			remainder = (remainder*10 + int(c-'0')) % 97
+		default:
+			remainder = (remainder*100 + int(c-'A') + 10) % 97
+		}
+	}
+	return remainder
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isAlphanumeric reports whether s only holds digits and upper case letters.
+func isAlphanumeric(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
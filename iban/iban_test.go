@@ -0,0 +1,68 @@
+package iban
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []string{
+		"DE89370400440532013000",
+		"GB29NWBK60161331926819",
+		"NL91ABNA0417164300",
+		"FR1420041010050500013M02606",
+		"NO9386011117947",
+	}
+	for _, iban := range valid {
+		assert.NoError(t, Validate(iban), iban)
+	}
+
+	invalid := map[string]error{
+		"":                         ErrInvalidLength,
+		"DE8937040044053201300":    ErrInvalidLength,
+		"DE88370400440532013000":   ErrInvalidChecksum,
+		"XX89370400440532013000":   ErrUnsupportedCountry,
+		"DE8937040044053201300!":   ErrInvalidCharacters,
+		"de89370400440532013000":   ErrUnsupportedCountry,
+		"DEAB370400440532013000":   ErrInvalidCharacters,
+		"gb29NWBK60161331926819xx": ErrUnsupportedCountry,
+	}
+	for iban, want := range invalid {
+		assert.ErrorIs(t, Validate(iban), want, iban)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	assert.Equal(t, "DE89370400440532013000", Normalize(" de89 3704 0044 0532 0130 00 "))
+}
+
+func TestGenerate(t *testing.T) {
+	iban, err := Generate("DE", "37040044", 532013000)
+	assert.NoError(t, err)
+	assert.Equal(t, "DE89370400440532013000", iban)
+
+	iban, err = Generate("GB", "NWBK601613", 31926819)
+	assert.NoError(t, err)
+	assert.Equal(t, "GB29NWBK60161331926819", iban)
+
+	for number := int64(1); number <= 1000; number++ {
+		iban, err := Generate("NL", "ABNA", number)
+		assert.NoError(t, err)
+		assert.NoError(t, Validate(iban))
+	}
+}
+
+func TestGenerateRejectsInvalidInput(t *testing.T) {
+	_, err := Generate("XX", "37040044", 1)
+	assert.ErrorIs(t, err, ErrUnsupportedCountry)
+
+	_, err = Generate("DE", "3704-0044", 1)
+	assert.ErrorIs(t, err, ErrInvalidCharacters)
+
+	_, err = Generate("DE", "37040044", 12345678901)
+	assert.ErrorIs(t, err, ErrInvalidLength)
+
+	_, err = Generate("DE", "37040044", -1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+// IdempotencyKey ties a client supplied Idempotency-Key header to the
+// request that first used it and the response that was sent back. Stores
+// claim the key in the same database transaction as the operation it
+// protects, so a retried request either replays the stored response or runs
+// the operation exactly once.
+type IdempotencyKey struct {
+	Key         string
+	Scope       string
+	Fingerprint string
+	StatusCode  int
+	Response    []byte
+	CreatedAt   time.Time
+
+	// Render builds the response for the result of the operation (e.g. the
+	// created account) so that it can be stored before the commit.
+	Render func(result any) (statusCode int, response []byte, err error)
+	// Replayed is set by the store when the key had already been used for
+	// the same request; StatusCode and Response then hold the stored answer.
+	Replayed bool
+}
+
+// newIdempotencyKey reads the Idempotency-Key header of the request. It
+// returns nil when the client did not send one. The fingerprint covers the
+// method, path and decoded body, so formatting differences in the JSON do
+// not count as a different request. respond turns the result of the
+// operation into the status code and body sent to the client.
+func newIdempotencyKey(r *http.Request, scope string, body any, respond func(result any) (int, any)) (*IdempotencyKey, error) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		return nil, nil
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, ValidationError("invalid_idempotency_key", "%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+	}
+
+	canonicalBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.Path)
+	hash.Write(canonicalBody)
+
+	return &IdempotencyKey{
+		Key:         key,
+		Scope:       scope,
+		Fingerprint: hex.EncodeToString(hash.Sum(nil)),
+		CreatedAt:   time.Now().UTC(),
+		Render: func(result any) (int, []byte, error) {
+			status, v := respond(result)
+			response, err := json.Marshal(v)
+			return status, append(response, '\n'), err
+		},
+	}, nil
+}
+
+// replayIdempotentResponse answers a retried request with the response
+// stored for its Idempotency-Key, if there is one. Handlers call it before
+// asking for a second factor: the retry may carry the code the first request
+// used up, and the operation will not run again anyway.
+func (s *APIServer) replayIdempotentResponse(w http.ResponseWriter, r *http.Request, scope string, body any) (bool, error) {
+	key, err := newIdempotencyKey(r, scope, body, nil)
+	if err != nil || key == nil {
+		return false, err
+	}
+	if err := s.store.GetIdempotentResponse(key); err != nil || !key.Replayed {
+		return false, err
+	}
+	return true, writeIdempotentResponse(w, key)
+}
+
+// writeIdempotentResponse sends the stored response of a key, which is
+// byte for byte the same for the original request and every replay.
+func writeIdempotentResponse(w http.ResponseWriter, key *IdempotencyKey) error {
+	w.Header().Add("Content-Type", "application/json")
+	if key.Replayed {
+		w.Header().Add(idempotentReplayedHeader, "true")
+	}
+	w.WriteHeader(key.StatusCode)
+	_, err := w.Write(key.Response)
+	return err
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+
+	defaultKeysDir = "keys"
+	rsaKeyBits     = 3072
+)
+
+// SigningKey is one key of the keyring. Its id (kid) starts with the day it
+// becomes active, e.g. 20261101-3f9a1c2e, so that keys can be generated ahead
+// of time and the keyring switches to them on schedule.
+type SigningKey struct {
+	ID          string
+	Algorithm   string
+	ActivatesAt time.Time
+	private     crypto.Signer
+}
+
+// GenerateSigningKey creates a new EdDSA (Ed25519) or RS256 key that is
+// used for signing from the day of activatesAt on.
+func GenerateSigningKey(algorithm string, activatesAt time.Time) (*SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	default:
+		return nil, fmt.Errorf("Unsupported signing algorithm: %s", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	id := activatesAt.UTC().Format("20060102") + "-" + hex.EncodeToString(suffix)
+	return newSigningKey(id, private)
+}
+
+func newSigningKey(id string, private crypto.Signer) (*SigningKey, error) {
+	day, _, ok := strings.Cut(id, "-")
+	activatesAt, err := time.Parse("20060102", day)
+	if !ok || err != nil {
+		return nil, fmt.Errorf("Key id %s does not start with its activation day", id)
+	}
+
+	key := &SigningKey{ID: id, ActivatesAt: activatesAt, private: private}
+	switch private.(type) {
+	case ed25519.PrivateKey:
+		key.Algorithm = AlgorithmEdDSA
+	case *rsa.PrivateKey:
+		key.Algorithm = AlgorithmRS256
+	default:
+		return nil, fmt.Errorf("Key %s has an unsupported type %T", id, private)
+	}
+	return key, nil
+}
+
+func (k *SigningKey) method() jwt.SigningMethod {
+	if k.Algorithm == AlgorithmEdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// verificationKey returns the public key in the form the jwt package
+// expects for the key's algorithm.
+func (k *SigningKey) verificationKey() crypto.PublicKey {
+	return k.private.Public()
+}
+
+// Save writes the private key as a PKCS #8 PEM file named after its id.
+func (k *SigningKey) Save(dir string) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.private)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, k.ID+".pem")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return path, pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// Keyring holds every key tokens may be signed with. The newest key that
+// is already active signs new tokens; all keys verify them, so tokens signed
+// with the previous key stay valid until they expire. Keys that are no
+// longer needed are retired by deleting their file.
+type Keyring struct {
+	keys []*SigningKey
+}
+
+func NewKeyring(keys ...*SigningKey) (*Keyring, error) {
+	ids := map[string]bool{}
+	for _, key := range keys {
+		if ids[key.ID] {
+			return nil, fmt.Errorf("Duplicate key id %s", key.ID)
+		}
+		ids[key.ID] = true
+	}
+
+	sorted := append([]*SigningKey{}, keys...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].ActivatesAt.Equal(sorted[j].ActivatesAt) {
+			return sorted[i].ID < sorted[j].ID
+		}
+		return sorted[i].ActivatesAt.Before(sorted[j].ActivatesAt)
+	})
+	keyring := &Keyring{keys: sorted}
+	if _, err := keyring.signingKey(time.Now()); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+// LoadKeyring reads all *.pem files of dir. It fails unless at least one of
+// the keys is active, so the server never runs without key material.
+func LoadKeyring(dir string) (*Keyring, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*SigningKey{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("%s is not a PKCS #8 private key", path)
+		}
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse %s: %w", path, err)
+		}
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s has an unsupported key type %T", path, private)
+		}
+		key, err := newSigningKey(strings.TrimSuffix(filepath.Base(path), ".pem"), signer)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No signing keys found in %s, create one with: gobank keys generate", dir)
+	}
+	return NewKeyring(keys...)
+}
+
+// keysDir returns the directory holding the signing keys, taken from
+// JWT_KEYS_DIR.
+func keysDir() string {
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		return dir
+	}
+	return defaultKeysDir
+}
+
+func (k *Keyring) signingKey(now time.Time) (*SigningKey, error) {
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		if !k.keys[i].ActivatesAt.After(now) {
+			return k.keys[i], nil
+		}
+	}
+	return nil, fmt.Errorf("No signing key is active yet")
+}
+
+func (k *Keyring) key(id string) *SigningKey {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+func (k *Keyring) CreateToken(principal Principal, sessionID string) (string, error) {
+	now := time.Now()
+	signingKey, err := k.signingKey(now)
+	if err != nil {
+		return "", err
+	}
+
+	jti, err := newRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	claims := &Claims{
+		Role:      principal.Role,
+		SessionID: sessionID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			Subject:   principal.Subject,
+			ExpiresAt: now.Add(accessTokenTTL).Unix(),
+			IssuedAt:  now.Unix(),
+			Issuer:    "gobank",
+		},
+	}
+
+	token := jwt.NewWithClaims(signingKey.method(), claims)
+	token.Header["kid"] = signingKey.ID
+	return token.SignedString(signingKey.private)
+}
+
+// ValidateToken only accepts tokens signed by a key of the keyring with the
+// algorithm of that key; in particular "none" and HMAC tokens are rejected.
+func (k *Keyring) ValidateToken(tokenString string) (*Claims, error) {
+	claims := new(Claims)
+	parser := &jwt.Parser{ValidMethods: []string{AlgorithmEdDSA, AlgorithmRS256}}
+
+	token, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		id, _ := token.Header["kid"].(string)
+		key := k.key(id)
+		if key == nil {
+			return nil, fmt.Errorf("unknown key id %q", id)
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("key %s does not sign with %s", id, token.Method.Alg())
+		}
+		return key.verificationKey(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid || claims.Id == "" || claims.SessionID == "" || claims.Subject == "" {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
+}
+
+// JSONWebKey is the public part of a signing key as defined by RFC 7517.
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS lists the public keys of the keyring, including keys that are not
+// active yet so that verifiers know them before the first token arrives.
+func (k *Keyring) JWKS() *JSONWebKeySet {
+	set := &JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range k.keys {
+		jwk := JSONWebKey{KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm}
+		switch public := key.verificationKey().(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType, jwk.Curve = "OKP", "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	now := time.Now().UTC()
+	oldKey, err := GenerateSigningKey(AlgorithmEdDSA, now.AddDate(0, 0, -30))
+	assert.NoError(t, err)
+	currentKey, err := GenerateSigningKey(AlgorithmRS256, now)
+	assert.NoError(t, err)
+	nextKey, err := GenerateSigningKey(AlgorithmEdDSA, now.AddDate(0, 0, 30))
+	assert.NoError(t, err)
+
+	previous, err := NewKeyring(oldKey)
+	assert.NoError(t, err)
+	keyring, err := NewKeyring(nextKey, oldKey, currentKey)
+	assert.NoError(t, err)
+
+	// the newest active key signs, keys scheduled for later do not
+	tokenString, err := keyring.CreateToken(testPrincipal, "session")
+	assert.NoError(t, err)
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, new(Claims))
+	assert.NoError(t, err)
+	assert.Equal(t, currentKey.ID, token.Header["kid"])
+	assert.Equal(t, AlgorithmRS256, token.Method.Alg())
+
+	claims, err := keyring.ValidateToken(tokenString)
+	assert.NoError(t, err)
+	assert.Equal(t, "customer:1", claims.Subject)
+
+	// tokens signed before the rotation stay valid
+	oldToken, err := previous.CreateToken(testPrincipal, "session")
+	assert.NoError(t, err)
+	_, err = keyring.ValidateToken(oldToken)
+	assert.NoError(t, err)
+
+	// unless the old key has been retired
+	retired, err := NewKeyring(currentKey)
+	assert.NoError(t, err)
+	_, err = retired.ValidateToken(oldToken)
+	assert.Error(t, err)
+}
+
+func TestKeyringRefusesWithoutActiveKey(t *testing.T) {
+	_, err := LoadKeyring(t.TempDir())
+	assert.Error(t, err)
+
+	future, err := GenerateSigningKey(AlgorithmEdDSA, time.Now().AddDate(0, 0, 2))
+	assert.NoError(t, err)
+	_, err = NewKeyring(future)
+	assert.Error(t, err)
+}
+
+func TestKeyringSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	key, err := GenerateSigningKey(AlgorithmEdDSA, time.Now())
+	assert.NoError(t, err)
+	_, err = key.Save(dir)
+	assert.NoError(t, err)
+
+	keyring, err := LoadKeyring(dir)
+	assert.NoError(t, err)
+	tokenString, err := keyring.CreateToken(testPrincipal, "session")
+	assert.NoError(t, err)
+
+	original, err := NewKeyring(key)
+	assert.NoError(t, err)
+	_, err = original.ValidateToken(tokenString)
+	assert.NoError(t, err)
+}
+
+func TestValidateTokenRejectsOtherAlgorithms(t *testing.T) {
+	key, err := GenerateSigningKey(AlgorithmEdDSA, time.Now())
+	assert.NoError(t, err)
+	keyring, err := NewKeyring(key)
+	assert.NoError(t, err)
+
+	claims := &Claims{
+		Role:           RoleAdmin,
+		SessionID:      "session",
+		StandardClaims: jwt.StandardClaims{Id: "jti", Subject: "staff:admin", ExpiresAt: time.Now().Add(time.Minute).Unix()},
+	}
+
+	// HMAC signed with the public key, a classic algorithm confusion attack
+	hmacToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	hmacToken.Header["kid"] = key.ID
+	tokenString, err := hmacToken.SignedString([]byte(key.verificationKey().(ed25519.PublicKey)))
+	assert.NoError(t, err)
+	_, err = keyring.ValidateToken(tokenString)
+	assert.Error(t, err)
+
+	noneToken := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	noneToken.Header["kid"] = key.ID
+	tokenString, err = noneToken.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	assert.NoError(t, err)
+	_, err = keyring.ValidateToken(tokenString)
+	assert.Error(t, err)
+
+	// a key of the keyring with the wrong algorithm for its kid
+	rsaKey, err := GenerateSigningKey(AlgorithmRS256, time.Now())
+	assert.NoError(t, err)
+	rsaToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	rsaToken.Header["kid"] = key.ID
+	tokenString, err = rsaToken.SignedString(rsaKey.private)
+	assert.NoError(t, err)
+	_, err = keyring.ValidateToken(tokenString)
+	assert.Error(t, err)
+}
+
+func TestHandleJWKS(t *testing.T) {
+	apiServer := NewAPIServer(":8000", NewMemoryStore(), testKeyring)
+
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	respRec := httptest.NewRecorder()
+	handler := http.HandlerFunc(makeHTTPHandleFunc(apiServer.handleJWKS))
+	handler.ServeHTTP(respRec, req)
+
+	assert.Equal(t, http.StatusOK, respRec.Code)
+	var set JSONWebKeySet
+	err := json.Unmarshal(respRec.Body.Bytes(), &set)
+	assert.NoError(t, err)
+	assert.Len(t, set.Keys, 1)
+	jwk := set.Keys[0]
+	assert.Equal(t, "OKP", jwk.KeyType)
+	assert.Equal(t, "Ed25519", jwk.Curve)
+	assert.Equal(t, AlgorithmEdDSA, jwk.Algorithm)
+	assert.NotContains(t, strings.ToLower(respRec.Body.String()), `"d"`)
+
+	// a token can be verified with nothing but the published key
+	tokenString, err := testKeyring.CreateToken(testPrincipal, "session")
+	assert.NoError(t, err)
+	public, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	assert.NoError(t, err)
+	token, err := jwt.ParseWithClaims(tokenString, new(Claims), func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, jwk.KeyID, token.Header["kid"])
+		return ed25519.PublicKey(public), nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, token.Valid)
+}
+
+var testPrincipal = Principal{Subject: "customer:1", Role: RoleCustomer}
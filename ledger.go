@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	journalKindOpeningBalance = "opening_balance"
+	journalKindTransfer       = "transfer"
+	journalKindDeposit        = "deposit"
+	journalKindWithdrawal     = "withdrawal"
+	journalKindRefund         = "refund"
+	journalKindReversal       = "reversal"
+)
+
+// openingBalanceLedger is the equity account that funds the opening balance
+// of new customer accounts. Customer accounts are booked under their IBAN.
+const openingBalanceLedger = "gobank:equity:opening-balance"
+
+// cashLedger is the asset account on the other side of deposits and
+// withdrawals, i.e. money that enters or leaves the bank.
+const cashLedger = "gobank:assets:cash"
+
+// fxLedger is the bank's position in each currency. Transfers between
+// accounts of different currencies sell one currency to it and buy the
+// other, which keeps every journal entry balanced per currency.
+const fxLedger = "gobank:fx:position"
+
+// newTransferEntry books a transfer as a debit on the sender and a credit on
+// the receiver. Customer balances are liabilities of the bank, so a credit
+// increases them and a debit decreases them. A converted transfer goes
+// through the FX position in both currencies.
+func newTransferEntry(fromIban, toIban string, amount Money, conversion *FXConversion, at time.Time) *JournalEntry {
+	postings := []*Posting{
+		{Account: fromIban, Direction: Debit, Amount: amount},
+		{Account: toIban, Direction: Credit, Amount: amount},
+	}
+	if conversion != nil {
+		postings = []*Posting{
+			{Account: fromIban, Direction: Debit, Amount: amount},
+			{Account: fxLedger, Direction: Credit, Amount: amount},
+			{Account: fxLedger, Direction: Debit, Amount: conversion.Amount},
+			{Account: toIban, Direction: Credit, Amount: conversion.Amount},
+		}
+	}
+	return &JournalEntry{
+		Kind:        journalKindTransfer,
+		Description: fmt.Sprintf("Transfer from %s to %s", fromIban, toIban),
+		Postings:    postings,
+		CreatedAt:   at,
+	}
+}
+
+func newOpeningBalanceEntry(iban string, amount Money, at time.Time) *JournalEntry {
+	return &JournalEntry{
+		Kind:        journalKindOpeningBalance,
+		Description: fmt.Sprintf("Opening balance of %s", iban),
+		Postings: []*Posting{
+			{Account: openingBalanceLedger, Direction: Debit, Amount: amount},
+			{Account: iban, Direction: Credit, Amount: amount},
+		},
+		CreatedAt: at,
+	}
+}
+
+// newCashEntry books a deposit (a credit on the account) or a withdrawal (a
+// debit on the account) against the cash ledger.
+func newCashEntry(iban string, direction PostingDirection, amount Money, reference string, at time.Time) *JournalEntry {
+	kind, description, cashDirection := journalKindDeposit, fmt.Sprintf("Deposit to %s", iban), Debit
+	if direction == Debit {
+		kind, description, cashDirection = journalKindWithdrawal, fmt.Sprintf("Withdrawal from %s", iban), Credit
+	}
+	if reference != "" {
+		description += ": " + reference
+	}
+	return &JournalEntry{
+		Kind:        kind,
+		Description: description,
+		Postings: []*Posting{
+			{Account: cashLedger, Direction: cashDirection, Amount: amount},
+			{Account: iban, Direction: direction, Amount: amount},
+		},
+		CreatedAt: at,
+	}
+}
+
+// cashEvent records the staff user who booked a deposit or a withdrawal.
+func cashEvent(transaction *Transaction, actor string) *AuditEvent {
+	kind, verb := AuditCashDeposited, "Deposited"
+	if transaction.Direction == Debit {
+		kind, verb = AuditCashWithdrawn, "Withdrew"
+	}
+	return &AuditEvent{
+		Kind:      kind,
+		Actor:     actor,
+		Subject:   transaction.AccountIban,
+		Message:   fmt.Sprintf("%s %s %s", verb, transaction.Amount, transaction.Amount.Currency),
+		CreatedAt: transaction.CreatedAt,
+	}
+}
+
+// Validate checks that the entry has postings, that every posting moves a
+// positive amount and that debits and credits are balanced per currency.
+func (e *JournalEntry) Validate() error {
+	if len(e.Postings) < 2 {
+		return fmt.Errorf("Journal entry needs at least two postings")
+	}
+
+	balances := map[string]int64{}
+	for _, posting := range e.Postings {
+		if !posting.Amount.IsPositive() {
+			return fmt.Errorf("Posting amount must be positive")
+		}
+		amount := posting.Amount.Amount
+		switch posting.Direction {
+		case Debit:
+			amount = -amount
+		case Credit:
+		default:
+			return fmt.Errorf("Invalid posting direction: %s", posting.Direction)
+		}
+
+		balance, err := checkedAdd(balances[posting.Amount.Currency], amount)
+		if err != nil {
+			return err
+		}
+		balances[posting.Amount.Currency] = balance
+	}
+
+	for _, balance := range balances {
+		if balance != 0 {
+			return fmt.Errorf("Journal entry is not balanced")
+		}
+	}
+	return nil
+}
+
+// newTransferTransactions derives the statement lines of both sides of a
+// booked transfer entry. Converted transfers record the applied rate, the
+// spread and the amount on the other side on both lines.
+func newTransferTransactions(entry *JournalEntry, from, to *Account, amount Money, conversion *FXConversion) (*Transaction, *Transaction) {
+	debit := &Transaction{
+		JournalEntryID:   entry.ID,
+		Kind:             entry.Kind,
+		AccountIban:      from.IBAN,
+		CounterpartyIban: to.IBAN,
+		Direction:        Debit,
+		Amount:           amount,
+		BalanceAfter:     from.Balance,
+		CreatedAt:        entry.CreatedAt,
+	}
+	credit := &Transaction{
+		JournalEntryID:   entry.ID,
+		Kind:             entry.Kind,
+		AccountIban:      to.IBAN,
+		CounterpartyIban: from.IBAN,
+		Direction:        Credit,
+		Amount:           amount,
+		BalanceAfter:     to.Balance,
+		CreatedAt:        entry.CreatedAt,
+	}
+	if conversion != nil {
+		debit.ExchangeRate, debit.Spread, debit.CounterAmount = &conversion.Rate, &conversion.Spread, &conversion.Amount
+		credit.ExchangeRate, credit.Spread, credit.CounterAmount = &conversion.Rate, &conversion.Spread, &amount
+		credit.Amount = conversion.Amount
+	}
+	return debit, credit
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Statuses of an account. Accounts open as active, or as pending while
+// ACCOUNT_OPENING is set to review, and end up closed instead of being
+// deleted so that their history is kept.
+const (
+	AccountStatusPending = "pending"
+	AccountStatusActive  = "active"
+	AccountStatusFrozen  = "frozen"
+	AccountStatusDormant = "dormant"
+	AccountStatusClosed  = "closed"
+)
+
+// accountTransitions lists the statuses an account can move to from each
+// status. Closed accounts never change again.
+var accountTransitions = map[string][]string{
+	AccountStatusPending: {AccountStatusActive, AccountStatusClosed},
+	AccountStatusActive:  {AccountStatusFrozen, AccountStatusDormant, AccountStatusClosed},
+	AccountStatusFrozen:  {AccountStatusActive, AccountStatusClosed},
+	AccountStatusDormant: {AccountStatusActive, AccountStatusFrozen, AccountStatusClosed},
+}
+
+func isAccountStatus(status string) bool {
+	_, ok := accountTransitions[status]
+	return ok || status == AccountStatusClosed
+}
+
+func canTransition(from, to string) bool {
+	for _, status := range accountTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCanSend rejects transfers and withdrawals from accounts that are not
+// active.
+func checkCanSend(account *Account) error {
+	if account.Status != AccountStatusActive {
+		return errAccountUnavailable(account.IBAN, account.Status)
+	}
+	return nil
+}
+
+// checkCanReceive rejects transfers and deposits into accounts that are not
+// active or dormant. Dormant accounts keep receiving money, e.g. interest,
+// but need to be reactivated before money leaves them.
+func checkCanReceive(account *Account) error {
+	if account.Status != AccountStatusActive && account.Status != AccountStatusDormant {
+		return errAccountUnavailable(account.IBAN, account.Status)
+	}
+	return nil
+}
+
+// initialAccountStatus reads ACCOUNT_OPENING: with "review" new accounts
+// stay pending until staff activate them, otherwise they are active right
+// away.
+func initialAccountStatus() string {
+	if os.Getenv("ACCOUNT_OPENING") == "review" {
+		return AccountStatusPending
+	}
+	return AccountStatusActive
+}
+
+// accountStatusEvent is the audit event written when actor changes the
+// status of an account.
+func accountStatusEvent(iban, from, to, actor string) *AuditEvent {
+	kind := AuditAccountStatus
+	switch {
+	case to == AccountStatusFrozen:
+		kind = AuditAccountFrozen
+	case from == AccountStatusFrozen && to == AccountStatusActive:
+		kind = AuditAccountUnfrozen
+	case to == AccountStatusClosed:
+		kind = AuditAccountClosed
+	}
+	return &AuditEvent{Kind: kind, Actor: actor, Subject: iban, Message: "Account is " + to, CreatedAt: time.Now().UTC()}
+}
+
+func errAccountFrozen(iban string) *Error {
+	return ForbiddenError("account_frozen", "Account %s is frozen", iban)
+}
+
+// errAccountUnavailable tells why money cannot move from or to an account
+// in the given status. The code is account_ followed by the status.
+func errAccountUnavailable(iban, status string) *Error {
+	if status == AccountStatusFrozen {
+		return errAccountFrozen(iban)
+	}
+	return ConflictError("account_"+status, "Account %s is %s", iban, status)
+}
+
+func errAccountStatusUnchanged(iban, status string) *Error {
+	return ConflictError("account_status_unchanged", "Account %s is already %s", iban, status)
+}
+
+func errInvalidStatusTransition(iban, from, to string) *Error {
+	return ConflictError("invalid_status_transition", "Account %s cannot go from %s to %s", iban, from, to)
+}
+
+func errAccountNotEmpty(iban string, balance Money) *Error {
+	return ConflictError("account_not_empty", "Account %s still holds %s %s; a payoutIban is needed to close it", iban, balance, balance.Currency).WithDetail("balance", balance)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountStatusTransitions(t *testing.T) {
+	assert.True(t, canTransition(AccountStatusPending, AccountStatusActive))
+	assert.True(t, canTransition(AccountStatusDormant, AccountStatusActive))
+	assert.False(t, canTransition(AccountStatusFrozen, AccountStatusDormant))
+	assert.False(t, canTransition(AccountStatusActive, AccountStatusPending))
+	// closed is final
+	assert.False(t, canTransition(AccountStatusClosed, AccountStatusActive))
+
+	assert.True(t, isAccountStatus(AccountStatusClosed))
+	assert.False(t, isAccountStatus("deleted"))
+}
+
+func TestAccountStatusMovesMoney(t *testing.T) {
+	account := &Account{IBAN: "DE89370400440532013000", Status: AccountStatusDormant}
+	assert.NoError(t, checkCanReceive(account))
+	err := checkCanSend(account)
+	assert.True(t, IsKind(err, KindConflict))
+	assert.Equal(t, "account_dormant", err.(*Error).Code)
+
+	account.Status = AccountStatusFrozen
+	assert.True(t, IsKind(checkCanReceive(account), KindForbidden))
+	account.Status = AccountStatusClosed
+	assert.True(t, IsKind(checkCanReceive(account), KindConflict))
+}
@@ -1,26 +1,262 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/beshoyabdelmalak/gobank/iban"
 	"github.com/joho/godotenv"
 )
 
 func main() {
+	storageKind := flag.String("storage", "postgres", "storage backend to use: postgres, sqlite or memory")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate up|down [steps]|status | keys generate [flags] | staff create [flags]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	err := godotenv.Load()
 	if err != nil {
 		log.Println("Warning: Error loading .env file")
 	}
 
-	store, err := NewPostgresStore()
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(*storageKind, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "keys" {
+		if err := runKeys(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "staff" {
+		if err := runStaff(*storageKind, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	keys, err := LoadKeyring(keysDir())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// fail early instead of on the first account creation or login
+	country, bankCode := ibanSettings()
+	if _, err := iban.Generate(country, bankCode, 0); err != nil {
+		log.Fatalf("Invalid IBAN_COUNTRY %s or IBAN_BANK_CODE %s: %v", country, bankCode, err)
+	}
+	if _, err := loginPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	if _, _, err := transferSecondFactorThreshold(); err != nil {
+		log.Fatalf("Invalid TRANSFER_2FA_THRESHOLD: %v", err)
+	}
+	if _, err := fxQuoteTTL(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := reversalNegativeBalancePolicy(); err != nil {
+		log.Fatal(err)
+	}
+	scheduler, err := schedulerPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	rates, err := loadExchangeRates()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := store.Init(); err != nil {
+	store, err := newStorage(*storageKind)
+	if err != nil {
 		log.Fatal(err)
 	}
+	if len(rates) > 0 {
+		if err := store.SetExchangeRates(rates, "file"); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d exchange rate(s)\n", len(rates))
+	}
+
+	go NewTransferScheduler(store, scheduler).Run(context.Background())
 
-	apiServer := NewAPIServer(":8000", store)
+	apiServer := NewAPIServer(":8000", store, keys)
 	apiServer.Run()
 }
+
+func newStorage(kind string) (Storage, error) {
+	switch kind {
+	case "postgres":
+		store, err := NewPostgresStore()
+		if err != nil {
+			return nil, err
+		}
+		if err := store.Init(); err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "sqlite":
+		store, err := NewSQLiteStore()
+		if err != nil {
+			return nil, err
+		}
+		if err := store.Init(); err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "memory":
+		log.Println("Warning: using in-memory storage, all data is lost on shutdown")
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("Unknown storage backend: %s", kind)
+	}
+}
+
+// runMigrate implements the migrate subcommand for the SQL backends.
+func runMigrate(kind string, args []string) error {
+	var store *sqlStore
+	switch kind {
+	case "postgres":
+		pgStore, err := NewPostgresStore()
+		if err != nil {
+			return err
+		}
+		store = &pgStore.sqlStore
+	case "sqlite":
+		sqliteStore, err := NewSQLiteStore()
+		if err != nil {
+			return err
+		}
+		store = &sqliteStore.sqlStore
+	default:
+		return fmt.Errorf("Storage backend %s has no migrations", kind)
+	}
+	defer store.db.Close()
+
+	migrator, err := newMigrator(store)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: migrate up|down [steps]|status")
+	}
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up()
+		log.Printf("Applied %d migration(s)\n", applied)
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("Invalid number of steps: %v", args[1])
+			}
+		}
+		reverted, err := migrator.Down(steps)
+		log.Printf("Reverted %d migration(s)\n", reverted)
+		return err
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if status.ChecksumMismatch {
+				state += " (checksum mismatch)"
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown migrate command: %s", args[0])
+	}
+}
+
+// runKeys implements the keys subcommand. Keys are generated into
+// JWT_KEYS_DIR; a key with a future activation day is published right away
+// and takes over signing on that day.
+func runKeys(args []string) error {
+	if len(args) == 0 || args[0] != "generate" {
+		return fmt.Errorf("Usage: keys generate [--alg=EdDSA|RS256] [--activate=YYYY-MM-DD]")
+	}
+
+	flags := flag.NewFlagSet("keys generate", flag.ContinueOnError)
+	algorithm := flags.String("alg", AlgorithmEdDSA, "signing algorithm: EdDSA or RS256")
+	activate := flags.String("activate", "", "day from which on the key signs tokens, defaults to today")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	activatesAt := time.Now().UTC()
+	if *activate != "" {
+		var err error
+		if activatesAt, err = time.Parse("2006-01-02", *activate); err != nil {
+			return fmt.Errorf("Invalid activation day: %v", *activate)
+		}
+	}
+
+	key, err := GenerateSigningKey(*algorithm, activatesAt)
+	if err != nil {
+		return err
+	}
+	path, err := key.Save(keysDir())
+	if err != nil {
+		return err
+	}
+	log.Printf("Generated %s key %s in %s\n", key.Algorithm, key.ID, path)
+	return nil
+}
+
+// runStaff implements the staff subcommand, which creates the first admin
+// and any staff user after that. The password is read from stdin so that it
+// stays out of the shell history.
+func runStaff(kind string, args []string) error {
+	if len(args) == 0 || args[0] != "create" {
+		return fmt.Errorf("Usage: staff create --username=NAME [--role=support|admin|auditor] < password")
+	}
+
+	flags := flag.NewFlagSet("staff create", flag.ContinueOnError)
+	username := flags.String("username", "", "name the staff user logs in with")
+	role := flags.String("role", RoleAdmin, "role: support, admin or auditor")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	user, err := NewStaffUser(*username, strings.TrimRight(password, "\r\n"), *role)
+	if err != nil {
+		return err
+	}
+
+	store, err := newStorage(kind)
+	if err != nil {
+		return err
+	}
+	if err := store.CreateStaffUser(user, "cli"); err != nil {
+		return err
+	}
+	log.Printf("Created %s %s\n", user.Role, user.Username)
+	return nil
+}
@@ -0,0 +1,1542 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in process memory. It behaves like the
+// Postgres store, which makes it useful for hermetic tests and demos, but all
+// data is lost when the process exits.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	customers      map[int]*Customer
+	customerLogins map[string]int
+
+	accounts     map[int]*Account
+	accountIbans map[string]int
+	holders      map[int]map[int]*AccountHolder
+	approvals    []*TransferApproval
+	scheduled    []*ScheduledTransfer
+	orders       []*StandingOrder
+	batches      []*TransferBatch
+	rates        map[[2]string]*ExchangeRate
+	fxQuotes     map[string]*FXQuote
+	journal      []*JournalEntry
+	transactions []*Transaction
+	keys         map[string]*IdempotencyKey
+
+	sessions      map[string]*Session
+	refreshTokens map[string]*RefreshToken
+	revokedTokens map[string]time.Time
+
+	loginThrottles map[string]*LoginThrottle
+	auditEvents    []*AuditEvent
+
+	totpEnrolments  map[string]*TOTPEnrolment
+	recoveryCodes   map[string]map[string]bool
+	loginChallenges map[string]*LoginChallenge
+
+	staffUsers map[string]*StaffUser
+
+	nextCustomerID     int
+	nextAccountID      int
+	nextAccountNumber  int64
+	nextJournalEntryID int
+	nextPostingID      int
+	nextTransactionID  int
+	nextAuditEventID   int
+	nextStaffUserID    int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		customers:      map[int]*Customer{},
+		customerLogins: map[string]int{},
+
+		accounts:     map[int]*Account{},
+		accountIbans: map[string]int{},
+		holders:      map[int]map[int]*AccountHolder{},
+		rates:        map[[2]string]*ExchangeRate{},
+		fxQuotes:     map[string]*FXQuote{},
+		keys:         map[string]*IdempotencyKey{},
+
+		sessions:      map[string]*Session{},
+		refreshTokens: map[string]*RefreshToken{},
+		revokedTokens: map[string]time.Time{},
+
+		loginThrottles: map[string]*LoginThrottle{},
+
+		totpEnrolments:  map[string]*TOTPEnrolment{},
+		recoveryCodes:   map[string]map[string]bool{},
+		loginChallenges: map[string]*LoginChallenge{},
+
+		staffUsers: map[string]*StaffUser{},
+	}
+}
+
+func (s *MemoryStore) CreateCustomer(customer *Customer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// usernames cannot contain an @, so they never collide with emails
+	if _, ok := s.customerLogins[customer.Username]; ok {
+		return errUsernameTaken(customer.Username)
+	}
+	if _, ok := s.customerLogins[customer.Email]; ok && customer.Email != "" {
+		return errEmailTaken(customer.Email)
+	}
+	s.nextCustomerID++
+	customer.ID = s.nextCustomerID
+	stored := *customer
+	s.customers[stored.ID] = &stored
+	s.customerLogins[stored.Username] = stored.ID
+	if stored.Email != "" {
+		s.customerLogins[stored.Email] = stored.ID
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetCustomerById(id int) (*Customer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	customer, ok := s.customers[id]
+	if !ok {
+		return nil, errCustomerNotFound(id)
+	}
+	copied := *customer
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetCustomerByLogin(login string) (*Customer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.customerLogins[login]
+	if !ok && strings.Contains(login, "@") {
+		id, ok = s.customerLogins[strings.ToLower(login)]
+	}
+	if !ok {
+		return nil, NotFoundError("customer_not_found", "Customer %s not found", login)
+	}
+	copied := *s.customers[id]
+	return &copied, nil
+}
+
+func (s *MemoryStore) NextAccountNumber() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextAccountNumber++
+	return s.nextAccountNumber, nil
+}
+
+func (s *MemoryStore) CreateAccount(account *Account, key *IdempotencyKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// mirrors the unique constraint on account.iban of the SQL stores
+	if _, ok := s.accountIbans[account.IBAN]; ok {
+		return fmt.Errorf("Account with IBAN number %s already exists", account.IBAN)
+	}
+	if replayed, err := s.claimIdempotencyKey(key); err != nil || replayed {
+		return err
+	}
+
+	s.nextAccountID++
+	account.ID = s.nextAccountID
+	stored := *account
+	s.accounts[stored.ID] = &stored
+	s.accountIbans[stored.IBAN] = stored.ID
+	s.holders[stored.ID] = map[int]*AccountHolder{stored.CustomerID: openingHolder(&stored)}
+
+	if account.Balance.IsPositive() {
+		entry := newOpeningBalanceEntry(account.IBAN, account.Balance, account.CreatedAt)
+		if err := s.postJournalEntry(entry); err != nil {
+			return err
+		}
+		s.insertTransaction(&Transaction{
+			JournalEntryID: entry.ID,
+			Kind:           entry.Kind,
+			AccountIban:    account.IBAN,
+			Direction:      Credit,
+			Amount:         account.Balance,
+			BalanceAfter:   account.Balance,
+			CreatedAt:      entry.CreatedAt,
+		})
+	}
+	return s.saveIdempotentResponse(key, account)
+}
+
+func (s *MemoryStore) GetAccountById(accountId int) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.accounts[accountId]
+	if !ok {
+		return nil, errAccountNotFound(accountId)
+	}
+	copied := *account
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetAccountByIban(accountIban string) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.accountByIban(accountIban)
+	if err != nil {
+		return nil, err
+	}
+	copied := *account
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetAccountsByCustomer(customerID int) ([]*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := []*Account{}
+	for id := 1; id <= s.nextAccountID; id++ {
+		holder, ok := s.holders[id][customerID]
+		if !ok || holder.Status != HolderStatusActive {
+			continue
+		}
+		if account, ok := s.accounts[id]; ok {
+			copied := *account
+			accounts = append(accounts, &copied)
+		}
+	}
+	return accounts, nil
+}
+
+func (s *MemoryStore) GetAccounts(filter *AccountFilter) ([]*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := []*Account{}
+	for id := s.nextAccountID; id > 0 && len(accounts) < filter.Limit; id-- {
+		account, ok := s.accounts[id]
+		if !ok ||
+			(filter.Cursor != 0 && id >= filter.Cursor) ||
+			(filter.Status != "" && account.Status != filter.Status) {
+			continue
+		}
+		copied := *account
+		accounts = append(accounts, &copied)
+	}
+	return accounts, nil
+}
+
+func (s *MemoryStore) SetAccountStatus(iban string, status string, actor string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.accountByIban(iban)
+	if err != nil {
+		return err
+	}
+	if account.Status == status {
+		return errAccountStatusUnchanged(iban, status)
+	}
+	if status == AccountStatusClosed || !canTransition(account.Status, status) {
+		return errInvalidStatusTransition(iban, account.Status, status)
+	}
+	s.insertAuditEvent(accountStatusEvent(iban, account.Status, status, actor))
+	account.Status = status
+	return nil
+}
+
+func (s *MemoryStore) CloseAccount(iban string, payoutIban string, actor string) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.accountByIban(iban)
+	if err != nil {
+		return nil, err
+	}
+	if account.Status == AccountStatusClosed {
+		return nil, errAccountStatusUnchanged(iban, AccountStatusClosed)
+	}
+	if err := s.reconcileAccount(account); err != nil {
+		return nil, err
+	}
+
+	var payout *Transaction
+	if !account.Balance.IsZero() {
+		if payoutIban == "" || payoutIban == iban {
+			return nil, errAccountNotEmpty(iban, account.Balance)
+		}
+		// the account is paid out even if it may not send otherwise, as
+		// closing it is the way out of any status
+		if payout, err = s.transferFrom(account, payoutIban, account.Balance, ""); err != nil {
+			return nil, err
+		}
+		copied := *payout
+		payout = &copied
+	}
+
+	now := time.Now().UTC()
+	s.insertAuditEvent(accountStatusEvent(iban, account.Status, AccountStatusClosed, actor))
+	account.Status = AccountStatusClosed
+	account.ClosedAt = &now
+	return payout, nil
+}
+
+func (s *MemoryStore) SetApprovalLimit(accountID int, limit *Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.accounts[accountID]
+	if !ok {
+		return errAccountNotFound(accountID)
+	}
+	account.ApprovalLimit = nil
+	if limit != nil {
+		copied := *limit
+		account.ApprovalLimit = &copied
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetAccountHolders(accountID int) ([]*AccountHolder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	holders := []*AccountHolder{}
+	for _, holder := range s.holders[accountID] {
+		holders = append(holders, s.copyAccountHolder(holder))
+	}
+	sort.Slice(holders, func(i, j int) bool {
+		if !holders[i].CreatedAt.Equal(holders[j].CreatedAt) {
+			return holders[i].CreatedAt.Before(holders[j].CreatedAt)
+		}
+		return holders[i].CustomerID < holders[j].CustomerID
+	})
+	return holders, nil
+}
+
+func (s *MemoryStore) GetAccountHolder(accountID, customerID int) (*AccountHolder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	holder, ok := s.holders[accountID][customerID]
+	if !ok {
+		return nil, errAccountHolderNotFound(accountID, customerID)
+	}
+	return s.copyAccountHolder(holder), nil
+}
+
+func (s *MemoryStore) GetInvitations(customerID int) ([]*AccountHolder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	invitations := []*AccountHolder{}
+	for id := 1; id <= s.nextAccountID; id++ {
+		if holder, ok := s.holders[id][customerID]; ok && holder.Status == HolderStatusInvited {
+			invitations = append(invitations, s.copyAccountHolder(holder))
+		}
+	}
+	return invitations, nil
+}
+
+func (s *MemoryStore) AddAccountHolder(holder *AccountHolder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	holders, ok := s.holders[holder.AccountID]
+	if !ok {
+		return errAccountNotFound(holder.AccountID)
+	}
+	if _, ok := holders[holder.CustomerID]; ok {
+		return ConflictError("account_holder_exists", "Customer %d already holds or was invited to account %d", holder.CustomerID, holder.AccountID)
+	}
+	stored := *holder
+	holders[holder.CustomerID] = &stored
+	return nil
+}
+
+func (s *MemoryStore) AcceptAccountHolder(accountID, customerID int) (*AccountHolder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	holder, ok := s.holders[accountID][customerID]
+	if !ok || holder.Status != HolderStatusInvited {
+		return nil, errAccountHolderNotFound(accountID, customerID)
+	}
+	now := time.Now().UTC()
+	holder.Status = HolderStatusActive
+	holder.AcceptedAt = &now
+	return s.copyAccountHolder(holder), nil
+}
+
+func (s *MemoryStore) RemoveAccountHolder(accountID, customerID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	holders, ok := s.holders[accountID]
+	if !ok {
+		return errAccountNotFound(accountID)
+	}
+	if _, ok := holders[customerID]; !ok {
+		return errAccountHolderNotFound(accountID, customerID)
+	}
+	for id, holder := range holders {
+		if id != customerID && holder.Permits(HolderPermissionManage) {
+			delete(holders, customerID)
+			return nil
+		}
+	}
+	return errLastAccountManager()
+}
+
+func (s *MemoryStore) TransferFunds(fromIban string, toIban string, amount Money, quoteID string, key *IdempotencyKey) (*Transaction, error) {
+	if !amount.IsPositive() {
+		return nil, errAmountNotPositive()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if replayed, err := s.claimIdempotencyKey(key); err != nil || replayed {
+		return nil, err
+	}
+
+	debit, err := s.transfer(fromIban, toIban, amount, quoteID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.saveIdempotentResponse(key, debit); err != nil {
+		return nil, err
+	}
+	copied := *debit
+	return &copied, nil
+}
+
+// transfer moves the amount and returns the sender's transaction. Every
+// check runs before the first change so a failed transfer leaves no trace,
+// just like a rolled back database transaction.
+func (s *MemoryStore) transfer(fromIban string, toIban string, amount Money, quoteID string) (*Transaction, error) {
+	fromAccount, err := s.accountByIban(fromIban)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCanSend(fromAccount); err != nil {
+		return nil, err
+	}
+	return s.transferFrom(fromAccount, toIban, amount, quoteID)
+}
+
+// transferFrom moves the amount from fromAccount whatever its status, which
+// the caller has checked.
+func (s *MemoryStore) transferFrom(fromAccount *Account, toIban string, amount Money, quoteID string) (*Transaction, error) {
+	fromIban := fromAccount.IBAN
+	if err := s.reconcileAccount(fromAccount); err != nil {
+		return nil, err
+	}
+	if !fromAccount.Balance.SameCurrency(amount) {
+		return nil, errCurrencyMismatch()
+	}
+	if amount.Cmp(fromAccount.Balance) > 0 {
+		return nil, errInsufficientFunds()
+	}
+	toAccount, err := s.accountByIban(toIban)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCanReceive(toAccount); err != nil {
+		return nil, err
+	}
+	conversion, quote, err := s.convert(amount, toAccount.Balance.Currency, quoteID)
+	if err != nil {
+		return nil, err
+	}
+	credited := amount
+	if conversion != nil {
+		credited = conversion.Amount
+	}
+
+	entry := newTransferEntry(fromIban, toIban, amount, conversion, time.Now().UTC())
+	if err := s.postJournalEntry(entry); err != nil {
+		return nil, err
+	}
+	if quote != nil {
+		s.fxQuotes[quote.ID] = quote
+	}
+	fromAccount.Balance = fromAccount.Balance.Sub(amount)
+	toAccount.Balance = toAccount.Balance.Add(credited)
+
+	debit, credit := newTransferTransactions(entry, fromAccount, toAccount, amount, conversion)
+	s.insertTransaction(debit)
+	s.insertTransaction(credit)
+	return debit, nil
+}
+
+func (s *MemoryStore) RefundTransfer(refund *Refund, key *IdempotencyKey) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if replayed, err := s.claimIdempotencyKey(key); err != nil || replayed {
+		return nil, err
+	}
+
+	journalEntryID := 0
+	for _, transaction := range s.transactions {
+		if transaction.ID == refund.TransactionID {
+			journalEntryID = transaction.JournalEntryID
+		}
+	}
+	lines := []*Transaction{}
+	for _, transaction := range s.transactions {
+		if journalEntryID != 0 && transaction.JournalEntryID == journalEntryID {
+			lines = append(lines, transaction)
+		}
+	}
+	originalCredit, originalDebit, err := refund.original(lines)
+	if err != nil {
+		return nil, err
+	}
+
+	recipient, err := s.accountByIban(originalCredit.AccountIban)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := s.accountByIban(originalDebit.AccountIban)
+	if err != nil {
+		return nil, err
+	}
+	if err := refund.checkAccounts(recipient, sender); err != nil {
+		return nil, err
+	}
+	if err := s.reconcileAccount(recipient); err != nil {
+		return nil, err
+	}
+
+	refunded := NewMoney(0, originalCredit.Amount.Currency)
+	returned := NewMoney(0, originalDebit.Amount.Currency)
+	for _, transaction := range s.transactions {
+		switch transaction.OriginalTransactionID {
+		case originalCredit.ID:
+			refunded = refunded.Add(transaction.Amount)
+		case originalDebit.ID:
+			returned = returned.Add(transaction.Amount)
+		}
+	}
+	amount, conversion, err := refund.amounts(originalCredit, originalDebit, refunded, returned)
+	if err != nil {
+		return nil, err
+	}
+	if amount.Cmp(recipient.Balance) > 0 && !refund.AllowNegative {
+		return nil, errInsufficientFunds()
+	}
+	credited := amount
+	if conversion != nil {
+		credited = conversion.Amount
+	}
+
+	entry := refund.entry(recipient.IBAN, sender.IBAN, amount, conversion, time.Now().UTC())
+	if err := s.postJournalEntry(entry); err != nil {
+		return nil, err
+	}
+	recipient.Balance = recipient.Balance.Sub(amount)
+	sender.Balance = sender.Balance.Add(credited)
+
+	debit, credit := newTransferTransactions(entry, recipient, sender, amount, conversion)
+	refund.link(debit, credit, originalCredit, originalDebit)
+	s.insertTransaction(debit)
+	s.insertTransaction(credit)
+	if refund.Reversal {
+		s.insertAuditEvent(reversalEvent(refund, debit))
+	}
+
+	if err := s.saveIdempotentResponse(key, debit); err != nil {
+		return nil, err
+	}
+	copied := *debit
+	return &copied, nil
+}
+
+// convert works like its SQL counterpart, but returns the used quote
+// instead of storing it, so that the transfer only stores it once nothing
+// can fail anymore.
+func (s *MemoryStore) convert(amount Money, currency string, quoteID string) (*FXConversion, *FXQuote, error) {
+	if amount.Currency == currency && quoteID == "" {
+		return nil, nil, nil
+	}
+
+	var rate *ExchangeRate
+	var used *FXQuote
+	if quoteID != "" {
+		quote, ok := s.fxQuotes[quoteID]
+		if !ok {
+			return nil, nil, errFXQuoteNotFound(quoteID)
+		}
+		copied := *quote
+		if err := copied.use(amount.Currency, currency, time.Now().UTC()); err != nil {
+			return nil, nil, err
+		}
+		rate, used = copied.exchangeRate(), &copied
+	} else {
+		var err error
+		if rate, err = s.exchangeRate(amount.Currency, currency); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	converted, err := rate.Convert(amount)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &FXConversion{Rate: rate.Applied(), Spread: rate.Spread, Amount: converted}, used, nil
+}
+
+func (s *MemoryStore) CreateTransferApproval(approval *TransferApproval, key *IdempotencyKey) error {
+	if !approval.Amount.IsPositive() {
+		return errAmountNotPositive()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if replayed, err := s.claimIdempotencyKey(key); err != nil || replayed {
+		return err
+	}
+
+	approval.ID = len(s.approvals) + 1
+	stored := *approval
+	s.approvals = append(s.approvals, &stored)
+	return s.saveIdempotentResponse(key, approval)
+}
+
+func (s *MemoryStore) GetTransferApprovals(iban string, status string) ([]*TransferApproval, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	approvals := []*TransferApproval{}
+	for i := len(s.approvals) - 1; i >= 0; i-- {
+		approval := s.approvals[i]
+		if approval.FromAccountIban != iban || (status != "" && approval.Status != status) {
+			continue
+		}
+		copied := *approval
+		approvals = append(approvals, &copied)
+	}
+	return approvals, nil
+}
+
+func (s *MemoryStore) GetTransferApproval(id int, iban string) (*TransferApproval, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	approval, err := s.transferApproval(id, iban)
+	if err != nil {
+		return nil, err
+	}
+	copied := *approval
+	return &copied, nil
+}
+
+func (s *MemoryStore) DecideTransferApproval(id int, iban string, approve bool, decidedBy int) (*TransferApproval, *Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.transferApproval(id, iban)
+	if err != nil {
+		return nil, nil, err
+	}
+	// decide on a copy so that a failed transfer leaves the approval pending
+	approval := *stored
+	if err := approval.decide(approve, decidedBy, time.Now().UTC()); err != nil {
+		return nil, nil, err
+	}
+
+	var debit *Transaction
+	if approve {
+		if debit, err = s.transfer(approval.FromAccountIban, approval.ToAccountIban, approval.Amount, ""); err != nil {
+			return nil, nil, err
+		}
+		approval.TransactionID = debit.ID
+		copied := *debit
+		debit = &copied
+	}
+	*stored = approval
+	return &approval, debit, nil
+}
+
+func (s *MemoryStore) transferApproval(id int, iban string) (*TransferApproval, error) {
+	if id < 1 || id > len(s.approvals) || s.approvals[id-1].FromAccountIban != iban {
+		return nil, errTransferApprovalNotFound(id)
+	}
+	return s.approvals[id-1], nil
+}
+
+func (s *MemoryStore) CreateScheduledTransfer(transfer *ScheduledTransfer, key *IdempotencyKey) error {
+	if !transfer.Amount.IsPositive() {
+		return errAmountNotPositive()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if replayed, err := s.claimIdempotencyKey(key); err != nil || replayed {
+		return err
+	}
+
+	transfer.ID = len(s.scheduled) + 1
+	stored := *transfer
+	s.scheduled = append(s.scheduled, &stored)
+	return s.saveIdempotentResponse(key, transfer)
+}
+
+func (s *MemoryStore) GetScheduledTransfers(iban string, status string) ([]*ScheduledTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transfers := []*ScheduledTransfer{}
+	for i := len(s.scheduled) - 1; i >= 0; i-- {
+		transfer := s.scheduled[i]
+		if transfer.FromAccountIban != iban || (status != "" && transfer.Status != status) {
+			continue
+		}
+		copied := *transfer
+		transfers = append(transfers, &copied)
+	}
+	return transfers, nil
+}
+
+func (s *MemoryStore) CancelScheduledTransfer(id int, iban string, cancelledBy int) (*ScheduledTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > len(s.scheduled) || s.scheduled[id-1].FromAccountIban != iban {
+		return nil, errScheduledTransferNotFound(id)
+	}
+	transfer := *s.scheduled[id-1]
+	if err := transfer.cancel(cancelledBy, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	*s.scheduled[id-1] = transfer
+	return &transfer, nil
+}
+
+func (s *MemoryStore) ClaimDueScheduledTransfers(now time.Time, leaseUntil time.Time, limit int) ([]*ScheduledTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*ScheduledTransfer{}
+	for _, transfer := range s.scheduled {
+		if transfer.Status != ScheduledStatusPending && transfer.Status != ScheduledStatusExecuting {
+			continue
+		}
+		if transfer.NextAttemptAt.After(now) {
+			continue
+		}
+		due = append(due, transfer)
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]*ScheduledTransfer, 0, len(due))
+	for _, transfer := range due {
+		transfer.Status, transfer.NextAttemptAt = ScheduledStatusExecuting, leaseUntil
+		copied := *transfer
+		claimed = append(claimed, &copied)
+	}
+	return claimed, nil
+}
+
+func (s *MemoryStore) RecordScheduledTransferAttempt(transfer *ScheduledTransfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := transfer.ID
+	if id < 1 || id > len(s.scheduled) || s.scheduled[id-1].Status != ScheduledStatusExecuting {
+		return errScheduledTransferNotFound(id)
+	}
+	*s.scheduled[id-1] = *transfer
+	return nil
+}
+
+func (s *MemoryStore) CreateStandingOrder(order *StandingOrder, key *IdempotencyKey) error {
+	if !order.Amount.IsPositive() {
+		return errAmountNotPositive()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if replayed, err := s.claimIdempotencyKey(key); err != nil || replayed {
+		return err
+	}
+
+	order.ID = len(s.orders) + 1
+	stored := *order
+	s.orders = append(s.orders, &stored)
+	return s.saveIdempotentResponse(key, order)
+}
+
+func (s *MemoryStore) GetStandingOrders(iban string, status string) ([]*StandingOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders := []*StandingOrder{}
+	for i := len(s.orders) - 1; i >= 0; i-- {
+		order := s.orders[i]
+		if order.FromAccountIban != iban || (status != "" && order.Status != status) {
+			continue
+		}
+		copied := *order
+		orders = append(orders, &copied)
+	}
+	return orders, nil
+}
+
+func (s *MemoryStore) GetStandingOrder(id int, iban string) (*StandingOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, err := s.standingOrder(id, iban)
+	if err != nil {
+		return nil, err
+	}
+	copied := *order
+	return &copied, nil
+}
+
+func (s *MemoryStore) UpdateStandingOrder(id int, iban string, req *StandingOrderRequest) (*StandingOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.standingOrder(id, iban)
+	if err != nil {
+		return nil, err
+	}
+	order := *stored
+	if err := order.update(req, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	*stored = order
+	return &order, nil
+}
+
+func (s *MemoryStore) CancelStandingOrder(id int, iban string, cancelledBy int) (*StandingOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.standingOrder(id, iban)
+	if err != nil {
+		return nil, err
+	}
+	order := *stored
+	if err := order.cancel(cancelledBy, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	*stored = order
+	for _, transfer := range s.scheduled {
+		if transfer.StandingOrderID == order.ID && transfer.Status == ScheduledStatusPending {
+			transfer.cancel(cancelledBy, *order.CancelledAt)
+		}
+	}
+	return &order, nil
+}
+
+func (s *MemoryStore) ScheduleStandingOrders(today string, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*StandingOrder{}
+	for _, order := range s.orders {
+		if order.Status == StandingOrderStatusActive && order.NextExecutionDate <= today {
+			due = append(due, order)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].NextExecutionDate < due[j].NextExecutionDate })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	created := 0
+	for _, order := range due {
+		for order.Status == StandingOrderStatusActive && order.NextExecutionDate <= today {
+			transfer := order.scheduledTransfer()
+			transfer.ID = len(s.scheduled) + 1
+			s.scheduled = append(s.scheduled, transfer)
+			order.advance()
+			created++
+		}
+	}
+	return created, nil
+}
+
+func (s *MemoryStore) standingOrder(id int, iban string) (*StandingOrder, error) {
+	if id < 1 || id > len(s.orders) || s.orders[id-1].FromAccountIban != iban {
+		return nil, errStandingOrderNotFound(id)
+	}
+	return s.orders[id-1], nil
+}
+
+func (s *MemoryStore) ExecuteTransferBatch(batch *TransferBatch, key *IdempotencyKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if replayed, err := s.claimIdempotencyKey(key); err != nil || replayed {
+		return err
+	}
+
+	// a failed transfer leaves no trace, so only atomic batches need to undo
+	// the items before it
+	savepoint := s.savepoint()
+	for _, item := range batch.Items {
+		if !batch.executes() {
+			break
+		}
+		debit, err := s.transfer(batch.FromAccountIban, item.ToAccountIban, item.Amount, "")
+		batch.record(item, debit, err)
+	}
+	if !batch.executes() {
+		s.rollbackTo(savepoint)
+	}
+	batch.finish()
+
+	batch.ID = len(s.batches) + 1
+	s.batches = append(s.batches, copyTransferBatch(batch))
+	return s.saveIdempotentResponse(key, batch)
+}
+
+func (s *MemoryStore) GetTransferBatch(id int) (*TransferBatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > len(s.batches) {
+		return nil, errTransferBatchNotFound(id)
+	}
+	return copyTransferBatch(s.batches[id-1]), nil
+}
+
+func copyTransferBatch(batch *TransferBatch) *TransferBatch {
+	copied := *batch
+	copied.Items = make([]*TransferBatchItem, len(batch.Items))
+	for i, item := range batch.Items {
+		copiedItem := *item
+		copied.Items[i] = &copiedItem
+	}
+	return &copied
+}
+
+// memorySavepoint is the state transfers change, kept to undo them like a
+// database savepoint.
+type memorySavepoint struct {
+	balances           map[int]Money
+	journal            int
+	transactions       int
+	nextJournalEntryID int
+	nextPostingID      int
+	nextTransactionID  int
+}
+
+func (s *MemoryStore) savepoint() *memorySavepoint {
+	savepoint := &memorySavepoint{
+		balances:           map[int]Money{},
+		journal:            len(s.journal),
+		transactions:       len(s.transactions),
+		nextJournalEntryID: s.nextJournalEntryID,
+		nextPostingID:      s.nextPostingID,
+		nextTransactionID:  s.nextTransactionID,
+	}
+	for id, account := range s.accounts {
+		savepoint.balances[id] = account.Balance
+	}
+	return savepoint
+}
+
+func (s *MemoryStore) rollbackTo(savepoint *memorySavepoint) {
+	for id, balance := range savepoint.balances {
+		s.accounts[id].Balance = balance
+	}
+	s.journal = s.journal[:savepoint.journal]
+	s.transactions = s.transactions[:savepoint.transactions]
+	s.nextJournalEntryID = savepoint.nextJournalEntryID
+	s.nextPostingID = savepoint.nextPostingID
+	s.nextTransactionID = savepoint.nextTransactionID
+}
+
+func (s *MemoryStore) Deposit(iban string, amount Money, reference string, actor string, key *IdempotencyKey) (*Transaction, error) {
+	return s.moveCash(iban, Credit, amount, reference, actor, key)
+}
+
+func (s *MemoryStore) Withdraw(iban string, amount Money, reference string, actor string, key *IdempotencyKey) (*Transaction, error) {
+	return s.moveCash(iban, Debit, amount, reference, actor, key)
+}
+
+func (s *MemoryStore) moveCash(iban string, direction PostingDirection, amount Money, reference string, actor string, key *IdempotencyKey) (*Transaction, error) {
+	if !amount.IsPositive() {
+		return nil, errAmountNotPositive()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if replayed, err := s.claimIdempotencyKey(key); err != nil || replayed {
+		return nil, err
+	}
+
+	account, err := s.accountByIban(iban)
+	if err != nil {
+		return nil, err
+	}
+	checkStatus := checkCanReceive
+	if direction == Debit {
+		checkStatus = checkCanSend
+	}
+	if err := checkStatus(account); err != nil {
+		return nil, err
+	}
+	if err := s.reconcileAccount(account); err != nil {
+		return nil, err
+	}
+	if !account.Balance.SameCurrency(amount) {
+		return nil, errCurrencyMismatch()
+	}
+	balance := account.Balance.Add(amount)
+	if direction == Debit {
+		if amount.Cmp(account.Balance) > 0 {
+			return nil, errInsufficientFunds()
+		}
+		balance = account.Balance.Sub(amount)
+	}
+
+	entry := newCashEntry(iban, direction, amount, reference, time.Now().UTC())
+	if err := s.postJournalEntry(entry); err != nil {
+		return nil, err
+	}
+	account.Balance = balance
+
+	transaction := &Transaction{
+		JournalEntryID: entry.ID,
+		Kind:           entry.Kind,
+		AccountIban:    iban,
+		Direction:      direction,
+		Amount:         amount,
+		BalanceAfter:   balance,
+		Reference:      reference,
+		CreatedAt:      entry.CreatedAt,
+	}
+	s.insertTransaction(transaction)
+	s.insertAuditEvent(cashEvent(transaction, actor))
+
+	if err := s.saveIdempotentResponse(key, transaction); err != nil {
+		return nil, err
+	}
+	copied := *transaction
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetLedgerBalance(iban string, asOf time.Time) (Money, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.accountByIban(iban)
+	if err != nil {
+		return Money{}, err
+	}
+	return s.ledgerBalance(account, asOf), nil
+}
+
+func (s *MemoryStore) GetTransactions(iban string, filter *TransactionFilter) ([]*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transactions := []*Transaction{}
+	for i := len(s.transactions) - 1; i >= 0 && len(transactions) < filter.Limit; i-- {
+		transaction := s.transactions[i]
+		if transaction.AccountIban != iban ||
+			(filter.Cursor != 0 && transaction.ID >= filter.Cursor) ||
+			(!filter.From.IsZero() && transaction.CreatedAt.Before(filter.From)) ||
+			(!filter.To.IsZero() && !transaction.CreatedAt.Before(filter.To)) {
+			continue
+		}
+		copied := *transaction
+		transactions = append(transactions, &copied)
+	}
+	return transactions, nil
+}
+
+func (s *MemoryStore) CreateSession(session *Session, refreshToken *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *session
+	s.sessions[session.ID] = &stored
+	refreshToken.SessionID = session.ID
+	storedToken := *refreshToken
+	s.refreshTokens[refreshToken.Hash] = &storedToken
+	return nil
+}
+
+func (s *MemoryStore) RotateRefreshToken(hash string, next *RefreshToken) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.refreshTokens[hash]
+	if !ok {
+		return nil, errInvalidRefreshToken()
+	}
+	session := s.sessions[current.SessionID]
+	if session.RevokedAt != nil {
+		return nil, errInvalidRefreshToken()
+	}
+
+	now := time.Now().UTC()
+	if current.UsedAt != nil {
+		// the token was used before, so someone else holds a copy of it
+		session.RevokedAt = &now
+		return nil, errInvalidRefreshToken()
+	}
+	if !current.ExpiresAt.After(now) {
+		return nil, errInvalidRefreshToken()
+	}
+
+	current.UsedAt = &now
+	next.SessionID = session.ID
+	storedToken := *next
+	s.refreshTokens[next.Hash] = &storedToken
+
+	copied := *session
+	return &copied, nil
+}
+
+func (s *MemoryStore) RevokeSession(sessionID string, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	if session, ok := s.sessions[sessionID]; ok && session.RevokedAt == nil {
+		session.RevokedAt = &now
+	}
+	for revoked, expiry := range s.revokedTokens {
+		if expiry.Before(now) {
+			delete(s.revokedTokens, revoked)
+		}
+	}
+	s.revokedTokens[jti] = expiresAt
+	return nil
+}
+
+func (s *MemoryStore) IsTokenRevoked(jti string, sessionID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.revokedTokens[jti]; ok {
+		return true, nil
+	}
+	session, ok := s.sessions[sessionID]
+	return !ok || session.RevokedAt != nil, nil
+}
+
+func (s *MemoryStore) GetLoginThrottle(kind, subject string) (*LoginThrottle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	throttle, ok := s.loginThrottles[kind+"\x00"+subject]
+	if !ok {
+		return &LoginThrottle{Kind: kind, Subject: subject}, nil
+	}
+	copied := *throttle
+	return &copied, nil
+}
+
+func (s *MemoryStore) RecordLoginFailure(kind, subject string, policy LoginPolicy) (*LoginThrottle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	throttle, ok := s.loginThrottles[kind+"\x00"+subject]
+	if !ok {
+		throttle = &LoginThrottle{Kind: kind, Subject: subject}
+		s.loginThrottles[kind+"\x00"+subject] = throttle
+	}
+	if throttle.recordFailure(policy, time.Now().UTC()) {
+		s.insertAuditEvent(throttle.lockoutEvent())
+	}
+	copied := *throttle
+	return &copied, nil
+}
+
+func (s *MemoryStore) ResetLoginThrottle(kind, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loginThrottles, kind+"\x00"+subject)
+	return nil
+}
+
+func (s *MemoryStore) UnlockLogin(subject string, actor string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loginThrottles, ThrottleAccount+"\x00"+subject)
+	s.insertAuditEvent(&AuditEvent{Kind: AuditAccountUnlocked, Actor: actor, Subject: subject, Message: "Unlocked by staff", CreatedAt: time.Now().UTC()})
+	return nil
+}
+
+func (s *MemoryStore) GetAuditEvents(subject string, limit int) ([]*AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := []*AuditEvent{}
+	for i := len(s.auditEvents) - 1; i >= 0 && len(events) < limit; i-- {
+		if subject != "" && s.auditEvents[i].Subject != subject {
+			continue
+		}
+		copied := *s.auditEvents[i]
+		events = append(events, &copied)
+	}
+	return events, nil
+}
+
+func (s *MemoryStore) GetTOTPEnrolment(subject string) (*TOTPEnrolment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enrolment, ok := s.totpEnrolments[subject]
+	if !ok {
+		return nil, nil
+	}
+	copied := *enrolment
+	return &copied, nil
+}
+
+func (s *MemoryStore) SaveTOTPEnrolment(enrolment *TOTPEnrolment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.totpEnrolments[enrolment.Subject]; ok && existing.Enabled() {
+		return errTOTPAlreadyEnabled()
+	}
+	stored := *enrolment
+	s.totpEnrolments[enrolment.Subject] = &stored
+	return nil
+}
+
+func (s *MemoryStore) ConfirmTOTPEnrolment(subject string, step int64, recoveryCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enrolment, ok := s.totpEnrolments[subject]
+	if !ok || enrolment.Enabled() {
+		return errTOTPAlreadyEnabled()
+	}
+	now := time.Now().UTC()
+	enrolment.ConfirmedAt = &now
+	enrolment.LastUsedStep = step
+
+	codes := map[string]bool{}
+	for _, hash := range recoveryCodeHashes {
+		codes[hash] = true
+	}
+	s.recoveryCodes[subject] = codes
+	return nil
+}
+
+func (s *MemoryStore) DeleteTOTPEnrolment(subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.totpEnrolments, subject)
+	delete(s.recoveryCodes, subject)
+	return nil
+}
+
+func (s *MemoryStore) UseTOTPStep(subject string, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enrolment, ok := s.totpEnrolments[subject]
+	if !ok || !enrolment.Enabled() || enrolment.LastUsedStep >= step {
+		return errInvalidSecondFactor()
+	}
+	enrolment.LastUsedStep = step
+	return nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(subject string, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// used codes are removed; the SQL stores keep them with their use time
+	if !s.recoveryCodes[subject][hash] {
+		return errInvalidSecondFactor()
+	}
+	delete(s.recoveryCodes[subject], hash)
+	return nil
+}
+
+func (s *MemoryStore) CreateLoginChallenge(challenge *LoginChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *challenge
+	s.loginChallenges[challenge.ID] = &stored
+	return nil
+}
+
+func (s *MemoryStore) GetLoginChallenge(id string) (*LoginChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge, ok := s.loginChallenges[id]
+	if !ok || !challenge.ExpiresAt.After(time.Now().UTC()) {
+		return nil, errInvalidLoginChallenge()
+	}
+	copied := *challenge
+	return &copied, nil
+}
+
+func (s *MemoryStore) CompleteLoginChallenge(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge, ok := s.loginChallenges[id]
+	if !ok || !challenge.ExpiresAt.After(time.Now().UTC()) {
+		return errInvalidLoginChallenge()
+	}
+	delete(s.loginChallenges, id)
+	return nil
+}
+
+func (s *MemoryStore) CreateStaffUser(user *StaffUser, actor string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.staffUsers[user.Username]; ok {
+		return errUsernameTaken(user.Username)
+	}
+	s.nextStaffUserID++
+	user.ID = s.nextStaffUserID
+	stored := *user
+	s.staffUsers[user.Username] = &stored
+	s.insertAuditEvent(staffCreatedEvent(user, actor))
+	return nil
+}
+
+func (s *MemoryStore) GetStaffUserByUsername(username string) (*StaffUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.staffUsers[username]
+	if !ok {
+		return nil, errStaffUserNotFound(username)
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetStaffUsers() ([]*StaffUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := []*StaffUser{}
+	for _, user := range s.staffUsers {
+		copied := *user
+		users = append(users, &copied)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (s *MemoryStore) SetExchangeRates(rates []*ExchangeRate, actor string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rate := range rates {
+		if err := rate.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, rate := range rates {
+		copied := *rate
+		s.rates[[2]string{rate.From, rate.To}] = &copied
+		s.insertAuditEvent(exchangeRateEvent(rate, actor))
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetExchangeRates() ([]*ExchangeRate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rates := []*ExchangeRate{}
+	for _, rate := range s.rates {
+		copied := *rate
+		rates = append(rates, &copied)
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].From != rates[j].From {
+			return rates[i].From < rates[j].From
+		}
+		return rates[i].To < rates[j].To
+	})
+	return rates, nil
+}
+
+func (s *MemoryStore) GetExchangeRate(from, to string) (*ExchangeRate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.exchangeRate(from, to)
+}
+
+func (s *MemoryStore) exchangeRate(from, to string) (*ExchangeRate, error) {
+	if rate, ok := s.rates[[2]string{from, to}]; ok {
+		copied := *rate
+		return &copied, nil
+	}
+	if rate, ok := s.rates[[2]string{to, from}]; ok {
+		return rate.Inverse(), nil
+	}
+	return nil, errExchangeRateUnavailable(from, to)
+}
+
+func (s *MemoryStore) CreateFXQuote(quote *FXQuote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *quote
+	s.fxQuotes[quote.ID] = &copied
+	return nil
+}
+
+func (s *MemoryStore) GetFXQuote(id string) (*FXQuote, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	quote, ok := s.fxQuotes[id]
+	if !ok {
+		return nil, errFXQuoteNotFound(id)
+	}
+	copied := *quote
+	return &copied, nil
+}
+
+// claimIdempotencyKey works like its SQL counterpart; the store's mutex
+// takes the place of the database transaction.
+func (s *MemoryStore) claimIdempotencyKey(key *IdempotencyKey) (bool, error) {
+	if key == nil {
+		return false, nil
+	}
+
+	stored, ok := s.keys[key.Scope+"\x00"+key.Key]
+	if !ok {
+		return false, nil
+	}
+	if stored.Fingerprint != key.Fingerprint {
+		return false, errIdempotencyKeyReused()
+	}
+	key.StatusCode = stored.StatusCode
+	key.Response = stored.Response
+	key.Replayed = true
+	return true, nil
+}
+
+func (s *MemoryStore) GetIdempotentResponse(key *IdempotencyKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.claimIdempotencyKey(key)
+	return err
+}
+
+func (s *MemoryStore) saveIdempotentResponse(key *IdempotencyKey, result any) error {
+	if key == nil {
+		return nil
+	}
+
+	statusCode, response, err := key.Render(result)
+	if err != nil {
+		return err
+	}
+	key.StatusCode, key.Response = statusCode, response
+	s.keys[key.Scope+"\x00"+key.Key] = &IdempotencyKey{
+		Key:         key.Key,
+		Scope:       key.Scope,
+		Fingerprint: key.Fingerprint,
+		StatusCode:  key.StatusCode,
+		Response:    key.Response,
+		CreatedAt:   key.CreatedAt,
+	}
+	return nil
+}
+
+// copyAccountHolder also fills in the username like the SQL stores' join
+// does.
+func (s *MemoryStore) copyAccountHolder(holder *AccountHolder) *AccountHolder {
+	copied := *holder
+	if customer, ok := s.customers[holder.CustomerID]; ok {
+		copied.Username = customer.Username
+	}
+	return &copied
+}
+
+func (s *MemoryStore) accountByIban(iban string) (*Account, error) {
+	id, ok := s.accountIbans[iban]
+	if !ok {
+		return nil, errAccountIbanNotFound(iban)
+	}
+	return s.accounts[id], nil
+}
+
+func (s *MemoryStore) ledgerBalance(account *Account, asOf time.Time) Money {
+	balance := NewMoney(0, account.Balance.Currency)
+	for _, entry := range s.journal {
+		if entry.CreatedAt.After(asOf) {
+			continue
+		}
+		for _, posting := range entry.Postings {
+			if posting.Account != account.IBAN || !posting.Amount.SameCurrency(balance) {
+				continue
+			}
+			if posting.Direction == Credit {
+				balance = balance.Add(posting.Amount)
+			} else {
+				balance = balance.Sub(posting.Amount)
+			}
+		}
+	}
+	return balance
+}
+
+func (s *MemoryStore) reconcileAccount(account *Account) error {
+	if s.ledgerBalance(account, time.Now().UTC()) != account.Balance {
+		return errLedgerMismatch(account.IBAN)
+	}
+	return nil
+}
+
+func (s *MemoryStore) postJournalEntry(entry *JournalEntry) error {
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+
+	s.nextJournalEntryID++
+	entry.ID = s.nextJournalEntryID
+	for _, posting := range entry.Postings {
+		s.nextPostingID++
+		posting.ID = s.nextPostingID
+		posting.JournalEntryID = entry.ID
+	}
+	s.journal = append(s.journal, entry)
+	return nil
+}
+
+func (s *MemoryStore) insertTransaction(transaction *Transaction) {
+	s.nextTransactionID++
+	transaction.ID = s.nextTransactionID
+	s.transactions = append(s.transactions, transaction)
+}
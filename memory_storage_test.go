@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStoreConcurrentTransfers(t *testing.T) {
+	store := NewMemoryStore()
+
+	sender := &Account{IBAN: "sender", Status: AccountStatusActive, Balance: NewMoney(1000, DefaultCurrency), CreatedAt: time.Now().UTC()}
+	receiver := &Account{IBAN: "receiver", Status: AccountStatusActive, Balance: NewMoney(0, DefaultCurrency), CreatedAt: time.Now().UTC()}
+	assert.NoError(t, store.CreateAccount(sender, nil))
+	assert.NoError(t, store.CreateAccount(receiver, nil))
+
+	// 150 transfers of 10 cents compete for a balance that covers only 100
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 150; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.TransferFunds("sender", "receiver", NewMoney(10, DefaultCurrency), "", nil); err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 100, succeeded)
+	sender, _ = store.GetAccountByIban("sender")
+	receiver, _ = store.GetAccountByIban("receiver")
+	assert.Equal(t, NewMoney(0, DefaultCurrency), sender.Balance)
+	assert.Equal(t, NewMoney(1000, DefaultCurrency), receiver.Balance)
+
+	ledgerBalance, err := store.GetLedgerBalance("receiver", time.Now().UTC())
+	assert.NoError(t, err)
+	assert.Equal(t, receiver.Balance, ledgerBalance)
+}
+
+func TestMemoryStoreFailedTransferLeavesNoTrace(t *testing.T) {
+	store := NewMemoryStore()
+
+	sender := &Account{IBAN: "sender", Status: AccountStatusActive, Balance: NewMoney(1000, DefaultCurrency), CreatedAt: time.Now().UTC()}
+	assert.NoError(t, store.CreateAccount(sender, nil))
+
+	_, err := store.TransferFunds("sender", "unknown", NewMoney(10, DefaultCurrency), "", nil)
+	assert.EqualError(t, err, "Account with IBAN number unknown not found")
+
+	sender, _ = store.GetAccountByIban("sender")
+	assert.Equal(t, NewMoney(1000, DefaultCurrency), sender.Balance)
+	transactions, err := store.GetTransactions("sender", &TransactionFilter{Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, transactions, 1)
+}
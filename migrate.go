@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is one versioned schema change. Migrations live in
+// migrations/<dialect>/<version>_<name>.up.sql with a matching .down.sql.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+type MigrationStatus struct {
+	Version          int
+	Name             string
+	AppliedAt        *time.Time
+	ChecksumMismatch bool
+}
+
+type appliedMigration struct {
+	version   int
+	checksum  string
+	appliedAt time.Time
+}
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migrator applies the embedded migrations of a store's dialect and records
+// them in the schema_migrations table.
+type Migrator struct {
+	store      *sqlStore
+	migrations []*Migration
+}
+
+func newMigrator(store *sqlStore) (*Migrator, error) {
+	dir, err := fs.Sub(migrationFiles, path.Join("migrations", store.dialect.name))
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{store: store, migrations: migrations}, nil
+}
+
+func loadMigrations(fsys fs.FS) ([]*Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("Invalid migration file name: %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("Migration %d has conflicting names %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+			sum := sha256.Sum256(content)
+			migration.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("Migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Up applies all pending migrations in order, each in its own transaction,
+// and returns how many were applied.
+func (m *Migrator) Up() (int, error) {
+	if err := m.verify(); err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, migration := range m.migrations {
+		done, err := m.apply(migration)
+		if err != nil {
+			return applied, fmt.Errorf("Migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		if done {
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+// Down reverts the given number of most recently applied migrations.
+func (m *Migrator) Down(steps int) (int, error) {
+	if err := m.verify(); err != nil {
+		return 0, err
+	}
+
+	reverted := 0
+	for i := len(m.migrations) - 1; i >= 0 && reverted < steps; i-- {
+		migration := m.migrations[i]
+		done, err := m.revert(migration)
+		if err != nil {
+			return reverted, fmt.Errorf("Reverting migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		if done {
+			reverted++
+		}
+	}
+	return reverted, nil
+}
+
+// Status lists every known migration and whether it has been applied.
+func (m *Migrator) Status() ([]*MigrationStatus, error) {
+	if err := m.createMigrationsTable(); err != nil {
+		return nil, err
+	}
+	applied, err := m.appliedMigrations(m.store)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []*MigrationStatus{}
+	for _, migration := range m.migrations {
+		status := &MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if record, ok := applied[migration.Version]; ok {
+			appliedAt := record.appliedAt
+			status.AppliedAt = &appliedAt
+			status.ChecksumMismatch = record.checksum != migration.Checksum
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (m *Migrator) createMigrationsTable() error {
+	query := `create table if not exists schema_migrations (
+		version integer primary key,
+		name varchar(255) not null,
+		checksum char(64) not null,
+		applied_at timestamp not null
+	)`
+	_, err := m.store.exec(query)
+	return err
+}
+
+func (m *Migrator) apply(migration *Migration) (bool, error) {
+	tx, err := m.store.begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.rollback()
+
+	if err := m.lock(tx); err != nil {
+		return false, err
+	}
+	applied, err := m.appliedMigrations(tx)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := applied[migration.Version]; ok {
+		return false, nil
+	}
+	adopted := false
+	if len(applied) == 0 {
+		if adopted, err = m.adoptUnversionedTables(tx, migration); err != nil {
+			return false, err
+		}
+	}
+
+	if !adopted {
+		if _, err := tx.exec(migration.Up); err != nil {
+			return false, err
+		}
+	}
+	query := `
+		insert into schema_migrations
+		(version, name, checksum, applied_at)
+		values
+		($1, $2, $3, $4)
+	`
+	if _, err := tx.exec(query, migration.Version, migration.Name, migration.Checksum, time.Now().UTC()); err != nil {
+		return false, err
+	}
+	return true, tx.commit()
+}
+
+func (m *Migrator) revert(migration *Migration) (bool, error) {
+	tx, err := m.store.begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.rollback()
+
+	if err := m.lock(tx); err != nil {
+		return false, err
+	}
+	applied, err := m.appliedMigrations(tx)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := applied[migration.Version]; !ok {
+		return false, nil
+	}
+
+	if _, err := tx.exec(migration.Down); err != nil {
+		return false, err
+	}
+	if _, err := tx.exec("delete from schema_migrations where version = $1", migration.Version); err != nil {
+		return false, err
+	}
+	return true, tx.commit()
+}
+
+// baselineColumns are the columns of the account table the server created
+// before migrations were introduced, which 0001_initial_schema reproduces.
+var baselineColumns = []string{"balance", "created_at", "first_name", "iban", "id", "last_name", "password"}
+
+// adoptUnversionedTables looks at a database without applied migrations
+// before its first migration runs. A database set up before migrations were
+// introduced holds just the baseline account table; it is adopted by
+// recording the first migration as applied instead of running it, and the
+// following migrations upgrade it. Any other tables are refused since their
+// schema is unknown.
+func (m *Migrator) adoptUnversionedTables(q querier, migration *Migration) (bool, error) {
+	tables, err := m.queryNames(q, m.store.dialect.listTables)
+	if err != nil {
+		return false, err
+	}
+	tables = slices.DeleteFunc(tables, func(table string) bool { return table == "schema_migrations" })
+	if len(tables) == 0 {
+		return false, nil
+	}
+	if migration.Version == 1 && slices.Equal(tables, []string{"account"}) {
+		columns, err := m.queryNames(q, m.store.dialect.listColumns, "account")
+		if err != nil {
+			return false, err
+		}
+		if slices.Equal(columns, baselineColumns) {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("Database has tables but no applied migrations: %s", strings.Join(tables, ", "))
+}
+
+// queryNames returns the single column the query selects, sorted.
+func (m *Migrator) queryNames(q querier, query string, args ...any) ([]string, error) {
+	rows, err := q.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, rows.Err()
+}
+
+// lock keeps concurrently starting instances from applying the same
+// migration twice.
+func (m *Migrator) lock(tx *sqlTx) error {
+	if tx.dialect.lockMigrations == "" {
+		return nil
+	}
+	_, err := tx.exec(tx.dialect.lockMigrations)
+	return err
+}
+
+type querier interface {
+	query(query string, args ...any) (*sql.Rows, error)
+}
+
+// appliedMigrations reads the schema_migrations table. Applied migrations
+// must match the embedded ones: an unknown version means the database was
+// migrated by a newer release, a changed checksum means a migration was
+// edited after it had been applied.
+func (m *Migrator) appliedMigrations(q querier) (map[int]*appliedMigration, error) {
+	rows, err := q.query("select version, checksum, applied_at from schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	known := map[int]*Migration{}
+	for _, migration := range m.migrations {
+		known[migration.Version] = migration
+	}
+
+	applied := map[int]*appliedMigration{}
+	for rows.Next() {
+		record := new(appliedMigration)
+		if err := rows.Scan(&record.version, &record.checksum, &record.appliedAt); err != nil {
+			return nil, err
+		}
+		if _, ok := known[record.version]; !ok {
+			return nil, fmt.Errorf("Database has unknown migration %d applied", record.version)
+		}
+		applied[record.version] = record
+	}
+	return applied, rows.Err()
+}
+
+// verify fails if an applied migration differs from the one embedded in
+// this binary.
+func (m *Migrator) verify() error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		if status.ChecksumMismatch {
+			return fmt.Errorf("Checksum mismatch for applied migration %d_%s", status.Version, status.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/beshoyabdelmalak/gobank/iban"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigratorUpDown(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	defer store.db.Close()
+
+	migrator, err := newMigrator(&store.sqlStore)
+	assert.NoError(t, err)
+
+	applied, err := migrator.Up()
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrator.migrations), applied)
+
+	// running up again is a no-op
+	applied, err = migrator.Up()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, applied)
+
+	statuses, err := migrator.Status()
+	assert.NoError(t, err)
+	for _, status := range statuses {
+		assert.NotNil(t, status.AppliedAt)
+		assert.False(t, status.ChecksumMismatch)
+	}
+
+	reverted, err := migrator.Down(len(migrator.migrations))
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrator.migrations), reverted)
+
+	_, err = store.exec("select count(*) from account")
+	assert.Error(t, err, "Expected the account table to be dropped")
+}
+
+func TestMigrateBalancesToMinorUnits(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	defer store.db.Close()
+
+	migrator, err := newMigrator(&store.sqlStore)
+	assert.NoError(t, err)
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+
+	// go back to before 0004_money_minor_units and store float balances
+	_, err = migrator.Down(len(migrator.migrations) - 3)
+	assert.NoError(t, err)
+	floats := []any{12.5, 0.125, 19.99, -2.5, nil}
+	for _, balance := range floats {
+		query := "insert into account (first_name, last_name, password, iban, balance, created_at) values ($1, $2, $3, $4, $5, $6)"
+		_, err = store.exec(query, "Ada", "Lovelace", "hash", "123456", balance, time.Now().UTC())
+		assert.NoError(t, err)
+	}
+
+	// the balances become cents, rounding half cents away from zero
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+	cents := []int64{1250, 13, 1999, -250, 0}
+	for i, expected := range cents {
+		var balance Money
+		query := "select balance, currency from account where id = $1"
+		assert.NoError(t, store.queryRow(query, i+1).Scan(&balance.Amount, &balance.Currency))
+		assert.Equal(t, NewMoney(expected, "EUR"), balance)
+	}
+
+	// and back into euros
+	_, err = migrator.Down(len(migrator.migrations) - 3)
+	assert.NoError(t, err)
+	for i, expected := range []float64{12.5, 0.13, 19.99, -2.5, 0} {
+		var balance float64
+		assert.NoError(t, store.queryRow("select balance from account where id = $1", i+1).Scan(&balance))
+		assert.Equal(t, expected, balance)
+	}
+}
+
+func TestMigrateLegacyAccountNumbersToIBANs(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	defer store.db.Close()
+
+	migrator, err := newMigrator(&store.sqlStore)
+	assert.NoError(t, err)
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+
+	// go back to before 0007_account_iban and store accounts with random
+	// numbers, two of them the same, and a transfer between them
+	_, err = migrator.Down(len(migrator.migrations) - 6)
+	assert.NoError(t, err)
+	now := time.Now().UTC()
+	ids := map[string][]int{}
+	balances := []int64{300, 200, 0}
+	for i, number := range []string{"42", "123456", "123456"} {
+		var id int
+		query := "insert into account (first_name, last_name, password, iban, balance, currency, created_at) values ($1, $2, $3, $4, $5, $6, $7) returning id"
+		assert.NoError(t, store.queryRow(query, "Ada", "Lovelace", "hash", number, balances[i], "EUR", now).Scan(&id))
+		ids[number] = append(ids[number], id)
+	}
+	post := func(kind string, postings ...*Posting) {
+		var entryID int
+		query := "insert into journal_entry (kind, description, created_at) values ($1, $2, $3) returning id"
+		assert.NoError(t, store.queryRow(query, kind, kind, now).Scan(&entryID))
+		for _, posting := range postings {
+			query := "insert into posting (journal_entry_id, account, direction, amount, currency, created_at) values ($1, $2, $3, $4, $5, $6)"
+			_, err := store.exec(query, entryID, posting.Account, posting.Direction, posting.Amount.Amount, "EUR", now)
+			assert.NoError(t, err)
+		}
+		query = "insert into account_transaction (journal_entry_id, kind, account_iban, counterparty_iban, direction, amount, balance_after, currency, created_at) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+		_, err := store.exec(query, entryID, kind, "42", "123456", Debit, 200, 300, "EUR", now)
+		assert.NoError(t, err)
+	}
+	post(journalKindDeposit,
+		&Posting{Account: cashLedger, Direction: Debit, Amount: NewMoney(500, "EUR")},
+		&Posting{Account: "42", Direction: Credit, Amount: NewMoney(500, "EUR")})
+	post(journalKindTransfer,
+		&Posting{Account: "42", Direction: Debit, Amount: NewMoney(200, "EUR")},
+		&Posting{Account: "123456", Direction: Credit, Amount: NewMoney(200, "EUR")})
+
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+
+	// every account has a valid IBAN of its own
+	ibans := map[int]string{}
+	for _, id := range append(ids["42"], ids["123456"]...) {
+		account, err := store.GetAccountById(id)
+		assert.NoError(t, err)
+		_, err = parseIBAN("iban", account.IBAN)
+		assert.NoError(t, err)
+		expected, err := iban.Generate(defaultIBANCountry, defaultIBANBankCode, int64(id))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, account.IBAN)
+		ibans[id] = account.IBAN
+	}
+	assert.Len(t, ibans, 3)
+
+	// the ledger and the statement follow the accounts, and a shared
+	// number stays with its oldest account
+	balance, err := store.GetLedgerBalance(ibans[ids["42"][0]], time.Now().UTC())
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(300, "EUR"), balance)
+	balance, err = store.GetLedgerBalance(ibans[ids["123456"][0]], time.Now().UTC())
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(200, "EUR"), balance)
+	var accountIban, counterpartyIban string
+	query := "select account_iban, counterparty_iban from account_transaction where kind = $1"
+	assert.NoError(t, store.queryRow(query, journalKindTransfer).Scan(&accountIban, &counterpartyIban))
+	assert.Equal(t, ibans[ids["42"][0]], accountIban)
+	assert.Equal(t, ibans[ids["123456"][0]], counterpartyIban)
+
+	// new accounts are numbered after the existing ones
+	number, err := store.NextAccountNumber()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(ids["123456"][1]+1), number)
+}
+
+func TestMigrateAdminAccountsToStaffUsers(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	defer store.db.Close()
+
+	migrator, err := newMigrator(&store.sqlStore)
+	assert.NoError(t, err)
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+
+	// go back to before 0012_staff_users and store an admin account
+	_, err = migrator.Down(len(migrator.migrations) - 11)
+	assert.NoError(t, err)
+	query := "insert into account (first_name, last_name, password, iban, currency, role, created_at) values ($1, $2, $3, $4, $5, $6, $7)"
+	_, err = store.exec(query, "Ada", "Admin", "hash", "DE89370400440532013000", "EUR", RoleAdmin, time.Now().UTC())
+	assert.NoError(t, err)
+
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+	user, err := store.GetStaffUserByUsername("DE89370400440532013000")
+	assert.NoError(t, err)
+	assert.Equal(t, RoleAdmin, user.Role)
+	assert.Equal(t, "hash", user.EncryptedPassword)
+	account, err := store.GetAccountByIban("DE89370400440532013000")
+	assert.NoError(t, err)
+	assert.Equal(t, AccountStatusActive, account.Status)
+}
+
+func TestMigrateAccountsToCustomers(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	defer store.db.Close()
+
+	migrator, err := newMigrator(&store.sqlStore)
+	assert.NoError(t, err)
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+
+	// go back to before 0013_customers and store an account with a session
+	// and two-factor authentication
+	_, err = migrator.Down(len(migrator.migrations) - 12)
+	assert.NoError(t, err)
+	accountIban := "DE89370400440532013000"
+	query := "insert into account (first_name, last_name, password, iban, currency, created_at) values ($1, $2, $3, $4, $5, $6)"
+	_, err = store.exec(query, "Ada", "Lovelace", "hash", accountIban, "EUR", time.Now().UTC())
+	assert.NoError(t, err)
+	_, err = store.exec("insert into session (id, subject, created_at) values ($1, $2, $3)", "session", accountIban, time.Now().UTC())
+	assert.NoError(t, err)
+	_, err = store.exec("insert into totp_enrolment (iban, secret, created_at) values ($1, $2, $3)", accountIban, "secret", time.Now().UTC())
+	assert.NoError(t, err)
+
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+	customer, err := store.GetCustomerByLogin(accountIban)
+	assert.NoError(t, err)
+	assert.Equal(t, "Ada", customer.FirstName)
+	assert.Equal(t, "hash", customer.EncryptedPassword)
+	account, err := store.GetAccountByIban(accountIban)
+	assert.NoError(t, err)
+	assert.Equal(t, customer.ID, account.CustomerID)
+	assert.Equal(t, AccountTypeCurrent, account.Type)
+
+	subject := customerSubject(customer.ID)
+	var sessionSubject string
+	assert.NoError(t, store.queryRow("select subject from session where id = $1", "session").Scan(&sessionSubject))
+	assert.Equal(t, subject, sessionSubject)
+	enrolment, err := store.GetTOTPEnrolment(subject)
+	assert.NoError(t, err)
+	assert.NotNil(t, enrolment)
+}
+
+func TestMigrateAccountOwnersToHolders(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	defer store.db.Close()
+
+	migrator, err := newMigrator(&store.sqlStore)
+	assert.NoError(t, err)
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+
+	// go back to before 0014_joint_accounts and store an account
+	_, err = migrator.Down(len(migrator.migrations) - 13)
+	assert.NoError(t, err)
+	customer, err := NewCustomer("ada", "ada@example.com", "correct horse", "Ada", "Lovelace")
+	assert.NoError(t, err)
+	assert.NoError(t, store.CreateCustomer(customer))
+	query := "insert into account (customer_id, iban, currency, created_at) values ($1, $2, $3, $4)"
+	_, err = store.exec(query, customer.ID, "DE89370400440532013000", "EUR", time.Now().UTC())
+	assert.NoError(t, err)
+	// every account needs a customer, as on postgres
+	_, err = store.exec(query, nil, "DE89370400440532013001", "EUR", time.Now().UTC())
+	assert.Error(t, err)
+
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+	accounts, err := store.GetAccountsByCustomer(customer.ID)
+	assert.NoError(t, err)
+	assert.Len(t, accounts, 1)
+	holder, err := store.GetAccountHolder(accounts[0].ID, customer.ID)
+	assert.NoError(t, err)
+	assert.True(t, holder.Permits(HolderPermissionManage))
+	assert.Nil(t, accounts[0].ApprovalLimit)
+}
+
+func TestMigrateOpeningBalances(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	defer store.db.Close()
+
+	migrator, err := newMigrator(&store.sqlStore)
+	assert.NoError(t, err)
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+
+	// go back to before 0021_opening_balances and store accounts with
+	// balances from before the ledger; the second one received a transfer
+	// since
+	_, err = migrator.Down(len(migrator.migrations) - 20)
+	assert.NoError(t, err)
+	customer, err := NewCustomer("ada", "ada@example.com", "correct horse", "Ada", "Lovelace")
+	assert.NoError(t, err)
+	assert.NoError(t, store.CreateCustomer(customer))
+	ibans := []string{}
+	for number, balance := range []int64{100000, 30000} {
+		accountIban, err := iban.Generate(defaultIBANCountry, defaultIBANBankCode, int64(number+1))
+		assert.NoError(t, err)
+		query := "insert into account (customer_id, iban, balance, currency, created_at) values ($1, $2, $3, $4, $5)"
+		_, err = store.exec(query, customer.ID, accountIban, balance, "EUR", time.Now().UTC())
+		assert.NoError(t, err)
+		ibans = append(ibans, accountIban)
+	}
+	tx, err := store.begin()
+	assert.NoError(t, err)
+	assert.NoError(t, store.postJournalEntry(tx, newCashEntry(ibans[1], Credit, NewMoney(5000, "EUR"), "", time.Now().UTC())))
+	_, err = tx.exec("update account set balance = balance + 5000 where iban = $1", ibans[1])
+	assert.NoError(t, err)
+	assert.NoError(t, tx.commit())
+
+	reconcile := func(accountIban string) error {
+		tx, err := store.begin()
+		assert.NoError(t, err)
+		defer tx.rollback()
+		account, err := store.lockAccount(tx, accountIban)
+		assert.NoError(t, err)
+		return store.reconcileAccount(tx, account)
+	}
+	for _, accountIban := range ibans {
+		assert.True(t, IsKind(reconcile(accountIban), KindInternal))
+	}
+	_, err = store.TransferFunds(ibans[0], ibans[1], NewMoney(100, "EUR"), "", nil)
+	assert.True(t, IsKind(err, KindInternal))
+
+	// the migration books what the postings do not explain
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+	for _, accountIban := range ibans {
+		assert.NoError(t, reconcile(accountIban))
+	}
+	_, err = store.TransferFunds(ibans[0], ibans[1], NewMoney(100, "EUR"), "", nil)
+	assert.NoError(t, err)
+
+	transactions, err := store.GetTransactions(ibans[1], &TransactionFilter{Limit: 10})
+	assert.NoError(t, err)
+	opening := transactions[len(transactions)-1]
+	assert.Equal(t, journalKindOpeningBalance, opening.Kind)
+	assert.Equal(t, NewMoney(30000, "EUR"), opening.Amount)
+	assert.Equal(t, Credit, opening.Direction)
+
+	// running it again books nothing more
+	_, err = migrator.Down(len(migrator.migrations) - 20)
+	assert.NoError(t, err)
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+	transactions, err = store.GetTransactions(ibans[0], &TransactionFilter{Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, transactions, 2)
+}
+
+func TestMigratorChecksumMismatch(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	defer store.db.Close()
+
+	migrator, err := newMigrator(&store.sqlStore)
+	assert.NoError(t, err)
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+
+	_, err = store.exec("update schema_migrations set checksum = $1 where version = 1", "edited")
+	assert.NoError(t, err)
+
+	statuses, err := migrator.Status()
+	assert.NoError(t, err)
+	assert.True(t, statuses[0].ChecksumMismatch)
+
+	_, err = migrator.Up()
+	assert.EqualError(t, err, "Checksum mismatch for applied migration 1_initial_schema")
+}
+
+func TestMigratorAdoptsBaselineSchema(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	defer store.db.Close()
+
+	// the account table as the server created it before migrations, with
+	// balances as floats of euros
+	_, err = store.exec(`create table account (
+		id integer primary key,
+		first_name varchar(70),
+		last_name varchar(70),
+		password varchar(100),
+		iban varchar(70),
+		balance float,
+		created_at timestamp
+	)`)
+	assert.NoError(t, err)
+	query := "insert into account (first_name, last_name, password, iban, balance, created_at) values ($1, $2, $3, $4, $5, $6)"
+	for _, balance := range []any{12.5, 19.99, nil} {
+		_, err = store.exec(query, "Ada", "Lovelace", "hash", "123456", balance, time.Now().UTC())
+		assert.NoError(t, err)
+	}
+
+	migrator, err := newMigrator(&store.sqlStore)
+	assert.NoError(t, err)
+	applied, err := migrator.Up()
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrator.migrations), applied)
+	statuses, err := migrator.Status()
+	assert.NoError(t, err)
+	assert.NotNil(t, statuses[0].AppliedAt)
+
+	// the accounts are upgraded with the rest of the schema
+	for id, balance := range map[int]Money{1: NewMoney(1250, "EUR"), 2: NewMoney(1999, "EUR"), 3: NewMoney(0, "EUR")} {
+		account, err := store.GetAccountById(id)
+		assert.NoError(t, err)
+		assert.Equal(t, balance, account.Balance)
+		_, err = parseIBAN("iban", account.IBAN)
+		assert.NoError(t, err)
+		customer, err := store.GetCustomerById(account.CustomerID)
+		assert.NoError(t, err)
+		assert.Equal(t, "Ada", customer.FirstName)
+	}
+}
+
+func TestMigratorRefusesUnknownSchema(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	defer store.db.Close()
+
+	// tables that are neither the baseline nor migrated
+	_, err = store.exec("create table account (id integer primary key, iban varchar(70))")
+	assert.NoError(t, err)
+	_, err = store.exec("create table ledger (id integer primary key)")
+	assert.NoError(t, err)
+
+	migrator, err := newMigrator(&store.sqlStore)
+	assert.NoError(t, err)
+	_, err = migrator.Up()
+	assert.EqualError(t, err, "Migration 1_initial_schema failed: Database has tables but no applied migrations: account, ledger")
+	_, err = store.exec("drop table ledger")
+	assert.NoError(t, err)
+	_, err = migrator.Up()
+	assert.EqualError(t, err, "Migration 1_initial_schema failed: Database has tables but no applied migrations: account")
+
+	// nothing was applied
+	statuses, err := migrator.Status()
+	assert.NoError(t, err)
+	assert.Nil(t, statuses[0].AppliedAt)
+
+	// once the tables are gone the database is migrated from scratch, and
+	// one that was migrated down completely can go up again
+	_, err = store.exec("drop table account")
+	assert.NoError(t, err)
+	applied, err := migrator.Up()
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrator.migrations), applied)
+	_, err = migrator.Down(len(migrator.migrations))
+	assert.NoError(t, err)
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+}
+
+func TestLoadMigrationsRequiresDownFile(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0001_first.up.sql":   {Data: []byte("create table a (id integer)")},
+		"0001_first.down.sql": {Data: []byte("drop table a")},
+		"0002_second.up.sql":  {Data: []byte("create table b (id integer)")},
+	}
+
+	_, err := loadMigrations(fsys)
+	assert.EqualError(t, err, "Migration 2_second needs both an up and a down file")
+}
@@ -0,0 +1,11 @@
+-- The account table as the server created it before migrations were
+-- introduced. Databases that already have it are adopted at this version.
+create table account (
+	id serial primary key,
+	first_name varchar(70),
+	last_name varchar(70),
+	password varchar(100),
+	iban varchar(70),
+	balance float,
+	created_at timestamp
+);
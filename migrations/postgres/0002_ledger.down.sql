@@ -0,0 +1,3 @@
+drop table posting;
+
+drop table journal_entry;
@@ -0,0 +1,18 @@
+create table journal_entry (
+	id serial primary key,
+	kind varchar(30) not null,
+	description varchar(255),
+	created_at timestamp not null
+);
+
+create table posting (
+	id serial primary key,
+	journal_entry_id integer not null references journal_entry(id),
+	account varchar(70) not null,
+	direction varchar(6) not null check (direction in ('debit', 'credit')),
+	amount bigint not null check (amount > 0),
+	currency char(3) not null,
+	created_at timestamp not null
+);
+
+create index posting_account_idx on posting (account, created_at);
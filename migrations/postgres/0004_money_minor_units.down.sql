@@ -0,0 +1,5 @@
+alter table account drop column currency;
+
+alter table account alter column balance drop not null;
+alter table account alter column balance drop default;
+alter table account alter column balance type float using balance / 100.0;
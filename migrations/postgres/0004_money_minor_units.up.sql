@@ -0,0 +1,8 @@
+-- Balances were floats of euros. They become whole cents, half cents
+-- rounded away from zero, and every account so far holds euros.
+alter table account alter column balance type bigint using round(coalesce(balance, 0)::numeric * 100)::bigint;
+alter table account alter column balance set default 0;
+alter table account alter column balance set not null;
+
+alter table account add column currency char(3) not null default 'EUR';
+alter table account alter column currency drop default;
@@ -0,0 +1,3 @@
+alter table account drop constraint account_iban_key;
+
+drop sequence account_number_seq;
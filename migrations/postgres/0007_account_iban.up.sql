@@ -0,0 +1,42 @@
+-- Account numbers are drawn from a sequence and turned into IBANs with
+-- check digits by the application.
+create sequence account_number_seq;
+
+-- Accounts opened before have random numbers instead of IBANs, and these
+-- may be shared. They get IBANs like new accounts, from the default country
+-- DE and bank code 10010010 with their id as the account number, and the
+-- sequence continues after the highest id. Postings and transactions follow
+-- their account; those of a shared number go to the oldest account with it,
+-- the one the server used to find first.
+create table account_iban_change (
+	id integer primary key,
+	old_iban varchar(70),
+	bban varchar(30) not null,
+	new_iban varchar(70)
+);
+
+insert into account_iban_change (id, old_iban, bban)
+select id, iban, '10010010' || lpad(id::text, 10, '0') from account;
+
+update account_iban_change
+set new_iban = 'DE' || lpad((98 - (bban || '131400')::numeric % 97)::text, 2, '0') || bban;
+
+update posting set account = (
+	select c.new_iban from account_iban_change c where c.old_iban = posting.account order by c.id limit 1
+) where account in (select old_iban from account_iban_change);
+
+update account_transaction set account_iban = (
+	select c.new_iban from account_iban_change c where c.old_iban = account_transaction.account_iban order by c.id limit 1
+) where account_iban in (select old_iban from account_iban_change);
+
+update account_transaction set counterparty_iban = (
+	select c.new_iban from account_iban_change c where c.old_iban = account_transaction.counterparty_iban order by c.id limit 1
+) where counterparty_iban in (select old_iban from account_iban_change);
+
+update account set iban = (select c.new_iban from account_iban_change c where c.id = account.id);
+
+select setval('account_number_seq', max(id)) from account;
+
+drop table account_iban_change;
+
+alter table account add constraint account_iban_key unique (iban);
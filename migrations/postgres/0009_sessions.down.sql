@@ -0,0 +1,3 @@
+drop table revoked_token;
+drop table refresh_token;
+drop table session;
@@ -0,0 +1,20 @@
+create table session (
+	id varchar(64) primary key,
+	iban varchar(70) not null,
+	created_at timestamp not null,
+	revoked_at timestamp
+);
+
+create table refresh_token (
+	token_hash char(64) primary key,
+	session_id varchar(64) not null references session(id) on delete cascade,
+	expires_at timestamp not null,
+	used_at timestamp,
+	created_at timestamp not null
+);
+
+-- Access tokens revoked before they expire, looked up by their jti claim.
+create table revoked_token (
+	jti varchar(64) primary key,
+	expires_at timestamp not null
+);
@@ -0,0 +1,19 @@
+create table login_throttle (
+	kind varchar(10) not null,
+	subject varchar(70) not null,
+	failures integer not null default 0,
+	last_failure_at timestamp,
+	locked_until timestamp,
+	primary key (kind, subject)
+);
+
+create table audit_event (
+	id serial primary key,
+	kind varchar(50) not null,
+	actor varchar(70) not null,
+	subject varchar(70) not null,
+	message varchar(255) not null,
+	created_at timestamp not null
+);
+
+create index audit_event_subject_idx on audit_event (subject, id);
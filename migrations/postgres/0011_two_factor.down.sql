@@ -0,0 +1,3 @@
+drop table login_challenge;
+drop table recovery_code;
+drop table totp_enrolment;
@@ -0,0 +1,22 @@
+create table totp_enrolment (
+	iban varchar(70) primary key,
+	secret varchar(64) not null,
+	confirmed_at timestamp,
+	last_used_step bigint not null default 0,
+	created_at timestamp not null
+);
+
+create table recovery_code (
+	iban varchar(70) not null,
+	code_hash char(64) not null,
+	used_at timestamp,
+	primary key (iban, code_hash)
+);
+
+create table login_challenge (
+	id varchar(64) primary key,
+	iban varchar(70) not null,
+	expires_at timestamp not null,
+	used_at timestamp,
+	created_at timestamp not null
+);
@@ -0,0 +1,9 @@
+delete from refresh_token where session_id in (select id from session where subject like 'staff:%');
+delete from session where subject like 'staff:%';
+alter table session rename column subject to iban;
+
+alter table account drop column status;
+alter table account add column role varchar(20) not null default 'customer';
+update account set role = 'admin' where iban in (select username from staff_user where role = 'admin');
+
+drop table staff_user;
@@ -0,0 +1,19 @@
+create table staff_user (
+	id serial primary key,
+	username varchar(64) not null unique,
+	password varchar(100) not null,
+	role varchar(20) not null,
+	created_at timestamp not null
+);
+
+-- Admins used to be accounts with the admin role. They become staff users
+-- that log in with their IBAN as username.
+insert into staff_user (username, password, role, created_at)
+select iban, password, 'admin', created_at from account where role = 'admin';
+
+alter table account drop column role;
+alter table account add column status varchar(20) not null default 'active';
+
+-- Sessions belong to an account (subject is its IBAN) or to a staff user
+-- (subject is "staff:" followed by the username).
+alter table session rename column iban to subject;
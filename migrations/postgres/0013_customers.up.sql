@@ -0,0 +1,37 @@
+create table customer (
+	id serial primary key,
+	username varchar(64) not null unique,
+	email varchar(254) unique,
+	first_name varchar(70),
+	last_name varchar(70),
+	password varchar(100) not null,
+	created_at timestamp not null
+);
+
+-- Every existing account becomes a customer that logs in with the IBAN as
+-- username.
+insert into customer (username, first_name, last_name, password, created_at)
+select iban, first_name, last_name, coalesce(password, ''), coalesce(created_at, current_timestamp) from account;
+
+alter table account add column customer_id integer references customer(id);
+update account set customer_id = (select c.id from customer c where c.username = account.iban);
+alter table account alter column customer_id set not null;
+create index account_customer_idx on account (customer_id);
+alter table account add column type varchar(20) not null default 'current';
+alter table account drop column first_name;
+alter table account drop column last_name;
+alter table account drop column password;
+
+-- Sessions, login throttles and two-factor authentication belong to the
+-- customer now, whose subject is "customer:" followed by the id.
+update session set subject = 'customer:' || (select c.id from customer c where c.username = session.subject)
+where subject in (select username from customer);
+update login_throttle set subject = 'customer:' || (select c.id from customer c where c.username = login_throttle.subject)
+where kind = 'account' and subject in (select username from customer);
+
+alter table totp_enrolment rename column iban to subject;
+update totp_enrolment set subject = 'customer:' || (select c.id from customer c where c.username = totp_enrolment.subject);
+alter table recovery_code rename column iban to subject;
+update recovery_code set subject = 'customer:' || (select c.id from customer c where c.username = recovery_code.subject);
+alter table login_challenge rename column iban to subject;
+update login_challenge set subject = 'customer:' || (select c.id from customer c where c.username = login_challenge.subject);
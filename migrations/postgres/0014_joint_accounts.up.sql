@@ -0,0 +1,39 @@
+-- Accounts can have several holders, each with a permission of view,
+-- transfer or manage. Invited holders have no access until they accept.
+create table account_holder (
+	account_id integer not null references account(id) on delete cascade,
+	customer_id integer not null references customer(id),
+	permission varchar(20) not null,
+	status varchar(20) not null,
+	invited_by integer references customer(id),
+	created_at timestamp not null,
+	accepted_at timestamp,
+	primary key (account_id, customer_id)
+);
+
+create index account_holder_customer_idx on account_holder (customer_id);
+
+-- The customer who opened an account manages it.
+insert into account_holder (account_id, customer_id, permission, status, created_at, accepted_at)
+select id, customer_id, 'manage', 'active', created_at, created_at from account;
+
+-- Transfers above the approval limit of an account with several holders
+-- wait for another holder to approve them. The limit is in minor units of
+-- the account currency; null means no limit.
+alter table account add column approval_limit bigint;
+
+create table transfer_approval (
+	id serial primary key,
+	from_iban varchar(70) not null,
+	to_iban varchar(70) not null,
+	amount bigint not null check (amount > 0),
+	currency char(3) not null,
+	status varchar(20) not null,
+	requested_by integer not null references customer(id),
+	decided_by integer references customer(id),
+	transaction_id integer,
+	created_at timestamp not null,
+	decided_at timestamp
+);
+
+create index transfer_approval_from_idx on transfer_approval (from_iban, id);
@@ -0,0 +1,4 @@
+drop index scheduled_transfer_standing_order_idx;
+alter table scheduled_transfer drop column max_attempts;
+alter table scheduled_transfer drop column standing_order_id;
+drop table standing_order;
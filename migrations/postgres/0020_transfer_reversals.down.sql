@@ -0,0 +1,2 @@
+drop index account_transaction_original_idx;
+alter table account_transaction drop column original_transaction_id;
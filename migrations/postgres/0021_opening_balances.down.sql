@@ -0,0 +1,2 @@
+-- The opening balances stay booked: without them the balances of the
+-- accounts would no longer reconcile.
@@ -0,0 +1,48 @@
+-- Accounts opened before the ledger hold a balance without postings, or
+-- with postings only for what moved since, and fail reconciliation. What
+-- the postings do not explain is booked as their opening balance, dated
+-- when the account was opened, like the opening balance of a new account.
+create table opening_balance (
+	iban varchar(70) primary key,
+	amount bigint not null,
+	currency char(3) not null,
+	created_at timestamp not null,
+	journal_entry_id integer
+);
+
+insert into opening_balance (iban, amount, currency, created_at)
+select iban, amount, currency, created_at from (
+	select a.iban, a.balance - coalesce((
+		select sum(case when p.direction = 'credit' then p.amount else -p.amount end)
+		from posting p
+		where p.account = a.iban and p.currency = a.currency
+	), 0) as amount, a.currency, coalesce(a.created_at, current_timestamp) as created_at
+	from account a
+	where not exists (
+		select 1 from posting p join journal_entry j on j.id = p.journal_entry_id
+		where p.account = a.iban and j.kind = 'opening_balance'
+	)
+) unexplained
+where amount <> 0;
+
+insert into journal_entry (kind, description, created_at)
+select 'opening_balance', 'Opening balance of ' || iban, created_at from opening_balance;
+
+update opening_balance set journal_entry_id = (
+	select max(j.id) from journal_entry j
+	where j.kind = 'opening_balance' and j.description = 'Opening balance of ' || opening_balance.iban
+);
+
+insert into posting (journal_entry_id, account, direction, amount, currency, created_at)
+select journal_entry_id, 'gobank:equity:opening-balance', case when amount > 0 then 'debit' else 'credit' end, abs(amount), currency, created_at
+from opening_balance;
+
+insert into posting (journal_entry_id, account, direction, amount, currency, created_at)
+select journal_entry_id, iban, case when amount > 0 then 'credit' else 'debit' end, abs(amount), currency, created_at
+from opening_balance;
+
+insert into account_transaction (journal_entry_id, kind, account_iban, direction, amount, balance_after, currency, created_at)
+select journal_entry_id, 'opening_balance', iban, case when amount > 0 then 'credit' else 'debit' end, abs(amount), amount, currency, created_at
+from opening_balance;
+
+drop table opening_balance;
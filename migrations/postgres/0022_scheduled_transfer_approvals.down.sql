@@ -0,0 +1 @@
+alter table scheduled_transfer drop column approval_id;
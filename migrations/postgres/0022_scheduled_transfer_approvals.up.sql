@@ -0,0 +1,3 @@
+-- Scheduled transfers above the approval limit of a joint account at their
+-- execution wait for the approval named here.
+alter table scheduled_transfer add column approval_id integer;
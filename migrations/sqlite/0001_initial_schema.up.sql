@@ -0,0 +1,11 @@
+-- The account table as the server created it before migrations were
+-- introduced.
+create table account (
+	id integer primary key autoincrement,
+	first_name varchar(70),
+	last_name varchar(70),
+	password varchar(100),
+	iban varchar(70),
+	balance float,
+	created_at timestamp
+);
@@ -0,0 +1,14 @@
+create table account_transaction (
+	id integer primary key autoincrement,
+	journal_entry_id integer not null references journal_entry(id),
+	kind varchar(30) not null,
+	account_iban varchar(70) not null,
+	counterparty_iban varchar(70),
+	direction varchar(6) not null check (direction in ('debit', 'credit')),
+	amount bigint not null,
+	balance_after bigint not null,
+	currency char(3) not null,
+	created_at timestamp not null
+);
+
+create index account_transaction_account_idx on account_transaction (account_iban, id);
@@ -0,0 +1,16 @@
+create table account_old (
+	id integer primary key autoincrement,
+	first_name varchar(70),
+	last_name varchar(70),
+	password varchar(100),
+	iban varchar(70),
+	balance float,
+	created_at timestamp
+);
+insert into account_old (id, first_name, last_name, password, iban, balance, created_at)
+select id, first_name, last_name, password, iban, balance / 100.0, created_at
+from account;
+delete from sqlite_sequence where name = 'account_old';
+insert into sqlite_sequence (name, seq) select 'account_old', seq from sqlite_sequence where name = 'account';
+drop table account;
+alter table account_old rename to account;
@@ -0,0 +1,21 @@
+-- Balances were floats of euros. They become whole cents, half cents
+-- rounded away from zero, and every account so far holds euros. SQLite
+-- cannot change the type of a column, so the table is rebuilt; its
+-- autoincrement counter is carried over.
+create table account_new (
+	id integer primary key autoincrement,
+	first_name varchar(70),
+	last_name varchar(70),
+	password varchar(100),
+	iban varchar(70),
+	balance bigint not null default 0,
+	currency char(3) not null,
+	created_at timestamp
+);
+insert into account_new (id, first_name, last_name, password, iban, balance, currency, created_at)
+select id, first_name, last_name, password, iban, cast(round(coalesce(balance, 0) * 100) as integer), 'EUR', created_at
+from account;
+delete from sqlite_sequence where name = 'account_new';
+insert into sqlite_sequence (name, seq) select 'account_new', seq from sqlite_sequence where name = 'account';
+drop table account;
+alter table account_new rename to account;
@@ -0,0 +1,9 @@
+create table idempotency_key (
+	scope varchar(255) not null,
+	idempotency_key varchar(255) not null,
+	fingerprint char(64) not null,
+	status_code integer,
+	response text,
+	created_at timestamp not null,
+	primary key (scope, idempotency_key)
+);
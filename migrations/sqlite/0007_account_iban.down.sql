@@ -0,0 +1,3 @@
+drop index account_iban_key;
+
+drop table account_number_seq;
@@ -0,0 +1,50 @@
+-- SQLite has no sequences, a single row counter takes their place.
+create table account_number_seq (
+	value integer not null
+);
+
+insert into account_number_seq (value) values (0);
+
+-- Accounts opened before have random numbers instead of IBANs, and these
+-- may be shared. They get IBANs like new accounts, from the default country
+-- DE and bank code 10010010 with their id as the account number, and the
+-- counter continues after the highest id. Postings and transactions follow
+-- their account; those of a shared number go to the oldest account with it,
+-- the one the server used to find first.
+create table account_iban_change (
+	id integer primary key,
+	old_iban varchar(70),
+	bban varchar(30) not null,
+	new_iban varchar(70)
+);
+
+insert into account_iban_change (id, old_iban, bban)
+select id, iban, '10010010' || substr('0000000000' || id, -10, 10) from account;
+
+-- the check digits are computed in two steps as the number, the BBAN
+-- followed by DE00 with the letters as digits, does not fit into an integer
+update account_iban_change
+set new_iban = 'DE' || substr('0' || (98 - (
+	(cast(substr(bban || '131400', 1, 12) as integer) % 97) * 1000000000000
+	+ cast(substr(bban || '131400', 13) as integer)
+) % 97), -2, 2) || bban;
+
+update posting set account = (
+	select c.new_iban from account_iban_change c where c.old_iban = posting.account order by c.id limit 1
+) where account in (select old_iban from account_iban_change);
+
+update account_transaction set account_iban = (
+	select c.new_iban from account_iban_change c where c.old_iban = account_transaction.account_iban order by c.id limit 1
+) where account_iban in (select old_iban from account_iban_change);
+
+update account_transaction set counterparty_iban = (
+	select c.new_iban from account_iban_change c where c.old_iban = account_transaction.counterparty_iban order by c.id limit 1
+) where counterparty_iban in (select old_iban from account_iban_change);
+
+update account set iban = (select c.new_iban from account_iban_change c where c.id = account.id);
+
+update account_number_seq set value = (select coalesce(max(id), 0) from account);
+
+drop table account_iban_change;
+
+create unique index account_iban_key on account (iban);
@@ -0,0 +1 @@
+alter table account_transaction drop column reference;
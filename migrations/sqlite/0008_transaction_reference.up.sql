@@ -0,0 +1 @@
+alter table account_transaction add column reference varchar(140);
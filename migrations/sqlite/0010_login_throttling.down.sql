@@ -0,0 +1,2 @@
+drop table audit_event;
+drop table login_throttle;
@@ -0,0 +1,27 @@
+-- Customers with several accounts log in with the IBAN of their first
+-- account again; what cannot be mapped back to an IBAN is dropped.
+delete from login_challenge;
+alter table login_challenge rename column subject to iban;
+delete from recovery_code where subject not in (select 'customer:' || customer_id from account);
+update recovery_code set subject = (select min(a.iban) from account a where 'customer:' || a.customer_id = recovery_code.subject);
+alter table recovery_code rename column subject to iban;
+delete from totp_enrolment where subject not in (select 'customer:' || customer_id from account);
+update totp_enrolment set subject = (select min(a.iban) from account a where 'customer:' || a.customer_id = totp_enrolment.subject);
+alter table totp_enrolment rename column subject to iban;
+
+delete from login_throttle where subject like 'customer:%';
+delete from refresh_token where session_id in (select id from session where subject like 'customer:%');
+delete from session where subject like 'customer:%';
+
+alter table account add column first_name varchar(70);
+alter table account add column last_name varchar(70);
+alter table account add column password varchar(100);
+update account set
+	first_name = (select c.first_name from customer c where c.id = account.customer_id),
+	last_name = (select c.last_name from customer c where c.id = account.customer_id),
+	password = (select c.password from customer c where c.id = account.customer_id);
+alter table account drop column type;
+drop index account_customer_idx;
+alter table account drop column customer_id;
+
+drop table customer;
@@ -0,0 +1,52 @@
+create table customer (
+	id integer primary key autoincrement,
+	username varchar(64) not null unique,
+	email varchar(254) unique,
+	first_name varchar(70),
+	last_name varchar(70),
+	password varchar(100) not null,
+	created_at timestamp not null
+);
+
+-- Every existing account becomes a customer that logs in with the IBAN as
+-- username.
+insert into customer (username, first_name, last_name, password, created_at)
+select iban, first_name, last_name, coalesce(password, ''), coalesce(created_at, current_timestamp) from account;
+
+-- SQLite cannot make a column not null after the fact, so the account table
+-- is rebuilt with the customer in place of the credentials. Nothing
+-- references it yet; its autoincrement counter is carried over so that ids
+-- of deleted accounts are not handed out again.
+create table account_new (
+	id integer primary key autoincrement,
+	customer_id integer not null references customer(id),
+	iban varchar(70),
+	type varchar(20) not null default 'current',
+	balance bigint not null default 0,
+	currency char(3) not null,
+	status varchar(20) not null default 'active',
+	created_at timestamp
+);
+insert into account_new (id, customer_id, iban, balance, currency, status, created_at)
+select id, (select c.id from customer c where c.username = account.iban), iban, balance, currency, status, created_at
+from account;
+delete from sqlite_sequence where name = 'account_new';
+insert into sqlite_sequence (name, seq) select 'account_new', seq from sqlite_sequence where name = 'account';
+drop table account;
+alter table account_new rename to account;
+create unique index account_iban_key on account (iban);
+create index account_customer_idx on account (customer_id);
+
+-- Sessions, login throttles and two-factor authentication belong to the
+-- customer now, whose subject is "customer:" followed by the id.
+update session set subject = 'customer:' || (select c.id from customer c where c.username = session.subject)
+where subject in (select username from customer);
+update login_throttle set subject = 'customer:' || (select c.id from customer c where c.username = login_throttle.subject)
+where kind = 'account' and subject in (select username from customer);
+
+alter table totp_enrolment rename column iban to subject;
+update totp_enrolment set subject = 'customer:' || (select c.id from customer c where c.username = totp_enrolment.subject);
+alter table recovery_code rename column iban to subject;
+update recovery_code set subject = 'customer:' || (select c.id from customer c where c.username = recovery_code.subject);
+alter table login_challenge rename column iban to subject;
+update login_challenge set subject = 'customer:' || (select c.id from customer c where c.username = login_challenge.subject);
@@ -0,0 +1,3 @@
+drop table transfer_approval;
+alter table account drop column approval_limit;
+drop table account_holder;
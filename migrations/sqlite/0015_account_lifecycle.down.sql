@@ -0,0 +1,4 @@
+-- Only active and frozen were known before, so accounts in any other status
+-- are frozen to keep money from moving.
+update account set status = 'frozen' where status not in ('active', 'frozen');
+alter table account drop column closed_at;
@@ -0,0 +1,3 @@
+-- Accounts are closed instead of deleted. Besides active and frozen, the
+-- status can now be pending, dormant or closed.
+alter table account add column closed_at timestamp;
@@ -0,0 +1,6 @@
+alter table account_transaction drop column counter_currency;
+alter table account_transaction drop column counter_amount;
+alter table account_transaction drop column exchange_spread;
+alter table account_transaction drop column exchange_rate;
+drop table fx_quote;
+drop table exchange_rate;
@@ -0,0 +1,34 @@
+-- Transfers between accounts of different currencies are converted at the
+-- rate of the currency pair less the spread. Rates and spreads are stored
+-- in units of 10^-8.
+create table exchange_rate (
+	from_currency char(3) not null,
+	to_currency char(3) not null,
+	rate bigint not null check (rate > 0),
+	spread bigint not null,
+	updated_at timestamp not null,
+	primary key (from_currency, to_currency)
+);
+
+-- A quote locks the rate of a currency pair for the customer who asked for
+-- it until it expires or a transfer uses it.
+create table fx_quote (
+	id varchar(64) primary key,
+	subject varchar(70) not null,
+	from_currency char(3) not null,
+	to_currency char(3) not null,
+	rate bigint not null,
+	spread bigint not null,
+	amount bigint,
+	converted_amount bigint,
+	created_at timestamp not null,
+	expires_at timestamp not null,
+	used_at timestamp
+);
+
+-- Converted transfers record the applied rate, the spread and the amount on
+-- the other side of the transfer.
+alter table account_transaction add column exchange_rate bigint;
+alter table account_transaction add column exchange_spread bigint;
+alter table account_transaction add column counter_amount bigint;
+alter table account_transaction add column counter_currency char(3);
@@ -0,0 +1 @@
+drop table scheduled_transfer;
@@ -0,0 +1,25 @@
+-- Transfers with an execution date after today are stored until the
+-- scheduler executes them on that day (in UTC). Failed attempts are tried
+-- again at next_attempt_at; the scheduler also moves it ahead while it
+-- executes a transfer.
+create table scheduled_transfer (
+	id integer primary key autoincrement,
+	from_iban varchar(70) not null,
+	to_iban varchar(70) not null,
+	amount bigint not null check (amount > 0),
+	currency char(3) not null,
+	execution_date char(10) not null,
+	status varchar(20) not null,
+	requested_by integer not null references customer(id),
+	attempts integer not null default 0,
+	next_attempt_at timestamp not null,
+	last_error text,
+	transaction_id integer,
+	cancelled_by integer references customer(id),
+	created_at timestamp not null,
+	executed_at timestamp,
+	cancelled_at timestamp
+);
+
+create index scheduled_transfer_from_idx on scheduled_transfer (from_iban, id);
+create index scheduled_transfer_due_idx on scheduled_transfer (status, next_attempt_at);
@@ -0,0 +1,31 @@
+-- Standing orders repeat a transfer on the days their frequency gives. On
+-- each of them the scheduler creates a scheduled transfer and moves
+-- next_execution_date ahead; last_execution_date is the latest day it did so.
+create table standing_order (
+	id integer primary key autoincrement,
+	from_iban varchar(70) not null,
+	to_iban varchar(70) not null,
+	amount bigint not null check (amount > 0),
+	currency char(3) not null,
+	frequency varchar(20) not null,
+	day_of_month integer,
+	start_date char(10) not null,
+	end_date char(10),
+	on_insufficient_funds varchar(10) not null,
+	status varchar(20) not null,
+	next_execution_date char(10),
+	last_execution_date char(10),
+	created_by integer not null references customer(id),
+	cancelled_by integer references customer(id),
+	created_at timestamp not null,
+	cancelled_at timestamp
+);
+
+create index standing_order_from_idx on standing_order (from_iban, id);
+create index standing_order_due_idx on standing_order (status, next_execution_date);
+
+-- A standing order schedules every execution once. Its scheduled transfers
+-- may be attempted fewer times than the scheduler allows.
+alter table scheduled_transfer add column standing_order_id integer references standing_order(id);
+alter table scheduled_transfer add column max_attempts integer;
+create unique index scheduled_transfer_standing_order_idx on scheduled_transfer (standing_order_id, execution_date);
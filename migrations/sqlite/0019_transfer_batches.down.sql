@@ -0,0 +1,2 @@
+drop table transfer_batch_item;
+drop table transfer_batch;
@@ -0,0 +1,27 @@
+-- A batch pays several beneficiaries from one account in a single request.
+-- Its items record whether their transfer went through and, if not, why.
+create table transfer_batch (
+	id integer primary key autoincrement,
+	from_iban varchar(70) not null,
+	mode varchar(20) not null,
+	status varchar(30) not null,
+	total_amount bigint not null,
+	currency char(3) not null,
+	succeeded integer not null,
+	failed integer not null,
+	requested_by integer not null references customer(id),
+	created_at timestamp not null
+);
+
+create table transfer_batch_item (
+	batch_id integer not null references transfer_batch(id),
+	item_index integer not null,
+	to_iban varchar(70) not null,
+	amount bigint not null,
+	currency char(3) not null,
+	status varchar(20) not null,
+	transaction_id integer,
+	error_code varchar(50),
+	error_message text,
+	primary key (batch_id, item_index)
+);
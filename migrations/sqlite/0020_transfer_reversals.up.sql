@@ -0,0 +1,5 @@
+-- Refunds and reversals pay a transfer back. Each of their lines points to
+-- the line of the original transfer on the same account, which also sums up
+-- what was paid back so far.
+alter table account_transaction add column original_transaction_id integer references account_transaction(id);
+create index account_transaction_original_idx on account_transaction (original_transaction_id);
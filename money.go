@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency new accounts are opened in.
+const DefaultCurrency = "EUR"
+
+// currencyExponents lists the number of decimal places (ISO 4217 minor
+// units) of the currencies GoBank accepts.
+var currencyExponents = map[string]int{
+	"AUD": 2,
+	"BHD": 3,
+	"CAD": 2,
+	"CHF": 2,
+	"CZK": 2,
+	"DKK": 2,
+	"EGP": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"JPY": 0,
+	"KWD": 3,
+	"NOK": 2,
+	"PLN": 2,
+	"SEK": 2,
+	"USD": 2,
+}
+
+// Money is an exact amount of a currency, stored as an integer number of
+// minor units (e.g. cents) so that repeated arithmetic never drifts.
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+func NewMoney(minorUnits int64, currency string) Money {
+	return Money{Amount: minorUnits, Currency: currency}
+}
+
+// ParseMoney parses a decimal amount such as "12.34" in the given currency.
+// Amounts with more decimal places than the currency allows are rejected
+// instead of being rounded.
+func ParseMoney(amount, currency string) (Money, error) {
+	exponent, ok := currencyExponents[currency]
+	if !ok {
+		return Money{}, ValidationError("unsupported_currency", "Unsupported currency: %q", currency)
+	}
+
+	digits := amount
+	negative := strings.HasPrefix(digits, "-")
+	if negative {
+		digits = digits[1:]
+	}
+	whole, fraction, hasFraction := strings.Cut(digits, ".")
+	if whole == "" || !isDigits(whole) || (hasFraction && (fraction == "" || !isDigits(fraction))) {
+		return Money{}, errInvalidAmount(amount)
+	}
+	if len(fraction) > exponent {
+		return Money{}, ValidationError("invalid_amount", "Amount %q has more than %d decimal places allowed for %s", amount, exponent, currency)
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+
+	minorUnits, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return Money{}, errInvalidAmount(amount)
+	}
+	if negative {
+		minorUnits = -minorUnits
+	}
+	return NewMoney(minorUnits, currency), nil
+}
+
+func errInvalidAmount(amount string) *Error {
+	return ValidationError("invalid_amount", "Invalid amount: %q", amount)
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the amount with exactly as many decimal places as the
+// currency has, without the currency code.
+func (m Money) String() string {
+	exponent := currencyExponents[m.Currency]
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	digits := strconv.FormatInt(amount, 10)
+	if exponent == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exponent] + "." + digits[len(digits)-exponent:]
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+func (m Money) SameCurrency(other Money) bool {
+	return m.Currency == other.Currency
+}
+
+// Add and Sub expect both amounts to share a currency; callers check that
+// with SameCurrency before doing arithmetic on amounts of unknown origin.
+func (m Money) Add(other Money) Money {
+	return NewMoney(m.Amount+other.Amount, m.Currency)
+}
+
+func (m Money) Sub(other Money) Money {
+	return NewMoney(m.Amount-other.Amount, m.Currency)
+}
+
+// Cmp returns -1, 0 or +1 depending on whether m is less than, equal to or
+// greater than other.
+func (m Money) Cmp(other Money) int {
+	switch {
+	case m.Amount < other.Amount:
+		return -1
+	case m.Amount > other.Amount:
+		return 1
+	default:
+		return 0
+	}
+}
+
+type moneyJSON struct {
+	Amount   json.RawMessage `json:"amount"`
+	Currency string          `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.String(), m.Currency})
+}
+
+// UnmarshalJSON accepts the amount as a decimal string or as a JSON number.
+// Numbers are parsed from their literal text, never through a float.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var raw moneyJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw.Amount) == 0 || string(raw.Amount) == "null" {
+		return ValidationError("invalid_amount", "Amount is required")
+	}
+
+	amount := string(raw.Amount)
+	if strings.HasPrefix(amount, `"`) {
+		if err := json.Unmarshal(raw.Amount, &amount); err != nil {
+			return err
+		}
+	}
+	if strings.ContainsAny(amount, "eE+") {
+		return errInvalidAmount(amount)
+	}
+
+	parsed, err := ParseMoney(amount, raw.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// checkedAdd guards sums of many amounts, e.g. when balancing a journal
+// entry, against int64 overflow.
+func checkedAdd(a, b int64) (int64, error) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, fmt.Errorf("Amount out of range")
+	}
+	return a + b, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		want     Money
+		wantErr  bool
+	}{
+		{amount: "12.34", currency: "EUR", want: NewMoney(1234, "EUR")},
+		{amount: "12.3", currency: "EUR", want: NewMoney(1230, "EUR")},
+		{amount: "12", currency: "EUR", want: NewMoney(1200, "EUR")},
+		{amount: "-0.05", currency: "EUR", want: NewMoney(-5, "EUR")},
+		{amount: "1000", currency: "JPY", want: NewMoney(1000, "JPY")},
+		{amount: "1.234", currency: "KWD", want: NewMoney(1234, "KWD")},
+		{amount: "0.001", currency: "EUR", wantErr: true},
+		{amount: "1.5", currency: "JPY", wantErr: true},
+		{amount: "1.", currency: "EUR", wantErr: true},
+		{amount: ".5", currency: "EUR", wantErr: true},
+		{amount: "1e3", currency: "EUR", wantErr: true},
+		{amount: "12.34", currency: "XXX", wantErr: true},
+		{amount: "99999999999999999999", currency: "EUR", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.amount, tt.currency)
+		if tt.wantErr {
+			assert.Error(t, err, tt.amount)
+			continue
+		}
+		assert.NoError(t, err, tt.amount)
+		assert.Equal(t, tt.want, got, tt.amount)
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	assert.Equal(t, "12.34", NewMoney(1234, "EUR").String())
+	assert.Equal(t, "0.05", NewMoney(5, "EUR").String())
+	assert.Equal(t, "-0.05", NewMoney(-5, "EUR").String())
+	assert.Equal(t, "1000", NewMoney(1000, "JPY").String())
+	assert.Equal(t, "1.234", NewMoney(1234, "KWD").String())
+}
+
+func TestMoneyJSON(t *testing.T) {
+	data, err := json.Marshal(NewMoney(1234, "EUR"))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"amount": "12.34", "currency": "EUR"}`, string(data))
+
+	var fromString, fromNumber Money
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount": "0.10", "currency": "EUR"}`), &fromString))
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount": 0.1, "currency": "EUR"}`), &fromNumber))
+	assert.Equal(t, NewMoney(10, "EUR"), fromString)
+	assert.Equal(t, fromString, fromNumber)
+
+	var invalid Money
+	assert.Error(t, json.Unmarshal([]byte(`{"amount": 0.123, "currency": "EUR"}`), &invalid))
+	assert.Error(t, json.Unmarshal([]byte(`{"amount": 1e2, "currency": "EUR"}`), &invalid))
+	assert.Error(t, json.Unmarshal([]byte(`{"currency": "EUR"}`), &invalid))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Roles of the users of the API. Customers log in with their username or
+// email and may only act on the accounts they own. Staff users log in with a
+// username and act on any account as far as their role allows.
+const (
+	RoleCustomer = "customer"
+	RoleSupport  = "support"
+	RoleAdmin    = "admin"
+	RoleAuditor  = "auditor"
+)
+
+// Permission is checked per route by requirePermission.
+type Permission string
+
+const (
+	PermissionReadProfile      Permission = "profile:read"
+	PermissionOpenAccounts     Permission = "accounts:open"
+	PermissionReadAccounts     Permission = "accounts:read"
+	PermissionDeleteAccounts   Permission = "accounts:delete"
+	PermissionInspectAccounts  Permission = "accounts:inspect"
+	PermissionSetAccountStatus Permission = "accounts:status"
+	PermissionUnlockLogins     Permission = "logins:unlock"
+	PermissionReadTransactions Permission = "transactions:read"
+	PermissionMoveCash         Permission = "cash:move"
+	PermissionTransfer         Permission = "transfers:create"
+	PermissionManageHolders    Permission = "holders:manage"
+	PermissionManageTwoFactor  Permission = "two_factor:manage"
+	PermissionReadAuditEvents  Permission = "audit:read"
+	PermissionManageStaff      Permission = "staff:manage"
+	PermissionManageRates      Permission = "fx_rates:manage"
+	PermissionReverseTransfers Permission = "transfers:reverse"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleCustomer: {
+		PermissionReadProfile,
+		PermissionOpenAccounts,
+		PermissionReadAccounts,
+		PermissionDeleteAccounts,
+		PermissionReadTransactions,
+		PermissionTransfer,
+		PermissionManageHolders,
+		PermissionManageTwoFactor,
+	},
+	RoleSupport: {
+		PermissionReadAccounts,
+		PermissionInspectAccounts,
+		PermissionSetAccountStatus,
+		PermissionUnlockLogins,
+		PermissionReadTransactions,
+	},
+	RoleAuditor: {
+		PermissionReadAccounts,
+		PermissionInspectAccounts,
+		PermissionReadTransactions,
+		PermissionReadAuditEvents,
+	},
+	RoleAdmin: {
+		PermissionReadAccounts,
+		PermissionDeleteAccounts,
+		PermissionInspectAccounts,
+		PermissionSetAccountStatus,
+		PermissionUnlockLogins,
+		PermissionReadTransactions,
+		PermissionMoveCash,
+		PermissionReadAuditEvents,
+		PermissionManageStaff,
+		PermissionManageRates,
+		PermissionReverseTransfers,
+	},
+}
+
+func roleHasPermission(role string, permission Permission) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func isStaffRole(role string) bool {
+	return role == RoleSupport || role == RoleAdmin || role == RoleAuditor
+}
+
+// staffSubjectPrefix sets the subjects of staff users apart from those of
+// customers.
+const staffSubjectPrefix = "staff:"
+
+// Principal is who a session and its tokens belong to.
+type Principal struct {
+	Subject string
+	Role    string
+}
+
+func staffPrincipal(user *StaffUser) Principal {
+	return Principal{Subject: staffSubjectPrefix + user.Username, Role: user.Role}
+}
+
+// StaffUser is an employee of the bank. Staff users are created by admins
+// or on the command line with: gobank staff create.
+type StaffUser struct {
+	ID                int
+	Username          string
+	EncryptedPassword string `json:"-"`
+	Role              string
+	CreatedAt         time.Time
+}
+
+const minStaffPasswordLength = 12
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,64}$`)
+
+func NewStaffUser(username, password, role string) (*StaffUser, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, ValidationError("invalid_username", "Username must be 3 to 64 letters, digits, dots, dashes or underscores").WithDetail("field", "username")
+	}
+	if !isStaffRole(role) {
+		return nil, ValidationError("invalid_role", "Invalid staff role: %s", role).WithDetail("field", "role")
+	}
+	if len(password) < minStaffPasswordLength {
+		return nil, ValidationError("invalid_password", "Password must be at least %d characters", minStaffPasswordLength).WithDetail("field", "password")
+	}
+
+	encryptedPassword, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return &StaffUser{
+		Username:          username,
+		EncryptedPassword: encryptedPassword,
+		Role:              role,
+		CreatedAt:         time.Now().UTC(),
+	}, nil
+}
+
+// requirePermission rejects requests whose token lacks the permission. It
+// runs after validateTokenMiddleware; handlers of routes that customers may
+// use additionally restrict them to their own accounts.
+func (s *APIServer) requirePermission(permission Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := getClaims(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if !roleHasPermission(claims.Role, permission) {
+			writeError(w, errForbidden())
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// authorized wraps a handler for a route that needs a valid access token
+// with the given permission.
+func (s *APIServer) authorized(permission Permission, f apiFunc) http.HandlerFunc {
+	return s.validateTokenMiddleware(s.requirePermission(permission, makeHTTPHandleFunc(f)))
+}
+
+// principal loads who the subject of a session is now, so that role
+// changes apply from the next refresh on.
+func (s *APIServer) principal(subject string) (Principal, error) {
+	if username, ok := strings.CutPrefix(subject, staffSubjectPrefix); ok {
+		user, err := s.store.GetStaffUserByUsername(username)
+		if err != nil {
+			return Principal{}, err
+		}
+		return staffPrincipal(user), nil
+	}
+	id, ok := customerID(subject)
+	if !ok {
+		return Principal{}, NotFoundError("unknown_subject", "Unknown subject %s", subject)
+	}
+	customer, err := s.store.GetCustomerById(id)
+	if err != nil {
+		return Principal{}, err
+	}
+	return customerPrincipal(customer), nil
+}
+
+func staffCreatedEvent(user *StaffUser, actor string) *AuditEvent {
+	return &AuditEvent{
+		Kind:      AuditStaffCreated,
+		Actor:     actor,
+		Subject:   staffSubjectPrefix + user.Username,
+		Message:   "Created with role " + user.Role,
+		CreatedAt: user.CreatedAt,
+	}
+}
+
+func errStaffUserNotFound(username string) *Error {
+	return NotFoundError("staff_user_not_found", "Staff user %s not found", username)
+}
+
+func errUsernameTaken(username string) *Error {
+	return ConflictError("username_taken", "Username %s is already taken", username).WithDetail("field", "username")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRolePermissions(t *testing.T) {
+	assert.True(t, roleHasPermission(RoleCustomer, PermissionTransfer))
+	// cash is booked by staff at the counter, never by customers
+	assert.False(t, roleHasPermission(RoleCustomer, PermissionMoveCash))
+	assert.True(t, roleHasPermission(RoleAdmin, PermissionMoveCash))
+	assert.False(t, roleHasPermission(RoleSupport, PermissionMoveCash))
+	assert.False(t, roleHasPermission(RoleCustomer, PermissionInspectAccounts))
+
+	assert.True(t, roleHasPermission(RoleSupport, PermissionSetAccountStatus))
+	assert.False(t, roleHasPermission(RoleSupport, PermissionReadAuditEvents))
+
+	assert.True(t, roleHasPermission(RoleAuditor, PermissionReadAuditEvents))
+	assert.False(t, roleHasPermission(RoleAuditor, PermissionSetAccountStatus))
+
+	// staff act on behalf of customers but never move money between them
+	assert.False(t, roleHasPermission(RoleAdmin, PermissionTransfer))
+	assert.True(t, roleHasPermission(RoleAdmin, PermissionManageStaff))
+	assert.True(t, roleHasPermission(RoleAdmin, PermissionManageRates))
+	assert.False(t, roleHasPermission(RoleSupport, PermissionManageRates))
+	assert.True(t, roleHasPermission(RoleAdmin, PermissionReverseTransfers))
+	assert.False(t, roleHasPermission(RoleSupport, PermissionReverseTransfers))
+
+	assert.False(t, roleHasPermission("unknown", PermissionReadAccounts))
+}
+
+func TestNewStaffUser(t *testing.T) {
+	user, err := NewStaffUser("jane.doe", "correct horse battery", RoleSupport)
+	assert.NoError(t, err)
+	assert.Equal(t, "staff:jane.doe", staffPrincipal(user).Subject)
+	assert.Equal(t, RoleSupport, staffPrincipal(user).Role)
+	assert.True(t, checkPasswordHash("correct horse battery", user.EncryptedPassword))
+
+	_, err = NewStaffUser("jane doe", "correct horse battery", RoleSupport)
+	assert.True(t, IsKind(err, KindValidation))
+	_, err = NewStaffUser("jane.doe", "correct horse battery", RoleCustomer)
+	assert.True(t, IsKind(err, KindValidation))
+	_, err = NewStaffUser("jane.doe", "too short", RoleSupport)
+	assert.True(t, IsKind(err, KindValidation))
+}
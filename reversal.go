@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+// Policies for reversals the recipient's balance does not cover.
+const (
+	// NegativeBalanceAllow reverses the transfer anyway and leaves the
+	// recipient with a negative balance.
+	NegativeBalanceAllow = "allow"
+	// NegativeBalanceReject rejects the reversal like a refund.
+	NegativeBalanceReject = "reject"
+)
+
+// reversalNegativeBalancePolicy reads REVERSAL_NEGATIVE_BALANCE. It
+// defaults to allow.
+func reversalNegativeBalancePolicy() (string, error) {
+	switch policy := os.Getenv("REVERSAL_NEGATIVE_BALANCE"); policy {
+	case "":
+		return NegativeBalanceAllow, nil
+	case NegativeBalanceAllow, NegativeBalanceReject:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("Invalid REVERSAL_NEGATIVE_BALANCE: %s", policy)
+	}
+}
+
+// Refund pays money of a transfer back from the recipient to the sender.
+// Customers refund transfers their account received, in part or in full;
+// admins reverse all of a transfer that was not refunded yet. Both sides get
+// a statement line linked to their line of the original transfer.
+type Refund struct {
+	// TransactionID is the recipient's line of the transfer for refunds,
+	// either line for reversals.
+	TransactionID int
+	// AccountIban is the account refunding the transfer. Reversals leave it
+	// empty.
+	AccountIban string
+	// Amount is in the recipient's currency; nil refunds everything that
+	// was not refunded yet.
+	Amount    *Money
+	Reference string
+	// Reversal marks the admin operation: it takes money from accounts that
+	// cannot send, and leaves the recipient negative if AllowNegative.
+	Reversal      bool
+	AllowNegative bool
+	Actor         string
+}
+
+func (r *Refund) kind() string {
+	if r.Reversal {
+		return journalKindReversal
+	}
+	return journalKindRefund
+}
+
+// title names the kind of refund in descriptions and references.
+func (r *Refund) title() string {
+	if r.Reversal {
+		return "Reversal"
+	}
+	return "Refund"
+}
+
+// original picks the recipient's and the sender's line out of the lines of
+// the transfer the refund names.
+func (r *Refund) original(lines []*Transaction) (*Transaction, *Transaction, error) {
+	var credit, debit *Transaction
+	for _, line := range lines {
+		switch line.Direction {
+		case Credit:
+			credit = line
+		case Debit:
+			debit = line
+		}
+	}
+	// customers only see the transfers their account received
+	if credit == nil || debit == nil || (!r.Reversal && (credit.ID != r.TransactionID || credit.AccountIban != r.AccountIban)) {
+		return nil, nil, errTransactionNotFound(r.TransactionID)
+	}
+	if credit.Kind != journalKindTransfer {
+		return nil, nil, ConflictError("not_refundable", "Transaction %d is a %s, only transfers can be refunded", r.TransactionID, credit.Kind)
+	}
+	return credit, debit, nil
+}
+
+// amounts returns what the recipient pays back and, for a converted
+// transfer, how it converts back. refunded is what the recipient paid back
+// before, returned what the sender got back. Converted transfers are paid
+// back at the original rate without a spread; paying back the rest returns
+// exactly what the sender has not got back yet.
+func (r *Refund) amounts(credit, debit *Transaction, refunded, returned Money) (Money, *FXConversion, error) {
+	remaining := credit.Amount.Sub(refunded)
+	if !remaining.IsPositive() {
+		return Money{}, nil, ConflictError("transfer_refunded", "Transaction %d was refunded in full", credit.ID)
+	}
+	amount := remaining
+	if r.Amount != nil {
+		amount = *r.Amount
+	}
+	if !amount.SameCurrency(remaining) {
+		return Money{}, nil, errCurrencyMismatch()
+	}
+	if !amount.IsPositive() {
+		return Money{}, nil, errAmountNotPositive()
+	}
+	if amount.Cmp(remaining) > 0 {
+		return Money{}, nil, ConflictError("refund_exceeds_transfer", "Only %s %s of transaction %d are left to refund", remaining, remaining.Currency, credit.ID).WithDetail("remaining", remaining)
+	}
+	if credit.CounterAmount == nil {
+		return amount, nil, nil
+	}
+
+	back := debit.Amount.Sub(returned)
+	if amount != remaining {
+		scaled := new(big.Int).Mul(big.NewInt(amount.Amount), big.NewInt(debit.Amount.Amount))
+		back = NewMoney(scaled.Quo(scaled, big.NewInt(credit.Amount.Amount)).Int64(), debit.Amount.Currency)
+	}
+	if !back.IsPositive() {
+		return Money{}, nil, ValidationError("amount_too_small", "%s %s is too small to be converted into %s", amount, amount.Currency, back.Currency)
+	}
+	rate := (&ExchangeRate{Rate: *credit.ExchangeRate}).Inverse().Rate
+	return amount, &FXConversion{Rate: rate, Spread: 0, Amount: back}, nil
+}
+
+// checkAccounts checks that money can move back between the accounts.
+// Reversals also take money from accounts that are frozen or may not send
+// for another reason, but closed accounts are final.
+func (r *Refund) checkAccounts(recipient, sender *Account) error {
+	if !r.Reversal {
+		if err := checkCanSend(recipient); err != nil {
+			return err
+		}
+		return checkCanReceive(sender)
+	}
+	for _, account := range []*Account{recipient, sender} {
+		if account.Status == AccountStatusClosed {
+			return errAccountUnavailable(account.IBAN, account.Status)
+		}
+	}
+	return nil
+}
+
+// link ties the statement lines of the refund to the original ones on the
+// same accounts. Without a reference of its own each line names the one it
+// pays back.
+func (r *Refund) link(debit, credit, originalCredit, originalDebit *Transaction) {
+	debit.OriginalTransactionID, credit.OriginalTransactionID = originalCredit.ID, originalDebit.ID
+	debit.Reference, credit.Reference = r.Reference, r.Reference
+	if r.Reference == "" {
+		debit.Reference = fmt.Sprintf("%s of transaction %d", r.title(), originalCredit.ID)
+		credit.Reference = fmt.Sprintf("%s of transaction %d", r.title(), originalDebit.ID)
+	}
+}
+
+// entry books the refund like a transfer from the recipient back to the
+// sender.
+func (r *Refund) entry(recipient, sender string, amount Money, conversion *FXConversion, at time.Time) *JournalEntry {
+	entry := newTransferEntry(recipient, sender, amount, conversion, at)
+	entry.Kind = r.kind()
+	entry.Description = fmt.Sprintf("%s from %s to %s", r.title(), recipient, sender)
+	return entry
+}
+
+func reversalEvent(refund *Refund, debit *Transaction) *AuditEvent {
+	return &AuditEvent{
+		Kind:      AuditTransferReversed,
+		Actor:     refund.Actor,
+		Subject:   debit.AccountIban,
+		Message:   fmt.Sprintf("Reversed %s %s of transaction %d to %s", debit.Amount, debit.Amount.Currency, debit.OriginalTransactionID, debit.CounterpartyIban),
+		CreatedAt: debit.CreatedAt,
+	}
+}
+
+func errTransactionNotFound(id int) *Error {
+	return NotFoundError("transaction_not_found", "Transaction %d not found", id)
+}
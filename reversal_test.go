@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefundOriginal(t *testing.T) {
+	lines := []*Transaction{
+		{ID: 7, Kind: journalKindTransfer, AccountIban: "DE89370400440532013000", Direction: Debit},
+		{ID: 8, Kind: journalKindTransfer, AccountIban: "DE89370400440532013001", Direction: Credit},
+	}
+
+	credit, debit, err := (&Refund{TransactionID: 8, AccountIban: "DE89370400440532013001"}).original(lines)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, credit.ID)
+	assert.Equal(t, 7, debit.ID)
+
+	// customers can only refund what their account received
+	_, _, err = (&Refund{TransactionID: 7, AccountIban: "DE89370400440532013000"}).original(lines)
+	assert.True(t, IsKind(err, KindNotFound))
+	_, _, err = (&Refund{TransactionID: 8, AccountIban: "DE89370400440532013000"}).original(lines)
+	assert.True(t, IsKind(err, KindNotFound))
+	_, _, err = (&Refund{TransactionID: 8}).original(nil)
+	assert.True(t, IsKind(err, KindNotFound))
+
+	// admins reverse a transfer by either of its lines
+	credit, _, err = (&Refund{TransactionID: 7, Reversal: true}).original(lines)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, credit.ID)
+
+	lines[0].Kind, lines[1].Kind = journalKindRefund, journalKindRefund
+	_, _, err = (&Refund{TransactionID: 7, Reversal: true}).original(lines)
+	assert.True(t, IsKind(err, KindConflict))
+}
+
+func TestRefundAmounts(t *testing.T) {
+	debit := &Transaction{ID: 7, Amount: NewMoney(1000, DefaultCurrency)}
+	credit := &Transaction{ID: 8, Amount: NewMoney(1000, DefaultCurrency)}
+	none := NewMoney(0, DefaultCurrency)
+
+	partial := NewMoney(300, DefaultCurrency)
+	amount, conversion, err := (&Refund{Amount: &partial}).amounts(credit, debit, none, none)
+	assert.NoError(t, err)
+	assert.Equal(t, partial, amount)
+	assert.Nil(t, conversion)
+
+	// without an amount the rest is refunded
+	amount, _, err = (&Refund{}).amounts(credit, debit, partial, partial)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(700, DefaultCurrency), amount)
+
+	tooMuch := NewMoney(701, DefaultCurrency)
+	_, _, err = (&Refund{Amount: &tooMuch}).amounts(credit, debit, partial, partial)
+	assert.True(t, IsKind(err, KindConflict))
+	_, _, err = (&Refund{}).amounts(credit, debit, credit.Amount, debit.Amount)
+	assert.True(t, IsKind(err, KindConflict))
+
+	for _, invalid := range []Money{NewMoney(0, DefaultCurrency), NewMoney(100, "USD")} {
+		_, _, err = (&Refund{Amount: &invalid}).amounts(credit, debit, none, none)
+		assert.True(t, IsKind(err, KindValidation), invalid.Currency)
+	}
+}
+
+func TestRefundAmountsConverted(t *testing.T) {
+	rate := Rate(108_900_000)
+	debit := &Transaction{ID: 7, Amount: NewMoney(10000, "EUR")}
+	credit := &Transaction{ID: 8, Amount: NewMoney(10890, "USD"), ExchangeRate: &rate, CounterAmount: &debit.Amount}
+
+	// partial refunds convert back in proportion to the original transfer
+	half := NewMoney(5445, "USD")
+	amount, conversion, err := (&Refund{Amount: &half}).amounts(credit, debit, NewMoney(0, "USD"), NewMoney(0, "EUR"))
+	assert.NoError(t, err)
+	assert.Equal(t, half, amount)
+	assert.Equal(t, NewMoney(5000, "EUR"), conversion.Amount)
+	assert.Equal(t, Rate(0), conversion.Spread)
+
+	// the rest returns exactly what the sender has not got back yet
+	amount, conversion, err = (&Refund{}).amounts(credit, debit, NewMoney(5446, "USD"), NewMoney(5001, "EUR"))
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(5444, "USD"), amount)
+	assert.Equal(t, NewMoney(4999, "EUR"), conversion.Amount)
+
+	cent := NewMoney(1, "USD")
+	_, _, err = (&Refund{Amount: &cent}).amounts(credit, debit, NewMoney(0, "USD"), NewMoney(0, "EUR"))
+	assert.True(t, IsKind(err, KindValidation))
+}
+
+func TestRefundCheckAccounts(t *testing.T) {
+	recipient := &Account{IBAN: "DE89370400440532013001", Status: AccountStatusFrozen}
+	sender := &Account{IBAN: "DE89370400440532013000", Status: AccountStatusActive}
+
+	assert.True(t, IsKind((&Refund{}).checkAccounts(recipient, sender), KindForbidden))
+	assert.NoError(t, (&Refund{Reversal: true}).checkAccounts(recipient, sender))
+
+	sender.Status = AccountStatusClosed
+	assert.True(t, IsKind((&Refund{Reversal: true}).checkAccounts(recipient, sender), KindConflict))
+}
+
+func TestRefundLink(t *testing.T) {
+	debit, credit := &Transaction{}, &Transaction{}
+	(&Refund{}).link(debit, credit, &Transaction{ID: 8}, &Transaction{ID: 7})
+	assert.Equal(t, 8, debit.OriginalTransactionID)
+	assert.Equal(t, 7, credit.OriginalTransactionID)
+	assert.Equal(t, "Refund of transaction 8", debit.Reference)
+	assert.Equal(t, "Refund of transaction 7", credit.Reference)
+
+	(&Refund{Reversal: true, Reference: "Wrong recipient"}).link(debit, credit, &Transaction{ID: 8}, &Transaction{ID: 7})
+	assert.Equal(t, "Wrong recipient", debit.Reference)
+	assert.Equal(t, "Wrong recipient", credit.Reference)
+}
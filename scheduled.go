@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Statuses of scheduled transfers. A transfer is executing while the
+// scheduler holds it; pending transfers can still be cancelled. Transfers
+// above the approval limit of a joint account on their execution date need
+// approval; the approval they wait for moves the money.
+const (
+	ScheduledStatusPending       = "pending"
+	ScheduledStatusExecuting     = "executing"
+	ScheduledStatusExecuted      = "executed"
+	ScheduledStatusFailed        = "failed"
+	ScheduledStatusCancelled     = "cancelled"
+	ScheduledStatusNeedsApproval = "needs_approval"
+)
+
+// executionDateLayout is the format of execution dates, which are days in
+// UTC.
+const executionDateLayout = "2006-01-02"
+
+// ScheduledTransfer is a transfer the scheduler executes on ExecutionDate.
+// Failed attempts are tried again at NextAttemptAt until the scheduler
+// policy, or MaxAttempts if it is lower, gives up on it. Standing orders
+// create one for each of their executions.
+type ScheduledTransfer struct {
+	ID              int        `json:"id"`
+	FromAccountIban string     `json:"fromAccountIban"`
+	ToAccountIban   string     `json:"toAccountIban"`
+	Amount          Money      `json:"amount"`
+	ExecutionDate   string     `json:"executionDate"`
+	Status          string     `json:"status"`
+	RequestedBy     int        `json:"requestedBy"`
+	Attempts        int        `json:"attempts"`
+	NextAttemptAt   time.Time  `json:"nextAttemptAt"`
+	LastError       string     `json:"lastError,omitempty"`
+	TransactionID   int        `json:"transactionId,omitempty"`
+	CancelledBy     int        `json:"cancelledBy,omitempty"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	ExecutedAt      *time.Time `json:"executedAt,omitempty"`
+	CancelledAt     *time.Time `json:"cancelledAt,omitempty"`
+	StandingOrderID int        `json:"standingOrderId,omitempty"`
+	MaxAttempts     int        `json:"maxAttempts,omitempty"`
+	ApprovalID      int        `json:"approvalId,omitempty"`
+}
+
+// parseExecutionDate parses the execution date of a transfer. It reports
+// whether the date lies after today; transfers dated today are executed
+// right away, earlier dates are rejected.
+func parseExecutionDate(value string, now time.Time) (string, bool, error) {
+	date, err := parseDate("invalid_execution_date", "executionDate", value, now)
+	if err != nil {
+		return "", false, err
+	}
+	return date, date > now.UTC().Format(executionDateLayout), nil
+}
+
+// parseDate parses the date in the request field and rejects dates before
+// today with the error code given.
+func parseDate(code, field, value string, now time.Time) (string, error) {
+	date, err := time.Parse(executionDateLayout, value)
+	if err != nil {
+		return "", ValidationError(code, "Invalid %s %q, expected YYYY-MM-DD", field, value).WithDetail("field", field)
+	}
+	if formatted := date.Format(executionDateLayout); formatted < now.UTC().Format(executionDateLayout) {
+		return "", ValidationError(code, "%s %s lies in the past", field, formatted).WithDetail("field", field)
+	}
+	return date.Format(executionDateLayout), nil
+}
+
+func newScheduledTransfer(fromIban, toIban string, amount Money, executionDate string, requestedBy int) *ScheduledTransfer {
+	// the date was parsed before
+	nextAttemptAt, _ := time.Parse(executionDateLayout, executionDate)
+	return &ScheduledTransfer{
+		FromAccountIban: fromIban,
+		ToAccountIban:   toIban,
+		Amount:          amount,
+		ExecutionDate:   executionDate,
+		Status:          ScheduledStatusPending,
+		RequestedBy:     requestedBy,
+		NextAttemptAt:   nextAttemptAt,
+		CreatedAt:       time.Now().UTC(),
+	}
+}
+
+// cancel withdraws a pending transfer. Transfers the scheduler already
+// holds or finished cannot be cancelled.
+func (t *ScheduledTransfer) cancel(cancelledBy int, now time.Time) error {
+	if t.Status != ScheduledStatusPending {
+		return ConflictError("scheduled_transfer_not_pending", "Scheduled transfer %d is %s", t.ID, t.Status)
+	}
+	t.Status = ScheduledStatusCancelled
+	t.CancelledBy = cancelledBy
+	t.CancelledAt = &now
+	return nil
+}
+
+// recordAttempt records the outcome of an execution. Failures are tried
+// again after the retry delay, unless they cannot succeed later or the
+// transfer ran out of attempts.
+func (t *ScheduledTransfer) recordAttempt(transactionID int, err error, policy SchedulerPolicy, now time.Time) {
+	t.Attempts++
+	if err == nil {
+		t.Status = ScheduledStatusExecuted
+		t.TransactionID = transactionID
+		t.LastError = ""
+		t.ExecutedAt = &now
+		return
+	}
+	// internal errors may name tables or hosts, which customers need not see
+	t.LastError = "Internal error"
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.Kind != KindInternal {
+		t.LastError = apiErr.Message
+	}
+	maxAttempts := policy.MaxAttempts
+	if t.MaxAttempts > 0 && t.MaxAttempts < maxAttempts {
+		maxAttempts = t.MaxAttempts
+	}
+	if IsKind(err, KindValidation) || IsKind(err, KindNotFound) || t.Attempts >= maxAttempts {
+		t.Status = ScheduledStatusFailed
+		return
+	}
+	t.Status = ScheduledStatusPending
+	t.NextAttemptAt = now.Add(policy.RetryDelay)
+}
+
+// awaitApproval records that the transfer was handed over to the approval
+// of another holder instead of being executed.
+func (t *ScheduledTransfer) awaitApproval(approvalID int) {
+	t.Attempts++
+	t.Status = ScheduledStatusNeedsApproval
+	t.ApprovalID = approvalID
+	t.LastError = "Transfer is above the approval limit and waits for another holder"
+}
+
+// SchedulerPolicy decides how often the scheduler looks for due transfers
+// and how often it tries to execute one before giving up.
+type SchedulerPolicy struct {
+	Interval    time.Duration
+	MaxAttempts int
+	RetryDelay  time.Duration
+}
+
+var defaultSchedulerPolicy = SchedulerPolicy{
+	Interval:    time.Minute,
+	MaxAttempts: 3,
+	RetryDelay:  time.Hour,
+}
+
+// schedulerLease is how long the scheduler holds the transfers it claimed.
+// Transfers of a scheduler that died while executing them are claimed again
+// after it; their idempotency key keeps them from being executed twice.
+const schedulerLease = 5 * time.Minute
+
+// schedulerBatchSize limits the transfers claimed per run.
+const schedulerBatchSize = 100
+
+// schedulerPolicy reads SCHEDULER_INTERVAL, SCHEDULED_TRANSFER_MAX_ATTEMPTS
+// and SCHEDULED_TRANSFER_RETRY_DELAY on top of the defaults.
+func schedulerPolicy() (SchedulerPolicy, error) {
+	policy := defaultSchedulerPolicy
+	if value := os.Getenv("SCHEDULED_TRANSFER_MAX_ATTEMPTS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return policy, fmt.Errorf("Invalid SCHEDULED_TRANSFER_MAX_ATTEMPTS: %v", value)
+		}
+		policy.MaxAttempts = n
+	}
+	for name, target := range map[string]*time.Duration{
+		"SCHEDULER_INTERVAL":             &policy.Interval,
+		"SCHEDULED_TRANSFER_RETRY_DELAY": &policy.RetryDelay,
+	} {
+		if value := os.Getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return policy, fmt.Errorf("Invalid %s: %v", name, value)
+			}
+			*target = d
+		}
+	}
+	return policy, nil
+}
+
+// TransferScheduler executes due scheduled transfers and standing orders in
+// the background of the server process.
+type TransferScheduler struct {
+	store  Storage
+	policy SchedulerPolicy
+}
+
+func NewTransferScheduler(store Storage, policy SchedulerPolicy) *TransferScheduler {
+	return &TransferScheduler{store: store, policy: policy}
+}
+
+// Run executes due transfers every interval until ctx is done.
+func (s *TransferScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.policy.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.RunDue(time.Now().UTC()); err != nil {
+			log.Printf("Scheduled transfers: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue schedules the executions of standing orders due today, then
+// executes the transfers due at now and returns how many it tried.
+func (s *TransferScheduler) RunDue(now time.Time) (int, error) {
+	if _, err := s.store.ScheduleStandingOrders(now.UTC().Format(executionDateLayout), schedulerBatchSize); err != nil {
+		return 0, err
+	}
+	due, err := s.store.ClaimDueScheduledTransfers(now, now.Add(schedulerLease), schedulerBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	for _, transfer := range due {
+		transactionID, approvalID, err := s.execute(transfer)
+		if approvalID != 0 {
+			transfer.awaitApproval(approvalID)
+		} else {
+			transfer.recordAttempt(transactionID, err, s.policy, now)
+		}
+		if err := s.store.RecordScheduledTransferAttempt(transfer); err != nil {
+			return 0, err
+		}
+	}
+	return len(due), nil
+}
+
+// execute runs the transfer through TransferFunds and returns the id of the
+// sender's transaction, or the id of the approval it waits for if it is
+// above the approval limit of a joint account by now. It uses idempotency
+// keys of its own, so that a transfer claimed again after a crash replays
+// the first execution.
+func (s *TransferScheduler) execute(transfer *ScheduledTransfer) (int, int, error) {
+	// the customer who scheduled the transfer may have lost access since,
+	// and the holders may have lowered the approval limit
+	account, err := s.store.GetAccountByIban(transfer.FromAccountIban)
+	if err != nil {
+		return 0, 0, err
+	}
+	holder, err := s.store.GetAccountHolder(account.ID, transfer.RequestedBy)
+	if err != nil && !IsKind(err, KindNotFound) {
+		return 0, 0, err
+	}
+	if err != nil || !holder.Permits(HolderPermissionTransfer) {
+		return 0, 0, ForbiddenError("holder_permission_revoked", "Customer %d may no longer transfer from %s", transfer.RequestedBy, transfer.FromAccountIban)
+	}
+	approvalNeeded, err := needsApproval(s.store, account, transfer.Amount)
+	if err != nil {
+		return 0, 0, err
+	}
+	if approvalNeeded {
+		approval := newTransferApproval(transfer.FromAccountIban, transfer.ToAccountIban, transfer.Amount, transfer.RequestedBy)
+		key := scheduledTransferKey(transfer, "scheduled transfer approval")
+		if err := s.store.CreateTransferApproval(approval, key); err != nil {
+			return 0, 0, err
+		}
+		if key.Replayed {
+			if err := json.Unmarshal(key.Response, approval); err != nil {
+				return 0, 0, err
+			}
+		}
+		return 0, approval.ID, nil
+	}
+
+	key := scheduledTransferKey(transfer, "scheduled transfer")
+	transaction, err := s.store.TransferFunds(transfer.FromAccountIban, transfer.ToAccountIban, transfer.Amount, "", key)
+	if err != nil {
+		return 0, 0, err
+	}
+	if key.Replayed {
+		transaction = new(Transaction)
+		if err := json.Unmarshal(key.Response, transaction); err != nil {
+			return 0, 0, err
+		}
+	}
+	return transaction.ID, 0, nil
+}
+
+// scheduledTransferKey is the idempotency key of the transfer in the scope
+// given. Its response is the stored result as JSON.
+func scheduledTransferKey(transfer *ScheduledTransfer, scope string) *IdempotencyKey {
+	return &IdempotencyKey{
+		Key:         strconv.Itoa(transfer.ID),
+		Scope:       scope,
+		Fingerprint: transfer.FromAccountIban + " " + transfer.ToAccountIban + " " + transfer.Amount.String() + " " + transfer.Amount.Currency,
+		CreatedAt:   time.Now().UTC(),
+		Render: func(result any) (int, []byte, error) {
+			response, err := json.Marshal(result)
+			return http.StatusOK, response, err
+		},
+	}
+}
+
+func errScheduledTransferNotFound(id int) *Error {
+	return NotFoundError("scheduled_transfer_not_found", "Scheduled transfer %d not found", id)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExecutionDate(t *testing.T) {
+	now := time.Date(2024, 3, 10, 23, 30, 0, 0, time.UTC)
+	date, future, err := parseExecutionDate("2024-03-11", now)
+	assert.NoError(t, err)
+	assert.Equal(t, "2024-03-11", date)
+	assert.True(t, future)
+
+	// today executes right away
+	_, future, err = parseExecutionDate("2024-03-10", now)
+	assert.NoError(t, err)
+	assert.False(t, future)
+
+	for _, invalid := range []string{"2024-03-09", "10.03.2024", "2024-02-30", ""} {
+		_, _, err := parseExecutionDate(invalid, now)
+		assert.True(t, IsKind(err, KindValidation), invalid)
+	}
+}
+
+func TestScheduledTransferRecordAttempt(t *testing.T) {
+	policy := SchedulerPolicy{MaxAttempts: 2, RetryDelay: time.Hour}
+	now := time.Now().UTC()
+	transfer := newScheduledTransfer("DE89370400440532013000", "DE89370400440532013001", NewMoney(100, DefaultCurrency), "2024-03-11", 1)
+
+	transfer.recordAttempt(0, errInsufficientFunds(), policy, now)
+	assert.Equal(t, ScheduledStatusPending, transfer.Status)
+	assert.Equal(t, now.Add(time.Hour), transfer.NextAttemptAt)
+
+	// internal errors are not shown to customers
+	transfer.recordAttempt(0, errors.New("pq: connection refused"), policy, now)
+	assert.Equal(t, ScheduledStatusFailed, transfer.Status)
+	assert.Equal(t, "Internal error", transfer.LastError)
+
+	// errors that cannot go away fail right away
+	transfer = newScheduledTransfer("DE89370400440532013000", "DE89370400440532013001", NewMoney(100, DefaultCurrency), "2024-03-11", 1)
+	transfer.recordAttempt(0, errAccountIbanNotFound("DE89370400440532013001"), policy, now)
+	assert.Equal(t, ScheduledStatusFailed, transfer.Status)
+	assert.Equal(t, 1, transfer.Attempts)
+
+	transfer = newScheduledTransfer("DE89370400440532013000", "DE89370400440532013001", NewMoney(100, DefaultCurrency), "2024-03-11", 1)
+	transfer.recordAttempt(42, nil, policy, now)
+	assert.Equal(t, ScheduledStatusExecuted, transfer.Status)
+	assert.Equal(t, 42, transfer.TransactionID)
+	assert.True(t, IsKind(transfer.cancel(1, now), KindConflict))
+}
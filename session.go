@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// Session is created by a login and lives until it is logged out. Access
+// tokens carry the session id (sid) so that revoking the session invalidates
+// all of them at once. Subject is the subject of the session's principal.
+type Session struct {
+	ID        string
+	Subject   string
+	CreatedAt time.Time
+	RevokedAt *time.Time
+}
+
+// RefreshToken is the server side record of a refresh token. Only the hash
+// of the token is stored. Every refresh uses up the presented token and
+// issues a new one; presenting a used token again revokes the session, since
+// it means the token has been stolen.
+type RefreshToken struct {
+	Hash      string
+	SessionID string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+func newSession(subject string) (*Session, error) {
+	id, err := newRandomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{ID: id, Subject: subject, CreatedAt: time.Now().UTC()}, nil
+}
+
+// newRefreshToken returns the token handed to the client together with the
+// record to store. The store fills in the session id on rotation.
+func newRefreshToken(sessionID string) (string, *RefreshToken, error) {
+	token, err := newRandomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now().UTC()
+	return token, &RefreshToken{
+		Hash:      hashRefreshToken(token),
+		SessionID: sessionID,
+		ExpiresAt: now.Add(refreshTokenTTL),
+		CreatedAt: now,
+	}, nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRandomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func errInvalidRefreshToken() *Error {
+	return UnauthorizedError("invalid_refresh_token", "Refresh token is invalid or expired")
+}
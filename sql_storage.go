@@ -0,0 +1,2555 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+)
+
+// sqlDialect captures the differences between the SQL databases GoBank
+// runs on. Queries are written with Postgres style $1 placeholders.
+type sqlDialect struct {
+	// name selects the migrations directory
+	name string
+	// forUpdate is appended to selects that lock the rows they read
+	forUpdate string
+	// rebind rewrites the placeholders of a query for the driver
+	rebind func(query string) string
+	// lockMigrations serializes concurrent migration runs
+	lockMigrations string
+	// nextAccountNumber draws the next value of the account number sequence
+	nextAccountNumber string
+	// listTables names the tables of the schema migrations run in
+	listTables string
+	// listColumns names the columns of the table given as $1
+	listColumns string
+}
+
+var postgresDialect = sqlDialect{
+	name:              "postgres",
+	forUpdate:         " FOR UPDATE",
+	rebind:            func(query string) string { return query },
+	lockMigrations:    "lock table schema_migrations in exclusive mode",
+	nextAccountNumber: "select nextval('account_number_seq')",
+	listTables:        "select table_name from information_schema.tables where table_schema = current_schema() and table_type = 'BASE TABLE'",
+	listColumns:       "select column_name from information_schema.columns where table_schema = current_schema() and table_name = $1",
+}
+
+var numberedPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+// SQLite binds $1 as a named parameter in order of appearance, so queries
+// use the explicitly numbered ?1 form instead. Rows are locked by starting
+// every transaction with BEGIN IMMEDIATE rather than with FOR UPDATE.
+var sqliteDialect = sqlDialect{
+	name:      "sqlite",
+	forUpdate: "",
+	rebind: func(query string) string {
+		return numberedPlaceholder.ReplaceAllString(query, "?$1")
+	},
+	nextAccountNumber: "update account_number_seq set value = value + 1 returning value",
+	listTables:        "select name from sqlite_master where type = 'table' and name not like 'sqlite_%'",
+	listColumns:       "select name from pragma_table_info($1)",
+}
+
+// sqlStore implements Storage on top of database/sql and is shared by the
+// Postgres and SQLite stores.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+func (s *sqlStore) exec(query string, args ...any) (sql.Result, error) {
+	return s.db.Exec(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) query(query string, args ...any) (*sql.Rows, error) {
+	return s.db.Query(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(query string, args ...any) *sql.Row {
+	return s.db.QueryRow(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) begin() (*sqlTx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{tx: tx, dialect: s.dialect}, nil
+}
+
+// Init brings the schema up to date by applying all pending migrations.
+func (s *sqlStore) Init() error {
+	migrator, err := newMigrator(s)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up()
+	return err
+}
+
+type sqlTx struct {
+	tx      *sql.Tx
+	dialect sqlDialect
+}
+
+func (t *sqlTx) exec(query string, args ...any) (sql.Result, error) {
+	return t.tx.Exec(t.dialect.rebind(query), args...)
+}
+
+func (t *sqlTx) query(query string, args ...any) (*sql.Rows, error) {
+	return t.tx.Query(t.dialect.rebind(query), args...)
+}
+
+func (t *sqlTx) queryRow(query string, args ...any) *sql.Row {
+	return t.tx.QueryRow(t.dialect.rebind(query), args...)
+}
+
+func (t *sqlTx) commit() error {
+	return t.tx.Commit()
+}
+
+// rollback is deferred right after begin; once the transaction has been
+// committed it does nothing.
+func (t *sqlTx) rollback() {
+	if err := t.tx.Rollback(); err != nil && err != sql.ErrTxDone {
+		log.Printf("Could not roll back: %v\n", err)
+	}
+}
+
+func (s *sqlStore) CreateCustomer(customer *Customer) error {
+	query := `
+		insert into customer
+		(username, email, first_name, last_name, password, created_at)
+		values
+		($1, nullif($2, ''), $3, $4, $5, $6)
+		on conflict do nothing
+		RETURNING id
+	`
+	err := s.queryRow(
+		query,
+		customer.Username,
+		customer.Email,
+		customer.FirstName,
+		customer.LastName,
+		customer.EncryptedPassword,
+		customer.CreatedAt,
+	).Scan(&customer.ID)
+	if err == sql.ErrNoRows {
+		// either the username or the email is taken, tell which one
+		if _, err := s.GetCustomerByLogin(customer.Username); err == nil {
+			return errUsernameTaken(customer.Username)
+		}
+		return errEmailTaken(customer.Email)
+	}
+	return err
+}
+
+func (s *sqlStore) GetCustomerById(id int) (*Customer, error) {
+	customer, err := scanCustomer(s.queryRow("select "+customerColumns+" from customer where id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, errCustomerNotFound(id)
+	}
+	return customer, err
+}
+
+func (s *sqlStore) GetCustomerByLogin(login string) (*Customer, error) {
+	query := "select " + customerColumns + " from customer where username = $1 or email = lower($1)"
+	customer, err := scanCustomer(s.queryRow(query, login))
+	if err == sql.ErrNoRows {
+		return nil, NotFoundError("customer_not_found", "Customer %s not found", login)
+	}
+	return customer, err
+}
+
+const customerColumns = "id, username, coalesce(email, ''), coalesce(first_name, ''), coalesce(last_name, ''), password, created_at"
+
+func scanCustomer(row *sql.Row) (*Customer, error) {
+	customer := new(Customer)
+	err := row.Scan(
+		&customer.ID,
+		&customer.Username,
+		&customer.Email,
+		&customer.FirstName,
+		&customer.LastName,
+		&customer.EncryptedPassword,
+		&customer.CreatedAt,
+	)
+	return customer, err
+}
+
+func (s *sqlStore) NextAccountNumber() (int64, error) {
+	var number int64
+	err := s.queryRow(s.dialect.nextAccountNumber).Scan(&number)
+	return number, err
+}
+
+func (s *sqlStore) CreateAccount(account *Account, key *IdempotencyKey) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	if replayed, err := claimIdempotencyKey(tx, key); err != nil || replayed {
+		return err
+	}
+
+	query := `
+		insert into account
+		(customer_id, iban, type, balance, currency, status, created_at)
+		values
+		($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+	err = tx.queryRow(
+		query,
+		account.CustomerID,
+		account.IBAN,
+		account.Type,
+		account.Balance.Amount,
+		account.Balance.Currency,
+		account.Status,
+		account.CreatedAt,
+	).Scan(&account.ID)
+
+	if err != nil {
+		return err
+	}
+	if err := insertAccountHolder(tx, openingHolder(account)); err != nil {
+		return err
+	}
+
+	if account.Balance.IsPositive() {
+		entry := newOpeningBalanceEntry(account.IBAN, account.Balance, account.CreatedAt)
+		if err := s.postJournalEntry(tx, entry); err != nil {
+			return err
+		}
+		transaction := &Transaction{
+			JournalEntryID: entry.ID,
+			Kind:           entry.Kind,
+			AccountIban:    account.IBAN,
+			Direction:      Credit,
+			Amount:         account.Balance,
+			BalanceAfter:   account.Balance,
+			CreatedAt:      entry.CreatedAt,
+		}
+		if err := s.insertTransaction(tx, transaction); err != nil {
+			return err
+		}
+	}
+
+	if err := saveIdempotentResponse(tx, key, account); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (s *sqlStore) GetAccountById(accountId int) (*Account, error) {
+	rows, err := s.query("select "+accountColumns+" from account where id=$1", accountId)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanAccount(rows)
+	}
+	return nil, errAccountNotFound(accountId)
+}
+
+func (s *sqlStore) GetAccountByIban(accountIban string) (*Account, error) {
+	rows, err := s.query("select "+accountColumns+" from account where iban=$1", accountIban)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanAccount(rows)
+	}
+	return nil, errAccountIbanNotFound(accountIban)
+}
+
+func (s *sqlStore) GetAccountsByCustomer(customerID int) ([]*Account, error) {
+	query := "select " + accountColumns + " from account where id in (select account_id from account_holder where customer_id = $1 and status = $2) order by id"
+	rows, err := s.query(query, customerID, HolderStatusActive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*Account{}
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+func (s *sqlStore) GetAccounts(filter *AccountFilter) ([]*Account, error) {
+	query := "select " + accountColumns + " from account where 1 = 1"
+	args := []any{}
+	addCondition := func(condition string, arg any) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" and %s $%d", condition, len(args))
+	}
+	if filter.Status != "" {
+		addCondition("status =", filter.Status)
+	}
+	if filter.Cursor != 0 {
+		addCondition("id <", filter.Cursor)
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" order by id desc limit $%d", len(args))
+
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*Account{}
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+func (s *sqlStore) SetAccountStatus(iban string, status string, actor string) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	account, err := s.lockAccount(tx, iban)
+	if err != nil {
+		return err
+	}
+	if account.Status == status {
+		return errAccountStatusUnchanged(iban, status)
+	}
+	if status == AccountStatusClosed || !canTransition(account.Status, status) {
+		return errInvalidStatusTransition(iban, account.Status, status)
+	}
+	if _, err := tx.exec("update account set status = $2 where iban = $1", iban, status); err != nil {
+		return err
+	}
+	if err := insertAuditEvent(tx, accountStatusEvent(iban, account.Status, status, actor)); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (s *sqlStore) CloseAccount(iban string, payoutIban string, actor string) (*Transaction, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	account, err := s.lockAccount(tx, iban)
+	if err != nil {
+		return nil, err
+	}
+	if account.Status == AccountStatusClosed {
+		return nil, errAccountStatusUnchanged(iban, AccountStatusClosed)
+	}
+	if err := s.reconcileAccount(tx, account); err != nil {
+		return nil, err
+	}
+
+	var payout *Transaction
+	if !account.Balance.IsZero() {
+		if payoutIban == "" || payoutIban == iban {
+			return nil, errAccountNotEmpty(iban, account.Balance)
+		}
+		// the account is paid out even if it may not send otherwise, as
+		// closing it is the way out of any status
+		if payout, err = s.transferFrom(tx, account, payoutIban, account.Balance, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	query := "update account set status = $2, closed_at = $3 where iban = $1"
+	if _, err := tx.exec(query, iban, AccountStatusClosed, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	if err := insertAuditEvent(tx, accountStatusEvent(iban, account.Status, AccountStatusClosed, actor)); err != nil {
+		return nil, err
+	}
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	return payout, nil
+}
+
+func (s *sqlStore) SetApprovalLimit(accountID int, limit *Money) error {
+	approvalLimit := sql.NullInt64{}
+	if limit != nil {
+		approvalLimit = sql.NullInt64{Int64: limit.Amount, Valid: true}
+	}
+	result, err := s.exec("update account set approval_limit = $2 where id = $1", accountID, approvalLimit)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, errAccountNotFound(accountID))
+}
+
+const accountHolderColumns = "h.account_id, h.customer_id, c.username, h.permission, h.status, coalesce(h.invited_by, 0), h.created_at, h.accepted_at"
+
+func (s *sqlStore) GetAccountHolders(accountID int) ([]*AccountHolder, error) {
+	return s.queryAccountHolders("h.account_id = $1 order by h.created_at, h.customer_id", accountID)
+}
+
+func (s *sqlStore) GetAccountHolder(accountID, customerID int) (*AccountHolder, error) {
+	holders, err := s.queryAccountHolders("h.account_id = $1 and h.customer_id = $2", accountID, customerID)
+	if err != nil {
+		return nil, err
+	}
+	if len(holders) == 0 {
+		return nil, errAccountHolderNotFound(accountID, customerID)
+	}
+	return holders[0], nil
+}
+
+func (s *sqlStore) GetInvitations(customerID int) ([]*AccountHolder, error) {
+	return s.queryAccountHolders("h.customer_id = $1 and h.status = $2 order by h.account_id", customerID, HolderStatusInvited)
+}
+
+func (s *sqlStore) queryAccountHolders(condition string, args ...any) ([]*AccountHolder, error) {
+	query := "select " + accountHolderColumns + " from account_holder h join customer c on c.id = h.customer_id where " + condition
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holders := []*AccountHolder{}
+	for rows.Next() {
+		holder := new(AccountHolder)
+		var acceptedAt sql.NullTime
+		err := rows.Scan(
+			&holder.AccountID,
+			&holder.CustomerID,
+			&holder.Username,
+			&holder.Permission,
+			&holder.Status,
+			&holder.InvitedBy,
+			&holder.CreatedAt,
+			&acceptedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if acceptedAt.Valid {
+			holder.AcceptedAt = &acceptedAt.Time
+		}
+		holders = append(holders, holder)
+	}
+	return holders, rows.Err()
+}
+
+func (s *sqlStore) AddAccountHolder(holder *AccountHolder) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	if err := insertAccountHolder(tx, holder); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (s *sqlStore) AcceptAccountHolder(accountID, customerID int) (*AccountHolder, error) {
+	query := "update account_holder set status = $3, accepted_at = $4 where account_id = $1 and customer_id = $2 and status = $5"
+	result, err := s.exec(query, accountID, customerID, HolderStatusActive, time.Now().UTC(), HolderStatusInvited)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAffected(result, errAccountHolderNotFound(accountID, customerID)); err != nil {
+		return nil, err
+	}
+	return s.GetAccountHolder(accountID, customerID)
+}
+
+func (s *sqlStore) RemoveAccountHolder(accountID, customerID int) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	// locking the account serializes holders removing each other
+	var id int
+	err = tx.queryRow("select id from account where id = $1"+tx.dialect.forUpdate, accountID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errAccountNotFound(accountID)
+	}
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.exec("delete from account_holder where account_id = $1 and customer_id = $2", accountID, customerID)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result, errAccountHolderNotFound(accountID, customerID)); err != nil {
+		return err
+	}
+
+	var managers int
+	query := "select count(*) from account_holder where account_id = $1 and status = $2 and permission = $3"
+	if err := tx.queryRow(query, accountID, HolderStatusActive, HolderPermissionManage).Scan(&managers); err != nil {
+		return err
+	}
+	if managers == 0 {
+		return errLastAccountManager()
+	}
+	return tx.commit()
+}
+
+func (s *sqlStore) TransferFunds(fromIban string, toIban string, amount Money, quoteID string, key *IdempotencyKey) (*Transaction, error) {
+	if !amount.IsPositive() {
+		return nil, errAmountNotPositive()
+	}
+
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	if replayed, err := claimIdempotencyKey(tx, key); err != nil || replayed {
+		return nil, err
+	}
+
+	debit, err := s.transfer(tx, fromIban, toIban, amount, quoteID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveIdempotentResponse(tx, key, debit); err != nil {
+		return nil, err
+	}
+
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	return debit, nil
+}
+
+// transfer moves the amount inside tx and returns the sender's transaction.
+// The receiver is credited the converted amount if it holds another
+// currency.
+func (s *sqlStore) transfer(tx *sqlTx, fromIban string, toIban string, amount Money, quoteID string) (*Transaction, error) {
+	fromAccount, err := s.lockAccount(tx, fromIban)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCanSend(fromAccount); err != nil {
+		return nil, err
+	}
+	return s.transferFrom(tx, fromAccount, toIban, amount, quoteID)
+}
+
+// transferFrom moves the amount from the locked fromAccount whatever its
+// status, which the caller has checked.
+func (s *sqlStore) transferFrom(tx *sqlTx, fromAccount *Account, toIban string, amount Money, quoteID string) (*Transaction, error) {
+	fromIban := fromAccount.IBAN
+	if err := s.reconcileAccount(tx, fromAccount); err != nil {
+		return nil, err
+	}
+	if !fromAccount.Balance.SameCurrency(amount) {
+		return nil, errCurrencyMismatch()
+	}
+	if amount.Cmp(fromAccount.Balance) > 0 {
+		return nil, errInsufficientFunds()
+	}
+
+	updateBalance := func(iban string, balance Money) error {
+		_, err := tx.exec("update account set balance = $2 where iban = $1", iban, balance.Amount)
+		return err
+	}
+
+	if err := updateBalance(fromIban, fromAccount.Balance.Sub(amount)); err != nil {
+		return nil, err
+	}
+
+	toAccount, err := s.lockAccount(tx, toIban)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCanReceive(toAccount); err != nil {
+		return nil, err
+	}
+	conversion, err := s.convert(tx, amount, toAccount.Balance.Currency, quoteID)
+	if err != nil {
+		return nil, err
+	}
+	credited := amount
+	if conversion != nil {
+		credited = conversion.Amount
+	}
+
+	if err := updateBalance(toIban, toAccount.Balance.Add(credited)); err != nil {
+		return nil, err
+	}
+
+	entry := newTransferEntry(fromIban, toIban, amount, conversion, time.Now().UTC())
+	if err := s.postJournalEntry(tx, entry); err != nil {
+		return nil, err
+	}
+
+	// from and to may be the same account, so the sender's resulting
+	// balance is read back after both updates
+	fromAccount, err = s.lockAccount(tx, fromIban)
+	if err != nil {
+		return nil, err
+	}
+	toAccount, err = s.lockAccount(tx, toIban)
+	if err != nil {
+		return nil, err
+	}
+
+	debit, credit := newTransferTransactions(entry, fromAccount, toAccount, amount, conversion)
+	if err := s.insertTransaction(tx, debit); err != nil {
+		return nil, err
+	}
+	if err := s.insertTransaction(tx, credit); err != nil {
+		return nil, err
+	}
+	return debit, nil
+}
+
+func (s *sqlStore) RefundTransfer(refund *Refund, key *IdempotencyKey) (*Transaction, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	if replayed, err := claimIdempotencyKey(tx, key); err != nil || replayed {
+		return nil, err
+	}
+
+	query := `
+		select ` + transactionColumns + `
+		from account_transaction
+		where journal_entry_id = (select journal_entry_id from account_transaction where id = $1)
+	`
+	rows, err := tx.query(query, refund.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := scanTransactions(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	originalCredit, originalDebit, err := refund.original(lines)
+	if err != nil {
+		return nil, err
+	}
+
+	recipient, err := s.lockAccount(tx, originalCredit.AccountIban)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := s.lockAccount(tx, originalDebit.AccountIban)
+	if err != nil {
+		return nil, err
+	}
+	if err := refund.checkAccounts(recipient, sender); err != nil {
+		return nil, err
+	}
+	if err := s.reconcileAccount(tx, recipient); err != nil {
+		return nil, err
+	}
+
+	paidBack := func(line *Transaction) (Money, error) {
+		paid := NewMoney(0, line.Amount.Currency)
+		query := "select coalesce(sum(amount), 0) from account_transaction where original_transaction_id = $1"
+		return paid, tx.queryRow(query, line.ID).Scan(&paid.Amount)
+	}
+	refunded, err := paidBack(originalCredit)
+	if err != nil {
+		return nil, err
+	}
+	returned, err := paidBack(originalDebit)
+	if err != nil {
+		return nil, err
+	}
+	amount, conversion, err := refund.amounts(originalCredit, originalDebit, refunded, returned)
+	if err != nil {
+		return nil, err
+	}
+	if amount.Cmp(recipient.Balance) > 0 && !refund.AllowNegative {
+		return nil, errInsufficientFunds()
+	}
+	credited := amount
+	if conversion != nil {
+		credited = conversion.Amount
+	}
+
+	updateBalance := func(iban string, balance Money) error {
+		_, err := tx.exec("update account set balance = $2 where iban = $1", iban, balance.Amount)
+		return err
+	}
+	if err := updateBalance(recipient.IBAN, recipient.Balance.Sub(amount)); err != nil {
+		return nil, err
+	}
+	// the sender is read again in case it is the recipient
+	if sender, err = s.lockAccount(tx, sender.IBAN); err != nil {
+		return nil, err
+	}
+	if err := updateBalance(sender.IBAN, sender.Balance.Add(credited)); err != nil {
+		return nil, err
+	}
+	entry := refund.entry(recipient.IBAN, sender.IBAN, amount, conversion, time.Now().UTC())
+	if err := s.postJournalEntry(tx, entry); err != nil {
+		return nil, err
+	}
+
+	// both may be the same account, so balances are read back after both
+	// updates
+	if recipient, err = s.lockAccount(tx, recipient.IBAN); err != nil {
+		return nil, err
+	}
+	if sender, err = s.lockAccount(tx, sender.IBAN); err != nil {
+		return nil, err
+	}
+	debit, credit := newTransferTransactions(entry, recipient, sender, amount, conversion)
+	refund.link(debit, credit, originalCredit, originalDebit)
+	if err := s.insertTransaction(tx, debit); err != nil {
+		return nil, err
+	}
+	if err := s.insertTransaction(tx, credit); err != nil {
+		return nil, err
+	}
+	if refund.Reversal {
+		if err := insertAuditEvent(tx, reversalEvent(refund, debit)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := saveIdempotentResponse(tx, key, debit); err != nil {
+		return nil, err
+	}
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	return debit, nil
+}
+
+// convert works out what amount is worth in currency, at the rate of the
+// quote with quoteID, which it uses up, or else at the current rate. It
+// returns nil if amount already is in currency.
+func (s *sqlStore) convert(tx *sqlTx, amount Money, currency string, quoteID string) (*FXConversion, error) {
+	if amount.Currency == currency && quoteID == "" {
+		return nil, nil
+	}
+
+	var rate *ExchangeRate
+	if quoteID != "" {
+		quote, err := scanFXQuote(tx.queryRow("select "+fxQuoteColumns+" from fx_quote where id = $1"+tx.dialect.forUpdate, quoteID))
+		if err == sql.ErrNoRows {
+			return nil, errFXQuoteNotFound(quoteID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := quote.use(amount.Currency, currency, time.Now().UTC()); err != nil {
+			return nil, err
+		}
+		if _, err := tx.exec("update fx_quote set used_at = $2 where id = $1", quote.ID, quote.UsedAt); err != nil {
+			return nil, err
+		}
+		rate = quote.exchangeRate()
+	} else {
+		var err error
+		if rate, err = exchangeRate(tx, amount.Currency, currency); err != nil {
+			return nil, err
+		}
+	}
+
+	converted, err := rate.Convert(amount)
+	if err != nil {
+		return nil, err
+	}
+	return &FXConversion{Rate: rate.Applied(), Spread: rate.Spread, Amount: converted}, nil
+}
+
+func (s *sqlStore) CreateTransferApproval(approval *TransferApproval, key *IdempotencyKey) error {
+	if !approval.Amount.IsPositive() {
+		return errAmountNotPositive()
+	}
+
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	if replayed, err := claimIdempotencyKey(tx, key); err != nil || replayed {
+		return err
+	}
+
+	query := `
+		insert into transfer_approval
+		(from_iban, to_iban, amount, currency, status, requested_by, created_at)
+		values
+		($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+	err = tx.queryRow(
+		query,
+		approval.FromAccountIban,
+		approval.ToAccountIban,
+		approval.Amount.Amount,
+		approval.Amount.Currency,
+		approval.Status,
+		approval.RequestedBy,
+		approval.CreatedAt,
+	).Scan(&approval.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := saveIdempotentResponse(tx, key, approval); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+const transferApprovalColumns = "id, from_iban, to_iban, amount, currency, status, requested_by, decided_by, transaction_id, created_at, decided_at"
+
+func (s *sqlStore) GetTransferApprovals(iban string, status string) ([]*TransferApproval, error) {
+	query := "select " + transferApprovalColumns + " from transfer_approval where from_iban = $1"
+	args := []any{iban}
+	if status != "" {
+		args = append(args, status)
+		query += " and status = $2"
+	}
+	rows, err := s.query(query+" order by id desc", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	approvals := []*TransferApproval{}
+	for rows.Next() {
+		approval, err := scanTransferApproval(rows)
+		if err != nil {
+			return nil, err
+		}
+		approvals = append(approvals, approval)
+	}
+	return approvals, rows.Err()
+}
+
+func (s *sqlStore) GetTransferApproval(id int, iban string) (*TransferApproval, error) {
+	query := "select " + transferApprovalColumns + " from transfer_approval where id = $1 and from_iban = $2"
+	approval, err := scanTransferApproval(s.queryRow(query, id, iban))
+	if err == sql.ErrNoRows {
+		return nil, errTransferApprovalNotFound(id)
+	}
+	return approval, err
+}
+
+func (s *sqlStore) DecideTransferApproval(id int, iban string, approve bool, decidedBy int) (*TransferApproval, *Transaction, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.rollback()
+
+	query := "select " + transferApprovalColumns + " from transfer_approval where id = $1 and from_iban = $2" + tx.dialect.forUpdate
+	approval, err := scanTransferApproval(tx.queryRow(query, id, iban))
+	if err == sql.ErrNoRows {
+		return nil, nil, errTransferApprovalNotFound(id)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := approval.decide(approve, decidedBy, time.Now().UTC()); err != nil {
+		return nil, nil, err
+	}
+
+	var debit *Transaction
+	if approve {
+		if debit, err = s.transfer(tx, approval.FromAccountIban, approval.ToAccountIban, approval.Amount, ""); err != nil {
+			return nil, nil, err
+		}
+		approval.TransactionID = debit.ID
+	}
+
+	query = "update transfer_approval set status = $2, decided_by = $3, transaction_id = $4, decided_at = $5 where id = $1"
+	transactionID := sql.NullInt64{Int64: int64(approval.TransactionID), Valid: debit != nil}
+	if _, err := tx.exec(query, approval.ID, approval.Status, approval.DecidedBy, transactionID, approval.DecidedAt); err != nil {
+		return nil, nil, err
+	}
+	if err := tx.commit(); err != nil {
+		return nil, nil, err
+	}
+	return approval, debit, nil
+}
+
+func scanTransferApproval(row interface{ Scan(...any) error }) (*TransferApproval, error) {
+	approval := new(TransferApproval)
+	var decidedBy, transactionID sql.NullInt64
+	var decidedAt sql.NullTime
+	err := row.Scan(
+		&approval.ID,
+		&approval.FromAccountIban,
+		&approval.ToAccountIban,
+		&approval.Amount.Amount,
+		&approval.Amount.Currency,
+		&approval.Status,
+		&approval.RequestedBy,
+		&decidedBy,
+		&transactionID,
+		&approval.CreatedAt,
+		&decidedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	approval.DecidedBy = int(decidedBy.Int64)
+	approval.TransactionID = int(transactionID.Int64)
+	if decidedAt.Valid {
+		approval.DecidedAt = &decidedAt.Time
+	}
+	return approval, nil
+}
+
+func (s *sqlStore) CreateScheduledTransfer(transfer *ScheduledTransfer, key *IdempotencyKey) error {
+	if !transfer.Amount.IsPositive() {
+		return errAmountNotPositive()
+	}
+
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	if replayed, err := claimIdempotencyKey(tx, key); err != nil || replayed {
+		return err
+	}
+	if err := insertScheduledTransfer(tx, transfer); err != nil {
+		return err
+	}
+	if err := saveIdempotentResponse(tx, key, transfer); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func insertScheduledTransfer(tx *sqlTx, transfer *ScheduledTransfer) error {
+	query := `
+		insert into scheduled_transfer
+		(from_iban, to_iban, amount, currency, execution_date, status, requested_by, next_attempt_at, created_at,
+		standing_order_id, max_attempts)
+		values
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id
+	`
+	return tx.queryRow(
+		query,
+		transfer.FromAccountIban,
+		transfer.ToAccountIban,
+		transfer.Amount.Amount,
+		transfer.Amount.Currency,
+		transfer.ExecutionDate,
+		transfer.Status,
+		transfer.RequestedBy,
+		transfer.NextAttemptAt,
+		transfer.CreatedAt,
+		sql.NullInt64{Int64: int64(transfer.StandingOrderID), Valid: transfer.StandingOrderID != 0},
+		sql.NullInt64{Int64: int64(transfer.MaxAttempts), Valid: transfer.MaxAttempts != 0},
+	).Scan(&transfer.ID)
+}
+
+const scheduledTransferColumns = `id, from_iban, to_iban, amount, currency, execution_date, status, requested_by, attempts,
+	next_attempt_at, coalesce(last_error, ''), transaction_id, cancelled_by, created_at, executed_at, cancelled_at,
+	coalesce(standing_order_id, 0), coalesce(max_attempts, 0), approval_id`
+
+func (s *sqlStore) GetScheduledTransfers(iban string, status string) ([]*ScheduledTransfer, error) {
+	query := "select " + scheduledTransferColumns + " from scheduled_transfer where from_iban = $1"
+	args := []any{iban}
+	if status != "" {
+		args = append(args, status)
+		query += " and status = $2"
+	}
+	return queryScheduledTransfers(s, query+" order by id desc", args...)
+}
+
+func (s *sqlStore) CancelScheduledTransfer(id int, iban string, cancelledBy int) (*ScheduledTransfer, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	query := "select " + scheduledTransferColumns + " from scheduled_transfer where id = $1 and from_iban = $2" + tx.dialect.forUpdate
+	transfer, err := scanScheduledTransfer(tx.queryRow(query, id, iban))
+	if err == sql.ErrNoRows {
+		return nil, errScheduledTransferNotFound(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := transfer.cancel(cancelledBy, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	query = "update scheduled_transfer set status = $2, cancelled_by = $3, cancelled_at = $4 where id = $1"
+	if _, err := tx.exec(query, transfer.ID, transfer.Status, transfer.CancelledBy, transfer.CancelledAt); err != nil {
+		return nil, err
+	}
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	return transfer, nil
+}
+
+func (s *sqlStore) ClaimDueScheduledTransfers(now time.Time, leaseUntil time.Time, limit int) ([]*ScheduledTransfer, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	query := `
+		select ` + scheduledTransferColumns + `
+		from scheduled_transfer
+		where status in ($1, $2) and next_attempt_at <= $3
+		order by next_attempt_at, id
+		limit $4
+	` + tx.dialect.forUpdate
+	transfers, err := queryScheduledTransfers(tx, query, ScheduledStatusPending, ScheduledStatusExecuting, now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, transfer := range transfers {
+		transfer.Status, transfer.NextAttemptAt = ScheduledStatusExecuting, leaseUntil
+		query := "update scheduled_transfer set status = $2, next_attempt_at = $3 where id = $1"
+		if _, err := tx.exec(query, transfer.ID, transfer.Status, transfer.NextAttemptAt); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
+
+func (s *sqlStore) RecordScheduledTransferAttempt(transfer *ScheduledTransfer) error {
+	query := `
+		update scheduled_transfer
+		set status = $3, attempts = $4, next_attempt_at = $5, last_error = $6, transaction_id = $7, executed_at = $8,
+		approval_id = $9
+		where id = $1 and status = $2
+	`
+	result, err := s.exec(
+		query,
+		transfer.ID,
+		ScheduledStatusExecuting,
+		transfer.Status,
+		transfer.Attempts,
+		transfer.NextAttemptAt,
+		sql.NullString{String: transfer.LastError, Valid: transfer.LastError != ""},
+		sql.NullInt64{Int64: int64(transfer.TransactionID), Valid: transfer.TransactionID != 0},
+		transfer.ExecutedAt,
+		sql.NullInt64{Int64: int64(transfer.ApprovalID), Valid: transfer.ApprovalID != 0},
+	)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, errScheduledTransferNotFound(transfer.ID))
+}
+
+func queryScheduledTransfers(q querier, query string, args ...any) ([]*ScheduledTransfer, error) {
+	rows, err := q.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []*ScheduledTransfer{}
+	for rows.Next() {
+		transfer, err := scanScheduledTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers, rows.Err()
+}
+
+func scanScheduledTransfer(row interface{ Scan(...any) error }) (*ScheduledTransfer, error) {
+	transfer := new(ScheduledTransfer)
+	var transactionID, cancelledBy, approvalID sql.NullInt64
+	var executedAt, cancelledAt sql.NullTime
+	err := row.Scan(
+		&transfer.ID,
+		&transfer.FromAccountIban,
+		&transfer.ToAccountIban,
+		&transfer.Amount.Amount,
+		&transfer.Amount.Currency,
+		&transfer.ExecutionDate,
+		&transfer.Status,
+		&transfer.RequestedBy,
+		&transfer.Attempts,
+		&transfer.NextAttemptAt,
+		&transfer.LastError,
+		&transactionID,
+		&cancelledBy,
+		&transfer.CreatedAt,
+		&executedAt,
+		&cancelledAt,
+		&transfer.StandingOrderID,
+		&transfer.MaxAttempts,
+		&approvalID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	transfer.TransactionID = int(transactionID.Int64)
+	transfer.CancelledBy = int(cancelledBy.Int64)
+	transfer.ApprovalID = int(approvalID.Int64)
+	if executedAt.Valid {
+		transfer.ExecutedAt = &executedAt.Time
+	}
+	if cancelledAt.Valid {
+		transfer.CancelledAt = &cancelledAt.Time
+	}
+	return transfer, nil
+}
+
+func (s *sqlStore) CreateStandingOrder(order *StandingOrder, key *IdempotencyKey) error {
+	if !order.Amount.IsPositive() {
+		return errAmountNotPositive()
+	}
+
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	if replayed, err := claimIdempotencyKey(tx, key); err != nil || replayed {
+		return err
+	}
+
+	query := `
+		insert into standing_order
+		(from_iban, to_iban, amount, currency, frequency, day_of_month, start_date, end_date, on_insufficient_funds,
+		status, next_execution_date, created_by, created_at)
+		values
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING id
+	`
+	err = tx.queryRow(
+		query,
+		order.FromAccountIban,
+		order.ToAccountIban,
+		order.Amount.Amount,
+		order.Amount.Currency,
+		order.Frequency,
+		sql.NullInt64{Int64: int64(order.DayOfMonth), Valid: order.DayOfMonth != 0},
+		order.StartDate,
+		sql.NullString{String: order.EndDate, Valid: order.EndDate != ""},
+		order.OnInsufficientFunds,
+		order.Status,
+		order.NextExecutionDate,
+		order.CreatedBy,
+		order.CreatedAt,
+	).Scan(&order.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := saveIdempotentResponse(tx, key, order); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+const standingOrderColumns = `id, from_iban, to_iban, amount, currency, frequency, coalesce(day_of_month, 0), start_date,
+	coalesce(end_date, ''), on_insufficient_funds, status, coalesce(next_execution_date, ''), coalesce(last_execution_date, ''),
+	created_by, coalesce(cancelled_by, 0), created_at, cancelled_at`
+
+func (s *sqlStore) GetStandingOrders(iban string, status string) ([]*StandingOrder, error) {
+	query := "select " + standingOrderColumns + " from standing_order where from_iban = $1"
+	args := []any{iban}
+	if status != "" {
+		args = append(args, status)
+		query += " and status = $2"
+	}
+	return queryStandingOrders(s, query+" order by id desc", args...)
+}
+
+func (s *sqlStore) GetStandingOrder(id int, iban string) (*StandingOrder, error) {
+	query := "select " + standingOrderColumns + " from standing_order where id = $1 and from_iban = $2"
+	order, err := scanStandingOrder(s.queryRow(query, id, iban))
+	if err == sql.ErrNoRows {
+		return nil, errStandingOrderNotFound(id)
+	}
+	return order, err
+}
+
+func (s *sqlStore) UpdateStandingOrder(id int, iban string, req *StandingOrderRequest) (*StandingOrder, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	order, err := lockStandingOrder(tx, id, iban)
+	if err != nil {
+		return nil, err
+	}
+	if err := order.update(req, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	query := `
+		update standing_order
+		set to_iban = $2, amount = $3, currency = $4, frequency = $5, day_of_month = $6, start_date = $7, end_date = $8,
+		on_insufficient_funds = $9, next_execution_date = $10
+		where id = $1
+	`
+	_, err = tx.exec(
+		query,
+		order.ID,
+		order.ToAccountIban,
+		order.Amount.Amount,
+		order.Amount.Currency,
+		order.Frequency,
+		sql.NullInt64{Int64: int64(order.DayOfMonth), Valid: order.DayOfMonth != 0},
+		order.StartDate,
+		sql.NullString{String: order.EndDate, Valid: order.EndDate != ""},
+		order.OnInsufficientFunds,
+		order.NextExecutionDate,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (s *sqlStore) CancelStandingOrder(id int, iban string, cancelledBy int) (*StandingOrder, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	order, err := lockStandingOrder(tx, id, iban)
+	if err != nil {
+		return nil, err
+	}
+	if err := order.cancel(cancelledBy, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	query := "update standing_order set status = $2, next_execution_date = null, cancelled_by = $3, cancelled_at = $4 where id = $1"
+	if _, err := tx.exec(query, order.ID, order.Status, order.CancelledBy, order.CancelledAt); err != nil {
+		return nil, err
+	}
+	query = `
+		update scheduled_transfer set status = $3, cancelled_by = $4, cancelled_at = $5
+		where standing_order_id = $1 and status = $2
+	`
+	_, err = tx.exec(query, order.ID, ScheduledStatusPending, ScheduledStatusCancelled, order.CancelledBy, order.CancelledAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (s *sqlStore) ScheduleStandingOrders(today string, limit int) (int, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.rollback()
+
+	query := `
+		select ` + standingOrderColumns + `
+		from standing_order
+		where status = $1 and next_execution_date <= $2
+		order by next_execution_date, id
+		limit $3
+	` + tx.dialect.forUpdate
+	orders, err := queryStandingOrders(tx, query, StandingOrderStatusActive, today, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, order := range orders {
+		// executions missed while the scheduler was down are caught up on
+		for order.Status == StandingOrderStatusActive && order.NextExecutionDate <= today {
+			if err := insertScheduledTransfer(tx, order.scheduledTransfer()); err != nil {
+				return 0, err
+			}
+			order.advance()
+			created++
+		}
+		query := "update standing_order set status = $2, next_execution_date = $3, last_execution_date = $4 where id = $1"
+		nextExecutionDate := sql.NullString{String: order.NextExecutionDate, Valid: order.NextExecutionDate != ""}
+		if _, err := tx.exec(query, order.ID, order.Status, nextExecutionDate, order.LastExecutionDate); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.commit(); err != nil {
+		return 0, err
+	}
+	return created, nil
+}
+
+func lockStandingOrder(tx *sqlTx, id int, iban string) (*StandingOrder, error) {
+	query := "select " + standingOrderColumns + " from standing_order where id = $1 and from_iban = $2" + tx.dialect.forUpdate
+	order, err := scanStandingOrder(tx.queryRow(query, id, iban))
+	if err == sql.ErrNoRows {
+		return nil, errStandingOrderNotFound(id)
+	}
+	return order, err
+}
+
+func queryStandingOrders(q querier, query string, args ...any) ([]*StandingOrder, error) {
+	rows, err := q.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []*StandingOrder{}
+	for rows.Next() {
+		order, err := scanStandingOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+func scanStandingOrder(row interface{ Scan(...any) error }) (*StandingOrder, error) {
+	order := new(StandingOrder)
+	var cancelledAt sql.NullTime
+	err := row.Scan(
+		&order.ID,
+		&order.FromAccountIban,
+		&order.ToAccountIban,
+		&order.Amount.Amount,
+		&order.Amount.Currency,
+		&order.Frequency,
+		&order.DayOfMonth,
+		&order.StartDate,
+		&order.EndDate,
+		&order.OnInsufficientFunds,
+		&order.Status,
+		&order.NextExecutionDate,
+		&order.LastExecutionDate,
+		&order.CreatedBy,
+		&order.CancelledBy,
+		&order.CreatedAt,
+		&cancelledAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if cancelledAt.Valid {
+		order.CancelledAt = &cancelledAt.Time
+	}
+	return order, nil
+}
+
+func (s *sqlStore) ExecuteTransferBatch(batch *TransferBatch, key *IdempotencyKey) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	if replayed, err := claimIdempotencyKey(tx, key); err != nil || replayed {
+		return err
+	}
+
+	// every item runs under a savepoint of its own, so that a failed one
+	// leaves the others in place; atomic batches roll back all of them
+	if _, err := tx.exec("savepoint transfer_batch"); err != nil {
+		return err
+	}
+	for _, item := range batch.Items {
+		if !batch.executes() {
+			break
+		}
+		if _, err := tx.exec("savepoint transfer_batch_item"); err != nil {
+			return err
+		}
+		debit, err := s.transfer(tx, batch.FromAccountIban, item.ToAccountIban, item.Amount, "")
+		batch.record(item, debit, err)
+		if err != nil {
+			_, err = tx.exec("rollback to savepoint transfer_batch_item")
+		} else {
+			_, err = tx.exec("release savepoint transfer_batch_item")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !batch.executes() {
+		if _, err := tx.exec("rollback to savepoint transfer_batch"); err != nil {
+			return err
+		}
+	}
+	batch.finish()
+
+	query := `
+		insert into transfer_batch
+		(from_iban, mode, status, total_amount, currency, succeeded, failed, requested_by, created_at)
+		values
+		($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id
+	`
+	err = tx.queryRow(
+		query,
+		batch.FromAccountIban,
+		batch.Mode,
+		batch.Status,
+		batch.Total.Amount,
+		batch.Total.Currency,
+		batch.Succeeded,
+		batch.Failed,
+		batch.RequestedBy,
+		batch.CreatedAt,
+	).Scan(&batch.ID)
+	if err != nil {
+		return err
+	}
+	for _, item := range batch.Items {
+		var errorCode, errorMessage sql.NullString
+		if item.Error != nil {
+			errorCode = sql.NullString{String: item.Error.Code, Valid: true}
+			errorMessage = sql.NullString{String: item.Error.Message, Valid: true}
+		}
+		query := `
+			insert into transfer_batch_item
+			(batch_id, item_index, to_iban, amount, currency, status, transaction_id, error_code, error_message)
+			values
+			($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		`
+		_, err := tx.exec(
+			query,
+			batch.ID,
+			item.Index,
+			item.ToAccountIban,
+			item.Amount.Amount,
+			item.Amount.Currency,
+			item.Status,
+			sql.NullInt64{Int64: int64(item.TransactionID), Valid: item.TransactionID != 0},
+			errorCode,
+			errorMessage,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := saveIdempotentResponse(tx, key, batch); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (s *sqlStore) GetTransferBatch(id int) (*TransferBatch, error) {
+	query := `
+		select id, from_iban, mode, status, total_amount, currency, succeeded, failed, requested_by, created_at
+		from transfer_batch
+		where id = $1
+	`
+	batch := new(TransferBatch)
+	err := s.queryRow(query, id).Scan(
+		&batch.ID,
+		&batch.FromAccountIban,
+		&batch.Mode,
+		&batch.Status,
+		&batch.Total.Amount,
+		&batch.Total.Currency,
+		&batch.Succeeded,
+		&batch.Failed,
+		&batch.RequestedBy,
+		&batch.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, errTransferBatchNotFound(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		select item_index, to_iban, amount, currency, status, coalesce(transaction_id, 0), error_code, error_message
+		from transfer_batch_item
+		where batch_id = $1
+		order by item_index
+	`
+	rows, err := s.query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batch.Items = []*TransferBatchItem{}
+	for rows.Next() {
+		item := new(TransferBatchItem)
+		var errorCode, errorMessage sql.NullString
+		err := rows.Scan(
+			&item.Index,
+			&item.ToAccountIban,
+			&item.Amount.Amount,
+			&item.Amount.Currency,
+			&item.Status,
+			&item.TransactionID,
+			&errorCode,
+			&errorMessage,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if errorCode.Valid {
+			item.Error = &BatchItemError{Code: errorCode.String, Message: errorMessage.String}
+		}
+		batch.Items = append(batch.Items, item)
+	}
+	return batch, rows.Err()
+}
+
+func (s *sqlStore) Deposit(iban string, amount Money, reference string, actor string, key *IdempotencyKey) (*Transaction, error) {
+	return s.moveCash(iban, Credit, amount, reference, actor, key)
+}
+
+func (s *sqlStore) Withdraw(iban string, amount Money, reference string, actor string, key *IdempotencyKey) (*Transaction, error) {
+	return s.moveCash(iban, Debit, amount, reference, actor, key)
+}
+
+// moveCash books money entering (Credit) or leaving (Debit) an account
+// against the cash ledger.
+func (s *sqlStore) moveCash(iban string, direction PostingDirection, amount Money, reference string, actor string, key *IdempotencyKey) (*Transaction, error) {
+	if !amount.IsPositive() {
+		return nil, errAmountNotPositive()
+	}
+
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	if replayed, err := claimIdempotencyKey(tx, key); err != nil || replayed {
+		return nil, err
+	}
+
+	account, err := s.lockAccount(tx, iban)
+	if err != nil {
+		return nil, err
+	}
+	checkStatus := checkCanReceive
+	if direction == Debit {
+		checkStatus = checkCanSend
+	}
+	if err := checkStatus(account); err != nil {
+		return nil, err
+	}
+	if err := s.reconcileAccount(tx, account); err != nil {
+		return nil, err
+	}
+	if !account.Balance.SameCurrency(amount) {
+		return nil, errCurrencyMismatch()
+	}
+
+	balance := account.Balance.Add(amount)
+	if direction == Debit {
+		if amount.Cmp(account.Balance) > 0 {
+			return nil, errInsufficientFunds()
+		}
+		balance = account.Balance.Sub(amount)
+	}
+	if _, err := tx.exec("update account set balance = $2 where iban = $1", iban, balance.Amount); err != nil {
+		return nil, err
+	}
+
+	entry := newCashEntry(iban, direction, amount, reference, time.Now().UTC())
+	if err := s.postJournalEntry(tx, entry); err != nil {
+		return nil, err
+	}
+	transaction := &Transaction{
+		JournalEntryID: entry.ID,
+		Kind:           entry.Kind,
+		AccountIban:    iban,
+		Direction:      direction,
+		Amount:         amount,
+		BalanceAfter:   balance,
+		Reference:      reference,
+		CreatedAt:      entry.CreatedAt,
+	}
+	if err := s.insertTransaction(tx, transaction); err != nil {
+		return nil, err
+	}
+	if err := insertAuditEvent(tx, cashEvent(transaction, actor)); err != nil {
+		return nil, err
+	}
+
+	if err := saveIdempotentResponse(tx, key, transaction); err != nil {
+		return nil, err
+	}
+
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// GetLedgerBalance rebuilds the balance of an account from the postings
+// booked up to and including asOf.
+func (s *sqlStore) GetLedgerBalance(iban string, asOf time.Time) (Money, error) {
+	return ledgerBalance(s, iban, asOf)
+}
+
+type queryRower interface {
+	queryRow(query string, args ...any) *sql.Row
+}
+
+func ledgerBalance(q queryRower, iban string, asOf time.Time) (Money, error) {
+	query := `
+		select a.currency, coalesce(sum(case when p.direction = 'credit' then p.amount else -p.amount end), 0)
+		from account a
+		left join posting p on p.account = a.iban and p.currency = a.currency and p.created_at <= $2
+		where a.iban = $1
+		group by a.currency
+	`
+	var balance Money
+	err := q.queryRow(query, iban, asOf).Scan(&balance.Currency, &balance.Amount)
+	if err == sql.ErrNoRows {
+		return Money{}, errAccountIbanNotFound(iban)
+	}
+	return balance, err
+}
+
+// reconcileAccount makes sure the stored balance of a locked account still
+// matches the sum of its postings before it is changed again.
+func (s *sqlStore) reconcileAccount(tx *sqlTx, account *Account) error {
+	balance, err := ledgerBalance(tx, account.IBAN, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if balance != account.Balance {
+		return errLedgerMismatch(account.IBAN)
+	}
+	return nil
+}
+
+func (s *sqlStore) postJournalEntry(tx *sqlTx, entry *JournalEntry) error {
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+
+	query := `
+		insert into journal_entry
+		(kind, description, created_at)
+		values
+		($1, $2, $3)
+		RETURNING id
+	`
+	if err := tx.queryRow(query, entry.Kind, entry.Description, entry.CreatedAt).Scan(&entry.ID); err != nil {
+		return err
+	}
+
+	for _, posting := range entry.Postings {
+		posting.JournalEntryID = entry.ID
+		query := `
+			insert into posting
+			(journal_entry_id, account, direction, amount, currency, created_at)
+			values
+			($1, $2, $3, $4, $5, $6)
+			RETURNING id
+		`
+		err := tx.queryRow(
+			query,
+			posting.JournalEntryID,
+			posting.Account,
+			posting.Direction,
+			posting.Amount.Amount,
+			posting.Amount.Currency,
+			entry.CreatedAt,
+		).Scan(&posting.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) GetTransactions(iban string, filter *TransactionFilter) ([]*Transaction, error) {
+	query := "select " + transactionColumns + " from account_transaction where account_iban = $1"
+	args := []any{iban}
+	addCondition := func(condition string, arg any) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" and %s $%d", condition, len(args))
+	}
+	if filter.Cursor != 0 {
+		addCondition("id <", filter.Cursor)
+	}
+	if !filter.From.IsZero() {
+		addCondition("created_at >=", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addCondition("created_at <", filter.To)
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" order by id desc limit $%d", len(args))
+
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTransactions(rows)
+}
+
+const transactionColumns = `id, journal_entry_id, kind, account_iban, coalesce(counterparty_iban, ''),
+	direction, amount, balance_after, currency, coalesce(reference, ''),
+	exchange_rate, exchange_spread, counter_amount, counter_currency, coalesce(original_transaction_id, 0), created_at`
+
+func scanTransactions(rows *sql.Rows) ([]*Transaction, error) {
+	transactions := []*Transaction{}
+	for rows.Next() {
+		transaction := new(Transaction)
+		var exchangeRate, spread, counterAmount sql.NullInt64
+		var counterCurrency sql.NullString
+		err := rows.Scan(
+			&transaction.ID,
+			&transaction.JournalEntryID,
+			&transaction.Kind,
+			&transaction.AccountIban,
+			&transaction.CounterpartyIban,
+			&transaction.Direction,
+			&transaction.Amount.Amount,
+			&transaction.BalanceAfter.Amount,
+			&transaction.Amount.Currency,
+			&transaction.Reference,
+			&exchangeRate,
+			&spread,
+			&counterAmount,
+			&counterCurrency,
+			&transaction.OriginalTransactionID,
+			&transaction.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		transaction.BalanceAfter.Currency = transaction.Amount.Currency
+		if counterAmount.Valid {
+			rate, spread, counter := Rate(exchangeRate.Int64), Rate(spread.Int64), NewMoney(counterAmount.Int64, counterCurrency.String)
+			transaction.ExchangeRate, transaction.Spread, transaction.CounterAmount = &rate, &spread, &counter
+		}
+		transactions = append(transactions, transaction)
+	}
+	return transactions, rows.Err()
+}
+
+func (s *sqlStore) CreateSession(session *Session, refreshToken *RefreshToken) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	query := "insert into session (id, subject, created_at) values ($1, $2, $3)"
+	if _, err := tx.exec(query, session.ID, session.Subject, session.CreatedAt); err != nil {
+		return err
+	}
+	refreshToken.SessionID = session.ID
+	if err := insertRefreshToken(tx, refreshToken); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (s *sqlStore) RotateRefreshToken(hash string, next *RefreshToken) (*Session, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	var current RefreshToken
+	var usedAt sql.NullTime
+	query := "select session_id, expires_at, used_at from refresh_token where token_hash = $1" + tx.dialect.forUpdate
+	err = tx.queryRow(query, hash).Scan(&current.SessionID, &current.ExpiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidRefreshToken()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session := new(Session)
+	var revokedAt sql.NullTime
+	query = "select id, subject, created_at, revoked_at from session where id = $1"
+	err = tx.queryRow(query, current.SessionID).Scan(&session.ID, &session.Subject, &session.CreatedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		return nil, errInvalidRefreshToken()
+	}
+
+	now := time.Now().UTC()
+	if usedAt.Valid {
+		// the token was used before, so someone else holds a copy of it
+		if _, err := tx.exec("update session set revoked_at = $2 where id = $1", session.ID, now); err != nil {
+			return nil, err
+		}
+		if err := tx.commit(); err != nil {
+			return nil, err
+		}
+		return nil, errInvalidRefreshToken()
+	}
+	if !current.ExpiresAt.After(now) {
+		return nil, errInvalidRefreshToken()
+	}
+
+	if _, err := tx.exec("update refresh_token set used_at = $2 where token_hash = $1", hash, now); err != nil {
+		return nil, err
+	}
+	next.SessionID = session.ID
+	if err := insertRefreshToken(tx, next); err != nil {
+		return nil, err
+	}
+
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *sqlStore) RevokeSession(sessionID string, jti string, expiresAt time.Time) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	now := time.Now().UTC()
+	if _, err := tx.exec("update session set revoked_at = $2 where id = $1 and revoked_at is null", sessionID, now); err != nil {
+		return err
+	}
+	// revoked tokens are only needed until they would have expired anyway
+	if _, err := tx.exec("delete from revoked_token where expires_at < $1", now); err != nil {
+		return err
+	}
+	query := "insert into revoked_token (jti, expires_at) values ($1, $2) on conflict (jti) do nothing"
+	if _, err := tx.exec(query, jti, expiresAt); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (s *sqlStore) IsTokenRevoked(jti string, sessionID string) (bool, error) {
+	query := `
+		select
+			exists (select 1 from revoked_token where jti = $1)
+			or not exists (select 1 from session where id = $2 and revoked_at is null)
+	`
+	var revoked bool
+	err := s.queryRow(query, jti, sessionID).Scan(&revoked)
+	return revoked, err
+}
+
+func (s *sqlStore) GetLoginThrottle(kind, subject string) (*LoginThrottle, error) {
+	return getLoginThrottle(s, kind, subject, "")
+}
+
+func getLoginThrottle(q queryRower, kind, subject string, forUpdate string) (*LoginThrottle, error) {
+	throttle := &LoginThrottle{Kind: kind, Subject: subject}
+	var lastFailureAt, lockedUntil sql.NullTime
+	query := "select failures, last_failure_at, locked_until from login_throttle where kind = $1 and subject = $2" + forUpdate
+	err := q.queryRow(query, kind, subject).Scan(&throttle.Failures, &lastFailureAt, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return throttle, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	throttle.LastFailureAt, throttle.LockedUntil = lastFailureAt.Time, lockedUntil.Time
+	return throttle, nil
+}
+
+func (s *sqlStore) RecordLoginFailure(kind, subject string, policy LoginPolicy) (*LoginThrottle, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	// make sure there is a row to lock
+	query := "insert into login_throttle (kind, subject) values ($1, $2) on conflict (kind, subject) do nothing"
+	if _, err := tx.exec(query, kind, subject); err != nil {
+		return nil, err
+	}
+	throttle, err := getLoginThrottle(tx, kind, subject, tx.dialect.forUpdate)
+	if err != nil {
+		return nil, err
+	}
+
+	locked := throttle.recordFailure(policy, time.Now().UTC())
+	query = "update login_throttle set failures = $3, last_failure_at = $4, locked_until = $5 where kind = $1 and subject = $2"
+	lockedUntil := sql.NullTime{Time: throttle.LockedUntil, Valid: !throttle.LockedUntil.IsZero()}
+	if _, err := tx.exec(query, kind, subject, throttle.Failures, throttle.LastFailureAt, lockedUntil); err != nil {
+		return nil, err
+	}
+	if locked {
+		if err := insertAuditEvent(tx, throttle.lockoutEvent()); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	return throttle, nil
+}
+
+func (s *sqlStore) ResetLoginThrottle(kind, subject string) error {
+	_, err := s.exec("delete from login_throttle where kind = $1 and subject = $2", kind, subject)
+	return err
+}
+
+func (s *sqlStore) UnlockLogin(subject string, actor string) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	if _, err := tx.exec("delete from login_throttle where kind = $1 and subject = $2", ThrottleAccount, subject); err != nil {
+		return err
+	}
+	event := &AuditEvent{Kind: AuditAccountUnlocked, Actor: actor, Subject: subject, Message: "Unlocked by staff", CreatedAt: time.Now().UTC()}
+	if err := insertAuditEvent(tx, event); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (s *sqlStore) GetAuditEvents(subject string, limit int) ([]*AuditEvent, error) {
+	query := "select id, kind, actor, subject, message, created_at from audit_event"
+	args := []any{}
+	if subject != "" {
+		args = append(args, subject)
+		query += " where subject = $1"
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(" order by id desc limit $%d", len(args))
+
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+	for rows.Next() {
+		event := new(AuditEvent)
+		if err := rows.Scan(&event.ID, &event.Kind, &event.Actor, &event.Subject, &event.Message, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s *sqlStore) GetTOTPEnrolment(subject string) (*TOTPEnrolment, error) {
+	enrolment := &TOTPEnrolment{Subject: subject}
+	var confirmedAt sql.NullTime
+	query := "select secret, confirmed_at, last_used_step, created_at from totp_enrolment where subject = $1"
+	err := s.queryRow(query, subject).Scan(&enrolment.Secret, &confirmedAt, &enrolment.LastUsedStep, &enrolment.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if confirmedAt.Valid {
+		enrolment.ConfirmedAt = &confirmedAt.Time
+	}
+	return enrolment, nil
+}
+
+func (s *sqlStore) SaveTOTPEnrolment(enrolment *TOTPEnrolment) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	if _, err := tx.exec("delete from totp_enrolment where subject = $1 and confirmed_at is null", enrolment.Subject); err != nil {
+		return err
+	}
+	query := `
+		insert into totp_enrolment
+		(subject, secret, created_at)
+		values
+		($1, $2, $3)
+		on conflict (subject) do nothing
+	`
+	result, err := tx.exec(query, enrolment.Subject, enrolment.Secret, enrolment.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result, errTOTPAlreadyEnabled()); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (s *sqlStore) ConfirmTOTPEnrolment(subject string, step int64, recoveryCodeHashes []string) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	query := "update totp_enrolment set confirmed_at = $2, last_used_step = $3 where subject = $1 and confirmed_at is null"
+	result, err := tx.exec(query, subject, time.Now().UTC(), step)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result, errTOTPAlreadyEnabled()); err != nil {
+		return err
+	}
+
+	if _, err := tx.exec("delete from recovery_code where subject = $1", subject); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.exec("insert into recovery_code (subject, code_hash) values ($1, $2)", subject, hash); err != nil {
+			return err
+		}
+	}
+	return tx.commit()
+}
+
+func (s *sqlStore) DeleteTOTPEnrolment(subject string) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	if _, err := tx.exec("delete from recovery_code where subject = $1", subject); err != nil {
+		return err
+	}
+	if _, err := tx.exec("delete from totp_enrolment where subject = $1", subject); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (s *sqlStore) UseTOTPStep(subject string, step int64) error {
+	// the condition on last_used_step makes concurrent uses of one code fail
+	query := "update totp_enrolment set last_used_step = $2 where subject = $1 and confirmed_at is not null and last_used_step < $2"
+	result, err := s.exec(query, subject, step)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, errInvalidSecondFactor())
+}
+
+func (s *sqlStore) UseRecoveryCode(subject string, hash string) error {
+	query := "update recovery_code set used_at = $3 where subject = $1 and code_hash = $2 and used_at is null"
+	result, err := s.exec(query, subject, hash, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, errInvalidSecondFactor())
+}
+
+func (s *sqlStore) CreateLoginChallenge(challenge *LoginChallenge) error {
+	query := `
+		insert into login_challenge
+		(id, subject, expires_at, created_at)
+		values
+		($1, $2, $3, $4)
+	`
+	_, err := s.exec(query, challenge.ID, challenge.Subject, challenge.ExpiresAt, challenge.CreatedAt)
+	return err
+}
+
+func (s *sqlStore) GetLoginChallenge(id string) (*LoginChallenge, error) {
+	challenge := &LoginChallenge{ID: id}
+	query := "select subject, expires_at, created_at from login_challenge where id = $1 and used_at is null and expires_at > $2"
+	err := s.queryRow(query, id, time.Now().UTC()).Scan(&challenge.Subject, &challenge.ExpiresAt, &challenge.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidLoginChallenge()
+	}
+	return challenge, err
+}
+
+func (s *sqlStore) CompleteLoginChallenge(id string) error {
+	now := time.Now().UTC()
+	query := "update login_challenge set used_at = $2 where id = $1 and used_at is null and expires_at > $2"
+	result, err := s.exec(query, id, now)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, errInvalidLoginChallenge())
+}
+
+func (s *sqlStore) CreateStaffUser(user *StaffUser, actor string) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	query := `
+		insert into staff_user
+		(username, password, role, created_at)
+		values
+		($1, $2, $3, $4)
+		on conflict (username) do nothing
+		RETURNING id
+	`
+	err = tx.queryRow(query, user.Username, user.EncryptedPassword, user.Role, user.CreatedAt).Scan(&user.ID)
+	if err == sql.ErrNoRows {
+		return errUsernameTaken(user.Username)
+	}
+	if err != nil {
+		return err
+	}
+	if err := insertAuditEvent(tx, staffCreatedEvent(user, actor)); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (s *sqlStore) GetStaffUserByUsername(username string) (*StaffUser, error) {
+	user := new(StaffUser)
+	query := "select " + staffUserColumns + " from staff_user where username = $1"
+	err := s.queryRow(query, username).Scan(&user.ID, &user.Username, &user.EncryptedPassword, &user.Role, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errStaffUserNotFound(username)
+	}
+	return user, err
+}
+
+func (s *sqlStore) GetStaffUsers() ([]*StaffUser, error) {
+	rows, err := s.query("select " + staffUserColumns + " from staff_user order by username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*StaffUser{}
+	for rows.Next() {
+		user := new(StaffUser)
+		if err := rows.Scan(&user.ID, &user.Username, &user.EncryptedPassword, &user.Role, &user.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+const staffUserColumns = "id, username, password, role, created_at"
+
+func (s *sqlStore) SetExchangeRates(rates []*ExchangeRate, actor string) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	query := `
+		insert into exchange_rate
+		(from_currency, to_currency, rate, spread, updated_at)
+		values
+		($1, $2, $3, $4, $5)
+		on conflict (from_currency, to_currency) do update
+		set rate = excluded.rate, spread = excluded.spread, updated_at = excluded.updated_at
+	`
+	for _, rate := range rates {
+		if err := rate.Validate(); err != nil {
+			return err
+		}
+		if _, err := tx.exec(query, rate.From, rate.To, rate.Rate, rate.Spread, rate.UpdatedAt); err != nil {
+			return err
+		}
+		if err := insertAuditEvent(tx, exchangeRateEvent(rate, actor)); err != nil {
+			return err
+		}
+	}
+	return tx.commit()
+}
+
+const exchangeRateColumns = "from_currency, to_currency, rate, spread, updated_at"
+
+func (s *sqlStore) GetExchangeRates() ([]*ExchangeRate, error) {
+	rows, err := s.query("select " + exchangeRateColumns + " from exchange_rate order by from_currency, to_currency")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := []*ExchangeRate{}
+	for rows.Next() {
+		rate := new(ExchangeRate)
+		if err := rows.Scan(&rate.From, &rate.To, &rate.Rate, &rate.Spread, &rate.UpdatedAt); err != nil {
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+	return rates, rows.Err()
+}
+
+func (s *sqlStore) GetExchangeRate(from, to string) (*ExchangeRate, error) {
+	return exchangeRate(s, from, to)
+}
+
+// exchangeRate finds the rate from one currency into another, inverting the
+// rate stored the other way round if there is no direct one.
+func exchangeRate(q queryRower, from, to string) (*ExchangeRate, error) {
+	query := "select " + exchangeRateColumns + " from exchange_rate where from_currency = $1 and to_currency = $2"
+	for _, pair := range [][2]string{{from, to}, {to, from}} {
+		rate := new(ExchangeRate)
+		err := q.queryRow(query, pair[0], pair[1]).Scan(&rate.From, &rate.To, &rate.Rate, &rate.Spread, &rate.UpdatedAt)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rate.From != from {
+			rate = rate.Inverse()
+		}
+		return rate, nil
+	}
+	return nil, errExchangeRateUnavailable(from, to)
+}
+
+func (s *sqlStore) CreateFXQuote(quote *FXQuote) error {
+	query := `
+		insert into fx_quote
+		(id, subject, from_currency, to_currency, rate, spread, amount, converted_amount, created_at, expires_at)
+		values
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+	var amount, convertedAmount sql.NullInt64
+	if quote.Amount != nil {
+		amount = sql.NullInt64{Int64: quote.Amount.Amount, Valid: true}
+		convertedAmount = sql.NullInt64{Int64: quote.ConvertedAmount.Amount, Valid: true}
+	}
+	_, err := s.exec(
+		query,
+		quote.ID,
+		quote.Subject,
+		quote.From,
+		quote.To,
+		quote.Rate,
+		quote.Spread,
+		amount,
+		convertedAmount,
+		quote.CreatedAt,
+		quote.ExpiresAt,
+	)
+	return err
+}
+
+func (s *sqlStore) GetFXQuote(id string) (*FXQuote, error) {
+	quote, err := scanFXQuote(s.queryRow("select "+fxQuoteColumns+" from fx_quote where id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, errFXQuoteNotFound(id)
+	}
+	return quote, err
+}
+
+const fxQuoteColumns = "id, subject, from_currency, to_currency, rate, spread, amount, converted_amount, created_at, expires_at, used_at"
+
+func scanFXQuote(row interface{ Scan(...any) error }) (*FXQuote, error) {
+	quote := new(FXQuote)
+	var amount, convertedAmount sql.NullInt64
+	var usedAt sql.NullTime
+	err := row.Scan(
+		&quote.ID,
+		&quote.Subject,
+		&quote.From,
+		&quote.To,
+		&quote.Rate,
+		&quote.Spread,
+		&amount,
+		&convertedAmount,
+		&quote.CreatedAt,
+		&quote.ExpiresAt,
+		&usedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	quote.AppliedRate = quote.exchangeRate().Applied()
+	if amount.Valid {
+		quote.Amount = &Money{Amount: amount.Int64, Currency: quote.From}
+		quote.ConvertedAmount = &Money{Amount: convertedAmount.Int64, Currency: quote.To}
+	}
+	if usedAt.Valid {
+		quote.UsedAt = &usedAt.Time
+	}
+	return quote, nil
+}
+
+// requireAffected returns errNone unless the statement changed a row.
+func requireAffected(result sql.Result, errNone error) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errNone
+	}
+	return nil
+}
+
+// insertAccountHolder fails with a conflict if the customer already holds
+// or was invited to the account.
+func insertAccountHolder(tx *sqlTx, holder *AccountHolder) error {
+	query := `
+		insert into account_holder
+		(account_id, customer_id, permission, status, invited_by, created_at, accepted_at)
+		values
+		($1, $2, $3, $4, $5, $6, $7)
+		on conflict do nothing
+	`
+	result, err := tx.exec(
+		query,
+		holder.AccountID,
+		holder.CustomerID,
+		holder.Permission,
+		holder.Status,
+		sql.NullInt64{Int64: int64(holder.InvitedBy), Valid: holder.InvitedBy != 0},
+		holder.CreatedAt,
+		holder.AcceptedAt,
+	)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, ConflictError("account_holder_exists", "Customer %d already holds or was invited to account %d", holder.CustomerID, holder.AccountID))
+}
+
+func insertRefreshToken(tx *sqlTx, refreshToken *RefreshToken) error {
+	query := `
+		insert into refresh_token
+		(token_hash, session_id, expires_at, created_at)
+		values
+		($1, $2, $3, $4)
+	`
+	_, err := tx.exec(query, refreshToken.Hash, refreshToken.SessionID, refreshToken.ExpiresAt, refreshToken.CreatedAt)
+	return err
+}
+
+func (s *sqlStore) insertTransaction(tx *sqlTx, transaction *Transaction) error {
+	query := `
+		insert into account_transaction
+		(journal_entry_id, kind, account_iban, counterparty_iban, direction, amount, balance_after, currency, reference,
+			exchange_rate, exchange_spread, counter_amount, counter_currency, original_transaction_id, created_at)
+		values
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		RETURNING id
+	`
+	var exchangeRate, spread, counterAmount sql.NullInt64
+	var counterCurrency sql.NullString
+	if transaction.CounterAmount != nil {
+		exchangeRate = sql.NullInt64{Int64: int64(*transaction.ExchangeRate), Valid: true}
+		spread = sql.NullInt64{Int64: int64(*transaction.Spread), Valid: true}
+		counterAmount = sql.NullInt64{Int64: transaction.CounterAmount.Amount, Valid: true}
+		counterCurrency = sql.NullString{String: transaction.CounterAmount.Currency, Valid: true}
+	}
+	return tx.queryRow(
+		query,
+		transaction.JournalEntryID,
+		transaction.Kind,
+		transaction.AccountIban,
+		sql.NullString{String: transaction.CounterpartyIban, Valid: transaction.CounterpartyIban != ""},
+		transaction.Direction,
+		transaction.Amount.Amount,
+		transaction.BalanceAfter.Amount,
+		transaction.Amount.Currency,
+		sql.NullString{String: transaction.Reference, Valid: transaction.Reference != ""},
+		exchangeRate,
+		spread,
+		counterAmount,
+		counterCurrency,
+		sql.NullInt64{Int64: int64(transaction.OriginalTransactionID), Valid: transaction.OriginalTransactionID != 0},
+		transaction.CreatedAt,
+	).Scan(&transaction.ID)
+}
+
+// claimIdempotencyKey records a new key inside tx. If the key exists the
+// insert waits for the transaction that holds it, and the stored response is
+// loaded into key instead. A nil key claims nothing.
+func claimIdempotencyKey(tx *sqlTx, key *IdempotencyKey) (bool, error) {
+	if key == nil {
+		return false, nil
+	}
+
+	query := `
+		insert into idempotency_key
+		(scope, idempotency_key, fingerprint, created_at)
+		values
+		($1, $2, $3, $4)
+		on conflict (scope, idempotency_key) do nothing
+	`
+	result, err := tx.exec(query, key.Scope, key.Key, key.Fingerprint, key.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 1 {
+		return false, err
+	}
+
+	query = `
+		select fingerprint, status_code, response
+		from idempotency_key
+		where scope = $1 and idempotency_key = $2
+	`
+	var fingerprint string
+	var response string
+	err = tx.queryRow(query, key.Scope, key.Key).Scan(&fingerprint, &key.StatusCode, &response)
+	if err != nil {
+		return false, err
+	}
+	if fingerprint != key.Fingerprint {
+		return false, errIdempotencyKeyReused()
+	}
+	key.Response = []byte(response)
+	key.Replayed = true
+	return true, nil
+}
+
+func (s *sqlStore) GetIdempotentResponse(key *IdempotencyKey) error {
+	// keys are only visible once the operation that claimed them committed,
+	// so every key found has its response
+	query := `
+		select fingerprint, status_code, response
+		from idempotency_key
+		where scope = $1 and idempotency_key = $2
+	`
+	var fingerprint string
+	var response string
+	err := s.queryRow(query, key.Scope, key.Key).Scan(&fingerprint, &key.StatusCode, &response)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fingerprint != key.Fingerprint {
+		return errIdempotencyKeyReused()
+	}
+	key.Response = []byte(response)
+	key.Replayed = true
+	return nil
+}
+
+// saveIdempotentResponse stores the response for the result of the
+// operation a key was claimed for.
+func saveIdempotentResponse(tx *sqlTx, key *IdempotencyKey, result any) error {
+	if key == nil {
+		return nil
+	}
+
+	statusCode, response, err := key.Render(result)
+	if err != nil {
+		return err
+	}
+	key.StatusCode, key.Response = statusCode, response
+
+	query := `
+		update idempotency_key
+		set status_code = $3, response = $4
+		where scope = $1 and idempotency_key = $2
+	`
+	_, err = tx.exec(query, key.Scope, key.Key, key.StatusCode, string(key.Response))
+	return err
+}
+
+func (s *sqlStore) lockAccount(tx *sqlTx, iban string) (*Account, error) {
+	// lockAccount locks the specified account for update and returns its details
+	var account Account
+
+	query := `SELECT iban, balance, currency, status FROM account WHERE iban = $1` + tx.dialect.forUpdate
+	err := tx.queryRow(query, iban).Scan(&account.IBAN, &account.Balance.Amount, &account.Balance.Currency, &account.Status)
+	if err == sql.ErrNoRows {
+		return nil, errAccountIbanNotFound(iban)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+const accountColumns = "id, customer_id, iban, type, balance, currency, status, approval_limit, created_at, closed_at"
+
+func scanAccount(rows *sql.Rows) (*Account, error) {
+	account := new(Account)
+	var approvalLimit sql.NullInt64
+	var closedAt sql.NullTime
+	err := rows.Scan(
+		&account.ID,
+		&account.CustomerID,
+		&account.IBAN,
+		&account.Type,
+		&account.Balance.Amount,
+		&account.Balance.Currency,
+		&account.Status,
+		&approvalLimit,
+		&account.CreatedAt,
+		&closedAt,
+	)
+	if approvalLimit.Valid {
+		limit := NewMoney(approvalLimit.Int64, account.Balance.Currency)
+		account.ApprovalLimit = &limit
+	}
+	if closedAt.Valid {
+		account.ClosedAt = &closedAt.Time
+	}
+	return account, err
+}
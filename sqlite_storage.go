@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore keeps all data in a single SQLite file. It is meant for
+// developer laptops and small deployments where running Postgres is overkill.
+type SQLiteStore struct {
+	sqlStore
+	path string
+}
+
+// NewSQLiteStore opens the database file at SQLITE_PATH, creating it if it
+// does not exist yet.
+func NewSQLiteStore() (*SQLiteStore, error) {
+	path := os.Getenv("SQLITE_PATH")
+	if path == "" {
+		path = "gobank.db"
+	}
+	return openSQLiteStore(path)
+}
+
+func openSQLiteStore(path string) (*SQLiteStore, error) {
+	// _txlock=immediate makes every transaction take the database write lock
+	// when it begins, which gives TransferFunds the same guarantees as
+	// SELECT ... FOR UPDATE on Postgres. Waiting writers retry for up to
+	// busy_timeout milliseconds instead of failing right away.
+	dsn := fmt.Sprintf("file:%s?_txlock=immediate&_busy_timeout=5000&_foreign_keys=on&_journal_mode=WAL", path)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	return &SQLiteStore{
+		sqlStore: sqlStore{db: db, dialect: sqliteDialect},
+		path:     path,
+	}, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLiteStoreConcurrentTransfers(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	defer store.db.Close()
+	assert.NoError(t, store.Init())
+
+	customer := &Customer{Username: "customer", EncryptedPassword: "hash", CreatedAt: time.Now().UTC()}
+	assert.NoError(t, store.CreateCustomer(customer))
+	sender := &Account{CustomerID: customer.ID, IBAN: "sender", Status: AccountStatusActive, Balance: NewMoney(500, DefaultCurrency), CreatedAt: time.Now().UTC()}
+	receiver := &Account{CustomerID: customer.ID, IBAN: "receiver", Status: AccountStatusActive, Balance: NewMoney(0, DefaultCurrency), CreatedAt: time.Now().UTC()}
+	assert.NoError(t, store.CreateAccount(sender, nil))
+	assert.NoError(t, store.CreateAccount(receiver, nil))
+
+	// 80 transfers of 10 cents compete for a balance that covers only 50
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 80; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.TransferFunds("sender", "receiver", NewMoney(10, DefaultCurrency), "", nil); err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 50, succeeded)
+	sender, _ = store.GetAccountByIban("sender")
+	receiver, _ = store.GetAccountByIban("receiver")
+	assert.Equal(t, NewMoney(0, DefaultCurrency), sender.Balance)
+	assert.Equal(t, NewMoney(500, DefaultCurrency), receiver.Balance)
+
+	ledgerBalance, err := store.GetLedgerBalance("receiver", time.Now().UTC())
+	assert.NoError(t, err)
+	assert.Equal(t, receiver.Balance, ledgerBalance)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"time"
+)
+
+// Frequencies of standing orders.
+const (
+	// FrequencyWeekly repeats every seven days from the start date.
+	FrequencyWeekly = "weekly"
+	// FrequencyMonthly repeats on DayOfMonth, or on the last day of months
+	// that are shorter.
+	FrequencyMonthly = "monthly"
+	// FrequencyLastBusinessDay repeats on the last weekday of every month.
+	FrequencyLastBusinessDay = "last_business_day"
+)
+
+// Statuses of standing orders. An order is finished once its end date
+// leaves no further execution.
+const (
+	StandingOrderStatusActive    = "active"
+	StandingOrderStatusFinished  = "finished"
+	StandingOrderStatusCancelled = "cancelled"
+)
+
+// Policies for executions the sender's balance does not cover, or that fail
+// for another reason the next attempt may not have.
+const (
+	// InsufficientFundsRetry tries the execution again like any scheduled
+	// transfer.
+	InsufficientFundsRetry = "retry"
+	// InsufficientFundsSkip gives up on the execution after the first
+	// attempt and waits for the next one.
+	InsufficientFundsSkip = "skip"
+)
+
+// StandingOrder transfers Amount from one account to another on every date
+// its frequency gives from StartDate up to EndDate. On each of these dates
+// the scheduler creates a scheduled transfer and executes it.
+type StandingOrder struct {
+	ID                  int        `json:"id"`
+	FromAccountIban     string     `json:"fromAccountIban"`
+	ToAccountIban       string     `json:"toAccountIban"`
+	Amount              Money      `json:"amount"`
+	Frequency           string     `json:"frequency"`
+	DayOfMonth          int        `json:"dayOfMonth,omitempty"`
+	StartDate           string     `json:"startDate"`
+	EndDate             string     `json:"endDate,omitempty"`
+	OnInsufficientFunds string     `json:"onInsufficientFunds"`
+	Status              string     `json:"status"`
+	NextExecutionDate   string     `json:"nextExecutionDate,omitempty"`
+	LastExecutionDate   string     `json:"lastExecutionDate,omitempty"`
+	CreatedBy           int        `json:"createdBy"`
+	CancelledBy         int        `json:"cancelledBy,omitempty"`
+	CreatedAt           time.Time  `json:"createdAt"`
+	CancelledAt         *time.Time `json:"cancelledAt,omitempty"`
+}
+
+func newStandingOrder(fromIban string, req *StandingOrderRequest, createdBy int, now time.Time) (*StandingOrder, error) {
+	order := &StandingOrder{
+		FromAccountIban: fromIban,
+		Status:          StandingOrderStatusActive,
+		CreatedBy:       createdBy,
+		CreatedAt:       now.UTC(),
+	}
+	if err := order.apply(req, now); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// update replaces the terms of an active order. They apply from the next
+// execution that was not scheduled yet.
+func (o *StandingOrder) update(req *StandingOrderRequest, now time.Time) error {
+	if o.Status != StandingOrderStatusActive {
+		return errStandingOrderNotActive(o)
+	}
+	return o.apply(req, now)
+}
+
+// apply validates the terms in req and sets them together with the next
+// execution date. The start date may only lie in the past if it is the
+// order's current one.
+func (o *StandingOrder) apply(req *StandingOrderRequest, now time.Time) error {
+	if !req.Amount.IsPositive() {
+		return errAmountNotPositive()
+	}
+	switch req.Frequency {
+	case FrequencyMonthly:
+		if req.DayOfMonth < 1 || req.DayOfMonth > 31 {
+			return ValidationError("invalid_day_of_month", "Monthly standing orders need a dayOfMonth from 1 to 31").WithDetail("field", "dayOfMonth")
+		}
+	case FrequencyWeekly, FrequencyLastBusinessDay:
+		if req.DayOfMonth != 0 {
+			return ValidationError("invalid_day_of_month", "Only monthly standing orders have a dayOfMonth").WithDetail("field", "dayOfMonth")
+		}
+	default:
+		return ValidationError("invalid_frequency", "Invalid frequency: %q", req.Frequency).WithDetail("field", "frequency")
+	}
+	policy := req.OnInsufficientFunds
+	if policy == "" {
+		policy = InsufficientFundsRetry
+	}
+	if policy != InsufficientFundsRetry && policy != InsufficientFundsSkip {
+		return ValidationError("invalid_policy", "Invalid onInsufficientFunds: %q", policy).WithDetail("field", "onInsufficientFunds")
+	}
+
+	// orders start today unless they say otherwise, updates keep the start
+	startDate := req.StartDate
+	if startDate == "" && o.StartDate != "" {
+		startDate = o.StartDate
+	}
+	if startDate == "" {
+		startDate = now.UTC().Format(executionDateLayout)
+	}
+	if startDate != o.StartDate {
+		var err error
+		if startDate, err = parseDate("invalid_date", "startDate", startDate, now); err != nil {
+			return err
+		}
+	}
+	start, _ := time.Parse(executionDateLayout, startDate)
+	if req.EndDate != "" {
+		end, err := time.Parse(executionDateLayout, req.EndDate)
+		if err != nil {
+			return ValidationError("invalid_date", "Invalid endDate %q, expected YYYY-MM-DD", req.EndDate).WithDetail("field", "endDate")
+		}
+		if end.Before(start) {
+			return ValidationError("invalid_date", "endDate lies before startDate").WithDetail("field", "endDate")
+		}
+	}
+
+	// the next execution is neither before today nor on a day that was
+	// scheduled already
+	from := start
+	if today := now.UTC().Truncate(24 * time.Hour); today.After(from) {
+		from = today
+	}
+	if o.LastExecutionDate != "" {
+		last, _ := time.Parse(executionDateLayout, o.LastExecutionDate)
+		if next := last.AddDate(0, 0, 1); next.After(from) {
+			from = next
+		}
+	}
+	next := nextExecution(req.Frequency, req.DayOfMonth, start, from).Format(executionDateLayout)
+	if req.EndDate != "" && next > req.EndDate {
+		return ValidationError("invalid_date", "The standing order ends before its next execution on %s", next).WithDetail("field", "endDate")
+	}
+
+	o.ToAccountIban = req.ToAccountIban
+	o.Amount = req.Amount
+	o.Frequency = req.Frequency
+	o.DayOfMonth = req.DayOfMonth
+	o.StartDate = startDate
+	o.EndDate = req.EndDate
+	o.OnInsufficientFunds = policy
+	o.NextExecutionDate = next
+	return nil
+}
+
+// nextExecution returns the first day on or after from that the frequency
+// gives for an order starting on start. All days are midnight in UTC.
+func nextExecution(frequency string, dayOfMonth int, start, from time.Time) time.Time {
+	if frequency == FrequencyWeekly {
+		if !from.After(start) {
+			return start
+		}
+		weeks := (int(from.Sub(start).Hours()/24) + 6) / 7
+		return start.AddDate(0, 0, 7*weeks)
+	}
+	for month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC); ; month = month.AddDate(0, 1, 0) {
+		var day time.Time
+		if frequency == FrequencyMonthly {
+			day = month.AddDate(0, 0, min(dayOfMonth, daysIn(month))-1)
+		} else {
+			day = lastBusinessDay(month)
+		}
+		if !day.Before(from) {
+			return day
+		}
+	}
+}
+
+func daysIn(month time.Time) int {
+	return month.AddDate(0, 1, -1).Day()
+}
+
+// lastBusinessDay is the last weekday of the month. Public holidays are
+// not taken into account.
+func lastBusinessDay(month time.Time) time.Time {
+	day := month.AddDate(0, 1, -1)
+	for day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+		day = day.AddDate(0, 0, -1)
+	}
+	return day
+}
+
+// advance moves the order past its next execution, which the scheduler just
+// created the scheduled transfer for. The order finishes once the end date
+// leaves no further execution.
+func (o *StandingOrder) advance() {
+	start, _ := time.Parse(executionDateLayout, o.StartDate)
+	last, _ := time.Parse(executionDateLayout, o.NextExecutionDate)
+	o.LastExecutionDate = o.NextExecutionDate
+	o.NextExecutionDate = nextExecution(o.Frequency, o.DayOfMonth, start, last.AddDate(0, 0, 1)).Format(executionDateLayout)
+	if o.EndDate != "" && o.NextExecutionDate > o.EndDate {
+		o.Status = StandingOrderStatusFinished
+		o.NextExecutionDate = ""
+	}
+}
+
+// scheduledTransfer is the transfer for the order's next execution.
+// Under the skip policy it is attempted only once.
+func (o *StandingOrder) scheduledTransfer() *ScheduledTransfer {
+	transfer := newScheduledTransfer(o.FromAccountIban, o.ToAccountIban, o.Amount, o.NextExecutionDate, o.CreatedBy)
+	transfer.StandingOrderID = o.ID
+	if o.OnInsufficientFunds == InsufficientFundsSkip {
+		transfer.MaxAttempts = 1
+	}
+	return transfer
+}
+
+// cancel stops an active order. Its scheduled transfers that are still
+// pending are cancelled with it by the store.
+func (o *StandingOrder) cancel(cancelledBy int, now time.Time) error {
+	if o.Status != StandingOrderStatusActive {
+		return errStandingOrderNotActive(o)
+	}
+	o.Status = StandingOrderStatusCancelled
+	o.NextExecutionDate = ""
+	o.CancelledBy = cancelledBy
+	o.CancelledAt = &now
+	return nil
+}
+
+func errStandingOrderNotActive(order *StandingOrder) *Error {
+	return ConflictError("standing_order_not_active", "Standing order %d is %s", order.ID, order.Status)
+}
+
+func errStandingOrderNotFound(id int) *Error {
+	return NotFoundError("standing_order_not_found", "Standing order %d not found", id)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func date(t *testing.T, value string) time.Time {
+	parsed, err := time.Parse(executionDateLayout, value)
+	assert.NoError(t, err)
+	return parsed
+}
+
+func TestNextExecution(t *testing.T) {
+	start := date(t, "2024-01-31")
+	next := func(frequency string, dayOfMonth int, from string) string {
+		return nextExecution(frequency, dayOfMonth, start, date(t, from)).Format(executionDateLayout)
+	}
+
+	assert.Equal(t, "2024-01-31", next(FrequencyWeekly, 0, "2024-01-01"))
+	assert.Equal(t, "2024-02-07", next(FrequencyWeekly, 0, "2024-02-01"))
+	assert.Equal(t, "2024-02-07", next(FrequencyWeekly, 0, "2024-02-07"))
+
+	// short months execute on their last day
+	assert.Equal(t, "2024-02-29", next(FrequencyMonthly, 31, "2024-02-01"))
+	assert.Equal(t, "2024-03-31", next(FrequencyMonthly, 31, "2024-03-01"))
+	assert.Equal(t, "2024-04-15", next(FrequencyMonthly, 15, "2024-03-16"))
+
+	// March 2024 ends on a Sunday, August 2024 on a Saturday
+	assert.Equal(t, "2024-03-29", next(FrequencyLastBusinessDay, 0, "2024-03-01"))
+	assert.Equal(t, "2024-08-30", next(FrequencyLastBusinessDay, 0, "2024-08-01"))
+	assert.Equal(t, "2024-09-30", next(FrequencyLastBusinessDay, 0, "2024-08-31"))
+}
+
+func TestStandingOrderAdvance(t *testing.T) {
+	now := date(t, "2024-01-10")
+	req := &StandingOrderRequest{ToAccountIban: "DE89370400440532013000", Amount: NewMoney(100, DefaultCurrency), Frequency: FrequencyMonthly, DayOfMonth: 5, EndDate: "2024-03-04"}
+	order, err := newStandingOrder("DE89370400440532013001", req, 1, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "2024-01-10", order.StartDate)
+	assert.Equal(t, "2024-02-05", order.NextExecutionDate)
+	assert.Equal(t, InsufficientFundsRetry, order.OnInsufficientFunds)
+
+	order.advance()
+	assert.Equal(t, "2024-02-05", order.LastExecutionDate)
+	assert.Equal(t, StandingOrderStatusFinished, order.Status)
+	assert.Empty(t, order.NextExecutionDate)
+	assert.True(t, IsKind(order.update(req, now), KindConflict))
+
+	// updates never schedule a day twice
+	order = &StandingOrder{Status: StandingOrderStatusActive, StartDate: "2024-01-01", LastExecutionDate: "2024-01-10"}
+	req = &StandingOrderRequest{Amount: NewMoney(100, DefaultCurrency), Frequency: FrequencyWeekly}
+	assert.NoError(t, order.update(req, now))
+	assert.Equal(t, "2024-01-01", order.StartDate)
+	assert.Equal(t, "2024-01-15", order.NextExecutionDate)
+
+	transfer := order.scheduledTransfer()
+	assert.Equal(t, "2024-01-15", transfer.ExecutionDate)
+	assert.Zero(t, transfer.MaxAttempts)
+}
+
+func TestStandingOrderValidation(t *testing.T) {
+	now := date(t, "2024-01-10")
+	for _, req := range []*StandingOrderRequest{
+		{Amount: NewMoney(0, DefaultCurrency), Frequency: FrequencyWeekly},
+		{Amount: NewMoney(100, DefaultCurrency), Frequency: "daily"},
+		{Amount: NewMoney(100, DefaultCurrency), Frequency: FrequencyMonthly},
+		{Amount: NewMoney(100, DefaultCurrency), Frequency: FrequencyWeekly, DayOfMonth: 3},
+		{Amount: NewMoney(100, DefaultCurrency), Frequency: FrequencyWeekly, StartDate: "2024-01-09"},
+		{Amount: NewMoney(100, DefaultCurrency), Frequency: FrequencyWeekly, StartDate: "2024-01-12", EndDate: "2024-01-11"},
+		{Amount: NewMoney(100, DefaultCurrency), Frequency: FrequencyLastBusinessDay, EndDate: "2024-01-30"},
+		{Amount: NewMoney(100, DefaultCurrency), Frequency: FrequencyWeekly, OnInsufficientFunds: "cancel"},
+	} {
+		_, err := newStandingOrder("DE89370400440532013001", req, 1, now)
+		assert.True(t, IsKind(err, KindValidation), "%+v", req)
+	}
+}
@@ -3,22 +3,160 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
 	"os"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
 type Storage interface {
-	CreateAccount(*Account) error
-	DeleteAccount(int) error
+	// CreateCustomer fails with a conflict if the username or email is taken.
+	CreateCustomer(customer *Customer) error
+	GetCustomerById(int) (*Customer, error)
+	// GetCustomerByLogin finds a customer by username or by email.
+	GetCustomerByLogin(login string) (*Customer, error)
+	NextAccountNumber() (int64, error)
+	// CreateAccount makes the customer who opens the account its first
+	// holder, with the manage permission.
+	CreateAccount(*Account, *IdempotencyKey) error
+	// GetIdempotentResponse marks the key as Replayed, with the stored
+	// status code and response, if it was used for the same request before.
+	// Keys used for another request are rejected like on a claim.
+	GetIdempotentResponse(key *IdempotencyKey) error
 	GetAccountById(int) (*Account, error)
 	GetAccountByIban(string) (*Account, error)
-	TransferFunds(fromIban string, toIban string, amount float64) error
+	// GetAccountsByCustomer lists the accounts the customer is an active
+	// holder of.
+	GetAccountsByCustomer(customerID int) ([]*Account, error)
+	GetAccounts(filter *AccountFilter) ([]*Account, error)
+	// SetAccountStatus moves an account to another status, as far as
+	// accountTransitions allow, and writes an audit event naming the actor.
+	// Accounts are closed with CloseAccount.
+	SetAccountStatus(iban string, status string, actor string) error
+	// CloseAccount pays out the remaining balance to payoutIban and closes
+	// the account, keeping it and its transactions. Accounts with money left
+	// need a payoutIban; they are paid out whatever their status.
+	CloseAccount(iban string, payoutIban string, actor string) (*Transaction, error)
+	// SetApprovalLimit sets or, with a nil limit, removes the approval limit
+	// of an account.
+	SetApprovalLimit(accountID int, limit *Money) error
+	// GetAccountHolders lists the holders of an account, invited ones
+	// included.
+	GetAccountHolders(accountID int) ([]*AccountHolder, error)
+	GetAccountHolder(accountID, customerID int) (*AccountHolder, error)
+	// GetInvitations lists the accounts the customer was invited to hold
+	// but did not accept yet.
+	GetInvitations(customerID int) ([]*AccountHolder, error)
+	// AddAccountHolder fails with a conflict if the customer already holds
+	// or was invited to the account.
+	AddAccountHolder(holder *AccountHolder) error
+	AcceptAccountHolder(accountID, customerID int) (*AccountHolder, error)
+	// RemoveAccountHolder fails with a conflict if the account would be left
+	// without an active holder who manages it.
+	RemoveAccountHolder(accountID, customerID int) error
+	// TransferFunds converts the amount if the receiver holds another
+	// currency, at the rate locked by the quote with quoteID or, without
+	// one, at the current rate. The quote is used up by the transfer.
+	TransferFunds(fromIban string, toIban string, amount Money, quoteID string, key *IdempotencyKey) (*Transaction, error)
+	// SetExchangeRates adds or replaces the rates of their currency pairs
+	// and writes an audit event per rate naming the actor.
+	SetExchangeRates(rates []*ExchangeRate, actor string) error
+	GetExchangeRates() ([]*ExchangeRate, error)
+	// GetExchangeRate finds the rate from one currency into another, or
+	// inverts the rate stored the other way round.
+	GetExchangeRate(from, to string) (*ExchangeRate, error)
+	CreateFXQuote(quote *FXQuote) error
+	GetFXQuote(id string) (*FXQuote, error)
+	// CreateTransferApproval holds back a transfer until another holder of
+	// the account approves it.
+	CreateTransferApproval(approval *TransferApproval, key *IdempotencyKey) error
+	// GetTransferApprovals lists the approvals of transfers from the
+	// account, newest first. An empty status matches every approval.
+	GetTransferApprovals(iban string, status string) ([]*TransferApproval, error)
+	// GetTransferApproval finds an approval of a transfer from the account.
+	GetTransferApproval(id int, iban string) (*TransferApproval, error)
+	// DecideTransferApproval approves or rejects a pending transfer from the
+	// account. Approving it runs the transfer in the same database
+	// transaction and returns the sender's transaction.
+	DecideTransferApproval(id int, iban string, approve bool, decidedBy int) (*TransferApproval, *Transaction, error)
+	// CreateScheduledTransfer stores a transfer for the scheduler to
+	// execute on its execution date.
+	CreateScheduledTransfer(transfer *ScheduledTransfer, key *IdempotencyKey) error
+	// GetScheduledTransfers lists the scheduled transfers from the account,
+	// newest first. An empty status matches every transfer.
+	GetScheduledTransfers(iban string, status string) ([]*ScheduledTransfer, error)
+	// CancelScheduledTransfer cancels a pending transfer from the account.
+	CancelScheduledTransfer(id int, iban string, cancelledBy int) (*ScheduledTransfer, error)
+	// ClaimDueScheduledTransfers marks up to limit pending transfers due at
+	// now, and executing ones whose lease ran out, as executing until
+	// leaseUntil and returns them.
+	ClaimDueScheduledTransfers(now time.Time, leaseUntil time.Time, limit int) ([]*ScheduledTransfer, error)
+	// RecordScheduledTransferAttempt stores the outcome of executing a
+	// claimed transfer.
+	RecordScheduledTransferAttempt(transfer *ScheduledTransfer) error
+	// CreateStandingOrder stores a standing order from the account.
+	CreateStandingOrder(order *StandingOrder, key *IdempotencyKey) error
+	// GetStandingOrders lists the standing orders from the account, newest
+	// first, optionally only those with the status given.
+	GetStandingOrders(iban string, status string) ([]*StandingOrder, error)
+	GetStandingOrder(id int, iban string) (*StandingOrder, error)
+	// UpdateStandingOrder replaces the terms of an active order.
+	UpdateStandingOrder(id int, iban string, req *StandingOrderRequest) (*StandingOrder, error)
+	// CancelStandingOrder cancels an active order together with its pending
+	// scheduled transfers.
+	CancelStandingOrder(id int, iban string, cancelledBy int) (*StandingOrder, error)
+	// ScheduleStandingOrders creates the scheduled transfers of up to limit
+	// active orders due on or before today and moves them to their next
+	// execution. It returns the number of transfers created.
+	ScheduleStandingOrders(today string, limit int) (int, error)
+	// ExecuteTransferBatch executes the items of the batch in a single
+	// database transaction and stores the batch with their outcomes. Failed
+	// items are recorded in the batch rather than returned as errors.
+	ExecuteTransferBatch(batch *TransferBatch, key *IdempotencyKey) error
+	GetTransferBatch(id int) (*TransferBatch, error)
+	// RefundTransfer pays a transfer back, in part or in full, and returns
+	// the recipient's line of the refund.
+	RefundTransfer(refund *Refund, key *IdempotencyKey) (*Transaction, error)
+	// Deposit and Withdraw book cash brought in or paid out by the staff
+	// user actor, who is recorded in an audit event.
+	Deposit(iban string, amount Money, reference string, actor string, key *IdempotencyKey) (*Transaction, error)
+	Withdraw(iban string, amount Money, reference string, actor string, key *IdempotencyKey) (*Transaction, error)
+	GetLedgerBalance(iban string, asOf time.Time) (Money, error)
+	GetTransactions(iban string, filter *TransactionFilter) ([]*Transaction, error)
+	CreateSession(session *Session, refreshToken *RefreshToken) error
+	RotateRefreshToken(hash string, next *RefreshToken) (*Session, error)
+	RevokeSession(sessionID string, jti string, expiresAt time.Time) error
+	// IsTokenRevoked reports whether the access token with the given jti or
+	// its session have been revoked. Unknown sessions count as revoked.
+	IsTokenRevoked(jti string, sessionID string) (bool, error)
+	GetLoginThrottle(kind, subject string) (*LoginThrottle, error)
+	// RecordLoginFailure counts a failed login and writes an audit event if
+	// it locks the subject.
+	RecordLoginFailure(kind, subject string, policy LoginPolicy) (*LoginThrottle, error)
+	ResetLoginThrottle(kind, subject string) error
+	// UnlockLogin lifts the lockout of a subject and writes an audit event
+	// naming the actor.
+	UnlockLogin(subject string, actor string) error
+	GetAuditEvents(subject string, limit int) ([]*AuditEvent, error)
+	// GetTOTPEnrolment returns nil if the subject never started enrolling.
+	GetTOTPEnrolment(subject string) (*TOTPEnrolment, error)
+	// SaveTOTPEnrolment starts a new enrolment, replacing an unconfirmed one.
+	SaveTOTPEnrolment(enrolment *TOTPEnrolment) error
+	ConfirmTOTPEnrolment(subject string, step int64, recoveryCodeHashes []string) error
+	DeleteTOTPEnrolment(subject string) error
+	UseTOTPStep(subject string, step int64) error
+	UseRecoveryCode(subject string, hash string) error
+	CreateLoginChallenge(challenge *LoginChallenge) error
+	GetLoginChallenge(id string) (*LoginChallenge, error)
+	CompleteLoginChallenge(id string) error
+	// CreateStaffUser fails with a conflict if the username is taken.
+	CreateStaffUser(user *StaffUser, actor string) error
+	GetStaffUserByUsername(username string) (*StaffUser, error)
+	GetStaffUsers() ([]*StaffUser, error)
 }
 
 type PostgresStore struct {
-	db *sql.DB
+	sqlStore
 }
 
 func NewPostgresStore() (*PostgresStore, error) {
@@ -37,149 +175,6 @@ func NewPostgresStore() (*PostgresStore, error) {
 	}
 
 	return &PostgresStore{
-		db: db,
+		sqlStore: sqlStore{db: db, dialect: postgresDialect},
 	}, nil
 }
-
-func (s *PostgresStore) Init() error {
-	return s.createAccountTable()
-}
-
-func (s *PostgresStore) createAccountTable() error {
-	query := `create table if not exists account (
-		id serial primary key,
-		first_name varchar(70),
-		last_name varchar(70),
-		password varchar(100),
-		iban varchar(70),
-		balance float,
-		created_at timestamp
-	)`
-	_, err := s.db.Exec(query)
-	return err
-}
-
-func (s *PostgresStore) CreateAccount(account *Account) error {
-	query := `
-		insert into account
-		(first_name, last_name, password, iban, balance, created_at) 
-		values 
-		($1, $2, $3, $4, $5, $6)
-		RETURNING id
-	`
-	err := s.db.QueryRow(
-		query,
-		account.FirstName,
-		account.LastName,
-		account.EncryptedPassword,
-		account.IBAN,
-		account.Balance,
-		account.CreatedAt,
-	).Scan(&account.ID)
-
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (s *PostgresStore) DeleteAccount(accountId int) error {
-	_, err := s.db.Query("delete from account where id=$1", accountId)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (s *PostgresStore) GetAccountById(accountId int) (*Account, error) {
-	rows, err := s.db.Query("select * from account where id=$1", accountId)
-
-	if err != nil {
-		return nil, err
-	}
-
-	for rows.Next() {
-		return scanAccount(rows)
-	}
-	return nil, fmt.Errorf("Account with id %d not found", accountId)
-}
-
-func (s *PostgresStore) GetAccountByIban(accountIban string) (*Account, error) {
-	rows, err := s.db.Query("select * from account where iban=$1", accountIban)
-
-	if err != nil {
-		return nil, err
-	}
-
-	for rows.Next() {
-		return scanAccount(rows)
-	}
-	return nil, fmt.Errorf("Account with IBAN number %s not found", accountIban)
-}
-
-func (s *PostgresStore) TransferFunds(fromIban string, toIban string, amount float64) error {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err := tx.Rollback(); err != nil {
-			log.Printf("Could not roll back: %v\n", err)
-		}
-	}()
-
-	fromAccount, err := s.lockAccount(tx, fromIban)
-	if err != nil {
-		return err
-	}
-	if amount > fromAccount.Balance {
-		return fmt.Errorf("Balance not sufficient")
-	}
-
-	updateBalance := func(iban string, balance float64) error {
-		_, err := tx.Exec("update account set balance = $2 where iban = $1", iban, balance)
-		return err
-	}
-
-	if err := updateBalance(fromIban, fromAccount.Balance-amount); err != nil {
-		return err
-	}
-
-	toAccount, err := s.lockAccount(tx, toIban)
-	if err != nil {
-		return err
-	}
-
-	if err := updateBalance(toIban, toAccount.Balance+amount); err != nil {
-		return err
-	}
-
-	return tx.Commit()
-}
-
-func (s *PostgresStore) lockAccount(tx *sql.Tx, iban string) (*Account, error) {
-	// lockAccount locks the specified account for update and returns its details
-	var account Account
-
-	query := `SELECT iban, balance FROM account WHERE iban = $1 FOR UPDATE;`
-	err := tx.QueryRow(query, iban).Scan(&account.IBAN, &account.Balance)
-	if err != nil {
-		return nil, err
-	}
-
-	return &account, nil
-}
-
-func scanAccount(rows *sql.Rows) (*Account, error) {
-	account := new(Account)
-	err := rows.Scan(
-		&account.ID,
-		&account.FirstName,
-		&account.LastName,
-		&account.EncryptedPassword,
-		&account.IBAN,
-		&account.Balance,
-		&account.CreatedAt,
-	)
-	return account, err
-}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Subjects whose failed logins are counted.
+const (
+	ThrottleAccount = "account"
+	ThrottleIP      = "ip"
+)
+
+// LoginPolicy decides how failed logins slow down further attempts. Every
+// failure doubles the delay before the next attempt, starting at BaseDelay
+// and capped at MaxDelay. Reaching the failure limit locks the subject for
+// LockoutDuration.
+type LoginPolicy struct {
+	MaxAccountFailures int
+	MaxIPFailures      int
+	LockoutDuration    time.Duration
+	BaseDelay          time.Duration
+	MaxDelay           time.Duration
+}
+
+var defaultLoginPolicy = LoginPolicy{
+	MaxAccountFailures: 5,
+	MaxIPFailures:      20,
+	LockoutDuration:    15 * time.Minute,
+	BaseDelay:          time.Second,
+	MaxDelay:           time.Minute,
+}
+
+// loginPolicy reads LOGIN_MAX_FAILURES, LOGIN_MAX_FAILURES_PER_IP,
+// LOGIN_LOCKOUT_DURATION and LOGIN_BASE_DELAY on top of the defaults.
+func loginPolicy() (LoginPolicy, error) {
+	policy := defaultLoginPolicy
+	for name, target := range map[string]*int{
+		"LOGIN_MAX_FAILURES":        &policy.MaxAccountFailures,
+		"LOGIN_MAX_FAILURES_PER_IP": &policy.MaxIPFailures,
+	} {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return policy, fmt.Errorf("Invalid %s: %v", name, value)
+			}
+			*target = n
+		}
+	}
+	for name, target := range map[string]*time.Duration{
+		"LOGIN_LOCKOUT_DURATION": &policy.LockoutDuration,
+		"LOGIN_BASE_DELAY":       &policy.BaseDelay,
+	} {
+		if value := os.Getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return policy, fmt.Errorf("Invalid %s: %v", name, value)
+			}
+			*target = d
+		}
+	}
+	return policy, nil
+}
+
+func (p LoginPolicy) maxFailures(kind string) int {
+	if kind == ThrottleIP {
+		return p.MaxIPFailures
+	}
+	return p.MaxAccountFailures
+}
+
+func (p LoginPolicy) delay(failures int) time.Duration {
+	if failures < 1 {
+		return 0
+	}
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(failures-1))
+	if delay > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+// LoginThrottle counts the failed logins of an account or a client IP.
+type LoginThrottle struct {
+	Kind          string
+	Subject       string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// BlockedUntil returns until when further login attempts are rejected, or
+// the zero time if they are allowed.
+func (t *LoginThrottle) BlockedUntil(policy LoginPolicy, now time.Time) time.Time {
+	if t.LockedUntil.After(now) {
+		return t.LockedUntil
+	}
+	if !t.LockedUntil.IsZero() || t.Failures == 0 {
+		return time.Time{}
+	}
+	if until := t.LastFailureAt.Add(policy.delay(t.Failures)); until.After(now) {
+		return until
+	}
+	return time.Time{}
+}
+
+// recordFailure adds a failed attempt at now and reports whether it locked
+// the subject. Counting starts over once a lockout has expired.
+func (t *LoginThrottle) recordFailure(policy LoginPolicy, now time.Time) bool {
+	if !t.LockedUntil.IsZero() && !t.LockedUntil.After(now) {
+		t.Failures, t.LockedUntil = 0, time.Time{}
+	}
+	t.Failures++
+	t.LastFailureAt = now
+	if t.LockedUntil.IsZero() && t.Failures >= policy.maxFailures(t.Kind) {
+		t.LockedUntil = now.Add(policy.LockoutDuration)
+		return true
+	}
+	return false
+}
+
+// lockoutEvent is the audit event written when recordFailure locks t.
+func (t *LoginThrottle) lockoutEvent() *AuditEvent {
+	kind := AuditAccountLocked
+	if t.Kind == ThrottleIP {
+		kind = AuditIPLocked
+	}
+	return &AuditEvent{
+		Kind:      kind,
+		Actor:     "system",
+		Subject:   t.Subject,
+		Message:   fmt.Sprintf("Locked until %s after %d failed logins", t.LockedUntil.Format(time.RFC3339), t.Failures),
+		CreatedAt: t.LastFailureAt,
+	}
+}
+
+// clientIP returns the address of the connecting client. Headers such as
+// X-Forwarded-For are ignored since clients can set them freely.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func errLoginThrottled(until, now time.Time) *Error {
+	retryAfter := int(math.Ceil(until.Sub(now).Seconds()))
+	return TooManyRequestsError("login_throttled", "Too many failed logins, retry in %d seconds", retryAfter).
+		WithDetail("retryAfter", retryAfter)
+}
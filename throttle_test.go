@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginThrottleProgressiveDelay(t *testing.T) {
+	policy := LoginPolicy{MaxAccountFailures: 4, LockoutDuration: time.Hour, BaseDelay: time.Second, MaxDelay: 3 * time.Second}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	throttle := &LoginThrottle{Kind: ThrottleAccount, Subject: "DE89370400440532013000"}
+	assert.True(t, throttle.BlockedUntil(policy, now).IsZero())
+
+	assert.False(t, throttle.recordFailure(policy, now))
+	assert.Equal(t, now.Add(time.Second), throttle.BlockedUntil(policy, now))
+	assert.True(t, throttle.BlockedUntil(policy, now.Add(time.Second)).IsZero())
+
+	assert.False(t, throttle.recordFailure(policy, now))
+	assert.Equal(t, now.Add(2*time.Second), throttle.BlockedUntil(policy, now))
+
+	// the delay is capped
+	assert.False(t, throttle.recordFailure(policy, now))
+	assert.Equal(t, now.Add(3*time.Second), throttle.BlockedUntil(policy, now))
+
+	// the last allowed failure locks the account
+	assert.True(t, throttle.recordFailure(policy, now))
+	assert.Equal(t, now.Add(time.Hour), throttle.BlockedUntil(policy, now))
+	assert.Equal(t, AuditAccountLocked, throttle.lockoutEvent().Kind)
+
+	// after the lockout counting starts over
+	later := now.Add(2 * time.Hour)
+	assert.True(t, throttle.BlockedUntil(policy, later).IsZero())
+	assert.False(t, throttle.recordFailure(policy, later))
+	assert.Equal(t, 1, throttle.Failures)
+}
+
+func TestLoginPolicyFromEnv(t *testing.T) {
+	t.Setenv("LOGIN_MAX_FAILURES", "3")
+	t.Setenv("LOGIN_LOCKOUT_DURATION", "5m")
+	policy, err := loginPolicy()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, policy.MaxAccountFailures)
+	assert.Equal(t, 5*time.Minute, policy.LockoutDuration)
+	assert.Equal(t, defaultLoginPolicy.MaxIPFailures, policy.MaxIPFailures)
+
+	t.Setenv("LOGIN_MAX_FAILURES", "0")
+	_, err = loginPolicy()
+	assert.Error(t, err)
+}
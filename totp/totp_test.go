@@ -0,0 +1,61 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// secret of the SHA1 test vectors in RFC 6238 appendix B
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeMatchesRFCTestVectors(t *testing.T) {
+	// the RFC lists eight digit codes, authenticator apps use the last six
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for unix, want := range vectors {
+		code, err := Code(rfcSecret, Step(time.Unix(unix, 0)))
+		assert.NoError(t, err)
+		assert.Equal(t, want[2:], code, "time %d", unix)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	assert.NoError(t, err)
+	now := time.Now()
+
+	code, err := Code(secret, Step(now))
+	assert.NoError(t, err)
+	step, ok := Validate(secret, code, now, 1)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now), step)
+
+	// the previous code is accepted within the allowed skew only
+	previous, err := Code(secret, Step(now)-1)
+	assert.NoError(t, err)
+	_, ok = Validate(secret, previous, now, 1)
+	assert.True(t, ok)
+	_, ok = Validate(secret, previous, now, 0)
+	assert.False(t, ok)
+
+	_, ok = Validate(secret, "12345", now, 1)
+	assert.False(t, ok)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("GoBank", "DE89370400440532013000", "JBSWY3DPEHPK3PXP")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/GoBank:DE89370400440532013000?"))
+	assert.Contains(t, uri, "secret=JBSWY3DPEHPK3PXP")
+	assert.Contains(t, uri, "issuer=GoBank")
+	assert.Contains(t, uri, "digits=6")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/beshoyabdelmalak/gobank/totp"
+)
+
+const (
+	totpIssuer = "GoBank"
+	// totpSkew accepts codes of the neighbouring time steps to allow for
+	// clock drift between the server and the authenticator app.
+	totpSkew           = 1
+	recoveryCodeCount  = 10
+	loginChallengeTTL  = 5 * time.Minute
+	totpCodeHeader     = "X-TOTP-Code"
+	recoveryCodeHeader = "X-Recovery-Code"
+)
+
+// TOTPEnrolment is the TOTP secret of a customer. It only protects logins
+// and transfers once it has been confirmed with a first valid code.
+// LastUsedStep is the time step of the last accepted code; codes of that or
+// an earlier step are rejected so that a code cannot be replayed.
+type TOTPEnrolment struct {
+	Subject      string
+	Secret       string
+	ConfirmedAt  *time.Time
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+func (e *TOTPEnrolment) Enabled() bool {
+	return e != nil && e.ConfirmedAt != nil
+}
+
+// LoginChallenge is handed out by a login with the right password when the
+// customer has two-factor authentication enabled. It is completed by
+// presenting a TOTP or recovery code within loginChallengeTTL.
+type LoginChallenge struct {
+	ID        string
+	Subject   string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+func newLoginChallenge(subject string) (*LoginChallenge, error) {
+	id, err := newRandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	return &LoginChallenge{ID: id, Subject: subject, ExpiresAt: now.Add(loginChallengeTTL), CreatedAt: now}, nil
+}
+
+// newRecoveryCodes returns codes like "7hq2-k4xm" and the hashes to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignores case and dashes so that codes can be typed the
+// way they were written down.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code
+// of the subject. Both can only be used once.
+func verifySecondFactor(store Storage, subject, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		return store.UseRecoveryCode(subject, hashRecoveryCode(recoveryCode))
+	}
+
+	enrolment, err := store.GetTOTPEnrolment(subject)
+	if err != nil {
+		return err
+	}
+	if !enrolment.Enabled() {
+		return errSecondFactorNotEnabled()
+	}
+	step, ok := totp.Validate(enrolment.Secret, code, time.Now(), totpSkew)
+	if !ok {
+		return errInvalidSecondFactor()
+	}
+	return store.UseTOTPStep(subject, step)
+}
+
+// transferSecondFactorThreshold reads TRANSFER_2FA_THRESHOLD, the amount in
+// the default currency above which transfers need a fresh second factor.
+// Without it no transfer needs one. Amounts in other currencies are
+// compared with it by exceedsThreshold.
+func transferSecondFactorThreshold() (Money, bool, error) {
+	value := os.Getenv("TRANSFER_2FA_THRESHOLD")
+	if value == "" {
+		return Money{}, false, nil
+	}
+	threshold, err := ParseMoney(value, DefaultCurrency)
+	return threshold, err == nil, err
+}
+
+func errInvalidSecondFactor() *Error {
+	return UnauthorizedError("invalid_second_factor", "Invalid or already used code")
+}
+
+func errSecondFactorNotEnabled() *Error {
+	return ForbiddenError("second_factor_not_enabled", "Two-factor authentication is not enabled")
+}
+
+func errTOTPAlreadyEnabled() *Error {
+	return ConflictError("second_factor_already_enabled", "Two-factor authentication is already enabled")
+}
+
+func errInvalidLoginChallenge() *Error {
+	return UnauthorizedError("invalid_challenge", "Login challenge is invalid or expired")
+}
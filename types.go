@@ -2,63 +2,418 @@ package main
 
 import (
 	"math/rand"
-	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// LoginRequest is the body of POST /login. Username is either the username
+// or the email of the customer.
 type LoginRequest struct {
-	IBAN     string `json:"iban"`
+	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
+// StaffLoginRequest is the body of POST /staff/login.
+type StaffLoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// LoginResponse carries the tokens of a new session.
 type LoginResponse struct {
-	IBAN  string `json:"iban"`
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
 }
 
-type CreateAccountRequest struct {
+// LoginChallengeResponse is returned instead of tokens when the customer has
+// two-factor authentication enabled; the challenge is completed at
+// POST /login/2fa.
+type LoginChallengeResponse struct {
+	Challenge string    `json:"challenge"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// SecondFactorRequest carries either a TOTP code or a recovery code.
+type SecondFactorRequest struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type TOTPEnrolmentResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioningUri"`
+}
+
+type ConfirmTOTPRequest struct {
+	Code string `json:"code"`
+}
+
+// RecoveryCodesResponse lists the recovery codes in plain text. They are
+// only shown once; the server keeps their hashes.
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// CreateCustomerRequest is the body of POST /customers, the sign-up of a
+// new customer.
+type CreateCustomerRequest struct {
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
-	Password  string `json:"password"`
 }
 
+// CreateAccountRequest opens another account for the logged in customer.
+// Type defaults to a current account and Currency to DefaultCurrency.
+type CreateAccountRequest struct {
+	Type     string `json:"type"`
+	Currency string `json:"currency,omitempty"`
+}
+
+// Claims of the access tokens. The token id (jti) and the session id (sid)
+// are checked against the revoked tokens and sessions on every request. The
+// subject (sub) is "customer:" and the id of a customer or "staff:" and the
+// username of a staff user.
 type Claims struct {
-	IBAN string `json:"iban"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"`
 	jwt.StandardClaims
 }
 
+// TransferRequest moves money from an account of the logged in customer to
+// any other account. Amount is in the currency of the sender; if the
+// receiver holds another currency it is converted at the current rate, or at
+// the rate locked by QuoteID. A future ExecutionDate (YYYY-MM-DD) schedules
+// the transfer for that day instead of executing it now.
 type TransferRequest struct {
-	ToAccountIban string  `json:"toAccountIban"`
-	Amount        float64 `json:"amount"`
+	FromAccountIban string `json:"fromAccountIban"`
+	ToAccountIban   string `json:"toAccountIban"`
+	Amount          Money  `json:"amount"`
+	QuoteID         string `json:"quoteId,omitempty"`
+	ExecutionDate   string `json:"executionDate,omitempty"`
 }
 
+// TransferBatchRequest pays several beneficiaries from one account in a
+// single request. Mode is atomic, the default, or best_effort.
+type TransferBatchRequest struct {
+	FromAccountIban string                     `json:"fromAccountIban"`
+	Mode            string                     `json:"mode,omitempty"`
+	Items           []TransferBatchItemRequest `json:"items"`
+}
+
+type TransferBatchItemRequest struct {
+	ToAccountIban string `json:"toAccountIban"`
+	Amount        Money  `json:"amount"`
+}
+
+// FXQuoteRequest asks for the rate from one currency into another. If Amount
+// is given the quote also tells what it converts into.
+type FXQuoteRequest struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount *Money `json:"amount,omitempty"`
+}
+
+// CashRequest is the body of deposits and withdrawals. Reference names the
+// source or purpose of the money, e.g. "ATM 42" or "salary".
+type CashRequest struct {
+	Amount    Money  `json:"amount"`
+	Reference string `json:"reference"`
+}
+
+// RefundRequest is the body of refunds and reversals. Without an amount a
+// refund pays back all of the transfer that was not refunded yet; reversals
+// always do.
+type RefundRequest struct {
+	Amount    *Money `json:"amount"`
+	Reference string `json:"reference"`
+}
+
+// TransferResponse has the status success and the sender's transaction
+// once money moved, pending_approval and the approval a joint account
+// waits for, or scheduled and the transfer executed on a later day.
+type TransferResponse struct {
+	Status            string             `json:"status"`
+	Transaction       *Transaction       `json:"transaction,omitempty"`
+	Approval          *TransferApproval  `json:"approval,omitempty"`
+	ScheduledTransfer *ScheduledTransfer `json:"scheduledTransfer,omitempty"`
+}
+
+// AddAccountHolderRequest invites the customer with the username or email
+// in Login to hold an account.
+type AddAccountHolderRequest struct {
+	Login      string `json:"login"`
+	Permission string `json:"permission"`
+}
+
+// ApprovalLimitRequest sets the amount above which transfers from a joint
+// account need the approval of a second holder. A null limit removes it.
+type ApprovalLimitRequest struct {
+	Limit *Money `json:"limit"`
+}
+
+// StandingOrderRequest sets up or changes a standing order. StartDate
+// defaults to today, DayOfMonth is only given for monthly orders and
+// OnInsufficientFunds is retry or skip.
+type StandingOrderRequest struct {
+	ToAccountIban       string `json:"toAccountIban"`
+	Amount              Money  `json:"amount"`
+	Frequency           string `json:"frequency"`
+	DayOfMonth          int    `json:"dayOfMonth,omitempty"`
+	StartDate           string `json:"startDate,omitempty"`
+	EndDate             string `json:"endDate,omitempty"`
+	OnInsufficientFunds string `json:"onInsufficientFunds,omitempty"`
+}
+
+// Transaction is one line on an account statement. Every transfer produces
+// a debit line for the sender and a credit line for the receiver. Transfers
+// between currencies record the applied ExchangeRate, the Spread the bank
+// took and CounterAmount, the amount on the other side.
+type Transaction struct {
+	ID               int              `json:"id"`
+	JournalEntryID   int              `json:"journalEntryId"`
+	Kind             string           `json:"kind"`
+	AccountIban      string           `json:"accountIban"`
+	CounterpartyIban string           `json:"counterpartyIban,omitempty"`
+	Direction        PostingDirection `json:"direction"`
+	Amount           Money            `json:"amount"`
+	BalanceAfter     Money            `json:"balanceAfter"`
+	Reference        string           `json:"reference,omitempty"`
+	ExchangeRate     *Rate            `json:"exchangeRate,omitempty"`
+	Spread           *Rate            `json:"spread,omitempty"`
+	CounterAmount    *Money           `json:"counterAmount,omitempty"`
+	// OriginalTransactionID links refunds and reversals to the line of the
+	// transfer they pay back on the same account.
+	OriginalTransactionID int       `json:"originalTransactionId,omitempty"`
+	CreatedAt             time.Time `json:"createdAt"`
+}
+
+// TransactionFilter narrows down an account's transaction history. From is
+// inclusive, To is exclusive and zero times are unbounded. Cursor is the id of
+// the last transaction of the previous page.
+type TransactionFilter struct {
+	From   time.Time
+	To     time.Time
+	Cursor int
+	Limit  int
+}
+
+type TransactionsResponse struct {
+	Transactions []*Transaction `json:"transactions"`
+	NextCursor   string         `json:"nextCursor,omitempty"`
+}
+
+// Account is the domain model of a bank account, opened by a customer and
+// held by one or more customers (see AccountHolder). It is never written to
+// clients directly; handlers convert it to an AccountResponse.
 type Account struct {
-	ID                int       `json:"id"`
-	FirstName         string    `json:"firstName"`
-	LastName          string    `json:"lastName"`
-	EncryptedPassword string    `json:"encryptedPassword"`
-	IBAN              string    `json:"iban"`
-	Balance           float64   `json:"balance"`
-	CreatedAt         time.Time `json:"createdAt"`
-}
-
-func NewAccount(firstName, lastName, password string) (*Account, error) {
-	encryptedPassword, err := HashPassword(password)
-	if err != nil {
-		return nil, err
+	ID            int
+	CustomerID    int
+	IBAN          string
+	Type          string
+	Balance       Money
+	Status        string
+	ApprovalLimit *Money
+	CreatedAt     time.Time
+	ClosedAt      *time.Time
+}
+
+const (
+	AccountTypeCurrent = "current"
+	AccountTypeSavings = "savings"
+)
+
+// AccountResponse is the public representation of an account. Only fields
+// listed here are ever sent to clients.
+type AccountResponse struct {
+	ID            int        `json:"id"`
+	CustomerID    int        `json:"customerId"`
+	IBAN          string     `json:"iban"`
+	Type          string     `json:"type"`
+	Balance       Money      `json:"balance"`
+	Status        string     `json:"status"`
+	ApprovalLimit *Money     `json:"approvalLimit,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	ClosedAt      *time.Time `json:"closedAt,omitempty"`
+}
+
+func NewAccountResponse(account *Account) *AccountResponse {
+	return &AccountResponse{
+		ID:            account.ID,
+		CustomerID:    account.CustomerID,
+		IBAN:          account.IBAN,
+		Type:          account.Type,
+		Balance:       account.Balance,
+		Status:        account.Status,
+		ApprovalLimit: account.ApprovalLimit,
+		CreatedAt:     account.CreatedAt,
+		ClosedAt:      account.ClosedAt,
+	}
+}
+
+// CustomerResponse is the public representation of a customer, the
+// password left out. Accounts lists the accounts the customer holds and
+// Invitations those they were invited to hold.
+type CustomerResponse struct {
+	ID          int                `json:"id"`
+	Username    string             `json:"username"`
+	Email       string             `json:"email,omitempty"`
+	FirstName   string             `json:"firstName"`
+	LastName    string             `json:"lastName"`
+	CreatedAt   time.Time          `json:"createdAt"`
+	Accounts    []*AccountResponse `json:"accounts"`
+	Invitations []*AccountHolder   `json:"invitations,omitempty"`
+}
+
+func NewCustomerResponse(customer *Customer, accounts []*Account) *CustomerResponse {
+	resp := &CustomerResponse{
+		ID:        customer.ID,
+		Username:  customer.Username,
+		Email:     customer.Email,
+		FirstName: customer.FirstName,
+		LastName:  customer.LastName,
+		CreatedAt: customer.CreatedAt,
+		Accounts:  []*AccountResponse{},
+	}
+	for _, account := range accounts {
+		resp.Accounts = append(resp.Accounts, NewAccountResponse(account))
+	}
+	return resp
+}
+
+// AccountFilter narrows down the accounts listed to staff. An empty Status
+// matches every account. Cursor is the id of the last account of the
+// previous page.
+type AccountFilter struct {
+	Status string
+	Cursor int
+	Limit  int
+}
+
+type AccountsResponse struct {
+	Accounts   []*AccountResponse `json:"accounts"`
+	NextCursor string             `json:"nextCursor,omitempty"`
+}
+
+// CloseAccountRequest is the optional body of DELETE /accounts/{id}. The
+// remaining balance is paid out to PayoutIban; without one only empty
+// accounts can be closed.
+type CloseAccountRequest struct {
+	PayoutIban string `json:"payoutIban"`
+}
+
+// AccountStatusRequest moves an account to another status. PayoutIban is
+// only used when closing it.
+type AccountStatusRequest struct {
+	Status     string `json:"status"`
+	PayoutIban string `json:"payoutIban"`
+}
+
+// AccountClosedResponse shows the closed account and the transaction that
+// paid out its balance, if any.
+type AccountClosedResponse struct {
+	*AccountResponse
+	Payout *Transaction `json:"payout,omitempty"`
+}
+
+// AccountDetailsResponse is what staff see when inspecting an account.
+type AccountDetailsResponse struct {
+	*AccountResponse
+	AuditEvents []*AuditEvent `json:"auditEvents"`
+}
+
+// CustomerDetailsResponse is what staff see when inspecting a customer:
+// the profile, accounts and login security state.
+type CustomerDetailsResponse struct {
+	*CustomerResponse
+	TwoFactorEnabled bool          `json:"twoFactorEnabled"`
+	LockedUntil      *time.Time    `json:"lockedUntil,omitempty"`
+	AuditEvents      []*AuditEvent `json:"auditEvents"`
+}
+
+// ExchangeRatesRequest adds or replaces the exchange rates of the listed
+// currency pairs; pairs not listed keep their rate.
+type ExchangeRatesRequest struct {
+	Rates []*ExchangeRate `json:"rates"`
+}
+
+type CreateStaffUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+type StaffUserResponse struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func NewStaffUserResponse(user *StaffUser) *StaffUserResponse {
+	return &StaffUserResponse{
+		ID:        user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+		CreatedAt: user.CreatedAt,
+	}
+}
+
+type PostingDirection string
+
+const (
+	Debit  PostingDirection = "debit"
+	Credit PostingDirection = "credit"
+)
+
+// JournalEntry groups the postings of one business event, e.g. a transfer.
+// The debits and credits of an entry always add up to the same amount.
+type JournalEntry struct {
+	ID          int        `json:"id"`
+	Kind        string     `json:"kind"`
+	Description string     `json:"description"`
+	Postings    []*Posting `json:"postings"`
+	CreatedAt   time.Time  `json:"createdAt"`
+}
+
+type Posting struct {
+	ID             int              `json:"id"`
+	JournalEntryID int              `json:"journalEntryId"`
+	Account        string           `json:"account"`
+	Direction      PostingDirection `json:"direction"`
+	Amount         Money            `json:"amount"`
+}
+
+func NewAccount(customerID int, accountType, currency, iban string) (*Account, error) {
+	if accountType == "" {
+		accountType = AccountTypeCurrent
+	}
+	if accountType != AccountTypeCurrent && accountType != AccountTypeSavings {
+		return nil, ValidationError("invalid_account_type", "Invalid account type: %s", accountType).WithDetail("field", "type")
+	}
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	if _, ok := currencyExponents[currency]; !ok {
+		return nil, ValidationError("unsupported_currency", "Unsupported currency: %q", currency).WithDetail("field", "currency")
 	}
 
 	return &Account{
-		ID:                rand.Intn(10000),
-		FirstName:         firstName,
-		LastName:          lastName,
-		EncryptedPassword: encryptedPassword,
-		IBAN:              strconv.Itoa(rand.Intn(1000000)),
-		Balance:           float64(rand.Intn(1000000)),
-		CreatedAt:         time.Now().UTC(),
+		ID:         rand.Intn(10000),
+		CustomerID: customerID,
+		IBAN:       iban,
+		Type:       accountType,
+		Balance:    NewMoney(0, currency),
+		Status:     AccountStatusActive,
+		CreatedAt:  time.Now().UTC(),
 	}, nil
 }
 